@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/admin"
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// The status, tasks, rotate and kill commands talk to a running spiffelink through its admin socket.
+
+// Print an error from the admin client and exit.
+func handleClientError(err error, logger *logrus.Logger) {
+	if slErr, ok := err.(slerror.SLError); ok {
+		handleErrors([]slerror.SLError{slErr}, logger)
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(1)
+}
+
+func addSocketFlag(cmd *cobra.Command) {
+	cmd.Flags().String("socket", config.DEFAULT_ADMIN_SOCKET_PATH, "Path to the admin socket of the running spiffelink")
+}
+
+func newClient(cmd *cobra.Command, logger *logrus.Logger) *admin.Client {
+	socketPath, _ := cmd.Flags().GetString("socket")
+	return admin.NewClient(socketPath, logger)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func printStatus(s status.Status) {
+	connected := "connected"
+	if !s.AgentConnected {
+		connected = "not connected"
+	}
+	fmt.Printf("Workload API: %s (last update %s)\n\n", connected, formatTime(s.LastAgentUpdate))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tSPIFFE ID\tLAST SUCCESS\tFAILURES\tSVID SERIAL\tSVID EXPIRY\tLAST ERROR")
+	for _, db := range s.Databases {
+		serial := db.SvidSerial
+		if serial == "" {
+			serial = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", db.Name, db.SpiffeID, formatTime(db.LastSuccess),
+			db.ConsecutiveFailures, serial, formatTime(db.SvidExpiry), db.LastError)
+	}
+	w.Flush()
+}
+
+func taskStatus(task admin.TaskInfo) string {
+	if task.Zombie {
+		return task.Status + " (ignoring cancellation)"
+	}
+	return task.Status
+}
+
+func printTasks(tasks []admin.TaskInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tDATABASE\tPRIORITY\tSTARTED\tDURATION\tSTATUS")
+	for _, task := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", task.ID, task.Type, task.Database, task.Priority,
+			formatTime(task.StartTime), task.Duration.Round(time.Millisecond), taskStatus(task))
+	}
+	w.Flush()
+}
+
+func printTask(task admin.TaskInfo) {
+	fmt.Printf("Task:     %s\n", task.ID)
+	fmt.Printf("Type:     %s\n", task.Type)
+	fmt.Printf("Database: %s\n", task.Database)
+	fmt.Printf("Priority: %s\n", task.Priority)
+	if task.ShellTarget != "" {
+		fmt.Printf("Target:   %s\n", task.ShellTarget)
+	}
+	if task.Group != "" {
+		fmt.Printf("Group:    %s\n", task.Group)
+	}
+	fmt.Printf("Queued:   %s\n", formatTime(task.EnqueueTime))
+	fmt.Printf("Started:  %s\n", formatTime(task.StartTime))
+	fmt.Printf("Timeout:  %s\n", task.Timeout)
+	fmt.Printf("Duration: %s\n", task.Duration.Round(time.Millisecond))
+	fmt.Printf("Status:   %s\n", taskStatus(task))
+
+	fmt.Println("\nSteps:")
+	for _, output := range task.Outputs {
+		result := "ok"
+		if len(output.Errors) > 0 {
+			result = "FAILED"
+		}
+		attempt := ""
+		if output.Attempt > 1 {
+			attempt = fmt.Sprintf(" attempt %d", output.Attempt)
+		}
+		fmt.Printf("  %s %-8s %-6s %s (%s)%s\n", output.Time.Local().Format(time.RFC3339), output.Stage, result, output.Name, output.Id, attempt)
+		for _, err := range output.Errors {
+			fmt.Printf("      %s: %s: %s\n", err.Code, err.Heading, err.Message)
+		}
+	}
+
+	fmt.Println("\nLogs:")
+	for _, entry := range task.Logs {
+		fields := make([]string, 0, len(entry.Fields))
+		for k, v := range entry.Fields {
+			fields = append(fields, k+"="+v)
+		}
+		fmt.Printf("  %s %-7s %s %s\n", entry.Time.Local().Format(time.RFC3339), entry.Level, entry.Message, strings.Join(fields, " "))
+	}
+}
+
+func NewStatusCmd(logger *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of a running spiffelink",
+		Long: `Show whether the running spiffelink is connected to the SPIFFE Workload API, and for each
+database, when it was last rotated and which SVID it has.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			s, err := newClient(cmd, logger).Status()
+			if err != nil {
+				handleClientError(err, logger)
+			}
+			printStatus(s)
+		},
+	}
+	addSocketFlag(cmd)
+	return cmd
+}
+
+func NewTasksCmd(logger *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tasks [task ID]",
+		Short: "List the tasks of a running spiffelink",
+		Long: `List the running, queued and finished tasks of the running spiffelink.
+Given a task ID, show that task with its step outputs and logs.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := newClient(cmd, logger)
+			if len(args) == 1 {
+				task, err := client.Task(args[0])
+				if err != nil {
+					handleClientError(err, logger)
+				}
+				printTask(task)
+				return
+			}
+			database, _ := cmd.Flags().GetString("database")
+			taskType, _ := cmd.Flags().GetString("type")
+			tasks, err := client.Tasks(database, taskType)
+			if err != nil {
+				handleClientError(err, logger)
+			}
+			printTasks(tasks)
+		},
+	}
+	addSocketFlag(cmd)
+	cmd.Flags().String("database", "", "Only list the tasks for this database")
+	cmd.Flags().String("type", "", "Only list the tasks of this type")
+	return cmd
+}
+
+func NewRotateCmd(logger *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate <database>",
+		Short: "Rotate the credentials of a database now",
+		Long: `Make the running spiffelink send the latest SVID to a database now, instead of waiting for
+the next update from the SPIFFE Workload API.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			task, err := newClient(cmd, logger).Rotate(args[0])
+			if err != nil {
+				handleClientError(err, logger)
+			}
+			fmt.Printf("Started task %s\n", task.ID)
+		},
+	}
+	addSocketFlag(cmd)
+	return cmd
+}
+
+func NewKillCmd(logger *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kill <task ID>",
+		Short: "Cancel a running task",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := newClient(cmd, logger).Kill(args[0]); err != nil {
+				handleClientError(err, logger)
+			}
+			fmt.Printf("Cancelled task %s\n", args[0])
+		},
+	}
+	addSocketFlag(cmd)
+	return cmd
+}
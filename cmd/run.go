@@ -7,11 +7,18 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/dfeldman/spiffelink/pkg/admin"
 	"github.com/dfeldman/spiffelink/pkg/config"
 	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/health"
+	"github.com/dfeldman/spiffelink/pkg/logging"
 	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/step"
 	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
 	"github.com/dfeldman/spiffelink/pkg/updater"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 
@@ -49,6 +56,16 @@ func NewRunCmd(logger *logrus.Logger) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			config, errs := config.ReadConfig(logger)
 			handleErrors(errs, logger)
+			logOutput, err := logging.Configure(logger, config.Log)
+			if err != nil {
+				handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+			}
+			defer logOutput.Close()
+			tel, err := telemetry.Setup(context.Background(), logger, config.OpenTelemetry)
+			if err != nil {
+				handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+			}
+			defer tel.Shutdown(context.Background())
 			// TODO Workloadapi.New will use an env var by default. We need to check that we default to the same env var.
 			api, err := workloadapi.New(context.Background(), workloadapi.WithAddr(config.SpiffeAgentSocketPath))
 			if err != nil {
@@ -56,8 +73,53 @@ func NewRunCmd(logger *logrus.Logger) *cobra.Command {
 				fmt.Printf("Unable to connect to socket path %s due to %v\n", config.SpiffeAgentSocketPath, err)
 			}
 			client := updater.NewRealWorkloadAPIClient(api)
-			updater := updater.NewUpdater(&config, client, taskmanager.NewManager(logger), datastore.GetDatastores(), logger)
-			updater.Start(context.Background())
+			tmOptions, err := taskmanager.OptionsFromConfig(logger, config.Tasks)
+			if err != nil {
+				handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+			}
+			gracePeriod, err := taskmanager.ShutdownGracePeriodFromConfig(logger, config.Tasks)
+			if err != nil {
+				handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+			}
+			tm := taskmanager.NewManager(logger, tmOptions...)
+			updater := updater.NewUpdater(&config, client, tm, datastore.GetDatastores(), logger)
+			if !config.Journal.Disabled {
+				// The journal only helps recover from a crash, so spiffelink runs without one if it can't
+				// be used, for example when it doesn't run as root and the default directory isn't writable
+				journal, err := step.NewJournal(config.Journal.Dir, logger)
+				if err == nil {
+					err = updater.UseJournal(journal)
+				}
+				if err != nil {
+					logger.Errorf("Running without a journal: %v", err)
+				}
+			}
+			if config.Health.ListenAddress != "" {
+				healthServer := health.NewServer(config.Health.ListenAddress, updater.Status(), tm, logger)
+				if err := healthServer.Start(); err != nil {
+					handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+				}
+				defer healthServer.Shutdown()
+			}
+			if !config.Admin.Disabled {
+				adminServer := admin.NewServer(config.Admin.SocketPath, updater.Status(), tm, updater, logger)
+				if err := adminServer.Start(); err != nil {
+					handleErrors([]slerror.SLError{err.(slerror.SLError)}, logger)
+				}
+				defer adminServer.Shutdown()
+			}
+			// Stop watching for updates on SIGTERM or SIGINT, or when the command's context is cancelled, then
+			// give the running tasks time to finish so no database is left half-updated
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM, os.Interrupt)
+			defer stop()
+			updater.Start(ctx)
+			stop()
+			logger.Infof("Shutting down; waiting up to %v for running tasks", gracePeriod)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+			defer cancel()
+			if err := tm.Shutdown(shutdownCtx); err != nil {
+				logger.Errorf("Error shutting down: %v", err)
+			}
 		},
 	}
 
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Build the step list for a configured database. The steps are built with an empty update, since only their
+// shape matters here, and nothing is run.
+func buildSteps(logger *logrus.Logger, conf config.Config, name string) (step.StepList, error) {
+	for _, dbConfig := range conf.Databases {
+		if dbConfig.Name != name {
+			continue
+		}
+		// Find the datastore the same way the updater does
+		for _, store := range datastore.GetDatastores() {
+			if dbConfig.Type != store.GetName() {
+				continue
+			}
+			shellContext, _ := shell.GetShellContextFromConfig(dbConfig.Shell, logger)
+			return store.GetUpdateSteps(context.Background(), dbConfig, shellContext, spiffelinkcore.SpiffeLinkUpdate{}), nil
+		}
+		return step.StepList{}, fmt.Errorf("no datastore found for database %s", name)
+	}
+	return step.StepList{}, fmt.Errorf("database %s is not configured", name)
+}
+
+func NewStepsCmd(logger *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "steps <database>",
+		Short: "Show the steps spiffelink takes to rotate a database",
+		Long: `Build the steps that spiffelink would run to rotate the credentials of a configured database,
+and print each step with the stages it defines, without running anything. Besides a text table, the steps
+can be printed as JSON, or as a Graphviz DOT or Mermaid graph for change reviews.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			// Bound here rather than when the command is built, since the run command binds the same key
+			viper.BindPFlag("config", cmd.Flags().Lookup("config"))
+			format, _ := cmd.Flags().GetString("format")
+			conf, errs := config.ReadConfig(logger)
+			handleErrors(errs, logger)
+
+			sl, err := buildSteps(logger, conf, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			info, err := sl.Describe()
+			if err != nil {
+				handleErrors([]slerror.SLError{slerror.StepGraphInvalidError(logger, sl.ID, err)}, logger)
+			}
+			if err := info.Render(os.Stdout, format); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("config", "c", "", "Path to the configuration file")
+	cmd.Flags().StringP("format", "f", step.FormatText, "Output format: "+strings.Join(step.Formats, ", "))
+	return cmd
+}
@@ -4,15 +4,18 @@ import (
 	"log"
 
 	"github.com/dfeldman/spiffelink/cmd"
+	"github.com/dfeldman/spiffelink/pkg/redact"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 func main() {
-	// TODO this initial logger we create here may get replaced after specifying different log options in config.
-	// Need to investigate
+	// This logger is used until the config file is read. The run command then applies the log section of the
+	// config to it (see the logging package), so the same logger is used throughout.
 	logger := logrus.New()
 	logger.SetLevel(logrus.DebugLevel)
+	// Make sure credentials from connection strings and secret references never reach the log
+	logger.AddHook(&redact.Hook{})
 	var rootCmd = &cobra.Command{
 		Use:   "spiffelink",
 		Short: "Spiffelink is a tool for updating databases using SPIFFE credentials",
@@ -22,6 +25,13 @@ func main() {
 	// Add the run command to the root command
 	runCmd := cmd.NewRunCmd(logger)
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(cmd.NewStepsCmd(logger))
+
+	// Commands that talk to a running spiffelink
+	rootCmd.AddCommand(cmd.NewStatusCmd(logger))
+	rootCmd.AddCommand(cmd.NewTasksCmd(logger))
+	rootCmd.AddCommand(cmd.NewRotateCmd(logger))
+	rootCmd.AddCommand(cmd.NewKillCmd(logger))
 
 	// Execute the root command
 	if err := rootCmd.Execute(); err != nil {
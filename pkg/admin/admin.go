@@ -0,0 +1,348 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/sirupsen/logrus"
+)
+
+// The admin package serves a small HTTP+JSON API on a Unix socket, so that a running spiffelink can be
+// inspected and controlled from the command line:
+//   GET  /v1/status                   agent connection, and the rotation status and SVID of each database
+//   GET  /v1/tasks                    running, queued and finished tasks, optionally filtered with ?database= or ?type=
+//   GET  /v1/tasks/{id}               one task, with its step outputs and logs
+//   POST /v1/tasks/{id}/kill          cancel a running task
+//   POST /v1/databases/{name}/rotate  rotate a database now, with the last SVIDs from the Workload API
+// The socket is only accessible to the user running spiffelink, which is the only access control.
+
+const shutdownTimeout = 5 * time.Second
+
+// Rotator starts a rotation of a database. It is implemented by the updater.
+type Rotator interface {
+	Rotate(name string) (*taskmanager.Task, error)
+}
+
+// ErrorInfo is an SLError in a form that can be sent as JSON.
+type ErrorInfo struct {
+	Code    string `json:"code"`
+	Heading string `json:"heading"`
+	Message string `json:"message"`
+}
+
+// OutputInfo is a StepFuncOutputMessage in a form that can be sent as JSON.
+type OutputInfo struct {
+	Name    string      `json:"name"`
+	Id      string      `json:"id"`
+	Stage   string      `json:"stage"`
+	Attempt int         `json:"attempt,omitempty"`
+	Time    time.Time   `json:"time"`
+	Errors  []ErrorInfo `json:"errors,omitempty"`
+}
+
+type LogInfo struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type TaskInfo struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Database string `json:"database,omitempty"`
+	Priority string `json:"priority"`
+	// The shared infrastructure the task uses, like a Docker daemon
+	ShellTarget string `json:"shellTarget,omitempty"`
+	// The group of tasks the task runs one at a time with, like the members of a cluster
+	Group       string    `json:"group,omitempty"`
+	EnqueueTime time.Time `json:"enqueueTime"`
+	// Zero while the task is queued
+	StartTime time.Time     `json:"startTime"`
+	Timeout   time.Duration `json:"timeout"`
+	Completed bool          `json:"completed"`
+	Status    string        `json:"status"`
+	// How long the task ran for, or has been running for
+	Duration time.Duration `json:"duration"`
+	// The task is still running long after it was cancelled
+	Zombie bool `json:"zombie,omitempty"`
+	// Outputs and Logs are only filled in when a single task is requested
+	Outputs []OutputInfo `json:"outputs,omitempty"`
+	Logs    []LogInfo    `json:"logs,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func newOutputInfo(output step.StepFuncOutputMessage) OutputInfo {
+	info := OutputInfo{
+		Name:    output.Name,
+		Id:      output.Id,
+		Stage:   output.Stage,
+		Attempt: output.Attempt,
+		Time:    output.Time,
+	}
+	for _, err := range output.Errors.Errors {
+		message := ""
+		if err.Err != nil {
+			message = err.Err.Error()
+		}
+		info.Errors = append(info.Errors, ErrorInfo{
+			Code:    string(err.Code),
+			Heading: err.Heading,
+			Message: message,
+		})
+	}
+	return info
+}
+
+func newTaskInfo(task *taskmanager.Task, detail bool) TaskInfo {
+	info := TaskInfo{
+		ID:          task.ID,
+		Type:        task.Type,
+		Database:    task.Database,
+		Priority:    task.Priority.String(),
+		ShellTarget: task.ShellTarget,
+		Group:       task.Group,
+		EnqueueTime: task.EnqueueTime,
+		StartTime:   task.GetStartTime(),
+		Timeout:     task.Timeout,
+		Completed:   task.Completed(),
+		Status:      string(task.GetStatus()),
+		Duration:    task.Duration(),
+		Zombie:      task.IsZombie(),
+	}
+	if !detail {
+		return info
+	}
+	for _, output := range task.GetOutputs() {
+		info.Outputs = append(info.Outputs, newOutputInfo(output))
+	}
+	for _, entry := range task.GetLogs() {
+		// Field values can be anything, including errors, which don't marshal to JSON
+		fields := make(map[string]string, len(entry.Fields))
+		for k, v := range entry.Fields {
+			fields[k] = fmt.Sprint(v)
+		}
+		info.Logs = append(info.Logs, LogInfo{
+			Time:    entry.Time,
+			Level:   entry.Level.String(),
+			Message: entry.Message,
+			Fields:  fields,
+		})
+	}
+	return info
+}
+
+type Server struct {
+	socketPath string
+	server     *http.Server
+	logger     *logrus.Logger
+}
+
+// NewHandler returns the handler for all the admin endpoints.
+func NewHandler(tracker *status.Tracker, tm taskmanager.ManagerInterface, rotator Rotator, logger *logrus.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, tracker.Snapshot())
+	})
+	mux.HandleFunc("/v1/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		database := r.URL.Query().Get("database")
+		taskType := r.URL.Query().Get("type")
+		match := func(task *taskmanager.Task) bool {
+			return (database == "" || task.Database == database) && (taskType == "" || task.Type == taskType)
+		}
+		running := tm.GetRunningTasks()
+		sort.Slice(running, func(i, j int) bool {
+			return running[i].EnqueueTime.Before(running[j].EnqueueTime)
+		})
+		running = append(running, tm.GetQueuedTasks()...)
+		finished := tm.GetHistory()
+		if database != "" {
+			finished = tm.GetHistoryByDatabase(database)
+		} else if taskType != "" {
+			finished = tm.GetHistoryByType(taskType)
+		}
+		tasks := []TaskInfo{}
+		for _, task := range append(running, finished...) {
+			if match(task) {
+				tasks = append(tasks, newTaskInfo(task, false))
+			}
+		}
+		writeJSON(w, http.StatusOK, tasks)
+	})
+	mux.HandleFunc("/v1/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		id, action := splitPath(strings.TrimPrefix(r.URL.Path, "/v1/tasks/"))
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			task := findTask(tm, id)
+			if task == nil {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("task %s not found", id))
+				return
+			}
+			writeJSON(w, http.StatusOK, newTaskInfo(task, true))
+		case action == "kill" && r.Method == http.MethodPost:
+			if err := tm.KillTask(id); err != nil {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("task %s: %v", id, err))
+				return
+			}
+			logger.Infof("Killed task %s from the admin API", id)
+			writeJSON(w, http.StatusOK, struct{}{})
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+	mux.HandleFunc("/v1/databases/", func(w http.ResponseWriter, r *http.Request) {
+		name, action := splitPath(strings.TrimPrefix(r.URL.Path, "/v1/databases/"))
+		if action != "rotate" || r.Method != http.MethodPost {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		task, err := rotator.Rotate(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger.Infof("Started rotation of database %s from the admin API", name)
+		writeJSON(w, http.StatusOK, newTaskInfo(task, false))
+	})
+	return mux
+}
+
+// Split "id/action" into its parts. The action is empty if there isn't one.
+func splitPath(path string) (string, string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Look for a task among the running tasks and then the finished ones.
+func findTask(tm taskmanager.ManagerInterface, id string) *taskmanager.Task {
+	if task, err := tm.GetTaskByID(id); err == nil {
+		return task
+	}
+	for _, task := range tm.GetHistory() {
+		if task.ID == id {
+			return task
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorResponse{Error: message})
+}
+
+func NewServer(socketPath string, tracker *status.Tracker, tm taskmanager.ManagerInterface, rotator Rotator, logger *logrus.Logger) *Server {
+	return &Server{
+		socketPath: socketPath,
+		server: &http.Server{
+			Handler:           NewHandler(tracker, tm, rotator, logger),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		logger: logger,
+	}
+}
+
+// Start listens on the socket and serves requests in the background.
+// A socket left behind by a previous run is removed first.
+func (s *Server) Start() error {
+	if err := checkSocketDir(filepath.Dir(s.socketPath)); err != nil {
+		return slerror.AdminListenFailedError(s.logger, s.socketPath, err)
+	}
+	if err := removeOldSocket(s.socketPath); err != nil {
+		return slerror.AdminListenFailedError(s.logger, s.socketPath, err)
+	}
+	// The socket is created with the permissions allowed by the umask, so make sure nobody else can
+	// connect to it before the chmod below
+	oldUmask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", s.socketPath)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return slerror.AdminListenFailedError(s.logger, s.socketPath, err)
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		listener.Close()
+		return slerror.AdminListenFailedError(s.logger, s.socketPath, err)
+	}
+	s.logger.Infof("Serving admin API on %s", s.socketPath)
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("Admin server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Create the directory for the socket if needed. Since the socket is only protected by its permissions,
+// refuse a directory that belongs to someone else or that other users can get into.
+func checkSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s belongs to uid %d, not to the user running spiffelink", dir, stat.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s has permissions %v, but only its owner may have access", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Remove the socket left behind by an earlier run. Anything else at the path is left alone.
+func removeOldSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
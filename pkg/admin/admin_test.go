@@ -0,0 +1,182 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockLogger() *logrus.Logger {
+	ml := logrus.New()
+	ml.Out = ioutil.Discard // Ensures that the logger does not print anything
+	return ml
+}
+
+// rotatorFunc lets a test supply the Rotate function directly.
+type rotatorFunc func(name string) (*taskmanager.Task, error)
+
+func (f rotatorFunc) Rotate(name string) (*taskmanager.Task, error) {
+	return f(name)
+}
+
+// Unix socket paths are limited to about 100 bytes, which t.TempDir can exceed, so use a short directory.
+func socketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sladmin")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "run", "admin.sock")
+}
+
+func TestAdminAPI(t *testing.T) {
+	logger := newMockLogger()
+	tracker := status.NewTracker()
+	tracker.AddDatabase("db1", "spiffe://example.org/db1")
+	tracker.AgentUpdate()
+	tm := taskmanager.NewManager(logger)
+	defer tm.Shutdown(context.Background())
+
+	// A finished task with one failed step
+	finished, err := tm.NewTask("databaseUpdate", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		logger.Info("Updating db1")
+		out <- step.StepFuncOutputMessage{Name: "Write wallet", Id: "WRITE_WALLET", Stage: "execute", Errors: slerror.SLErrorList{
+			Errors: []slerror.SLError{slerror.New("Mock error")},
+		}}
+	}, taskmanager.WithDatabase("db1"))
+	require.NoError(t, err)
+	<-finished.Done()
+
+	// A task that runs until it is killed
+	running, err := tm.NewTask("databaseUpdate", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		<-ctx.Done()
+	}, taskmanager.WithDatabase("db1"))
+	require.NoError(t, err)
+
+	rotator := rotatorFunc(func(name string) (*taskmanager.Task, error) {
+		if name != "db1" {
+			return nil, fmt.Errorf("database %s is not configured", name)
+		}
+		return finished, nil
+	})
+
+	path := socketPath(t)
+	server := NewServer(path, tracker, tm, rotator, logger)
+	require.NoError(t, server.Start())
+	defer server.Shutdown()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := NewClient(path, logger)
+
+	s, err := client.Status()
+	require.NoError(t, err)
+	assert.True(t, s.AgentConnected)
+	require.Len(t, s.Databases, 1)
+	assert.Equal(t, "spiffe://example.org/db1", s.Databases[0].SpiffeID)
+
+	tasks, err := client.Tasks("", "")
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	assert.Equal(t, running.ID, tasks[0].ID)
+	assert.False(t, tasks[0].Completed)
+	assert.Equal(t, "running", tasks[0].Status)
+	assert.Equal(t, finished.ID, tasks[1].ID)
+	assert.True(t, tasks[1].Completed)
+	assert.Equal(t, "failed", tasks[1].Status)
+
+	tasks, err = client.Tasks("db2", "")
+	require.NoError(t, err)
+	assert.Empty(t, tasks)
+	tasks, err = client.Tasks("db1", "databaseUpdate")
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2)
+
+	task, err := client.Task(finished.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "db1", task.Database)
+	require.Len(t, task.Outputs, 1)
+	assert.Equal(t, "WRITE_WALLET", task.Outputs[0].Id)
+	require.Len(t, task.Outputs[0].Errors, 1)
+	assert.Equal(t, "ERROR_UNKNOWN", task.Outputs[0].Errors[0].Code)
+	assert.NotEmpty(t, task.Logs)
+
+	_, err = client.Task("databaseUpdate 99")
+	assert.Error(t, err)
+
+	rotation, err := client.Rotate("db1")
+	require.NoError(t, err)
+	assert.Equal(t, finished.ID, rotation.ID)
+	_, err = client.Rotate("db2")
+	assert.EqualError(t, err, "database db2 is not configured")
+
+	require.NoError(t, client.Kill(running.ID))
+	select {
+	case <-running.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not killed")
+	}
+	assert.Error(t, client.Kill(running.ID))
+}
+
+func TestClientNotRunning(t *testing.T) {
+	client := NewClient(socketPath(t), newMockLogger())
+	_, err := client.Status()
+	require.Error(t, err)
+	slErr, ok := err.(slerror.SLError)
+	require.True(t, ok)
+	assert.Equal(t, slerror.ErrorCode("ADMIN_CONNECT_FAILED"), slErr.Code)
+}
+
+func TestSocketDirectoryMustBePrivate(t *testing.T) {
+	logger := newMockLogger()
+	path := socketPath(t)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, os.Chmod(filepath.Dir(path), 0770))
+
+	server := NewServer(path, status.NewTracker(), taskmanager.NewManager(logger), nil, logger)
+	err := server.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "only its owner may have access")
+}
+
+func TestOnlyOldSocketIsRemoved(t *testing.T) {
+	logger := newMockLogger()
+	tm := taskmanager.NewManager(logger)
+	defer tm.Shutdown(context.Background())
+	path := socketPath(t)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+
+	// A regular file at the path is not replaced
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+	server := NewServer(path, status.NewTracker(), tm, nil, logger)
+	err := server.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a socket")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// A socket left behind by an earlier run is
+	require.NoError(t, os.Remove(path))
+	old, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	server = NewServer(path, status.NewTracker(), tm, nil, logger)
+	require.NoError(t, server.Start())
+	server.Shutdown()
+}
@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/sirupsen/logrus"
+)
+
+const clientTimeout = 30 * time.Second
+
+// Client calls the admin API of a running spiffelink.
+type Client struct {
+	socketPath string
+	http       *http.Client
+	logger     *logrus.Logger
+}
+
+func NewClient(socketPath string, logger *logrus.Logger) *Client {
+	return &Client{
+		socketPath: socketPath,
+		http: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+		logger: logger,
+	}
+}
+
+// Send a request, and decode the response into out. The host in the URL is ignored since every
+// request goes to the socket.
+func (c *Client) do(method string, path string, out interface{}) error {
+	req, err := http.NewRequest(method, "http://spiffelink"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return slerror.AdminConnectFailedError(c.logger, c.socketPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("admin API returned %s", resp.Status)
+		}
+		return fmt.Errorf("%s", errResp.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) Status() (status.Status, error) {
+	var s status.Status
+	err := c.do(http.MethodGet, "/v1/status", &s)
+	return s, err
+}
+
+// Tasks returns the running tasks followed by the finished ones, most recent first. If database or
+// taskType are set, only the tasks that match them are returned.
+func (c *Client) Tasks(database string, taskType string) ([]TaskInfo, error) {
+	query := url.Values{}
+	if database != "" {
+		query.Set("database", database)
+	}
+	if taskType != "" {
+		query.Set("type", taskType)
+	}
+	path := "/v1/tasks"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var tasks []TaskInfo
+	err := c.do(http.MethodGet, path, &tasks)
+	return tasks, err
+}
+
+// Task returns one task with its step outputs and logs.
+func (c *Client) Task(id string) (TaskInfo, error) {
+	var task TaskInfo
+	err := c.do(http.MethodGet, "/v1/tasks/"+url.PathEscape(id), &task)
+	return task, err
+}
+
+func (c *Client) Kill(id string) error {
+	return c.do(http.MethodPost, "/v1/tasks/"+url.PathEscape(id)+"/kill", nil)
+}
+
+// Rotate starts a rotation of a database, and returns the task doing it.
+func (c *Client) Rotate(database string) (TaskInfo, error) {
+	var task TaskInfo
+	err := c.do(http.MethodPost, "/v1/databases/"+url.PathEscape(database)+"/rotate", &task)
+	return task, err
+}
@@ -0,0 +1,576 @@
+package cassandra
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/secret"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/tlscheck"
+	"gopkg.in/yaml.v3"
+)
+
+// The cassandra datastore installs the SVID as the TLS certificate of an Apache Cassandra or ScyllaDB node.
+// It doesn't need to be told where the files go: Pre reads cassandra.yaml (or scylla.yaml) through the
+// ShellContext, and the files named in server_encryption_options and client_encryption_options are
+// overwritten in place, in the format the node expects.
+//
+// Cassandra reads JKS keystores and truststores, or PKCS#12 ones when store_type says so. Cassandra 4.1 and
+// later can use PEM files instead, with ssl_context_factory set to PEMBasedSslContextFactory: the keystore
+// then holds the key and certificate chain, and the truststore the CA certificates. Cassandra is told to load
+// the new files with nodetool reloadssl.
+//
+// Scylla reads a PEM certificate chain, key and CA bundle, named by certificate, keyfile and truststore. It
+// notices when they change and reloads them by itself.
+//
+// Post checks that a new TLS connection to the node gets the new certificate.
+//
+// The connection string is the node's host and JMX port, where nodetool connects, followed by options:
+//
+//	cassandra://node1:7199?conf=/etc/cassandra/cassandra.yaml&jmxUser=spiffelink&jmxPassword=${env:JMX_PASSWORD}
+//
+//	flavor         cassandra (the default) or scylla
+//	conf           the node's configuration file (/etc/cassandra/cassandra.yaml, or /etc/scylla/scylla.yaml
+//	               for scylla, by default)
+//	home           the directory relative paths in the configuration file are relative to (by default, the
+//	               parent of the directory conf is in, as in a Cassandra tarball install)
+//	jmxUser        with cassandra, the JMX user nodetool authenticates as
+//	jmxPassword    its password, preferably a secret reference. nodetool reads it from a file that is
+//	               written next to the keystore and removed afterwards.
+//	tlsPort        the port Post connects to with TLS. By default, the native transport port if client
+//	               encryption is enabled, and the internode port otherwise.
+//	reloadTimeout  how long the node gets to present the new certificate (1m by default)
+//	legacyPKCS12   true to encrypt PKCS#12 keystores with 3DES, for nodes on JVMs older than 8u301
+//	bin            with cassandra, the directory nodetool is in, if it isn't in one of DefaultBinDirs
+
+// Flavors
+const (
+	FlavorCassandra = "cassandra"
+	FlavorScylla    = "scylla"
+)
+
+// Defaults for the options
+const (
+	DefaultJMXPort       = "7199"
+	DefaultCassandraConf = "/etc/cassandra/cassandra.yaml"
+	DefaultScyllaConf    = "/etc/scylla/scylla.yaml"
+	DefaultReloadTimeout = time.Minute
+)
+
+// Where nodetool is looked for if the connection string doesn't say
+var DefaultBinDirs = []string{"/usr/bin", "/usr/local/bin", "/opt/cassandra/bin", "/usr/share/cassandra/bin"}
+
+// How long nodetool may take
+const commandTimeout = time.Minute
+
+// How often Post tries a handshake
+const handshakeInterval = 2 * time.Second
+
+// State keys
+const (
+	backupsKey  = "cassandra.backups"
+	reloadedKey = "cassandra.reloaded"
+)
+
+type Cassandra struct {
+}
+
+func (*Cassandra) GetName() string {
+	return "cassandra"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	Host          string
+	JMXPort       string
+	Flavor        string
+	Conf          string
+	Home          string
+	JMXUser       string
+	JMXPassword   string
+	TLSPort       string
+	ReloadTimeout time.Duration
+	BinDir        string
+	LegacyPKCS12  bool
+}
+
+// ParseOptions parses a cassandra connection string.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{Flavor: FlavorCassandra, ReloadTimeout: DefaultReloadTimeout}
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "cassandra" || u.Hostname() == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like cassandra://host:port?conf=...")
+	}
+	opts.Host, opts.JMXPort = u.Hostname(), u.Port()
+	if opts.JMXPort == "" {
+		opts.JMXPort = DefaultJMXPort
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "flavor":
+			if v != FlavorCassandra && v != FlavorScylla {
+				return opts, fmt.Errorf("flavor must be %s or %s", FlavorCassandra, FlavorScylla)
+			}
+			opts.Flavor = v
+		case "conf", "home":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("%s must be an absolute path", name)
+			}
+			if name == "conf" {
+				opts.Conf = path.Clean(v)
+			} else {
+				opts.Home = path.Clean(v)
+			}
+		case "jmxUser":
+			opts.JMXUser = v
+		case "jmxPassword":
+			opts.JMXPassword = v
+		case "tlsPort":
+			if port, err := strconv.Atoi(v); err != nil || port <= 0 || port > 65535 {
+				return opts, fmt.Errorf("tlsPort must be a port number")
+			}
+			opts.TLSPort = v
+		case "reloadTimeout":
+			if opts.ReloadTimeout, err = time.ParseDuration(v); err != nil || opts.ReloadTimeout <= 0 {
+				return opts, fmt.Errorf("reloadTimeout must be a positive duration")
+			}
+		case "bin":
+			opts.BinDir = v
+		case "legacyPKCS12":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("legacyPKCS12 must be true or false")
+			}
+			opts.LegacyPKCS12 = v == "true"
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	if opts.Flavor == FlavorScylla && (opts.JMXUser != "" || opts.JMXPassword != "" || opts.BinDir != "") {
+		return opts, fmt.Errorf("jmxUser, jmxPassword and bin are only used with cassandra")
+	}
+	// nodetool looks the password up by the user in its password file
+	if opts.JMXPassword != "" && opts.JMXUser == "" {
+		return opts, fmt.Errorf("jmxPassword needs jmxUser")
+	}
+	if opts.Conf == "" {
+		opts.Conf = DefaultCassandraConf
+		if opts.Flavor == FlavorScylla {
+			opts.Conf = DefaultScyllaConf
+		}
+	}
+	if opts.Home == "" {
+		opts.Home = path.Dir(path.Dir(opts.Conf))
+	}
+	return opts, nil
+}
+
+// The parts of cassandra.yaml and scylla.yaml this datastore reads
+type nodeConfig struct {
+	Server                 encryptionOptions `yaml:"server_encryption_options"`
+	Client                 encryptionOptions `yaml:"client_encryption_options"`
+	NativeTransportPort    int               `yaml:"native_transport_port"`
+	NativeTransportPortSSL int               `yaml:"native_transport_port_ssl"`
+	StoragePort            int               `yaml:"storage_port"`
+	SSLStoragePort         int               `yaml:"ssl_storage_port"`
+}
+
+type encryptionOptions struct {
+	Enabled             bool   `yaml:"enabled"`
+	InternodeEncryption string `yaml:"internode_encryption"`
+	Keystore            string `yaml:"keystore"`
+	KeystorePassword    string `yaml:"keystore_password"`
+	Truststore          string `yaml:"truststore"`
+	TruststorePassword  string `yaml:"truststore_password"`
+	StoreType           string `yaml:"store_type"`
+	SSLContextFactory   struct {
+		ClassName string `yaml:"class_name"`
+	} `yaml:"ssl_context_factory"`
+	// Scylla names its PEM files with these, and the CA bundle with truststore
+	Certificate string `yaml:"certificate"`
+	Keyfile     string `yaml:"keyfile"`
+}
+
+// Whether the options are in use. Internode encryption is on when internode_encryption isn't none, or,
+// from Cassandra 4.0, when enabled is true.
+func (e encryptionOptions) on(server bool) bool {
+	return e.Enabled || (server && e.InternodeEncryption != "" && e.InternodeEncryption != "none")
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+	// From the configuration file, for keystores and truststores
+	password string
+}
+
+// The files the node reads, in the order they are written. Keys come before certificates, so the node never
+// loads a certificate without its key.
+func (c nodeConfig) files(opts Options) ([]file, error) {
+	var files []file
+	byPath := make(map[string]file)
+	add := func(section string, f file) error {
+		if !path.IsAbs(f.path) {
+			f.path = path.Join(opts.Home, f.path)
+		}
+		if f.format.NeedsPassword() && f.password == "" {
+			return fmt.Errorf("%s has no password for %s", section, f.path)
+		}
+		if other, ok := byPath[f.path]; ok {
+			if other != f {
+				return fmt.Errorf("%s is used as both %s and %s", f.path, other.format, f.format)
+			}
+			return nil
+		}
+		byPath[f.path] = f
+		files = append(files, f)
+		return nil
+	}
+	for _, section := range []struct {
+		name    string
+		options encryptionOptions
+		server  bool
+	}{
+		{"server_encryption_options", c.Server, true},
+		{"client_encryption_options", c.Client, false},
+	} {
+		e := section.options
+		if !e.on(section.server) {
+			continue
+		}
+		var sectionFiles []file
+		if opts.Flavor == FlavorScylla {
+			if e.Certificate == "" || e.Keyfile == "" {
+				return nil, fmt.Errorf("%s must set certificate and keyfile", section.name)
+			}
+			sectionFiles = append(sectionFiles, file{path: e.Keyfile, format: credformat.PEMKey}, file{path: e.Certificate, format: credformat.PEMChain})
+			if e.Truststore != "" {
+				sectionFiles = append(sectionFiles, file{path: e.Truststore, format: credformat.PEMBundle})
+			}
+		} else {
+			keystore, truststore, err := e.formats(section.name)
+			if err != nil {
+				return nil, err
+			}
+			sectionFiles = append(sectionFiles, file{path: e.Keystore, format: keystore, password: e.KeystorePassword})
+			if e.Truststore != "" {
+				sectionFiles = append(sectionFiles, file{path: e.Truststore, format: truststore, password: e.TruststorePassword})
+			}
+		}
+		for _, f := range sectionFiles {
+			if !f.format.NeedsPassword() {
+				f.password = ""
+			}
+			if err := add(section.name, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("neither server_encryption_options nor client_encryption_options is enabled")
+	}
+	return files, nil
+}
+
+// The formats of Cassandra's keystore and truststore
+func (e encryptionOptions) formats(section string) (credformat.Format, credformat.Format, error) {
+	if e.Keystore == "" {
+		return "", "", fmt.Errorf("%s doesn't name a keystore file", section)
+	}
+	switch {
+	case strings.HasSuffix(e.SSLContextFactory.ClassName, "PEMBasedSslContextFactory") || strings.EqualFold(e.StoreType, "PEM"):
+		if e.KeystorePassword != "" {
+			return "", "", fmt.Errorf("%s sets keystore_password, and encrypted PEM keys aren't supported", section)
+		}
+		return credformat.PEMCombined, credformat.PEMBundle, nil
+	case e.StoreType == "" || strings.EqualFold(e.StoreType, "JKS"):
+		return credformat.JKSKeystore, credformat.JKSTruststore, nil
+	case strings.EqualFold(e.StoreType, "PKCS12"):
+		return credformat.PKCS12Keystore, credformat.PKCS12Truststore, nil
+	}
+	return "", "", fmt.Errorf("%s has an unsupported store_type %s", section, e.StoreType)
+}
+
+// The port Post connects to, if the connection string doesn't say
+func (c nodeConfig) tlsPort(flavor string) int {
+	switch {
+	case c.Client.on(false) && c.NativeTransportPortSSL != 0:
+		return c.NativeTransportPortSSL
+	case c.Client.on(false) && c.NativeTransportPort != 0:
+		return c.NativeTransportPort
+	case c.Client.on(false):
+		return 9042
+	case c.SSLStoragePort != 0:
+		return c.SSLStoragePort
+	case flavor == FlavorScylla:
+		return 7001
+	case c.StoragePort != 0:
+		return c.StoragePort
+	}
+	return 7000
+}
+
+func (*Cassandra) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "cassandra",
+		ID:            "cassandra",
+		Steps: []step.Step{
+			{
+				Name:              "Write the keystores and certificates named in the node's configuration",
+				Id:                "WRITE_FILES",
+				TelemetryID:       "CASSANDRA_WRITE_FILES",
+				CheckDependencies: checkDependencies,
+				Pre:               checkCredentials,
+				Execute:           writeFiles,
+				Post:              checkFiles,
+				Undo:              restoreFiles,
+				// Files that already hold the credentials aren't rewritten
+				Idempotent: true,
+			},
+			{
+				Name:        "Reload the certificates",
+				Id:          "RELOAD",
+				TelemetryID: "CASSANDRA_RELOAD",
+				Execute:     reload,
+				Post:        waitForCertificate,
+				// Undo is done by restoreFiles, once the old files are back
+				Idempotent: true,
+			},
+		},
+	}
+}
+
+// Everything a stage needs to work on the node
+type node struct {
+	opts       Options
+	creds      credformat.Credentials
+	files      []file
+	tlsAddress string
+}
+
+// The files the node reads, and what goes in each
+func (n *node) credentialFiles() []credfiles.File {
+	files := make([]credfiles.File, len(n.files))
+	for i, f := range n.files {
+		opts := credformat.Options{Password: f.password, LegacyPKCS12: n.opts.LegacyPKCS12}
+		files[i] = credfiles.File{Path: f.path, Format: f.format, Creds: n.creds, Opts: opts}
+	}
+	return files
+}
+
+// Parse the options, select the credentials, and read the node's configuration file for the files to write
+func prepare(ctx context.Context, sfi step.StepFuncInput) (*node, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return nil, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	n := &node{opts: opts}
+	if n.creds, err = credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID); err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	data, err := sfi.ShellContext.ReadFile(ctx, opts.Conf)
+	if err != nil {
+		return nil, step.Failed(slerror.CassandraConfigInvalidError(sfi.Sl.Logger, opts.Conf, err))
+	}
+	var conf nodeConfig
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, step.Failed(slerror.CassandraConfigInvalidError(sfi.Sl.Logger, opts.Conf, err))
+	}
+	if n.files, err = conf.files(opts); err != nil {
+		return nil, step.Failed(slerror.CassandraConfigInvalidError(sfi.Sl.Logger, opts.Conf, err))
+	}
+	port := opts.TLSPort
+	if port == "" {
+		port = strconv.Itoa(conf.tlsPort(opts.Flavor))
+	}
+	n.tlsAddress = net.JoinHostPort(opts.Host, port)
+	return n, step.StepFuncOutputMessage{}
+}
+
+func findNodetool(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	dirs := DefaultBinDirs
+	if opts.BinDir != "" {
+		dirs = []string{opts.BinDir}
+	}
+	exe, err := sfi.ShellContext.FindExecutable(ctx, dirs, "nodetool")
+	if err != nil {
+		return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, "nodetool", err))
+	}
+	return exe, step.StepFuncOutputMessage{}
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	n, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, f := range n.files {
+		if err := sfi.ShellContext.CheckPathWriteable(ctx, path.Dir(f.path)); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, f.path, err))
+		}
+	}
+	if n.opts.Flavor == FlavorScylla {
+		return step.StepFuncOutputMessage{}
+	}
+	_, output = findNodetool(ctx, sfi, n.opts)
+	return output
+}
+
+// Check that there are credentials to write, before anything is changed
+func checkCredentials(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := prepare(ctx, sfi)
+	return output
+}
+
+func writeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	n, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files := n.credentialFiles()
+	if output := credfiles.Save(ctx, sfi, backupsKey, credfiles.Targets(files)); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, files)
+}
+
+func checkFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	n, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, n.credentialFiles())
+}
+
+// Put the files back the way Execute found them. Scylla notices by itself. Cassandra is asked to reload them
+// if it was asked to load the new ones, and if there is something to go back to: it can't load files that
+// don't exist, and keeps the certificate it has.
+func restoreFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	backups, output := credfiles.Restore(ctx, sfi, backupsKey)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if reloaded, _ := step.Get[bool](sfi.State, reloadedKey); !reloaded {
+		return step.StepFuncOutputMessage{}
+	}
+	if len(backups) == 0 {
+		return step.StepFuncOutputMessage{}
+	}
+	for _, b := range backups {
+		if !b.Existed() {
+			sfi.Logger.Warn("Cassandra keeps the new certificate until it is restarted, since there were no files before")
+			return step.StepFuncOutputMessage{}
+		}
+	}
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	return reloadSSL(ctx, sfi, opts, path.Dir(backups[0].Path))
+}
+
+// Run nodetool reloadssl. The JMX password goes in a password file in dir, which is removed afterwards, since
+// anyone on the host can see nodetool's arguments.
+func reloadSSL(ctx context.Context, sfi step.StepFuncInput, opts Options, dir string) step.StepFuncOutputMessage {
+	exe, output := findNodetool(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	args := []string{"-h", opts.Host, "-p", opts.JMXPort}
+	if opts.JMXUser != "" {
+		args = append(args, "-u", opts.JMXUser)
+	}
+	run := func(args ...string) error {
+		_, err := sfi.ShellContext.RunCmd(ctx, exe, append(args, "reloadssl"), nil, commandTimeout)
+		return err
+	}
+	if opts.JMXPassword == "" {
+		if err := run(args...); err != nil {
+			return step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "nodetool reloadssl", err))
+		}
+		return step.StepFuncOutputMessage{}
+	}
+	password, err := secret.Resolve(ctx, sfi.Sl.Logger, opts.JMXPassword)
+	if err != nil {
+		return step.Failed(err)
+	}
+	// nodetool splits the lines of the file at whitespace
+	if strings.IndexFunc(password, unicode.IsSpace) >= 0 {
+		return step.Failed(fmt.Errorf("nodetool can't read a JMX password with whitespace from a file"))
+	}
+	data := []byte(opts.JMXUser + " " + password + "\n")
+	err = credfiles.WithSecretFile(ctx, sfi, dir, "nodetool", data, func(path string) error {
+		return run(append(args, "-pwf", path)...)
+	})
+	if err != nil {
+		return step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "nodetool reloadssl", err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Ask Cassandra to reload the files. Scylla reloads them by itself.
+func reload(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	n, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	opts := n.opts
+	if opts.Flavor == FlavorScylla {
+		sfi.Logger.Info("Scylla reloads the new files by itself")
+		return step.StepFuncOutputMessage{}
+	}
+	// Set first, since a reload may do something even if it fails
+	if err := step.Put(sfi.State, reloadedKey, true); err != nil {
+		return step.Failed(err)
+	}
+	sfi.Logger.Infof("Asking Cassandra at %s:%s to reload its certificates", opts.Host, opts.JMXPort)
+	return reloadSSL(ctx, sfi, opts, path.Dir(n.files[0].path))
+}
+
+// Check that the node presents the new certificate to new connections
+func waitForCertificate(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	n, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	leaf := n.creds.SVID.Certificates[0]
+	// The node may ask for a client certificate, and the SVID is one it now trusts
+	clientCert := &tls.Certificate{PrivateKey: n.creds.SVID.PrivateKey, Leaf: leaf}
+	for _, cert := range n.creds.SVID.Certificates {
+		clientCert.Certificate = append(clientCert.Certificate, cert.Raw)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, n.opts.ReloadTimeout)
+	defer cancel()
+	err := tlscheck.WaitFor(waitCtx, n.tlsAddress, tlscheck.Options{ClientCertificate: clientCert}, leaf, handshakeInterval)
+	if err != nil {
+		return step.Failed(slerror.TLSCertificateNotServedError(sfi.Sl.Logger, n.tlsAddress, leaf.SerialNumber.String(), err))
+	}
+	return step.StepFuncOutputMessage{}
+}
@@ -1,12 +1,16 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
 
 	"os"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/dfeldman/spiffelink/pkg/redact"
+	"github.com/dfeldman/spiffelink/pkg/secret"
 	"github.com/dfeldman/spiffelink/pkg/slerror"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -15,15 +19,37 @@ import (
 
 const DEFAULT_TIMEOUT_SECONDS = 300
 
+const DEFAULT_ADMIN_SOCKET_PATH = "/run/spiffelink/admin.sock"
+
+const DEFAULT_JOURNAL_DIR = "/var/lib/spiffelink/journal"
+
 type ShellContextConfig struct {
 	ShellType   string
 	ContainerID string
+	// The shared infrastructure this shell goes through, like a Docker daemon or SSH bastion, for
+	// tasks.shellTargetLimits. Defaults to the shell type.
+	Target string
+	// A file to record every call through the shell to, so a session can be replayed in a test. Leave it
+	// empty unless you are capturing a problem, since the file grows with every rotation.
+	Record string
+}
+
+// TargetName returns the name used to limit how many tasks use this shell's infrastructure at once.
+func (s ShellContextConfig) TargetName() string {
+	if s.Target != "" {
+		return s.Target
+	}
+	return s.ShellType
 }
 
 // Structures to store all the config information
 type DatabaseConfig struct {
-	Name             string
-	Type             string
+	Name string
+	Type string
+	// The connection string may contain secret references like ${env:VAR} or ${file:/path}.
+	// Use ResolveConnectionString to get the real value, and only inside the step that needs it.
+	// Datastores that parse their connection string into options resolve each option instead, so
+	// that a secret can't change how the string is parsed.
 	ConnectionString string
 	SpiffeID         string
 	ParsedSpiffeID   spiffeid.ID
@@ -52,14 +78,91 @@ type OpenTelemetryConfig struct {
 	OtlpExporter OTLPExporterConfig
 }
 
+type LogFileConfig struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+type LogSyslogConfig struct {
+	// Network and Address are passed to syslog.Dial. Leave both empty to use the local syslog daemon.
+	Network string
+	Address string
+	Tag     string
+}
+
+type LogConfig struct {
+	Level string
+	// "text" (the default) or "json"
+	Format string
+	// "stderr" (the default), "file" or "syslog"
+	Output string
+	File   LogFileConfig
+	Syslog LogSyslogConfig
+}
+
+type HealthConfig struct {
+	// Address to serve /metrics, /healthz and /readyz on, like ":9090". Leave empty to disable.
+	ListenAddress string
+}
+
+type TaskManagerConfig struct {
+	// Number of finished tasks to keep, with their outputs and logs. Defaults to 100.
+	HistorySize int
+	// How long to keep finished tasks, like "24h" (the default)
+	HistoryMaxAge string
+	// How long to wait for running tasks to finish when spiffelink is stopped, like "30s" (the default)
+	ShutdownGracePeriod string
+	// Most tasks that can run at once. Other tasks wait in a queue. 0 (the default) means no limit.
+	MaxConcurrency int
+	// Most tasks that can run at once for each shell target (see ShellContextConfig.Target)
+	ShellTargetLimits map[string]int
+}
+
+type AdminConfig struct {
+	// Unix socket for the admin API used by the status, tasks, rotate and kill commands.
+	// Defaults to DEFAULT_ADMIN_SOCKET_PATH.
+	SocketPath string
+	Disabled   bool
+}
+
+type JournalConfig struct {
+	// Directory where each rotation is journaled while it runs, so a rotation interrupted by a crash can be
+	// finished or undone on the next start. Defaults to DEFAULT_JOURNAL_DIR.
+	Dir      string
+	Disabled bool
+}
+
 type Config struct {
 	SpiffeAgentSocketPath string
 	Databases             []DatabaseConfig
 	OpenTelemetry         OpenTelemetryConfig
+	Log                   LogConfig
+	Health                HealthConfig
+	Admin                 AdminConfig
+	Tasks                 TaskManagerConfig
+	Journal               JournalConfig
 }
 
 var debugMode = true
 
+// ResolveConnectionString returns the connection string with all secret references replaced by their values.
+func (db *DatabaseConfig) ResolveConnectionString(ctx context.Context, log *logrus.Logger) (string, error) {
+	return secret.Resolve(ctx, log, db.ConnectionString)
+}
+
+// Redacted returns a copy of the config that is safe to print, with any credentials in connection strings removed.
+func (c Config) Redacted() Config {
+	databases := make([]DatabaseConfig, len(c.Databases))
+	for i, db := range c.Databases {
+		db.ConnectionString = redact.String(db.ConnectionString)
+		databases[i] = db
+	}
+	c.Databases = databases
+	return c
+}
+
 func isValidName(s string) bool {
 	r := regexp.MustCompile("^[a-zA-Z0-9]+$")
 	return (len(s) < 255) && r.MatchString(s)
@@ -143,6 +246,10 @@ func parseDatabaseConfigFields(log *logrus.Logger, db *DatabaseConfig) []error {
 	if db.ConnectionString == "" {
 		errs = append(errs, slerror.ConnectionStringEmptyError(log))
 	}
+	// Secret references are only checked for syntax here. They are resolved later by the steps that use them.
+	if err := secret.Validate(log, db.ConnectionString); err != nil {
+		errs = append(errs, err)
+	}
 	if db.SpiffeID == "" {
 		errs = append(errs, slerror.SpiffeIDEmptyError(log))
 	}
@@ -165,6 +272,20 @@ func parseDatabaseConfigFields(log *logrus.Logger, db *DatabaseConfig) []error {
 		break
 	case "dummy":
 		break
+	case "files":
+		break
+	case "kafka":
+		break
+	case "mssql":
+		break
+	case "redis":
+		break
+	case "elasticsearch":
+		break
+	case "cassandra":
+		break
+	case "etcd":
+		break
 	default:
 		errs = append(errs, slerror.InvalidDatabaseType(log))
 	}
@@ -188,16 +309,23 @@ func ParseConfig(log *logrus.Logger) (Config, []slerror.SLError) {
 		return Config{}, errs
 	}
 
+	setLogLevel(log)
+
 	if debugMode {
-		spew.Dump(config)
+		log.Debug(spew.Sdump(config.Redacted()))
 	}
 
-	setLogLevel(log)
-
 	spiffeIDs := make(map[string]bool)
-	for _, db := range config.Databases {
-		errs := parseDatabaseConfigFields(log, &db)
-		errs = append(errs, errs...)
+	// By index, so the defaults and the parsed SPIFFE ID are kept
+	for i := range config.Databases {
+		db := &config.Databases[i]
+		for _, err := range parseDatabaseConfigFields(log, db) {
+			var slerr slerror.SLError
+			if !errors.As(err, &slerr) {
+				slerr = slerror.CantParseConfigFile(fmt.Errorf("database %s: %w", db.Name, err), log)
+			}
+			errs = append(errs, slerr)
+		}
 
 		spiffeIDs[db.SpiffeID] = true
 	}
@@ -206,6 +334,12 @@ func ParseConfig(log *logrus.Logger) (Config, []slerror.SLError) {
 		// TODO need to handle this error better
 		errs = append(errs, slerror.CantParseConfigFile(fmt.Errorf("no databases given in configuration file"), log))
 	}
+	if config.Admin.SocketPath == "" {
+		config.Admin.SocketPath = DEFAULT_ADMIN_SOCKET_PATH
+	}
+	if config.Journal.Dir == "" {
+		config.Journal.Dir = DEFAULT_JOURNAL_DIR
+	}
 	otel := config.OpenTelemetry
 	if otel.OtlpExporter.Endpoint == "" {
 		log.Debug("no OpenTelemetry exporter specified; telemetry is disabled")
@@ -0,0 +1,116 @@
+package credfiles
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/step"
+)
+
+// The credfiles package writes the credential files of a database through the ShellContext, and backs up the
+// ones a step is about to replace, so that the step's Undo can put them back. A step that replaces files uses
+// it like this:
+//
+//	Execute: Save(ctx, sfi, key, Targets(files)), then Write(ctx, sfi, files)
+//	Post:    Check(ctx, sfi, files)
+//	Undo:    Restore(ctx, sfi, key)
+//
+// Each file is copied next to itself, readable only by its owner, and only the paths of the copies go in the
+// step's State, since the State is journaled to disk and the files hold private keys. The copies are left in
+// place after the run, since a step that fails later can still undo this one, and the next rotation replaces
+// them.
+
+// Added to the path of a file to get the path of its copy
+const BackupSuffix = ".spiffelink-backup"
+
+// Permissions of the copies
+const backupPerm os.FileMode = 0600
+
+// Target is a file to back up, with the permissions to put it back with.
+type Target struct {
+	Path string
+	Perm os.FileMode
+	// Where to copy the file. Defaults to Path with BackupSuffix; a datastore whose file names change on
+	// every rotation can use a name that doesn't, so old copies don't pile up.
+	Copy string
+}
+
+// Backup is a file as Save found it.
+type Backup struct {
+	Path string `json:"path"`
+	// Where the file was copied to, or "" if it didn't exist, in which case Restore removes it
+	Copy string      `json:"copy,omitempty"`
+	Perm os.FileMode `json:"perm"`
+}
+
+// Existed reports whether the file existed when it was backed up.
+func (b Backup) Existed() bool {
+	return b.Copy != ""
+}
+
+// Save copies the files and puts the backups in the State under key. It writes the copies, so it belongs in
+// Execute rather than Pre, which also runs in dry runs. If the State already has backups under key, from an
+// earlier attempt at the step, they are kept, since the files may have been replaced since.
+func Save(ctx context.Context, sfi step.StepFuncInput, key string, targets []Target) step.StepFuncOutputMessage {
+	if sfi.State.Has(key) {
+		sfi.Logger.Debug("Keeping the backups from the first attempt")
+		return step.StepFuncOutputMessage{}
+	}
+	backups := make([]Backup, 0, len(targets))
+	for _, t := range targets {
+		b := Backup{Path: t.Path, Perm: t.Perm}
+		data, err := sfi.ShellContext.ReadFile(ctx, t.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, t.Path, err))
+		}
+		if err == nil {
+			b.Copy = t.Copy
+			if b.Copy == "" {
+				b.Copy = t.Path + BackupSuffix
+			}
+			if err := sfi.ShellContext.WriteFile(ctx, b.Copy, data, backupPerm); err != nil {
+				return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, b.Copy, err))
+			}
+		}
+		backups = append(backups, b)
+	}
+	// The backups only count once they are all written, so Undo doesn't restore from a missing copy
+	if err := step.Put(sfi.State, key, backups); err != nil {
+		return step.Failed(err)
+	}
+	sfi.Logger.Debugf("Backed up %d files", len(backups))
+	return step.StepFuncOutputMessage{}
+}
+
+// Saved returns the backups Save put in the State under key, or false if Save hasn't run.
+func Saved(sfi step.StepFuncInput, key string) ([]Backup, bool) {
+	return step.Get[[]Backup](sfi.State, key)
+}
+
+// Restore puts the files back the way Save found them, and returns their backups. It returns no backups if
+// Save hasn't run, since the step can't have changed anything before that.
+func Restore(ctx context.Context, sfi step.StepFuncInput, key string) ([]Backup, step.StepFuncOutputMessage) {
+	backups, ok := Saved(sfi, key)
+	if !ok {
+		return nil, step.StepFuncOutputMessage{}
+	}
+	for _, b := range backups {
+		if !b.Existed() {
+			if err := sfi.ShellContext.RemoveFile(ctx, b.Path); err != nil {
+				return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, b.Path, err))
+			}
+			continue
+		}
+		data, err := sfi.ShellContext.ReadFile(ctx, b.Copy)
+		if err != nil {
+			return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, b.Copy, err))
+		}
+		if err := sfi.ShellContext.WriteFile(ctx, b.Path, data, b.Perm); err != nil {
+			return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, b.Path, err))
+		}
+	}
+	return backups, step.StepFuncOutputMessage{}
+}
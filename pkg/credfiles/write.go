@@ -0,0 +1,101 @@
+package credfiles
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/step"
+)
+
+// File is a credential file a datastore writes: where it goes, and what is rendered into it.
+type File struct {
+	Path   string
+	Format credformat.Format
+	Creds  credformat.Credentials
+	Opts   credformat.Options
+}
+
+// Targets returns the files as targets for Save, each put back with the permissions of its format.
+func Targets(files []File) []Target {
+	targets := make([]Target, len(files))
+	for i, f := range files {
+		targets[i] = Target{Path: f.Path, Perm: f.Format.Perm()}
+	}
+	return targets
+}
+
+// Write renders the files and writes them, leaving alone the ones that already have the credentials.
+func Write(ctx context.Context, sfi step.StepFuncInput, files []File) step.StepFuncOutputMessage {
+	for _, f := range files {
+		if data, err := sfi.ShellContext.ReadFile(ctx, f.Path); err == nil && credformat.Unchanged(f.Format, data, f.Creds, f.Opts) {
+			sfi.Logger.Debugf("%s already has the credentials", f.Path)
+			continue
+		}
+		data, err := credformat.Render(f.Format, f.Creds, f.Opts)
+		if err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, f.Path, err))
+		}
+		if err := sfi.ShellContext.WriteFile(ctx, f.Path, data, f.Format.Perm()); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, f.Path, err))
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Check fails unless every file has the credentials, for a Post to check that Write did its job.
+func Check(ctx context.Context, sfi step.StepFuncInput, files []File) step.StepFuncOutputMessage {
+	for _, f := range files {
+		data, err := sfi.ShellContext.ReadFile(ctx, f.Path)
+		if err != nil || !credformat.Unchanged(f.Format, data, f.Creds, f.Opts) {
+			serial := f.Creds.SVID.Certificates[0].SerialNumber.String()
+			return step.Failed(slerror.CredentialNotAppliedError(sfi.Sl.Logger, f.Path, serial))
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// SaveNew is Save for a step that only writes files that don't exist yet, like ones named after what they
+// hold: it records which of the paths don't exist, without copying the others, which the step leaves alone.
+// Restore removes the ones it recorded.
+func SaveNew(ctx context.Context, sfi step.StepFuncInput, key string, paths []string) step.StepFuncOutputMessage {
+	if sfi.State.Has(key) {
+		sfi.Logger.Debug("Keeping the files recorded by the first attempt")
+		return step.StepFuncOutputMessage{}
+	}
+	var backups []Backup
+	for _, p := range paths {
+		_, err := sfi.ShellContext.ReadFile(ctx, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			backups = append(backups, Backup{Path: p})
+		} else if err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, p, err))
+		}
+	}
+	if err := step.Put(sfi.State, key, backups); err != nil {
+		return step.Failed(err)
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Ends the names of the files WithSecretFile writes
+const SecretFileSuffix = ".spiffelink-secret"
+
+// WithSecretFile writes data to a file in dir that only its owner can read, calls fn with its path, and
+// removes the file again. It is for commands that can read a secret from a file, so the secret isn't in their
+// arguments, where anyone on the host can see it with ps.
+func WithSecretFile(ctx context.Context, sfi step.StepFuncInput, dir, name string, data []byte, fn func(path string) error) error {
+	p := path.Join(dir, "."+name+SecretFileSuffix)
+	if err := sfi.ShellContext.WriteFile(ctx, p, data, 0600); err != nil {
+		return err
+	}
+	defer func() {
+		if err := sfi.ShellContext.RemoveFile(ctx, p); err != nil {
+			sfi.Logger.Warnf("Could not remove %s: %v", p, err)
+		}
+	}()
+	return fn(p)
+}
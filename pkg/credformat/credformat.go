@@ -0,0 +1,395 @@
+package credformat
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/secret"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The credformat package renders an SVID and trust bundle into the files databases read their credentials
+// from: PEM for most, and PKCS#12 or Java KeyStore for the JVM-based ones. Datastores use it instead of
+// encoding certificates themselves:
+//
+//	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+//	data, err := credformat.Render(credformat.PKCS12Keystore, creds, credformat.Options{Password: password})
+//
+// Keystores come out different every time they are rendered, since they are encrypted with a random salt, so
+// they can't be compared byte for byte. Fingerprint and FileFingerprint identify what a file holds instead,
+// and Unchanged uses them to tell whether a file needs to be written at all.
+
+// Format is a kind of credential file.
+type Format string
+
+const (
+	// The SVID's certificate chain, leaf first
+	PEMChain Format = "pem-chain"
+	// The SVID's private key, in PKCS#8
+	PEMKey Format = "pem-key"
+	// The trust bundle's authorities
+	PEMBundle Format = "pem-bundle"
+	// The private key followed by the certificate chain, in one file
+	PEMCombined Format = "pem-combined"
+	// PKCS#12 with the private key and certificate chain
+	PKCS12Keystore Format = "pkcs12"
+	// PKCS#12 with the trust bundle's authorities as trusted certificates
+	PKCS12Truststore Format = "pkcs12-truststore"
+	// Java KeyStore with the private key and certificate chain
+	JKSKeystore Format = "jks"
+	// Java KeyStore with the trust bundle's authorities as trusted certificates
+	JKSTruststore Format = "jks-truststore"
+)
+
+// DefaultAlias is the alias of the key entry in a keystore, if Options doesn't set one.
+const DefaultAlias = "spiffelink"
+
+// Formats lists every format.
+var Formats = []Format{PEMChain, PEMKey, PEMBundle, PEMCombined, PKCS12Keystore, PKCS12Truststore, JKSKeystore, JKSTruststore}
+
+// HasKey reports whether files of this format hold the private key.
+func (f Format) HasKey() bool {
+	switch f {
+	case PEMKey, PEMCombined, PKCS12Keystore, JKSKeystore:
+		return true
+	}
+	return false
+}
+
+// NeedsPassword reports whether files of this format are protected with a password.
+func (f Format) NeedsPassword() bool {
+	switch f {
+	case PKCS12Keystore, PKCS12Truststore, JKSKeystore, JKSTruststore:
+		return true
+	}
+	return false
+}
+
+// Perm returns the permissions a file of this format should have. Only the owner can read a private key.
+func (f Format) Perm() fs.FileMode {
+	if f.HasKey() {
+		return 0600
+	}
+	return 0644
+}
+
+// Credentials are what gets rendered: the SVID for a database, and the authorities it trusts.
+type Credentials struct {
+	SVID   *x509svid.SVID
+	Bundle []*x509.Certificate
+}
+
+// Options for rendering.
+type Options struct {
+	// The password keystores are protected with. Resolve it with ResolvePassword.
+	Password string
+	// The alias of the key entry in a keystore. Defaults to DefaultAlias.
+	Alias string
+	// Encrypt PKCS#12 files with 3DES and SHA-1 instead of AES and PBKDF2, for JVMs older than 8u301 and
+	// 11.0.12, which can't read the modern algorithms
+	LegacyPKCS12 bool
+}
+
+func (o Options) alias() string {
+	if o.Alias == "" {
+		return DefaultAlias
+	}
+	return o.Alias
+}
+
+func (o Options) pkcs12Encoder() *pkcs12.Encoder {
+	if o.LegacyPKCS12 {
+		return pkcs12.Legacy
+	}
+	return pkcs12.Modern
+}
+
+// ErrSVIDNotFound is returned by Select when the update has no SVID for the SPIFFE ID.
+var ErrSVIDNotFound = errors.New("no SVID for the SPIFFE ID in the update")
+
+// Select picks the SVID for a SPIFFE ID out of an update, and trusts the authorities of every trust
+// domain in it, so federated peers are trusted too.
+func Select(update spiffelinkcore.SpiffeLinkUpdate, spiffeID string) (Credentials, error) {
+	var creds Credentials
+	for _, svid := range update.Svids {
+		if svid.ID.String() == spiffeID && len(svid.Certificates) > 0 {
+			creds.SVID = svid
+			break
+		}
+	}
+	if creds.SVID == nil {
+		return creds, fmt.Errorf("%w: %s", ErrSVIDNotFound, spiffeID)
+	}
+	for _, bundle := range update.Bundles {
+		creds.Bundle = append(creds.Bundle, bundle.X509Authorities()...)
+	}
+	return creds, nil
+}
+
+// ResolvePassword resolves a password that may be a secret reference, like ${env:KEYSTORE_PASSWORD}. Like
+// everything resolved by the secret package, it is redacted from logs from then on.
+func ResolvePassword(ctx context.Context, log *logrus.Logger, ref string) (string, error) {
+	password, err := secret.Resolve(ctx, log, ref)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", slerror.KeystorePasswordMissingError(log)
+	}
+	return password, nil
+}
+
+// Render returns the contents of a file of the given format.
+func Render(f Format, creds Credentials, opts Options) ([]byte, error) {
+	if creds.SVID == nil && (f.HasKey() || f == PEMChain) {
+		return nil, ErrSVIDNotFound
+	}
+	if f.NeedsPassword() && opts.Password == "" {
+		return nil, fmt.Errorf("a password is needed for %s", f)
+	}
+	switch f {
+	case PEMChain:
+		return certificatesPEM(creds.SVID.Certificates), nil
+	case PEMKey:
+		return keyPEM(creds.SVID.PrivateKey)
+	case PEMBundle:
+		return certificatesPEM(creds.Bundle), nil
+	case PEMCombined:
+		key, err := keyPEM(creds.SVID.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return append(key, certificatesPEM(creds.SVID.Certificates)...), nil
+	case PKCS12Keystore:
+		certs := creds.SVID.Certificates
+		return opts.pkcs12Encoder().Encode(creds.SVID.PrivateKey, certs[0], certs[1:], opts.Password)
+	case PKCS12Truststore:
+		return opts.pkcs12Encoder().EncodeTrustStore(creds.Bundle, opts.Password)
+	case JKSKeystore:
+		return encodeJKS([]jksEntry{{alias: opts.alias(), key: creds.SVID.PrivateKey, chain: creds.SVID.Certificates}}, opts.Password, time.Now())
+	case JKSTruststore:
+		entries := make([]jksEntry, len(creds.Bundle))
+		for i, cert := range creds.Bundle {
+			entries[i] = jksEntry{alias: fmt.Sprintf("ca-%d", i), cert: cert}
+		}
+		return encodeJKS(entries, opts.Password, time.Now())
+	}
+	return nil, fmt.Errorf("unknown credential format %s", f)
+}
+
+// What a file holds, which is all its fingerprint depends on
+type contents struct {
+	key   crypto.PublicKey
+	chain []*x509.Certificate
+	// Authorities, in any order
+	trusted []*x509.Certificate
+}
+
+// The contents a file of the format would have for the credentials
+func wanted(f Format, creds Credentials) contents {
+	var c contents
+	if f.HasKey() {
+		c.key = creds.SVID.PrivateKey.Public()
+	}
+	switch f {
+	case PEMChain, PEMCombined, PKCS12Keystore, JKSKeystore:
+		c.chain = creds.SVID.Certificates
+	case PEMBundle, PKCS12Truststore, JKSTruststore:
+		c.trusted = creds.Bundle
+	}
+	return c
+}
+
+func (c contents) fingerprint(f Format) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", f)
+	if c.key != nil {
+		der, err := x509.MarshalPKIXPublicKey(c.key)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "key %x\n", der)
+	}
+	for _, cert := range c.chain {
+		fmt.Fprintf(h, "chain %x\n", cert.Raw)
+	}
+	trusted := make([]string, len(c.trusted))
+	for i, cert := range c.trusted {
+		trusted[i] = hex.EncodeToString(cert.Raw)
+	}
+	sort.Strings(trusted)
+	for _, der := range trusted {
+		fmt.Fprintf(h, "trusted %s\n", der)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Fingerprint identifies what a file of the given format would hold for the credentials. It is the same for
+// every rendering, and doesn't depend on the password.
+func Fingerprint(f Format, creds Credentials) (string, error) {
+	if creds.SVID == nil && (f.HasKey() || f == PEMChain) {
+		return "", ErrSVIDNotFound
+	}
+	return wanted(f, creds).fingerprint(f)
+}
+
+// FileFingerprint returns the fingerprint of an existing file of the given format. It fails if the file
+// can't be parsed, or can't be opened with the password.
+func FileFingerprint(f Format, data []byte, opts Options) (string, error) {
+	c, err := parse(f, data, opts)
+	if err != nil {
+		return "", err
+	}
+	return c.fingerprint(f)
+}
+
+// Unchanged reports whether an existing file already holds the credentials, with the right password, so
+// it doesn't need to be written.
+func Unchanged(f Format, data []byte, creds Credentials, opts Options) bool {
+	want, err := Fingerprint(f, creds)
+	if err != nil {
+		return false
+	}
+	have, err := FileFingerprint(f, data, opts)
+	return err == nil && have == want
+}
+
+// Leaf returns the SVID's certificate from a file of a format that holds the chain.
+func Leaf(f Format, data []byte, opts Options) (*x509.Certificate, error) {
+	c, err := parse(f, data, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.chain) == 0 {
+		return nil, fmt.Errorf("no certificate in the %s file", f)
+	}
+	return c.chain[0], nil
+}
+
+func parse(f Format, data []byte, opts Options) (contents, error) {
+	var c contents
+	switch f {
+	case PEMChain, PEMKey, PEMBundle, PEMCombined:
+		certs, key, err := parsePEM(data)
+		if err != nil {
+			return c, err
+		}
+		if f.HasKey() {
+			if key == nil {
+				return c, errors.New("no private key")
+			}
+			c.key = key.Public()
+		}
+		if f == PEMBundle {
+			c.trusted = certs
+		} else if f != PEMKey {
+			c.chain = certs
+		}
+		return c, nil
+	case PKCS12Keystore:
+		key, cert, caCerts, err := pkcs12.DecodeChain(data, opts.Password)
+		if err != nil {
+			return c, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return c, errors.New("unsupported private key")
+		}
+		c.key = signer.Public()
+		c.chain = append([]*x509.Certificate{cert}, caCerts...)
+		return c, nil
+	case PKCS12Truststore:
+		certs, err := pkcs12.DecodeTrustStore(data, opts.Password)
+		c.trusted = certs
+		return c, err
+	case JKSKeystore, JKSTruststore:
+		entries, err := decodeJKS(data, opts.Password)
+		if err != nil {
+			return c, err
+		}
+		for _, entry := range entries {
+			if entry.cert != nil {
+				c.trusted = append(c.trusted, entry.cert)
+				continue
+			}
+			if entry.alias != opts.alias() {
+				continue
+			}
+			signer, ok := entry.key.(crypto.Signer)
+			if !ok {
+				return c, errors.New("unsupported private key")
+			}
+			c.key = signer.Public()
+			c.chain = entry.chain
+		}
+		if f == JKSKeystore {
+			if c.key == nil {
+				return c, fmt.Errorf("no key entry %s", opts.alias())
+			}
+			// Trusted certificates aren't part of a keystore's fingerprint
+			c.trusted = nil
+		}
+		return c, nil
+	}
+	return c, fmt.Errorf("unknown credential format %s", f)
+}
+
+// The certificates and private key in PEM data. Anything else in it is ignored.
+func parsePEM(data []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			signer, ok := parsed.(crypto.Signer)
+			if !ok {
+				return nil, nil, errors.New("unsupported private key")
+			}
+			key = signer
+		}
+	}
+	if len(bytes.TrimSpace(data)) > 0 && certs == nil && key == nil {
+		return nil, nil, errors.New("no PEM data")
+	}
+	return certs, key, nil
+}
+
+func certificatesPEM(certs []*x509.Certificate) []byte {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+func keyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
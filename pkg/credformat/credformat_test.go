@@ -0,0 +1,240 @@
+package credformat
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const spiffeID = "spiffe://example.org/db"
+
+var opts = Options{Password: "changeit"}
+
+// Credentials with an SVID issued by an intermediate CA, so the chain has two certificates
+func newCredentials(t *testing.T, ca *spiffetest.CA) Credentials {
+	certs, key := ca.CreateCA().CreateX509SVID(spiffeID)
+	return Credentials{
+		SVID:   &x509svid.SVID{ID: spiffeid.RequireFromString(spiffeID), Certificates: certs, PrivateKey: key},
+		Bundle: append(ca.Roots(), spiffetest.NewCA(t).Roots()...),
+	}
+}
+
+func TestRenderAndParse(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	creds := newCredentials(t, ca)
+	for _, f := range Formats {
+		t.Run(string(f), func(t *testing.T) {
+			data, err := Render(f, creds, opts)
+			require.NoError(t, err)
+			c, err := parse(f, data, opts)
+			require.NoError(t, err)
+			assert.Equal(t, wanted(f, creds), c)
+			assert.True(t, Unchanged(f, data, creds, opts))
+
+			// Keystores are salted and timestamped, so they can differ every time, but their fingerprint doesn't
+			again, err := Render(f, creds, opts)
+			require.NoError(t, err)
+			if !f.NeedsPassword() {
+				assert.Equal(t, data, again)
+			}
+			fingerprint, err := Fingerprint(f, creds)
+			require.NoError(t, err)
+			fileFingerprint, err := FileFingerprint(f, again, opts)
+			require.NoError(t, err)
+			assert.Equal(t, fingerprint, fileFingerprint)
+		})
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	creds := newCredentials(t, ca)
+	rotated := Credentials{SVID: newCredentials(t, ca).SVID, Bundle: creds.Bundle}
+	newBundle := Credentials{SVID: creds.SVID, Bundle: spiffetest.NewCA(t).Roots()}
+	reordered := Credentials{SVID: creds.SVID, Bundle: []*x509.Certificate{creds.Bundle[1], creds.Bundle[0]}}
+	for _, f := range Formats {
+		data, err := Render(f, creds, opts)
+		require.NoError(t, err)
+		if f == PEMBundle || f == PKCS12Truststore || f == JKSTruststore {
+			assert.True(t, Unchanged(f, data, rotated, opts), "%s: a new SVID doesn't change the trust bundle", f)
+			assert.False(t, Unchanged(f, data, newBundle, opts), "%s: the bundle changed", f)
+		} else {
+			assert.False(t, Unchanged(f, data, rotated, opts), "%s: the SVID changed", f)
+			assert.True(t, Unchanged(f, data, newBundle, opts), "%s: the bundle isn't in the file", f)
+		}
+		// The order of the authorities doesn't matter
+		assert.True(t, Unchanged(f, data, reordered, opts), f)
+		assert.False(t, Unchanged(f, []byte("garbage"), creds, opts), f)
+		if f.NeedsPassword() {
+			// A keystore with the wrong password has to be rewritten
+			assert.False(t, Unchanged(f, data, creds, Options{Password: "another"}), f)
+		}
+	}
+}
+
+func TestNoKeyEntry(t *testing.T) {
+	creds := newCredentials(t, spiffetest.NewCA(t))
+	data, err := Render(JKSKeystore, creds, Options{Password: "changeit", Alias: "kafka"})
+	require.NoError(t, err)
+	assert.True(t, Unchanged(JKSKeystore, data, creds, Options{Password: "changeit", Alias: "kafka"}))
+	assert.False(t, Unchanged(JKSKeystore, data, creds, opts))
+}
+
+func TestJKS(t *testing.T) {
+	creds := newCredentials(t, spiffetest.NewCA(t))
+	data, err := Render(JKSKeystore, creds, opts)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0xFEEDFEED), binary.BigEndian.Uint32(data))
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(data[4:]))
+
+	entries, err := decodeJKS(data, opts.Password)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, DefaultAlias, entries[0].alias)
+	assert.Equal(t, creds.SVID.Certificates, entries[0].chain)
+	assert.Equal(t, creds.SVID.PrivateKey, entries[0].key)
+
+	// The digest covers the whole keystore
+	tampered := append([]byte(nil), data...)
+	tampered[20] ^= 1
+	_, err = decodeJKS(tampered, opts.Password)
+	assert.Error(t, err)
+	_, err = decodeJKS(data, "wrong")
+	assert.Error(t, err)
+	_, err = decodeJKS(data[:10], opts.Password)
+	assert.Error(t, err)
+
+	// Passwords outside ASCII are hashed as UTF-16, like Java does
+	data, err = Render(JKSTruststore, creds, Options{Password: "pässwörd"})
+	require.NoError(t, err)
+	entries, err = decodeJKS(data, "pässwörd")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "ca-0", entries[0].alias)
+	assert.True(t, creds.Bundle[1].Equal(entries[1].cert))
+}
+
+// keytool.jks is written by the JDK's keytool, with testdata/gen-jks.sh, so the decoder is checked against
+// Java's own keystores and not only against encodeJKS
+func TestDecodeKeytoolJKS(t *testing.T) {
+	data, err := os.ReadFile("testdata/keytool.jks")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("testdata/keytool.jks is missing; generate it with testdata/gen-jks.sh")
+	}
+	require.NoError(t, err)
+	entries, err := decodeJKS(data, "changeit")
+	require.NoError(t, err)
+	byAlias := map[string]jksEntry{}
+	for _, entry := range entries {
+		byAlias[entry.alias] = entry
+	}
+	require.Len(t, byAlias, 3)
+	for _, alias := range []string{"rsa", "ec"} {
+		entry := byAlias[alias]
+		require.Len(t, entry.chain, 1, alias)
+		assert.Equal(t, "keytool-"+alias, entry.chain[0].Subject.CommonName)
+		signer, ok := entry.key.(crypto.Signer)
+		require.True(t, ok, alias)
+		assert.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(entry.chain[0].PublicKey), alias)
+	}
+	require.NotNil(t, byAlias["ca"].cert)
+	assert.Equal(t, "keytool-ca", byAlias["ca"].cert.Subject.CommonName)
+
+	_, err = decodeJKS(data, "wrong")
+	assert.Error(t, err)
+}
+
+// Legacy PKCS#12 files are encrypted with 3DES, which every JVM can read, rather than with PBES2
+func TestLegacyPKCS12(t *testing.T) {
+	creds := newCredentials(t, spiffetest.NewCA(t))
+	pbeWith3DES, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3})
+	require.NoError(t, err)
+	pbes2, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13})
+	require.NoError(t, err)
+	legacy := Options{Password: opts.Password, LegacyPKCS12: true}
+
+	for _, f := range []Format{PKCS12Keystore, PKCS12Truststore} {
+		data, err := Render(f, creds, legacy)
+		require.NoError(t, err)
+		assert.True(t, bytes.Contains(data, pbeWith3DES), f)
+		assert.False(t, bytes.Contains(data, pbes2), f)
+		assert.True(t, Unchanged(f, data, creds, legacy), f)
+
+		data, err = Render(f, creds, opts)
+		require.NoError(t, err)
+		assert.True(t, bytes.Contains(data, pbes2), f)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	creds := newCredentials(t, spiffetest.NewCA(t))
+	_, err := Render(PKCS12Keystore, creds, Options{})
+	assert.Error(t, err)
+	_, err = Render(PEMKey, Credentials{Bundle: creds.Bundle}, opts)
+	assert.ErrorIs(t, err, ErrSVIDNotFound)
+	_, err = Render("der", creds, opts)
+	assert.Error(t, err)
+	// The bundle doesn't need an SVID
+	_, err = Render(PEMBundle, Credentials{Bundle: creds.Bundle}, opts)
+	assert.NoError(t, err)
+}
+
+func TestSelect(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	creds := newCredentials(t, ca)
+	other, key := ca.CreateX509SVID("spiffe://example.org/other")
+	federated := spiffetest.NewCA(t)
+	update := spiffelinkcore.SpiffeLinkUpdate{
+		Svids: []*x509svid.SVID{
+			{ID: spiffeid.RequireFromString("spiffe://example.org/other"), Certificates: other, PrivateKey: key},
+			creds.SVID,
+		},
+		Bundles: []*x509bundle.Bundle{
+			x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("example.org"), ca.Roots()),
+			x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("partner.org"), federated.Roots()),
+		},
+	}
+	selected, err := Select(update, spiffeID)
+	require.NoError(t, err)
+	assert.Equal(t, creds.SVID, selected.SVID)
+	assert.Equal(t, append(ca.Roots(), federated.Roots()...), selected.Bundle)
+
+	_, err = Select(update, "spiffe://example.org/missing")
+	assert.ErrorIs(t, err, ErrSVIDNotFound)
+}
+
+func TestResolvePassword(t *testing.T) {
+	t.Setenv("CREDFORMAT_TEST_PASSWORD", "from-the-environment")
+	password, err := ResolvePassword(context.Background(), logrus.New(), "${env:CREDFORMAT_TEST_PASSWORD}")
+	require.NoError(t, err)
+	assert.Equal(t, "from-the-environment", password)
+
+	t.Setenv("CREDFORMAT_TEST_PASSWORD", "")
+	_, err = ResolvePassword(context.Background(), logrus.New(), "${env:CREDFORMAT_TEST_PASSWORD}")
+	assert.Error(t, err)
+	_, err = ResolvePassword(context.Background(), logrus.New(), "${env:CREDFORMAT_TEST_UNSET}")
+	assert.Error(t, err)
+}
+
+func TestPerm(t *testing.T) {
+	assert.Equal(t, fs.FileMode(0600), PEMKey.Perm())
+	assert.Equal(t, fs.FileMode(0600), JKSKeystore.Perm())
+	assert.Equal(t, fs.FileMode(0644), PEMChain.Perm())
+	assert.Equal(t, fs.FileMode(0644), PKCS12Truststore.Perm())
+}
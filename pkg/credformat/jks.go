@@ -0,0 +1,296 @@
+package credformat
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1" // JKS is defined in terms of SHA-1
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf16"
+)
+
+// Java KeyStore (JKS) is the JVM's own keystore format, which older Kafka, Cassandra and Elasticsearch setups
+// still expect. There is no Go library for it in the module graph, so this writes and reads it directly,
+// following sun.security.provider.JavaKeyStore and KeyProtector:
+//
+//	magic 0xFEEDFEED, version 2, entry count
+//	each entry: tag (1 private key, 2 trusted certificate), alias, creation time in ms, then
+//	  private key: the protected key, and the chain as (type, length, DER) triples
+//	  trusted certificate: one (type, length, DER) triple
+//	SHA-1 of the password, "Mighty Aphrodite" and everything above
+//
+// The private key is protected with the keystore password, which is how keytool creates keystores by default.
+// The tests decode a keystore keytool wrote, made by testdata/gen-jks.sh, as well as the ones encodeJKS writes.
+
+const (
+	jksMagic          = 0xFEEDFEED
+	jksVersion        = 2
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+	jksCertType       = "X.509"
+	jksWhitener       = "Mighty Aphrodite"
+	jksSaltLen        = sha1.Size
+)
+
+// The OID of Sun's KeyProtector algorithm
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// An entry in a JKS keystore
+type jksEntry struct {
+	alias string
+	// Set for a private key entry
+	key   crypto.PrivateKey
+	chain []*x509.Certificate
+	// Set for a trusted certificate entry
+	cert *x509.Certificate
+}
+
+// Java keeps passwords as UTF-16 chars, and hashes each as two bytes, big-endian
+func jksPasswordBytes(password string) []byte {
+	chars := utf16.Encode([]rune(password))
+	b := make([]byte, 0, 2*len(chars))
+	for _, c := range chars {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+// The key stream KeyProtector XORs the key with
+func jksKeyStream(passwd []byte, salt []byte, length int) []byte {
+	stream := make([]byte, 0, length+sha1.Size)
+	digest := salt
+	for len(stream) < length {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		stream = append(stream, digest...)
+	}
+	return stream[:length]
+}
+
+func jksProtectKey(key crypto.PrivateKey, password string) ([]byte, error) {
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	passwd := jksPasswordBytes(password)
+	salt := make([]byte, jksSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	stream := jksKeyStream(passwd, salt, len(plain))
+	encrypted := make([]byte, 0, len(salt)+len(plain)+sha1.Size)
+	encrypted = append(encrypted, salt...)
+	for i := range plain {
+		encrypted = append(encrypted, plain[i]^stream[i])
+	}
+	check := sha1.Sum(append(passwd, plain...))
+	encrypted = append(encrypted, check[:]...)
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: encrypted,
+	})
+}
+
+func jksRecoverKey(protected []byte, password string) (crypto.PrivateKey, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protected, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		return nil, fmt.Errorf("unsupported key protection algorithm %s", info.Algorithm.Algorithm)
+	}
+	encrypted := info.EncryptedData
+	if len(encrypted) < jksSaltLen+sha1.Size {
+		return nil, errors.New("protected key is too short")
+	}
+	passwd := jksPasswordBytes(password)
+	salt := encrypted[:jksSaltLen]
+	body := encrypted[jksSaltLen : len(encrypted)-sha1.Size]
+	stream := jksKeyStream(passwd, salt, len(body))
+	plain := make([]byte, len(body))
+	for i := range body {
+		plain[i] = body[i] ^ stream[i]
+	}
+	check := sha1.Sum(append(passwd, plain...))
+	if subtle.ConstantTimeCompare(check[:], encrypted[len(encrypted)-sha1.Size:]) != 1 {
+		return nil, errors.New("wrong password for the private key")
+	}
+	return x509.ParsePKCS8PrivateKey(plain)
+}
+
+// Writes the big-endian fields of a keystore
+type jksWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *jksWriter) u16(v uint16) { _ = binary.Write(&w.buf, binary.BigEndian, v) }
+func (w *jksWriter) u32(v uint32) { _ = binary.Write(&w.buf, binary.BigEndian, v) }
+func (w *jksWriter) u64(v uint64) { _ = binary.Write(&w.buf, binary.BigEndian, v) }
+
+// Java's writeUTF. Aliases and the certificate type are ASCII, so modified UTF-8 is the same as UTF-8.
+func (w *jksWriter) utf(s string) {
+	w.u16(uint16(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *jksWriter) cert(cert *x509.Certificate) {
+	w.utf(jksCertType)
+	w.u32(uint32(len(cert.Raw)))
+	w.buf.Write(cert.Raw)
+}
+
+func encodeJKS(entries []jksEntry, password string, now time.Time) ([]byte, error) {
+	w := &jksWriter{}
+	w.u32(jksMagic)
+	w.u32(jksVersion)
+	w.u32(uint32(len(entries)))
+	for _, entry := range entries {
+		if entry.key != nil {
+			protected, err := jksProtectKey(entry.key, password)
+			if err != nil {
+				return nil, err
+			}
+			w.u32(jksPrivateKeyTag)
+			w.utf(entry.alias)
+			w.u64(uint64(now.UnixMilli()))
+			w.u32(uint32(len(protected)))
+			w.buf.Write(protected)
+			w.u32(uint32(len(entry.chain)))
+			for _, cert := range entry.chain {
+				w.cert(cert)
+			}
+		} else {
+			w.u32(jksTrustedCertTag)
+			w.utf(entry.alias)
+			w.u64(uint64(now.UnixMilli()))
+			w.cert(entry.cert)
+		}
+	}
+	digest := jksDigest(w.buf.Bytes(), password)
+	w.buf.Write(digest)
+	return w.buf.Bytes(), nil
+}
+
+func jksDigest(data []byte, password string) []byte {
+	h := sha1.New()
+	h.Write(jksPasswordBytes(password))
+	h.Write([]byte(jksWhitener))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Reads the big-endian fields of a keystore, remembering the first error
+type jksReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *jksReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *jksReader) u32() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *jksReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *jksReader) utf() string {
+	var n uint16
+	r.read(&n)
+	return string(r.bytes(int(n)))
+}
+
+func (r *jksReader) cert(version uint32) *x509.Certificate {
+	if version == jksVersion {
+		if certType := r.utf(); r.err == nil && certType != jksCertType {
+			r.err = fmt.Errorf("unsupported certificate type %s", certType)
+		}
+	}
+	der := r.bytes(int(r.u32()))
+	if r.err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		r.err = err
+	}
+	return cert
+}
+
+// Decode a JKS keystore, checking its integrity with the password
+func decodeJKS(data []byte, password string) ([]jksEntry, error) {
+	if len(data) < sha1.Size {
+		return nil, errors.New("not a JKS keystore")
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	r := &jksReader{r: bytes.NewReader(body)}
+	if magic := r.u32(); r.err != nil || magic != jksMagic {
+		return nil, errors.New("not a JKS keystore")
+	}
+	version := r.u32()
+	if version != 1 && version != jksVersion {
+		return nil, fmt.Errorf("unsupported JKS version %d", version)
+	}
+	if subtle.ConstantTimeCompare(jksDigest(body, password), digest) != 1 {
+		return nil, errors.New("the keystore was tampered with, or the password is wrong")
+	}
+	count := r.u32()
+	var entries []jksEntry
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		tag := r.u32()
+		entry := jksEntry{alias: r.utf()}
+		var created uint64
+		r.read(&created)
+		switch tag {
+		case jksPrivateKeyTag:
+			protected := r.bytes(int(r.u32()))
+			chainLen := r.u32()
+			for j := uint32(0); j < chainLen && r.err == nil; j++ {
+				entry.chain = append(entry.chain, r.cert(version))
+			}
+			if r.err == nil {
+				entry.key, r.err = jksRecoverKey(protected, password)
+			}
+		case jksTrustedCertTag:
+			entry.cert = r.cert(version)
+		default:
+			r.err = fmt.Errorf("unsupported JKS entry type %d", tag)
+		}
+		entries = append(entries, entry)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return entries, nil
+}
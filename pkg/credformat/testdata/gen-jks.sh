@@ -0,0 +1,17 @@
+#!/bin/sh
+# Generates keytool.jks, which TestDecodeKeytoolJKS decodes, so that the JKS decoder is checked against a
+# keystore the JDK wrote rather than only against its own encoder. Run it from anywhere, with a JDK's keytool
+# on the PATH.
+set -e
+cd "$(dirname "$0")"
+rm -f keytool.jks ca.der
+keytool() { command keytool -storetype JKS -keystore keytool.jks -storepass changeit "$@"; }
+
+keytool -genkeypair -alias rsa -keyalg RSA -keysize 2048 -keypass changeit -dname CN=keytool-rsa -validity 36500
+keytool -genkeypair -alias ec -keyalg EC -groupname secp256r1 -keypass changeit -dname CN=keytool-ec -validity 36500
+# A trusted certificate entry, from a key pair that is then removed
+keytool -genkeypair -alias ca -keyalg EC -groupname secp256r1 -keypass changeit -dname CN=keytool-ca -validity 36500
+keytool -exportcert -alias ca -file ca.der
+keytool -delete -alias ca
+keytool -importcert -noprompt -alias ca -file ca.der
+rm ca.der
@@ -2,9 +2,17 @@ package datastore
 
 import (
 	"context"
+	"time"
 
+	"github.com/dfeldman/spiffelink/pkg/cassandra"
 	"github.com/dfeldman/spiffelink/pkg/config"
 	"github.com/dfeldman/spiffelink/pkg/dummy"
+	"github.com/dfeldman/spiffelink/pkg/elasticsearch"
+	"github.com/dfeldman/spiffelink/pkg/etcd"
+	"github.com/dfeldman/spiffelink/pkg/files"
+	"github.com/dfeldman/spiffelink/pkg/kafka"
+	"github.com/dfeldman/spiffelink/pkg/mssql"
+	"github.com/dfeldman/spiffelink/pkg/redis"
 	"github.com/dfeldman/spiffelink/pkg/shell"
 	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
 	"github.com/dfeldman/spiffelink/pkg/step"
@@ -21,7 +29,21 @@ type Datastore interface {
 	GetUpdateSteps(context.Context, config.DatabaseConfig, shell.ShellContext, spiffelinkcore.SpiffeLinkUpdate) step.StepList
 }
 
+// Scheduler is implemented by datastores whose databases need rotating at times of their own, besides on every
+// update from the Workload API. The updater runs the database's steps again at those times.
+type Scheduler interface {
+	// Return when the database next needs a rotation after now, or false if it never does
+	NextRun(dbConfig config.DatabaseConfig, now time.Time) (time.Time, bool)
+}
+
+// Grouper is implemented by datastores whose databases must not be rotated at the same time as some others,
+// like the members of one cluster. Rotations in the same group run one at a time, in the order they started.
+type Grouper interface {
+	// Return the database's group, or "" if it can be rotated alongside any other database
+	Group(dbConfig config.DatabaseConfig) string
+}
+
 // TODO This is not a good pattern. Instead this should work like GetShellContextFromConfig.
 func GetDatastores() []Datastore {
-	return []Datastore{&dummy.Dummy{}}
+	return []Datastore{&dummy.Dummy{}, &files.Files{}, &kafka.Kafka{}, &mssql.MSSQL{}, &redis.Redis{}, &elasticsearch.Elasticsearch{}, &cassandra.Cassandra{}, &etcd.Etcd{}}
 }
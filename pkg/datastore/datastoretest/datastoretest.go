@@ -0,0 +1,530 @@
+// Package datastoretest is a conformance suite for datastores. Every datastore should pass it, so that the
+// updater can rely on the same behavior from all of them: a rotation installs the new SVID, a rotation that
+// is interrupted puts the old one back, Post notices when the new SVID didn't take, steps stop when they
+// are cancelled, and nothing is touched except through the ShellContext.
+//
+// A datastore's test runs the suite with a fake ShellContext:
+//
+//	func TestConformance(t *testing.T) {
+//		datastoretest.Run(t, datastoretest.Suite{
+//			Datastore:   &mydb.MyDB{},
+//			Config:      func(dir string) config.DatabaseConfig { ... },
+//			NewShell:    func(t *testing.T, dir string) shell.ShellContext { ... },
+//			Certificate: func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) { ... },
+//			// Only for datastores that run commands
+//			Mutating:    func(path string, args []string) bool { ... },
+//		})
+//	}
+package datastoretest
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The SPIFFE ID the suite issues SVIDs for, if the config doesn't set one
+const DefaultSpiffeID = "spiffe://example.org/datastoretest"
+
+// Suite describes the datastore under test.
+type Suite struct {
+	Datastore datastore.Datastore
+	// Config returns the configuration of a database that keeps all of its files under dir. The suite fills
+	// in the SPIFFE ID and name if they are empty.
+	Config func(dir string) config.DatabaseConfig
+	// NewShell returns a fake ShellContext for one scenario, in which dir exists and is writeable. It must not
+	// touch the real filesystem: the suite fails if anything appears in dir.
+	NewShell func(t *testing.T, dir string) shell.ShellContext
+	// Certificate returns the leaf certificate the database is using, by looking at it through the
+	// ShellContext, or nil if it has none.
+	Certificate func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error)
+	// Mutating reports whether a command changes the database, like a reload, a restart or a change to its
+	// configuration, rather than only looking at it. Commands that change something count as writes: a dry
+	// run fails if it runs one, and they are lost along with the writes when the suite checks that Post
+	// notices. A datastore that runs commands in those scenarios must set it.
+	Mutating func(path string, args []string) bool
+}
+
+// Run runs every scenario as a subtest.
+func Run(t *testing.T, s Suite) {
+	require.NotNil(t, s.Datastore, "Suite.Datastore is required")
+	require.NotNil(t, s.Config, "Suite.Config is required")
+	require.NotNil(t, s.NewShell, "Suite.NewShell is required")
+	require.NotNil(t, s.Certificate, "Suite.Certificate is required")
+
+	scenarios := []struct {
+		name string
+		run  func(e *env)
+	}{
+		{"Rotate", testRotate},
+		{"Idempotent", testIdempotent},
+		{"DryRunChangesNothing", testDryRun},
+		{"RollbackRestoresPrevious", testRollback},
+		{"RollbackOfFirstRotation", testRollbackFirst},
+		{"PostDetectsUnappliedCertificate", testPostDetectsUnapplied},
+		{"CancelledBeforeStart", testCancelledBeforeStart},
+		{"CancelledDuringExecute", testCancelledDuringExecute},
+		{"RotateFromExpired", testRotateFromExpired},
+		{"RotateToShortLived", testRotateToShortLived},
+	}
+	for _, scenario := range scenarios {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) {
+			e := newEnv(t, s)
+			scenario.run(e)
+			e.checkNoFilesystemAccess()
+		})
+	}
+}
+
+// Everything one scenario needs
+type env struct {
+	t     *testing.T
+	s     Suite
+	dir   string
+	dbc   config.DatabaseConfig
+	sl    *spiffelinkcore.SpiffeLinkCore
+	ca    *spiffetest.CA
+	shell shell.ShellContext
+}
+
+func newEnv(t *testing.T, s Suite) *env {
+	dir := t.TempDir()
+	dbc := s.Config(dir)
+	if dbc.SpiffeID == "" {
+		dbc.SpiffeID = DefaultSpiffeID
+	}
+	if dbc.Name == "" {
+		dbc.Name = "datastoretest"
+	}
+	dbc.ParsedSpiffeID = spiffeid.RequireFromString(dbc.SpiffeID)
+	logger := logrus.New()
+	logger.Out = testWriter{t}
+	return &env{
+		t:     t,
+		s:     s,
+		dir:   dir,
+		dbc:   dbc,
+		sl:    &spiffelinkcore.SpiffeLinkCore{Logger: logger, Config: &config.Config{}},
+		ca:    spiffetest.NewCA(t),
+		shell: s.NewShell(t, dir),
+	}
+}
+
+// Sends log output to the test log, so it is only shown for failed tests
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// An update with a new SVID for the database, valid for an hour
+func (e *env) update() spiffelinkcore.SpiffeLinkUpdate {
+	certs, key := e.ca.CreateX509SVID(e.dbc.SpiffeID)
+	return e.updateWith(certs, key)
+}
+
+// An update with a new SVID for the database, valid between notBefore and notAfter
+func (e *env) updateValidFor(notBefore time.Time, notAfter time.Time) spiffelinkcore.SpiffeLinkUpdate {
+	certs, key := e.ca.CreateX509SVIDWithValidity(e.dbc.SpiffeID, notBefore, notAfter)
+	return e.updateWith(certs, key)
+}
+
+func (e *env) updateWith(certs []*x509.Certificate, key crypto.Signer) spiffelinkcore.SpiffeLinkUpdate {
+	return spiffelinkcore.SpiffeLinkUpdate{
+		Svids:   []*x509svid.SVID{{ID: e.dbc.ParsedSpiffeID, Certificates: certs, PrivateKey: key}},
+		Bundles: []*x509bundle.Bundle{x509bundle.FromX509Authorities(e.dbc.ParsedSpiffeID.TrustDomain(), e.ca.Roots())},
+	}
+}
+
+// Run the datastore's steps for an update through the given shell
+func (e *env) run(ctx context.Context, sc shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate, mode step.Mode, extra ...step.Step) []step.StepFuncOutputMessage {
+	sl := e.s.Datastore.GetUpdateSteps(ctx, e.dbc, sc, update)
+	require.NotEmpty(e.t, sl.Steps, "the datastore has no steps")
+	runner := step.Runner{Sl: e.sl, Dbc: &e.dbc, Update: &update, ShellContext: sc}
+	return runner.Run(ctx, append(sl.Steps, extra...), mode)
+}
+
+// Apply an update, which must succeed
+func (e *env) apply(update spiffelinkcore.SpiffeLinkUpdate) {
+	ctx, sc := e.checked(context.Background())
+	outputs := e.run(ctx, sc, update, step.Execute)
+	require.Nil(e.t, outputs, "rotation failed: %s", describe(outputs))
+}
+
+// Wrap the scenario's shell so every call is checked
+func (e *env) checked(ctx context.Context) (context.Context, *checkedShell) {
+	ctx = context.WithValue(ctx, runMarker{}, true)
+	return ctx, &checkedShell{ShellContext: e.shell, t: e.t, dir: e.dir, runCtx: ctx, mutating: e.s.Mutating}
+}
+
+// The certificate the database is using now
+func (e *env) certificate() *x509.Certificate {
+	cert, err := e.s.Certificate(context.Background(), e.shell, e.dbc)
+	require.NoError(e.t, err)
+	return cert
+}
+
+// Check the database is using the SVID of an update, or no SVID if update is nil
+func (e *env) requireUsing(update *spiffelinkcore.SpiffeLinkUpdate, msg string) {
+	cert := e.certificate()
+	if update == nil {
+		require.Nil(e.t, cert, msg)
+		return
+	}
+	require.NotNil(e.t, cert, msg)
+	want := update.Svids[0].Certificates[0]
+	require.Equal(e.t, want.SerialNumber.String(), cert.SerialNumber.String(), msg)
+	require.True(e.t, want.Equal(cert), msg)
+}
+
+// Nothing should have been written to the real directory, since all file access goes through the fake shell
+func (e *env) checkNoFilesystemAccess() {
+	entries, err := os.ReadDir(e.dir)
+	require.NoError(e.t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Empty(e.t, names, "the datastore wrote to the filesystem without going through the ShellContext")
+}
+
+func testRotate(e *env) {
+	first, second := e.update(), e.update()
+	e.apply(first)
+	e.requireUsing(&first, "the first SVID was not installed")
+	e.apply(second)
+	e.requireUsing(&second, "the second SVID was not installed")
+}
+
+func testIdempotent(e *env) {
+	update := e.update()
+	e.apply(update)
+	e.apply(update)
+	e.requireUsing(&update, "applying the same SVID twice did not leave it installed")
+}
+
+func testDryRun(e *env) {
+	first, second := e.update(), e.update()
+	e.apply(first)
+	ctx, sc := e.checked(context.Background())
+	sc.readOnly = true
+	outputs := e.run(ctx, sc, second, step.DryRun)
+	require.Nil(e.t, outputs, "dry run failed: %s", describe(outputs))
+	e.requireUsing(&first, "a dry run changed the certificate")
+}
+
+// A step that cancels the run when it executes, after every step of the datastore has finished, so the
+// runner rolls them all back.
+func cancelAfter(steps []step.Step, cancel context.CancelFunc) step.Step {
+	sentinel := step.Step{
+		Name:        "Cancel the run",
+		Id:          "DATASTORETEST_CANCEL",
+		TelemetryID: "DATASTORETEST_CANCEL",
+		Execute: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			cancel()
+			<-ctx.Done()
+			return step.StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{
+				slerror.StepCancelledError(sfi.Sl.Logger, "Cancel the run", "execute", ctx.Err()),
+			}}}
+		},
+	}
+	// If the datastore's steps form a graph, the sentinel has to wait for all of them
+	graph := false
+	for _, s := range steps {
+		if len(s.DependsOn) > 0 {
+			graph = true
+		}
+	}
+	if graph {
+		for _, s := range steps {
+			if s.Id != "" {
+				sentinel.DependsOn = append(sentinel.DependsOn, s.Id)
+			}
+		}
+	}
+	return sentinel
+}
+
+// Run an update that is interrupted once all of the datastore's steps have finished
+func (e *env) interruptedRotation(update spiffelinkcore.SpiffeLinkUpdate) []step.StepFuncOutputMessage {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, sc := e.checked(ctx)
+	steps := e.s.Datastore.GetUpdateSteps(ctx, e.dbc, sc, update).Steps
+	return e.run(ctx, sc, update, step.Execute, cancelAfter(steps, cancel))
+}
+
+func testRollback(e *env) {
+	first, second := e.update(), e.update()
+	e.apply(first)
+	outputs := e.interruptedRotation(second)
+	require.True(e.t, hasCode(outputs, slerror.StepCancelledCode), "the run was not cancelled: %s", describe(outputs))
+	requireUndoSucceeded(e.t, outputs)
+	e.requireUsing(&first, "undo did not restore the previous SVID")
+}
+
+func testRollbackFirst(e *env) {
+	outputs := e.interruptedRotation(e.update())
+	require.True(e.t, hasCode(outputs, slerror.StepCancelledCode), "the run was not cancelled: %s", describe(outputs))
+	requireUndoSucceeded(e.t, outputs)
+	e.requireUsing(nil, "undo did not remove the SVID installed by the first rotation")
+}
+
+func requireUndoSucceeded(t *testing.T, outputs []step.StepFuncOutputMessage) {
+	for _, output := range outputs {
+		if output.Stage == "undo" {
+			require.True(t, output.Errors.Empty(), "undo of %s failed: %v", output.Name, output.Errors.Errors)
+		}
+	}
+}
+
+func testPostDetectsUnapplied(e *env) {
+	first, second := e.update(), e.update()
+	sl := e.s.Datastore.GetUpdateSteps(context.Background(), e.dbc, e.shell, second)
+	hasPost := false
+	for _, s := range sl.Steps {
+		hasPost = hasPost || s.Post != nil
+	}
+	require.True(e.t, hasPost, "no step has a Post stage to check the SVID was applied")
+
+	e.apply(first)
+	ctx, sc := e.checked(context.Background())
+	// The shell reports success for every change, but doesn't make it
+	sc.loseWrites = true
+	outputs := e.run(ctx, sc, second, step.Execute)
+	require.NotNil(e.t, outputs, "the rotation succeeded although the SVID was never written")
+	var postFailed bool
+	for _, output := range outputs {
+		postFailed = postFailed || (output.Stage == "post" && !output.Errors.Empty())
+	}
+	require.True(e.t, postFailed, "Post did not fail when the SVID was not applied: %s", describe(outputs))
+	e.requireUsing(&first, "the previous SVID should still be in use")
+}
+
+func testCancelledBeforeStart(e *env) {
+	first, second := e.update(), e.update()
+	e.apply(first)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx, sc := e.checked(ctx)
+	sc.readOnly = true
+	outputs := e.run(ctx, sc, second, step.Execute)
+	require.True(e.t, hasCode(outputs, slerror.StepCancelledCode), "the run was not cancelled: %s", describe(outputs))
+	e.requireUsing(&first, "a cancelled run changed the certificate")
+}
+
+func testCancelledDuringExecute(e *env) {
+	first, second := e.update(), e.update()
+	e.apply(first)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, sc := e.checked(ctx)
+	// The run is cancelled as soon as the datastore writes anything
+	sc.afterWrite = cancel
+	outputs := e.run(ctx, sc, second, step.Execute)
+	require.NotZero(e.t, sc.writes(), "the datastore never wrote through the ShellContext")
+	require.True(e.t, hasCode(outputs, slerror.StepCancelledCode), "the run was not cancelled: %s", describe(outputs))
+	requireUndoSucceeded(e.t, outputs)
+	e.requireUsing(&first, "undo did not restore the previous SVID after the run was cancelled")
+}
+
+func testRotateFromExpired(e *env) {
+	now := time.Now()
+	expired := e.updateValidFor(now.Add(-2*time.Hour), now.Add(-time.Hour))
+	e.apply(expired)
+	e.requireUsing(&expired, "the expired SVID was not installed")
+	fresh := e.update()
+	e.apply(fresh)
+	e.requireUsing(&fresh, "rotating away from an expired SVID failed")
+}
+
+func testRotateToShortLived(e *env) {
+	now := time.Now()
+	first := e.update()
+	e.apply(first)
+	shortLived := e.updateValidFor(now.Add(-time.Minute), now.Add(time.Minute))
+	e.apply(shortLived)
+	e.requireUsing(&shortLived, "the SVID that is about to expire was not installed")
+}
+
+func hasCode(outputs []step.StepFuncOutputMessage, code slerror.ErrorCode) bool {
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			if err.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A summary of the errors in a run's outputs, for failure messages
+func describe(outputs []step.StepFuncOutputMessage) string {
+	var lines []string
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			lines = append(lines, output.Name+"/"+output.Stage+": "+string(err.Code)+": "+err.Error())
+		}
+	}
+	if len(lines) == 0 {
+		return "no errors"
+	}
+	return strings.Join(lines, "; ")
+}
+
+// Context key set on the context of every run, so the shell can tell the datastore passed it through
+type runMarker struct{}
+
+// checkedShell wraps the scenario's shell. It checks that every call gets the context of the stage that made
+// it, so cancelling the run reaches the ShellContext, and that nothing is written outside the database's
+// directory. It can also lose writes, refuse them, or cancel the run after the first one. Commands that
+// change the database are writes too.
+type checkedShell struct {
+	shell.ShellContext
+	t        *testing.T
+	dir      string
+	runCtx   context.Context
+	mutating func(path string, args []string) bool
+	// Report success for WriteFile, RemoveFile and mutating commands without doing anything
+	loseWrites bool
+	// Fail the test if anything is written
+	readOnly bool
+	// Called after the first WriteFile or RemoveFile
+	afterWrite func()
+
+	mu       sync.Mutex
+	numWrite int
+}
+
+func (c *checkedShell) checkContext(ctx context.Context, call string) {
+	// Rollback after an interruption gets a new context, since the run's context is done by then
+	if ctx.Value(runMarker{}) == nil && c.runCtx.Err() == nil {
+		c.t.Errorf("%s was called with a context that doesn't come from the step's context", call)
+	}
+}
+
+func (c *checkedShell) checkWrite(ctx context.Context, call string, path string) {
+	c.checkContext(ctx, call)
+	rel, err := filepath.Rel(c.dir, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		c.t.Errorf("%s of %s, which is outside the database's directory %s", call, path, c.dir)
+	}
+	if c.readOnly {
+		c.t.Errorf("%s of %s in a run that should not change anything", call, path)
+	}
+}
+
+// Count a write, and cancel the run if that was asked for
+func (c *checkedShell) wrote() {
+	c.mu.Lock()
+	c.numWrite++
+	first := c.numWrite == 1
+	c.mu.Unlock()
+	if first && c.afterWrite != nil {
+		c.afterWrite()
+	}
+}
+
+func (c *checkedShell) writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numWrite
+}
+
+func (c *checkedShell) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
+	c.checkContext(ctx, "FindExecutable")
+	return c.ShellContext.FindExecutable(ctx, paths, name)
+}
+
+func (c *checkedShell) CheckExecutable(ctx context.Context, execPath string) error {
+	c.checkContext(ctx, "CheckExecutable")
+	return c.ShellContext.CheckExecutable(ctx, execPath)
+}
+
+func (c *checkedShell) FindPaths(ctx context.Context, paths []string) ([]string, error) {
+	c.checkContext(ctx, "FindPaths")
+	return c.ShellContext.FindPaths(ctx, paths)
+}
+
+func (c *checkedShell) RunCmd(ctx context.Context, path string, args []string, environ []string, timeout time.Duration) (string, error) {
+	c.checkContext(ctx, "RunCmd")
+	if c.mutating == nil {
+		if c.readOnly || c.loseWrites {
+			c.t.Errorf("RunCmd of %s in a scenario that checks for changes, but Suite.Mutating isn't set to say whether it changes anything", path)
+		}
+		return c.ShellContext.RunCmd(ctx, path, args, environ, timeout)
+	}
+	if !c.mutating(path, args) {
+		return c.ShellContext.RunCmd(ctx, path, args, environ, timeout)
+	}
+	if c.readOnly {
+		c.t.Errorf("RunCmd of %s %s in a run that should not change anything", path, strings.Join(args, " "))
+	}
+	if c.loseWrites {
+		return "", nil
+	}
+	output, err := c.ShellContext.RunCmd(ctx, path, args, environ, timeout)
+	if err != nil {
+		return output, err
+	}
+	c.wrote()
+	return output, nil
+}
+
+func (c *checkedShell) CheckPathWriteable(ctx context.Context, path string) error {
+	c.checkContext(ctx, "CheckPathWriteable")
+	return c.ShellContext.CheckPathWriteable(ctx, path)
+}
+
+func (c *checkedShell) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	c.checkContext(ctx, "ReadFile")
+	return c.ShellContext.ReadFile(ctx, path)
+}
+
+func (c *checkedShell) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	c.checkWrite(ctx, "WriteFile", path)
+	if c.loseWrites {
+		return nil
+	}
+	if err := c.ShellContext.WriteFile(ctx, path, data, perm); err != nil {
+		return err
+	}
+	c.wrote()
+	return nil
+}
+
+func (c *checkedShell) RemoveFile(ctx context.Context, path string) error {
+	c.checkWrite(ctx, "RemoveFile", path)
+	if c.loseWrites {
+		return nil
+	}
+	if err := c.ShellContext.RemoveFile(ctx, path); err != nil {
+		return err
+	}
+	c.wrote()
+	return nil
+}
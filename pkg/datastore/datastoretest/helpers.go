@@ -0,0 +1,55 @@
+package datastoretest
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// These helpers are for a datastore's own tests, beyond the conformance suite.
+
+// NewUpdate returns an update with a new SVID from ca for each of the IDs, and ca's authorities as the bundle
+// of the first ID's trust domain.
+func NewUpdate(ca *spiffetest.CA, ids ...spiffeid.ID) spiffelinkcore.SpiffeLinkUpdate {
+	update := spiffelinkcore.SpiffeLinkUpdate{
+		Bundles: []*x509bundle.Bundle{x509bundle.FromX509Authorities(ids[0].TrustDomain(), ca.Roots())},
+	}
+	for _, id := range ids {
+		certs, key := ca.CreateX509SVID(id.String())
+		update.Svids = append(update.Svids, &x509svid.SVID{ID: id, Certificates: certs, PrivateKey: key})
+	}
+	return update
+}
+
+// RunSteps runs a datastore's steps for an update through sh, as the updater would, and returns their output.
+func RunSteps(ctx context.Context, store datastore.Datastore, dbc config.DatabaseConfig, sh shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) []step.StepFuncOutputMessage {
+	dbc.ParsedSpiffeID = spiffeid.RequireFromString(dbc.SpiffeID)
+	sl := &spiffelinkcore.SpiffeLinkCore{Logger: logrus.New(), Config: &config.Config{}}
+	steps := store.GetUpdateSteps(ctx, dbc, sh, update)
+	runner := step.Runner{Sl: sl, Dbc: &dbc, Update: &update, ShellContext: sh}
+	return runner.Run(ctx, steps.Steps, step.Execute)
+}
+
+// CredentialWrites returns the files a fake shell was asked to write, leaving out the backups of the files
+// they replaced and the secret files commands read, for tests that check which files a rotation rewrote.
+func CredentialWrites(sh *fakeshell.FakeShell) []fakeshell.Call {
+	var writes []fakeshell.Call
+	for _, call := range sh.CallsTo(fakeshell.WriteFile) {
+		if !strings.HasSuffix(call.Path, credfiles.BackupSuffix) && !strings.HasSuffix(call.Path, credfiles.SecretFileSuffix) {
+			writes = append(writes, call)
+		}
+	}
+	return writes
+}
@@ -0,0 +1,67 @@
+package datastoretest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/require"
+)
+
+// Replay runs a datastore's steps against a session recorded with shell.RecordingShellContext, for a new SVID
+// for dbc, and fails the test unless the steps make exactly the calls that were recorded. It returns the
+// outputs of the run, so the test can check how the recorded problem is handled:
+//
+//	sessions, err := shell.LoadRecording("testdata/customer-1234.jsonl")
+//	require.NoError(t, err)
+//	outputs, _ := datastoretest.Replay(t, &mydb.MyDB{}, dbc, sessions[0], step.Execute)
+//	assert.Nil(t, outputs)
+//
+// dbc must be the config the session was recorded with, so the steps look in the same places. The replay
+// shell is returned too, for tests that need to match command arguments differently before checking.
+func Replay(t *testing.T, ds datastore.Datastore, dbc config.DatabaseConfig, session shell.Session, mode step.Mode) ([]step.StepFuncOutputMessage, *shell.ReplayShellContext) {
+	require.NotEmpty(t, session.Calls, "the session has no calls")
+	if dbc.SpiffeID == "" {
+		dbc.SpiffeID = DefaultSpiffeID
+	}
+	dbc.ParsedSpiffeID = spiffeid.RequireFromString(dbc.SpiffeID)
+	logger := logrus.New()
+	logger.Out = testWriter{t}
+	e := &env{
+		t:   t,
+		s:   Suite{Datastore: ds},
+		dbc: dbc,
+		sl:  &spiffelinkcore.SpiffeLinkCore{Logger: logger, Config: &config.Config{}},
+		ca:  spiffetest.NewCA(t),
+	}
+	sc := shell.NewReplayShellContext(session)
+	outputs := e.run(context.Background(), sc, e.update(), mode)
+	if unexpected := sc.Unexpected(); len(unexpected) > 0 {
+		t.Errorf("the steps made calls that are not in session %s:\n%s", session.ID, describeCalls(unexpected))
+	}
+	if unused := sc.Unused(); len(unused) > 0 {
+		t.Errorf("the steps did not make these calls from session %s:\n%s", session.ID, describeCalls(unused))
+	}
+	return outputs, sc
+}
+
+func describeCalls(calls []shell.Record) string {
+	var b strings.Builder
+	for _, call := range calls {
+		fmt.Fprintf(&b, "  %s %s", call.Method, call.Path)
+		if len(call.Args) > 0 {
+			fmt.Fprintf(&b, " %s", strings.Join(call.Args, " "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -1,13 +1,18 @@
 package dockershell
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 
 	"github.com/sirupsen/logrus"
 )
@@ -37,16 +42,37 @@ func NewDockerContext(containerID string, logger *logrus.Logger) (*DockerContext
 	}, nil
 }
 
+// exitError is returned by exec when the command ran and exited with a non-zero status, as opposed to a
+// command that couldn't be run at all.
+type exitError struct {
+	code   int
+	output string
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("command exited with code %d: %s", e.code, e.output)
+}
+
 func (dc *DockerContext) execCommand(ctx context.Context, cmd ...string) (string, error) {
+	stdout, stderr, err := dc.exec(ctx, nil, nil, cmd...)
+	return stdout + stderr, err
+}
+
+// Run a command in the container with environ added to its environment, sending it stdin if that isn't nil,
+// and return what it wrote to stdout and stderr. Without a TTY, Docker sends both on one stream, with a header before each frame, so the stream is
+// split with stdcopy.
+func (dc *DockerContext) exec(ctx context.Context, stdin []byte, environ []string, cmd ...string) (string, string, error) {
 	execConfig := types.ExecConfig{
+		AttachStdin:  stdin != nil,
 		AttachStdout: true,
 		AttachStderr: true,
+		Env:          environ,
 		Cmd:          cmd,
 	}
 
 	execIDResp, err := dc.cli.ContainerExecCreate(ctx, dc.containerID, execConfig)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	execStartCheck := types.ExecStartCheck{
@@ -55,31 +81,42 @@ func (dc *DockerContext) execCommand(ctx context.Context, cmd ...string) (string
 	}
 	execAttachResp, err := dc.cli.ContainerExecAttach(ctx, execIDResp.ID, execStartCheck)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer execAttachResp.Close()
 
-	output := ""
-	buf := make([]byte, 1024)
-	for {
-		n, err := execAttachResp.Reader.Read(buf)
-		if err != nil {
-			// We potentially should return an error here
-			break
-		}
-		output += string(buf[:n])
+	// The input is written while the output is read, so neither side waits for the other
+	written := make(chan error, 1)
+	if stdin != nil {
+		go func() {
+			_, err := execAttachResp.Conn.Write(stdin)
+			if closeErr := execAttachResp.CloseWrite(); err == nil {
+				err = closeErr
+			}
+			written <- err
+		}()
+	} else {
+		written <- nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, execAttachResp.Reader); err != nil {
+		return stdout.String(), stderr.String(), err
+	}
+	if err := <-written; err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("unable to send input to the command: %w", err)
 	}
 
 	// Check the exit code of the executed command
 	execInspect, err := dc.cli.ContainerExecInspect(ctx, execIDResp.ID)
 	if err != nil {
-		return output, err
+		return stdout.String(), stderr.String(), err
 	}
 	if execInspect.ExitCode != 0 {
-		return output, fmt.Errorf("command exited with code %d: %s", execInspect.ExitCode, output)
+		return stdout.String(), stderr.String(), &exitError{code: execInspect.ExitCode, output: stdout.String() + stderr.String()}
 	}
 
-	return output, nil
+	return stdout.String(), stderr.String(), nil
 }
 
 func (dc *DockerContext) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
@@ -126,7 +163,8 @@ func (dc *DockerContext) RunCmd(ctx context.Context, path string, args []string,
 	defer cancel()
 
 	cmd := append([]string{path}, args...)
-	output, err := dc.execCommand(ctx, cmd...)
+	stdout, stderr, err := dc.exec(ctx, nil, environ, cmd...)
+	output := stdout + stderr
 	if ctx.Err() == context.DeadlineExceeded {
 		dc.logger.Error("Command timed out")
 		return "", fmt.Errorf("command timed out")
@@ -147,6 +185,50 @@ func (dc *DockerContext) CheckPathWriteable(ctx context.Context, path string) er
 	return nil
 }
 
+func (dc *DockerContext) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	// test exits with 1 if the file isn't there. Any other failure, like a daemon that can't be reached, is
+	// returned as it is, so a file that couldn't be checked isn't taken for one that doesn't exist.
+	if _, err := dc.execCommand(ctx, "test", "-f", path); err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) && exit.code == 1 {
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	stdout, _, err := dc.exec(ctx, nil, nil, "cat", path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(stdout), nil
+}
+
+// The container's shell reads the data from stdin, so it isn't in the container's process list, into a file
+// next to the destination. The file is created with the final permissions, given the owner and group of the
+// file it replaces so the database can still read it, and renamed over the destination.
+const writeScript = `set -e
+tmp="$1.$$.tmp"
+trap 'rm -f "$tmp"' EXIT
+umask "$3"
+cat > "$tmp"
+if [ -e "$1" ]; then chown "$(stat -c %u:%g "$1")" "$tmp"; fi
+chmod "$2" "$tmp"
+mv -f "$tmp" "$1"`
+
+func (dc *DockerContext) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	if data == nil {
+		data = []byte{}
+	}
+	mode := fmt.Sprintf("%o", perm.Perm())
+	umask := fmt.Sprintf("%03o", 0777&^perm.Perm())
+	_, _, err := dc.exec(ctx, data, nil, "sh", "-c", writeScript, "sh", path, mode, umask)
+	return err
+}
+
+func (dc *DockerContext) RemoveFile(ctx context.Context, path string) error {
+	_, err := dc.execCommand(ctx, "rm", "-f", path)
+	return err
+}
+
 // func createTarArchive(filePath, content []byte) ([]byte, error) {
 // 	var buf bytes.Buffer
 // 	tw := stdcopy.NewStdWriter(&buf)
@@ -1,20 +1,46 @@
 package dummy
 
 import (
+	"bytes"
 	"context"
-	"crypto/x509"
 	"encoding/pem"
-	"fmt"
-	"io/ioutil"
-	"os"
+	"path"
 
 	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
 	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
 	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
 	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 )
 
-// TODO write unit tests for this module
+// The dummy package implements a simple "dummy" database. Every time the cert or trust
+// bundle are updated, dummy writes them to files in the directory given as its connection
+// string, through the ShellContext. Then it checks that the contents of the files are as
+// expected. It has similar configuration to a real database.
+// This is for test and dev use only.
+
+// Files written by dummy, relative to its directory
+const (
+	SvidFile   = "svid.pem"
+	KeyFile    = "svid_key.pem"
+	BundleFile = "bundle.pem"
+)
+
+var files = []string{SvidFile, KeyFile, BundleFile}
+
+// The format each file is written in
+var formats = map[string]credformat.Format{
+	SvidFile:   credformat.PEMChain,
+	KeyFile:    credformat.PEMKey,
+	BundleFile: credformat.PEMBundle,
+}
+
+// State key for the backups of the files as they were before Execute, so Undo can put them back
+const backupsKey = "dummy.backups"
+
 type Dummy struct {
 }
 
@@ -29,56 +55,98 @@ func (*Dummy) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, sh
 		ID:            "dummy",
 		Steps: []step.Step{
 			{
-				Name:        "Save the certificate to disk",
-				TelemetryID: "DUMMY_SAVE_CERTIFICATE",
-				Execute:     executeDummyDatastore,
+				Name:              "Save the certificate to disk",
+				Id:                "SAVE_CERTIFICATE",
+				TelemetryID:       "DUMMY_SAVE_CERTIFICATE",
+				CheckDependencies: checkDummyDirectory,
+				Execute:           executeDummyDatastore,
+				Post:              checkDummyCertificate,
+				Undo:              restoreDummyFiles,
+				// Writing the same files again is harmless
+				Idempotent: true,
 			},
 		},
 	}
 }
 
-// The dummy package implements a simple "dummy" database. Every time the cert or trust
-// bundle are updated, dummy writes them to a temp file. Then it checks that the contents
-// of the file are as expected. It has similar configuration to a real database.
-// This is for test and dev use only.
-
-func saveSpiffeLinkUpdateToDisk(update spiffelinkcore.SpiffeLinkUpdate, savePath string) error {
-	os.Mkdir(savePath, 0644)
-	for i, bundle := range update.Bundles {
-		bundleData := getCertificatesPEM(bundle.X509Authorities())
-		err := ioutil.WriteFile(fmt.Sprintf("%s/bundle_%d.pem", savePath, i), bundleData, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to write bundle to file: %w", err)
-		}
+// The connection string is the directory the files go in. It may be a secret reference, so it is
+// resolved in each stage that needs it.
+func directory(ctx context.Context, sfi step.StepFuncInput) (string, step.StepFuncOutputMessage) {
+	dir, err := sfi.Dbc.ResolveConnectionString(ctx, sfi.Sl.Logger)
+	if err != nil {
+		return "", step.Failed(err)
 	}
+	return dir, step.StepFuncOutputMessage{}
+}
 
-	for i, svid := range update.Svids {
-		svidData := getCertificatesPEM(svid.Certificates)
-		err := ioutil.WriteFile(fmt.Sprintf("%s/svid_%d.pem", savePath, i), svidData, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to write svid to file: %w", err)
+func filePath(dir string, name string) string {
+	return path.Join(dir, name)
+}
+
+// Find the SVID for the database in the update
+func findSVID(sfi step.StepFuncInput) *x509svid.SVID {
+	for _, svid := range sfi.Update.Svids {
+		if svid.ID.String() == sfi.Dbc.SpiffeID {
+			return svid
 		}
 	}
-
 	return nil
 }
 
-func getCertificatesPEM(certs []*x509.Certificate) []byte {
-	pemData := make([]byte, 0)
-	for _, cert := range certs {
-		block := &pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: cert.Raw,
-		}
+func checkDummyDirectory(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	dir, output := directory(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if err := sfi.ShellContext.CheckPathWriteable(ctx, dir); err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, dir, err))
+	}
+	return step.StepFuncOutputMessage{}
+}
 
-		pemData = append(pemData, pem.EncodeToMemory(block)...)
+func executeDummyDatastore(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	dir, output := directory(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
 	}
+	var written []credfiles.File
+	for _, name := range files {
+		written = append(written, credfiles.File{Path: filePath(dir, name), Format: formats[name], Creds: creds})
+	}
+	if output := credfiles.Save(ctx, sfi, backupsKey, credfiles.Targets(written)); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, written)
+}
 
-	return pemData
+// Check that the certificate file has the SVID from the update
+func checkDummyCertificate(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	svid := findSVID(sfi)
+	if svid == nil {
+		return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	dir, output := directory(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	svidPath := filePath(dir, SvidFile)
+	data, err := sfi.ShellContext.ReadFile(ctx, svidPath)
+	if err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, svidPath, err))
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || !bytes.Equal(block.Bytes, svid.Certificates[0].Raw) {
+		return step.Failed(slerror.CredentialNotAppliedError(sfi.Sl.Logger, svidPath, svid.Certificates[0].SerialNumber.String()))
+	}
+	return step.StepFuncOutputMessage{}
 }
 
-// TO do : add an output channel
-func executeDummyDatastore(ctx context.Context, sfi step.StepFuncInput) (step.State, step.StepFuncOutputMessage) {
-	//saveSpiffeLinkUpdateToDisk(*sfi.Update, "/dummy/")
-	return nil, step.StepFuncOutputMessage{}
+// Put the files back the way Execute found them
+func restoreDummyFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, backupsKey)
+	return output
 }
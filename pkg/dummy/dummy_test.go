@@ -0,0 +1,73 @@
+package dummy_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/datastore/datastoretest"
+	"github.com/dfeldman/spiffelink/pkg/dummy"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	datastoretest.Run(t, suite(func(dir string) config.DatabaseConfig {
+		return config.DatabaseConfig{Type: "dummy", ConnectionString: dir}
+	}))
+}
+
+// The directory can be a secret reference, which is resolved in each stage
+func TestConformanceWithSecretDirectory(t *testing.T) {
+	secrets := t.TempDir()
+	datastoretest.Run(t, suite(func(dir string) config.DatabaseConfig {
+		f, err := ioutil.TempFile(secrets, "dir")
+		if err == nil {
+			_, err = f.WriteString(dir + "\n")
+			f.Close()
+		}
+		if err != nil {
+			// Config is called from the scenarios' own tests, so it can't use t
+			panic(err)
+		}
+		return config.DatabaseConfig{Type: "dummy", ConnectionString: "${file:" + f.Name() + "}"}
+	}))
+}
+
+func suite(conf func(dir string) config.DatabaseConfig) datastoretest.Suite {
+	return datastoretest.Suite{
+		Datastore: &dummy.Dummy{},
+		Config:    conf,
+		NewShell: func(t *testing.T, dir string) shell.ShellContext {
+			sh := fakeshell.NewFakeShell()
+			sh.MkdirAll(dir, 0755)
+			return sh
+		},
+		Certificate: func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) {
+			dir, err := dbc.ResolveConnectionString(ctx, logrus.New())
+			if err != nil {
+				return nil, err
+			}
+			data, err := sc.ReadFile(ctx, path.Join(dir, dummy.SvidFile))
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("%s has no certificate", dummy.SvidFile)
+			}
+			return x509.ParseCertificate(block.Bytes)
+		},
+	}
+}
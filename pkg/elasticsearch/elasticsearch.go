@@ -0,0 +1,756 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/secret"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"gopkg.in/yaml.v3"
+)
+
+// The elasticsearch datastore installs the SVID as the TLS certificate of an Elasticsearch or OpenSearch
+// node. Like the cassandra datastore, it doesn't need to be told where the files go: each stage reads
+// elasticsearch.yml (or opensearch.yml) from the node's config directory through the ShellContext, and the
+// files it names for the transport and HTTP layers are overwritten in place, in the format it names.
+//
+// Elasticsearch reads xpack.security.<layer>.ssl.key, certificate and certificate_authorities, or
+// keystore.path and truststore.path, for each layer whose ssl.enabled is true. It notices when those files
+// change on disk and reloads them by itself, within resource.reload.interval.high (5 seconds by default).
+//
+// OpenSearch reads plugins.security.ssl.<layer>.pemkey_filepath, pemcert_filepath and
+// pemtrustedcas_filepath, or keystore_filepath and truststore_filepath, for the transport layer, and for the
+// HTTP layer if plugins.security.ssl.http.enabled is true. It doesn't notice new files, so its security
+// plugin is asked to reload them with PUT _plugins/_security/api/ssl/<layer>/reloadcerts, which needs
+// plugins.security.ssl_cert_reload_enabled.
+//
+// Post then asks the node which certificates it has loaded, until it reports the SVID: Elasticsearch with
+// GET _ssl/certificates, and OpenSearch with GET _plugins/_security/api/ssl/certs.
+//
+// The connection string is the node's HTTP address, followed by options:
+//
+//	https://node1:9200?dir=/etc/elasticsearch&user=spiffelink&password=${env:ES_PASSWORD}&cacert=/etc/spiffelink/es-http-ca.crt
+//
+//	flavor            elasticsearch (the default) or opensearch
+//	dir               the node's config directory (required), which has elasticsearch.yml or opensearch.yml.
+//	                  Relative paths in it are relative to dir.
+//	layers            the layers whose files are rotated, separated by commas (by default, every layer the
+//	                  node has TLS enabled for)
+//	keystorePassword  the password for keystores and truststores, preferably a secret reference. Needed
+//	                  when the node uses them, unless the configuration file has their passwords, since
+//	                  Elasticsearch keeps them in its secure settings.
+//	legacyPKCS12      true to encrypt PKCS#12 keystores with 3DES, for JVMs older than 8u301
+//	user, password    the user spiffelink authenticates as, and its password, preferably a secret reference
+//	cacert            a CA bundle, on the host spiffelink runs on, to verify the node with as well as the
+//	                  system's CAs
+//	clientCert        a client certificate and key, on the host spiffelink runs on, to present to the node.
+//	clientKey         OpenSearch only allows the admin certificate to reload certificates by default.
+//	reloadTimeout     how long the node gets to report the new certificate (2m by default)
+
+// Flavors
+const (
+	FlavorElasticsearch = "elasticsearch"
+	FlavorOpenSearch    = "opensearch"
+)
+
+// TLS layers
+const (
+	LayerTransport = "transport"
+	LayerHTTP      = "http"
+)
+
+const DefaultReloadTimeout = 2 * time.Minute
+
+// How long one request may take
+const requestTimeout = 30 * time.Second
+
+// How often Post asks the node for its certificates
+const pollInterval = 2 * time.Second
+
+// State keys
+const (
+	backupsKey  = "elasticsearch.backups"
+	reloadedKey = "elasticsearch.reloaded"
+)
+
+type Elasticsearch struct {
+}
+
+func (*Elasticsearch) GetName() string {
+	return "elasticsearch"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	// The node's HTTP address, like https://node1:9200
+	URL    string
+	Flavor string
+	Dir    string
+	// Empty for every layer the node has TLS enabled for
+	Layers           []string
+	KeystorePassword string
+	LegacyPKCS12     bool
+	User             string
+	Password         string
+	CACert           string
+	ClientCert       string
+	ClientKey        string
+	ReloadTimeout    time.Duration
+}
+
+// ParseOptions parses an elasticsearch connection string.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{
+		Flavor:        FlavorElasticsearch,
+		ReloadTimeout: DefaultReloadTimeout,
+	}
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like https://host:port?dir=...")
+	}
+	opts.URL = u.Scheme + "://" + u.Host
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "flavor":
+			if v != FlavorElasticsearch && v != FlavorOpenSearch {
+				return opts, fmt.Errorf("flavor must be %s or %s", FlavorElasticsearch, FlavorOpenSearch)
+			}
+			opts.Flavor = v
+		case "dir":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("dir must be an absolute path")
+			}
+			opts.Dir = path.Clean(v)
+		case "layers":
+			opts.Layers = strings.Split(v, ",")
+			for _, layer := range opts.Layers {
+				if layer != LayerTransport && layer != LayerHTTP {
+					return opts, fmt.Errorf("layers must be %s, %s or both", LayerTransport, LayerHTTP)
+				}
+			}
+		case "keystorePassword":
+			opts.KeystorePassword = v
+		case "legacyPKCS12":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("legacyPKCS12 must be true or false")
+			}
+			opts.LegacyPKCS12 = v == "true"
+		case "user":
+			opts.User = v
+		case "password":
+			opts.Password = v
+		case "cacert":
+			opts.CACert = v
+		case "clientCert":
+			opts.ClientCert = v
+		case "clientKey":
+			opts.ClientKey = v
+		case "reloadTimeout":
+			if opts.ReloadTimeout, err = time.ParseDuration(v); err != nil || opts.ReloadTimeout <= 0 {
+				return opts, fmt.Errorf("reloadTimeout must be a duration like 2m")
+			}
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	switch {
+	case opts.Dir == "":
+		return opts, fmt.Errorf("the dir option is required")
+	case (opts.ClientCert == "") != (opts.ClientKey == ""):
+		return opts, fmt.Errorf("clientCert and clientKey must be set together")
+	}
+	return opts, nil
+}
+
+// The node's configuration file
+func (o Options) conf() string {
+	return path.Join(o.Dir, o.Flavor+".yml")
+}
+
+// The node's settings. elasticsearch.yml may nest settings or give them dotted names, or mix the two, so the
+// names are flattened to their dotted form.
+type settings map[string]interface{}
+
+func parseSettings(data []byte) (settings, error) {
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	s := make(settings)
+	s.flatten("", tree)
+	return s, nil
+}
+
+func (s settings) flatten(prefix string, tree map[string]interface{}) {
+	for name, value := range tree {
+		if sub, ok := value.(map[string]interface{}); ok {
+			s.flatten(prefix+name+".", sub)
+		} else {
+			s[prefix+name] = value
+		}
+	}
+}
+
+// A setting's value, or "" if it isn't set or is a list
+func (s settings) get(name string) string {
+	switch v := s[name].(type) {
+	case nil, []interface{}:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// A setting that may be a list or a single value
+func (s settings) list(name string) []string {
+	if values, ok := s[name].([]interface{}); ok {
+		var list []string
+		for _, v := range values {
+			list = append(list, fmt.Sprint(v))
+		}
+		return list
+	}
+	if v := s.get(name); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+	// For keystores and truststores, from the configuration file if it has it
+	password string
+}
+
+// Where one layer's files are, in the order they are written, or nil if the layer doesn't use TLS. The key
+// comes before the certificate, so the node never loads a certificate without its key.
+func (s settings) layerFiles(flavor string, layer string) ([]file, error) {
+	var on bool
+	var key, cert, keyPassword, keystore, keystoreType, keystorePassword, truststore, truststoreType, truststorePassword string
+	var cas []string
+	if flavor == FlavorOpenSearch {
+		p := "plugins.security.ssl." + layer + "."
+		// The security plugin always uses TLS between nodes
+		on = s.get(p+"enabled") == "true" || (layer == LayerTransport && s.get(p+"enabled") != "false")
+		key, cert, cas, keyPassword = s.get(p+"pemkey_filepath"), s.get(p+"pemcert_filepath"), s.list(p+"pemtrustedcas_filepath"), s.get(p+"pemkey_password")
+		keystore, keystoreType, keystorePassword = s.get(p+"keystore_filepath"), s.get(p+"keystore_type"), s.get(p+"keystore_password")
+		truststore, truststoreType, truststorePassword = s.get(p+"truststore_filepath"), s.get(p+"truststore_type"), s.get(p+"truststore_password")
+	} else {
+		p := "xpack.security." + layer + ".ssl."
+		on = s.get(p+"enabled") == "true"
+		key, cert, cas, keyPassword = s.get(p+"key"), s.get(p+"certificate"), s.list(p+"certificate_authorities"), s.get(p+"key_passphrase")
+		keystore, keystoreType, keystorePassword = s.get(p+"keystore.path"), s.get(p+"keystore.type"), s.get(p+"keystore.password")
+		truststore, truststoreType, truststorePassword = s.get(p+"truststore.path"), s.get(p+"truststore.type"), s.get(p+"truststore.password")
+	}
+	if !on {
+		return nil, nil
+	}
+	var files []file
+	switch {
+	case (key != "" || cert != "") && keystore != "":
+		return nil, fmt.Errorf("the %s layer names both a key and a keystore", layer)
+	case key != "" && cert != "":
+		if keyPassword != "" {
+			return nil, fmt.Errorf("the %s layer has a key password, and encrypted PEM keys aren't supported", layer)
+		}
+		files = append(files, file{path: key, format: credformat.PEMKey}, file{path: cert, format: credformat.PEMChain})
+	case keystore != "":
+		format, err := storeFormat(flavor, keystore, keystoreType, false)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file{path: keystore, format: format, password: keystorePassword})
+	default:
+		return nil, fmt.Errorf("the %s layer has TLS enabled, but doesn't name its key and certificate, or a keystore", layer)
+	}
+	switch {
+	case len(cas) > 0 && truststore != "":
+		return nil, fmt.Errorf("the %s layer names both a CA bundle and a truststore", layer)
+	case len(cas) > 1:
+		return nil, fmt.Errorf("the %s layer names more than one CA bundle, so spiffelink doesn't know which to write", layer)
+	case len(cas) == 1:
+		files = append(files, file{path: cas[0], format: credformat.PEMBundle})
+	case truststore != "":
+		format, err := storeFormat(flavor, truststore, truststoreType, true)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file{path: truststore, format: format, password: truststorePassword})
+	}
+	return files, nil
+}
+
+// The format of a keystore or truststore. Without a type, Elasticsearch goes by the file's extension, and
+// OpenSearch assumes JKS.
+func storeFormat(flavor string, file string, storeType string, trust bool) (credformat.Format, error) {
+	if storeType == "" {
+		storeType = "JKS"
+		if ext := strings.ToLower(path.Ext(file)); flavor == FlavorElasticsearch && (ext == ".p12" || ext == ".pfx" || ext == ".pkcs12") {
+			storeType = "PKCS12"
+		}
+	}
+	switch {
+	case strings.EqualFold(storeType, "PKCS12") && trust:
+		return credformat.PKCS12Truststore, nil
+	case strings.EqualFold(storeType, "PKCS12"):
+		return credformat.PKCS12Keystore, nil
+	case strings.EqualFold(storeType, "JKS") && trust:
+		return credformat.JKSTruststore, nil
+	case strings.EqualFold(storeType, "JKS"):
+		return credformat.JKSKeystore, nil
+	}
+	return "", fmt.Errorf("%s has an unsupported type %s", file, storeType)
+}
+
+// The files and layers to rotate. A file that more than one layer uses is written once.
+func (s settings) files(opts Options) ([]file, []string, error) {
+	var files []file
+	var layers []string
+	byPath := make(map[string]file)
+	for _, layer := range []string{LayerTransport, LayerHTTP} {
+		wanted := len(opts.Layers) == 0
+		for _, l := range opts.Layers {
+			wanted = wanted || l == layer
+		}
+		if !wanted {
+			continue
+		}
+		layerFiles, err := s.layerFiles(opts.Flavor, layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if layerFiles == nil {
+			if len(opts.Layers) > 0 {
+				return nil, nil, fmt.Errorf("the %s layer doesn't have TLS enabled", layer)
+			}
+			continue
+		}
+		layers = append(layers, layer)
+		for _, f := range layerFiles {
+			if !path.IsAbs(f.path) {
+				f.path = path.Join(opts.Dir, f.path)
+			}
+			if other, ok := byPath[f.path]; ok {
+				if other != f {
+					return nil, nil, fmt.Errorf("%s is used as both %s and %s", f.path, other.format, f.format)
+				}
+				continue
+			}
+			byPath[f.path] = f
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil, errors.New("neither the transport nor the HTTP layer has TLS enabled")
+	}
+	return files, layers, nil
+}
+
+func (*Elasticsearch) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "elasticsearch",
+		ID:            "elasticsearch",
+		Steps: []step.Step{
+			{
+				Name:              "Write the certificate files",
+				Id:                "WRITE_FILES",
+				TelemetryID:       "ELASTICSEARCH_WRITE_FILES",
+				CheckDependencies: checkDependencies,
+				Pre:               checkCredentials,
+				Execute:           writeFiles,
+				Post:              checkFiles,
+				Undo:              restoreFiles,
+				// Files that already hold the credentials aren't rewritten
+				Idempotent: true,
+			},
+			{
+				Name:        "Reload the certificates",
+				Id:          "RELOAD",
+				TelemetryID: "ELASTICSEARCH_RELOAD",
+				Execute:     reload,
+				Post:        waitForCertificate,
+				// Undo is done by restoreFiles, once the old files are back
+				Idempotent: true,
+			},
+		},
+	}
+}
+
+// What a stage works with: the options, the credentials, and the files and layers from the node's
+// configuration file
+type target struct {
+	opts   Options
+	creds  credformat.Credentials
+	files  []file
+	layers []string
+}
+
+// Parse the options, select the credentials, and read the node's configuration file for the files to write
+func prepare(ctx context.Context, sfi step.StepFuncInput) (*target, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return nil, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	t := &target{opts: opts}
+	if t.creds, err = credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID); err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	data, err := sfi.ShellContext.ReadFile(ctx, opts.conf())
+	if err != nil {
+		return nil, step.Failed(slerror.ElasticsearchConfigInvalidError(sfi.Sl.Logger, opts.conf(), err))
+	}
+	s, err := parseSettings(data)
+	if err == nil {
+		t.files, t.layers, err = s.files(opts)
+	}
+	if err != nil {
+		return nil, step.Failed(slerror.ElasticsearchConfigInvalidError(sfi.Sl.Logger, opts.conf(), err))
+	}
+	// Elasticsearch keeps keystore passwords in its secure settings, so they come from the connection string
+	for i, f := range t.files {
+		if !f.format.NeedsPassword() || f.password != "" {
+			continue
+		}
+		if opts.KeystorePassword == "" {
+			return nil, step.Failed(slerror.ElasticsearchConfigInvalidError(sfi.Sl.Logger, opts.conf(),
+				fmt.Errorf("%s needs a password, and the keystorePassword option isn't set", f.path)))
+		}
+		if t.files[i].password, err = credformat.ResolvePassword(ctx, sfi.Sl.Logger, opts.KeystorePassword); err != nil {
+			return nil, step.Failed(err)
+		}
+	}
+	return t, step.StepFuncOutputMessage{}
+}
+
+// The files the node reads, and what goes in each
+func (t *target) credentialFiles() []credfiles.File {
+	files := make([]credfiles.File, len(t.files))
+	for i, f := range t.files {
+		opts := credformat.Options{Password: f.password, LegacyPKCS12: t.opts.LegacyPKCS12}
+		files[i] = credfiles.File{Path: f.path, Format: f.format, Creds: t.creds, Opts: opts}
+	}
+	return files
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, f := range t.files {
+		if err := sfi.ShellContext.CheckPathWriteable(ctx, path.Dir(f.path)); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, f.path, err))
+		}
+	}
+	_, output = connect(ctx, sfi, t)
+	return output
+}
+
+// Check that there are credentials to write, and that the node's configuration file says where, before
+// anything is changed
+func checkCredentials(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := prepare(ctx, sfi)
+	return output
+}
+
+func writeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files := t.credentialFiles()
+	if output := credfiles.Save(ctx, sfi, backupsKey, credfiles.Targets(files)); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, files)
+}
+
+func checkFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, t.credentialFiles())
+}
+
+// Put the files back the way Execute found them. Elasticsearch notices by itself. OpenSearch is asked to
+// reload them if it was asked to load the new ones, and if there is something to go back to: it refuses to
+// reload files that don't exist, and keeps the certificate it has.
+func restoreFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	backups, output := credfiles.Restore(ctx, sfi, backupsKey)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if reloaded, _ := step.Get[bool](sfi.State, reloadedKey); !reloaded {
+		return step.StepFuncOutputMessage{}
+	}
+	for _, b := range backups {
+		if !b.Existed() {
+			sfi.Logger.Warn("OpenSearch keeps the new certificate until it is restarted, since there were no files before")
+			return step.StepFuncOutputMessage{}
+		}
+	}
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	n, output := connect(ctx, sfi, t)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return n.reloadCerts(ctx, sfi)
+}
+
+// Ask OpenSearch to reload the files, unless it already has the SVID. Elasticsearch reloads them by itself.
+func reload(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() || t.opts.Flavor != FlavorOpenSearch {
+		return output
+	}
+	n, output := connect(ctx, sfi, t)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if loaded, err := n.reports(ctx, t.creds.SVID.Certificates[0]); err == nil && loaded {
+		sfi.Logger.Info("OpenSearch already has the SVID, so it isn't asked to reload")
+		return step.StepFuncOutputMessage{}
+	}
+	// Set first, since a reload may do something even if it fails
+	if err := step.Put(sfi.State, reloadedKey, true); err != nil {
+		return step.Failed(err)
+	}
+	return n.reloadCerts(ctx, sfi)
+}
+
+// Ask the node for its certificates until it reports the SVID
+func waitForCertificate(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	t, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	n, output := connect(ctx, sfi, t)
+	if !output.Errors.Empty() {
+		return output
+	}
+	leaf := t.creds.SVID.Certificates[0]
+	waitCtx, cancel := context.WithTimeout(ctx, t.opts.ReloadTimeout)
+	defer cancel()
+	var last error
+	for {
+		loaded, err := n.reports(waitCtx, leaf)
+		if err == nil && loaded {
+			return step.StepFuncOutputMessage{}
+		}
+		if err == nil {
+			err = errors.New("the node reports other certificates")
+		}
+		if waitCtx.Err() == nil || last == nil {
+			last = err
+		}
+		select {
+		case <-waitCtx.Done():
+			var reqErr *requestError
+			if errors.As(last, &reqErr) {
+				return step.Failed(slerror.ElasticsearchRequestFailedError(sfi.Sl.Logger, reqErr.url, reqErr.err))
+			}
+			return step.Failed(slerror.ElasticsearchCertificateNotLoadedError(sfi.Sl.Logger, t.opts.URL, leaf.SerialNumber.String(), last))
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// A connection to the node's HTTP API
+type node struct {
+	opts Options
+	// The layers being rotated
+	layers   []string
+	client   *http.Client
+	password string
+}
+
+// A request to the node that failed
+type requestError struct {
+	url string
+	err error
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("request to %s failed: %v", e.url, e.err)
+}
+
+func connect(ctx context.Context, sfi step.StepFuncInput, t *target) (*node, step.StepFuncOutputMessage) {
+	opts := t.opts
+	n := &node{opts: opts, layers: t.layers}
+	if opts.Password != "" {
+		var err error
+		if n.password, err = secret.Resolve(ctx, sfi.Sl.Logger, opts.Password); err != nil {
+			return nil, step.Failed(err)
+		}
+	}
+	tlsConfig := &tls.Config{}
+	if opts.CACert != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(opts.CACert)
+		if err == nil && !roots.AppendCertsFromPEM(data) {
+			err = fmt.Errorf("no certificates in %s", opts.CACert)
+		}
+		if err != nil {
+			return nil, step.Failed(slerror.ElasticsearchRequestFailedError(sfi.Sl.Logger, opts.URL, err))
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, step.Failed(slerror.ElasticsearchRequestFailedError(sfi.Sl.Logger, opts.URL, err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	n.client = &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return n, step.StepFuncOutputMessage{}
+}
+
+// Send a request, and decode the response into out
+func (n *node) do(ctx context.Context, method string, apiPath string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, n.opts.URL+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	if n.opts.User != "" {
+		req.SetBasicAuth(n.opts.User, n.password)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// One of the certificates Elasticsearch reports
+type sslCertificate struct {
+	Path          string `json:"path"`
+	SerialNumber  string `json:"serial_number"`
+	HasPrivateKey bool   `json:"has_private_key"`
+}
+
+// One of the certificates OpenSearch reports. It doesn't give serial numbers, so the SVID is recognized by
+// its subject and validity.
+type securityCertificate struct {
+	SubjectDN string `json:"subject_dn"`
+	NotBefore string `json:"not_before"`
+	NotAfter  string `json:"not_after"`
+}
+
+type securityCertificates struct {
+	HTTP      []securityCertificate `json:"http_certificates_list"`
+	Transport []securityCertificate `json:"transport_certificates_list"`
+}
+
+// Whether the node reports leaf as one of its certificates. For OpenSearch, every layer that is reloaded
+// must have it.
+func (n *node) reports(ctx context.Context, leaf *x509.Certificate) (bool, error) {
+	if n.opts.Flavor == FlavorOpenSearch {
+		var certs securityCertificates
+		apiPath := "/_plugins/_security/api/ssl/certs"
+		if err := n.do(ctx, http.MethodGet, apiPath, &certs); err != nil {
+			return false, &requestError{url: n.opts.URL + apiPath, err: err}
+		}
+		for _, layer := range n.layers {
+			list := certs.Transport
+			if layer == LayerHTTP {
+				list = certs.HTTP
+			}
+			if !containsLeaf(list, leaf) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	var certs []sslCertificate
+	apiPath := "/_ssl/certificates"
+	if err := n.do(ctx, http.MethodGet, apiPath, &certs); err != nil {
+		return false, &requestError{url: n.opts.URL + apiPath, err: err}
+	}
+	// Elasticsearch gives the serial number in hex
+	serial := leaf.SerialNumber.Text(16)
+	for _, cert := range certs {
+		if cert.HasPrivateKey && strings.EqualFold(strings.TrimLeft(cert.SerialNumber, "0"), serial) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func containsLeaf(list []securityCertificate, leaf *x509.Certificate) bool {
+	for _, cert := range list {
+		notBefore, err1 := time.Parse(time.RFC3339, cert.NotBefore)
+		notAfter, err2 := time.Parse(time.RFC3339, cert.NotAfter)
+		if err1 == nil && err2 == nil && notBefore.Equal(leaf.NotBefore) && notAfter.Equal(leaf.NotAfter) &&
+			cert.SubjectDN == leaf.Subject.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask OpenSearch to reload each layer's files
+func (n *node) reloadCerts(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	for _, layer := range n.layers {
+		sfi.Logger.Infof("Asking OpenSearch at %s to reload its %s certificates", n.opts.URL, layer)
+		if err := n.do(ctx, http.MethodPut, "/_plugins/_security/api/ssl/"+layer+"/reloadcerts", nil); err != nil {
+			return step.Failed(slerror.ElasticsearchReloadFailedError(sfi.Sl.Logger, n.opts.URL, layer, err))
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
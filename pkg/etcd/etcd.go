@@ -0,0 +1,441 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// The etcd datastore installs SVIDs as the certificates of one etcd member that uses file-based TLS: the
+// server certificate it presents to clients, the peer certificate it uses with the other members, and a
+// client certificate for etcdctl, along with the CA bundle it trusts. The three can come from one SVID or from
+// different ones, matched by SPIFFE ID. etcd reads the files again for each new connection, so writing them is
+// enough. Post checks with etcdctl endpoint health that the member accepts the new client certificate and
+// presents a server certificate the new CA bundle trusts. The server SVID needs the member's DNS names or IP
+// addresses, since etcd clients verify them.
+//
+// Each member is a database of its own, of type etcd, with a shell on the member's host. Members with the same
+// cluster option are changed one at a time, in the order of the configuration: a member's rotation starts only
+// once the previous member's has finished, Post included, whichever hosts they are on. Before a member is
+// changed, Pre checks that the whole cluster is healthy with etcdctl endpoint health --cluster, using the
+// client certificate already on the member, so the rollout stops at the first member that breaks.
+//
+// The connection string is the member's client URL, without https, followed by options:
+//
+//	etcd://10.0.0.1:2379?dir=/etc/kubernetes/pki/etcd&peerID=spiffe://example.org/etcd-peer
+//
+//	dir           the directory the files are written to (required)
+//	server        the names of the server, peer and client certificate and key files in dir, without .crt
+//	peer          and .key (server, peer and healthcheck-client by default, as kubeadm names them)
+//	client
+//	ca            the name of the CA bundle file in dir (ca.crt by default)
+//	serverID      the SPIFFE IDs of the server, peer and client SVIDs (the database's SPIFFE ID by default)
+//	peerID
+//	clientID
+//	cluster       a name for the member's cluster, shared by the members that must be changed one at a time
+//	clusterCheck  false to change the member without checking the cluster's health first, to repair a
+//	              member a bad rotation broke
+//	bin           the directory etcdctl is in, if it isn't in one of DefaultBinDirs
+
+// Defaults for the options
+const (
+	DefaultPort   = "2379"
+	DefaultServer = "server"
+	DefaultPeer   = "peer"
+	DefaultClient = "healthcheck-client"
+	DefaultCA     = "ca.crt"
+)
+
+// Where etcdctl is looked for if the connection string doesn't say
+var DefaultBinDirs = []string{"/usr/local/bin", "/usr/bin", "/opt/etcd/bin"}
+
+// How long etcdctl may take
+const commandTimeout = 30 * time.Second
+
+// State keys
+const (
+	backupsKey = "etcd.backups"
+)
+
+type Etcd struct {
+}
+
+func (*Etcd) GetName() string {
+	return "etcd"
+}
+
+// Group puts the rotations of the members of a cluster in one task group, so they run one at a time.
+func (*Etcd) Group(conf config.DatabaseConfig) string {
+	opts, err := ParseOptions(conf.ConnectionString)
+	if err != nil || opts.Cluster == "" {
+		return ""
+	}
+	return "etcd/" + opts.Cluster
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	// host:port of the member's client URL
+	Address string
+	Dir     string
+	Server  string
+	Peer    string
+	Client  string
+	CA      string
+	// Empty for the database's SPIFFE ID
+	ServerID     string
+	PeerID       string
+	ClientID     string
+	Cluster      string
+	ClusterCheck bool
+	BinDir       string
+}
+
+// ParseOptions parses an etcd connection string.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{Server: DefaultServer, Peer: DefaultPeer, Client: DefaultClient, CA: DefaultCA, ClusterCheck: true}
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "etcd" || u.Hostname() == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like etcd://host:port?dir=...")
+	}
+	opts.Address = u.Host
+	if u.Port() == "" {
+		opts.Address = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "dir":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("dir must be an absolute path")
+			}
+			opts.Dir = path.Clean(v)
+		case "server", "peer", "client", "ca":
+			if strings.Contains(v, "/") {
+				return opts, fmt.Errorf("%s must be a file name in dir", name)
+			}
+			switch name {
+			case "server":
+				opts.Server = v
+			case "peer":
+				opts.Peer = v
+			case "client":
+				opts.Client = v
+			case "ca":
+				opts.CA = v
+			}
+		case "serverID", "peerID", "clientID":
+			if _, err := spiffeid.FromString(v); err != nil {
+				return opts, fmt.Errorf("%s must be a SPIFFE ID: %w", name, err)
+			}
+			switch name {
+			case "serverID":
+				opts.ServerID = v
+			case "peerID":
+				opts.PeerID = v
+			case "clientID":
+				opts.ClientID = v
+			}
+		case "cluster":
+			opts.Cluster = v
+		case "clusterCheck":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("clusterCheck must be true or false")
+			}
+			opts.ClusterCheck = v == "true"
+		case "bin":
+			opts.BinDir = v
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	if opts.Dir == "" {
+		return opts, fmt.Errorf("the dir option is required")
+	}
+	sets := opts.sets("")
+	for i, a := range sets {
+		for _, b := range sets[i+1:] {
+			if a.name == b.name && a.id != b.id {
+				return opts, fmt.Errorf("the %s and %s certificates are both %s, but from different SVIDs", a.role, b.role, a.name)
+			}
+		}
+		if a.name+".crt" == opts.CA {
+			return opts, fmt.Errorf("the %s certificate and the CA bundle are both %s", a.role, opts.CA)
+		}
+	}
+	return opts, nil
+}
+
+// A certificate and key, from one SVID
+type certSet struct {
+	role string
+	name string
+	id   string
+}
+
+// The server, peer and client sets. spiffeID is used for the ones the options don't give an ID.
+func (o Options) sets(spiffeID string) []certSet {
+	or := func(id string) string {
+		if id == "" {
+			return spiffeID
+		}
+		return id
+	}
+	return []certSet{
+		{role: "server", name: o.Server, id: or(o.ServerID)},
+		{role: "peer", name: o.Peer, id: or(o.PeerID)},
+		{role: "client", name: o.Client, id: or(o.ClientID)},
+	}
+}
+
+func (o Options) caPath() string {
+	return path.Join(o.Dir, o.CA)
+}
+
+func (o Options) certPath(name string) string {
+	return path.Join(o.Dir, name+".crt")
+}
+
+func (o Options) keyPath(name string) string {
+	return path.Join(o.Dir, name+".key")
+}
+
+// A file a step writes
+func (*Etcd) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "etcd",
+		ID:            "etcd",
+		Steps: []step.Step{
+			{
+				Name:              "Check that the cluster is healthy",
+				Id:                "CHECK_CLUSTER",
+				TelemetryID:       "ETCD_CHECK_CLUSTER",
+				CheckDependencies: checkDependencies,
+				Pre:               checkCluster,
+				Idempotent:        true,
+			},
+			{
+				Name:        "Write the server, peer and client certificates and the CA bundle",
+				Id:          "WRITE_FILES",
+				TelemetryID: "ETCD_WRITE_FILES",
+				Pre:         checkCredentials,
+				Execute:     writeFiles,
+				Post:        checkFiles,
+				Undo:        restoreFiles,
+				// Files that already hold the credentials aren't rewritten
+				Idempotent: true,
+			},
+			{
+				Name:        "Check the member's health with the new certificates",
+				Id:          "CHECK_MEMBER",
+				TelemetryID: "ETCD_CHECK_MEMBER",
+				Post:        checkMember,
+				Idempotent:  true,
+			},
+		},
+	}
+}
+
+func parse(sfi step.StepFuncInput) (Options, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return opts, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	return opts, step.StepFuncOutputMessage{}
+}
+
+// The files to write, in order: the CA bundle first, so the member trusts the new certificates before anything
+// presents them, and each key before its certificate, so etcd never reads a certificate without its key.
+func credentialFiles(sfi step.StepFuncInput, opts Options) ([]credfiles.File, step.StepFuncOutputMessage) {
+	var files []credfiles.File
+	written := make(map[string]bool)
+	for _, set := range opts.sets(sfi.Dbc.SpiffeID) {
+		creds, err := credformat.Select(*sfi.Update, set.id)
+		if err != nil {
+			return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, set.id))
+		}
+		if len(files) == 0 {
+			files = append(files, credfiles.File{Path: opts.caPath(), Format: credformat.PEMBundle, Creds: creds})
+		}
+		if written[set.name] {
+			continue
+		}
+		written[set.name] = true
+		files = append(files,
+			credfiles.File{Path: opts.keyPath(set.name), Format: credformat.PEMKey, Creds: creds},
+			credfiles.File{Path: opts.certPath(set.name), Format: credformat.PEMChain, Creds: creds})
+	}
+	return files, step.StepFuncOutputMessage{}
+}
+
+func findEtcdctl(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	dirs := DefaultBinDirs
+	if opts.BinDir != "" {
+		dirs = []string{opts.BinDir}
+	}
+	exe, err := sfi.ShellContext.FindExecutable(ctx, dirs, "etcdctl")
+	if err != nil {
+		return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, "etcdctl", err))
+	}
+	return exe, step.StepFuncOutputMessage{}
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if err := sfi.ShellContext.CheckPathWriteable(ctx, opts.Dir); err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+	}
+	_, output = findEtcdctl(ctx, sfi, opts)
+	return output
+}
+
+// The health of each endpoint, as etcdctl endpoint health -w json reports it
+type endpointHealth struct {
+	Endpoint string `json:"endpoint"`
+	Health   bool   `json:"health"`
+	Error    string `json:"error"`
+}
+
+// Run etcdctl endpoint health against the member, with the client certificate and CA bundle in dir. With
+// cluster, every member of the cluster is checked.
+func health(ctx context.Context, sfi step.StepFuncInput, opts Options, cluster bool) step.StepFuncOutputMessage {
+	exe, output := findEtcdctl(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	endpoints := "https://" + opts.Address
+	args := []string{
+		"--endpoints=" + endpoints,
+		"--cacert=" + opts.caPath(),
+		"--cert=" + opts.certPath(opts.Client),
+		"--key=" + opts.keyPath(opts.Client),
+		"endpoint", "health", "-w", "json",
+	}
+	if cluster {
+		args = append(args, "--cluster")
+		endpoints = "the cluster of " + endpoints
+	}
+	// etcdctl exits with an error if an endpoint is unhealthy. The report is checked as well, in case a
+	// version doesn't.
+	out, err := sfi.ShellContext.RunCmd(ctx, exe, args, nil, commandTimeout)
+	if err != nil {
+		return step.Failed(slerror.EtcdUnhealthyError(sfi.Sl.Logger, endpoints, err))
+	}
+	var report []endpointHealth
+	if err := json.Unmarshal([]byte(out), &report); err != nil || len(report) == 0 {
+		return step.Failed(slerror.EtcdUnhealthyError(sfi.Sl.Logger, endpoints, fmt.Errorf("unexpected output %q", strings.TrimSpace(out))))
+	}
+	var unhealthy []string
+	for _, e := range report {
+		if !e.Health {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", e.Endpoint, e.Error))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return step.Failed(slerror.EtcdUnhealthyError(sfi.Sl.Logger, endpoints, errors.New(strings.Join(unhealthy, "; "))))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Check that every member is healthy before this one is changed, with the client certificate already here.
+// Before the first rotation there isn't one, so there is nothing to check with.
+func checkCluster(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() || !opts.ClusterCheck {
+		return output
+	}
+	for _, p := range []string{opts.caPath(), opts.certPath(opts.Client), opts.keyPath(opts.Client)} {
+		_, err := sfi.ShellContext.ReadFile(ctx, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			sfi.Logger.Warnf("The cluster's health isn't checked, since there is no %s yet", p)
+			return step.StepFuncOutputMessage{}
+		}
+		if err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, p, err))
+		}
+	}
+	return health(ctx, sfi, opts, true)
+}
+
+// Check that there are credentials to write, before anything is changed
+func checkCredentials(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	_, output = credentialFiles(sfi, opts)
+	return output
+}
+
+func writeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files, output := credentialFiles(sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if output := credfiles.Save(ctx, sfi, backupsKey, credfiles.Targets(files)); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, files)
+}
+
+func checkFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files, output := credentialFiles(sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, files)
+}
+
+// Put the files back the way Execute found them. etcd uses them for the next connection.
+func restoreFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, backupsKey)
+	return output
+}
+
+// Check that the member accepts the new client certificate, and that the new CA bundle trusts its server
+// certificate
+func checkMember(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return health(ctx, sfi, opts, false)
+}
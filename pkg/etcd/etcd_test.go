@@ -0,0 +1,375 @@
+package etcd_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/datastore/datastoretest"
+	"github.com/dfeldman/spiffelink/pkg/etcd"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// An etcd member behind a fake etcdctl. Like etcd, it reads its server certificate and key, and the CA bundle
+// it trusts clients with, from dir for each connection. A member is healthy to etcdctl if etcdctl's CA bundle
+// trusts the member's server certificate and the member's CA bundle trusts etcdctl's client certificate. Only
+// trust is checked, not expiry, so the conformance suite can install an expired SVID. The other members of the
+// cluster are only healthy or not.
+type fakeMember struct {
+	dir    string
+	server string
+	sh     *fakeshell.FakeShell
+	mu     sync.Mutex
+	down   bool
+	others map[string]bool
+}
+
+func newFakeMember(dir string) *fakeMember {
+	m := &fakeMember{dir: dir, server: "server", others: map[string]bool{"https://10.0.0.2:2379": true, "https://10.0.0.3:2379": true}}
+	m.sh = fakeshell.NewFakeShell()
+	m.sh.MkdirAll(dir, 0755)
+	m.sh.AddExecutable(dir+"/etcdctl", m.etcdctl)
+	return m
+}
+
+func (m *fakeMember) etcdctl(ctx context.Context, args []string, environ []string) (string, error) {
+	flags := make(map[string]string)
+	var command []string
+	for _, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(name, "--") {
+			flags[name] = value
+		} else {
+			command = append(command, arg)
+		}
+	}
+	if strings.Join(command, " ") != "endpoint health -w json --cluster" && strings.Join(command, " ") != "endpoint health -w json" {
+		return "", fmt.Errorf("unexpected arguments %q", args)
+	}
+	type endpointHealth struct {
+		Endpoint string `json:"endpoint"`
+		Health   bool   `json:"health"`
+		Error    string `json:"error,omitempty"`
+	}
+	report := []endpointHealth{{Endpoint: flags["--endpoints"], Health: true}}
+	if err := m.connect(ctx, flags["--cacert"], flags["--cert"], flags["--key"]); err != nil {
+		report[0] = endpointHealth{Endpoint: flags["--endpoints"], Error: err.Error()}
+	}
+	if strings.HasSuffix(strings.Join(command, " "), "--cluster") {
+		m.mu.Lock()
+		for endpoint, healthy := range m.others {
+			e := endpointHealth{Endpoint: endpoint, Health: healthy}
+			if !healthy {
+				e.Error = "context deadline exceeded"
+			}
+			report = append(report, e)
+		}
+		m.mu.Unlock()
+	}
+	out, _ := json.Marshal(report)
+	for _, e := range report {
+		if !e.Health {
+			return string(out), fmt.Errorf("Error: unhealthy cluster")
+		}
+	}
+	return string(out), nil
+}
+
+// A TLS connection from etcdctl to the member, checked without the network
+func (m *fakeMember) connect(ctx context.Context, cacert string, cert string, key string) error {
+	m.mu.Lock()
+	down := m.down
+	m.mu.Unlock()
+	if down {
+		return fmt.Errorf("connection refused")
+	}
+	clientCAs, err := m.pool(ctx, cacert)
+	if err != nil {
+		return err
+	}
+	client, err := m.keyPair(ctx, cert, key)
+	if err != nil {
+		return err
+	}
+	server, err := m.keyPair(ctx, m.dir+"/"+m.server+".crt", m.dir+"/"+m.server+".key")
+	if err != nil {
+		return err
+	}
+	memberCAs, err := m.pool(ctx, m.dir+"/ca.crt")
+	if err != nil {
+		return err
+	}
+	if err := verify(server, clientCAs); err != nil {
+		return err
+	}
+	return verify(client, memberCAs)
+}
+
+// Check the signatures from the leaf up to one of the roots
+func verify(pair tls.Certificate, roots []*x509.Certificate) error {
+	var chain []*x509.Certificate
+	for _, raw := range pair.Certificate {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return err
+		}
+	}
+	for _, root := range roots {
+		if chain[len(chain)-1].CheckSignatureFrom(root) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("x509: certificate signed by unknown authority")
+}
+
+func (m *fakeMember) pool(ctx context.Context, p string) ([]*x509.Certificate, error) {
+	data, err := m.sh.ReadFile(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, cert)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", p)
+	}
+	return roots, nil
+}
+
+func (m *fakeMember) keyPair(ctx context.Context, cert string, key string) (tls.Certificate, error) {
+	certPEM, err := m.sh.ReadFile(ctx, cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := m.sh.ReadFile(ctx, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func TestConformance(t *testing.T) {
+	var mu sync.Mutex
+	members := make(map[shell.ShellContext]*fakeMember)
+	datastoretest.Run(t, datastoretest.Suite{
+		Datastore: &etcd.Etcd{},
+		Config: func(dir string) config.DatabaseConfig {
+			return config.DatabaseConfig{Type: "etcd", ConnectionString: fmt.Sprintf("etcd://10.0.0.1?dir=%s&bin=%s", dir, dir)}
+		},
+		NewShell: func(t *testing.T, dir string) shell.ShellContext {
+			m := newFakeMember(dir)
+			mu.Lock()
+			defer mu.Unlock()
+			members[m.sh] = m
+			return m.sh
+		},
+		Certificate: func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) {
+			mu.Lock()
+			m, ok := members[sc]
+			mu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("unknown shell")
+			}
+			data, err := sc.ReadFile(ctx, m.dir+"/server.crt")
+			if err != nil {
+				return nil, nil
+			}
+			return credformat.Leaf(credformat.PEMChain, data, credformat.Options{})
+		},
+		// etcdctl only checks the health of the members
+		Mutating: func(path string, args []string) bool { return false },
+	})
+}
+
+const dir = "/etc/kubernetes/pki/etcd"
+
+var (
+	serverID = spiffeid.RequireFromString("spiffe://example.org/etcd-server")
+	peerID   = spiffeid.RequireFromString("spiffe://example.org/etcd-peer")
+	clientID = spiffeid.RequireFromString("spiffe://example.org/etcd-client")
+)
+
+func run(m *fakeMember, options string, update spiffelinkcore.SpiffeLinkUpdate) []step.StepFuncOutputMessage {
+	dbc := config.DatabaseConfig{
+		Name:             "etcd1",
+		Type:             "etcd",
+		ConnectionString: "etcd://10.0.0.1:2379?dir=" + dir + "&bin=" + dir + options,
+		SpiffeID:         serverID.String(),
+	}
+	return datastoretest.RunSteps(context.Background(), &etcd.Etcd{}, dbc, m.sh, update)
+}
+
+func leaf(t *testing.T, m *fakeMember, name string) *x509.Certificate {
+	data, err := m.sh.ReadFile(context.Background(), dir+"/"+name+".crt")
+	require.NoError(t, err)
+	cert, err := credformat.Leaf(credformat.PEMChain, data, credformat.Options{})
+	require.NoError(t, err)
+	return cert
+}
+
+func TestSeveralSVIDs(t *testing.T) {
+	m := newFakeMember(dir)
+	ca := spiffetest.NewCA(t)
+	options := "&peerID=" + peerID.String() + "&clientID=" + clientID.String()
+	first := datastoretest.NewUpdate(ca, serverID, peerID, clientID)
+	require.Nil(t, run(m, options, first))
+	for i, name := range []string{"server", "peer", "healthcheck-client"} {
+		assert.True(t, first.Svids[i].Certificates[0].Equal(leaf(t, m, name)), name)
+	}
+	// Before the first rotation there is no client certificate to check the cluster with, so etcdctl only
+	// checks the member afterwards
+	calls := m.sh.CallsTo(fakeshell.RunCmd)
+	require.Len(t, calls, 1)
+	assert.Equal(t, []string{
+		"--endpoints=https://10.0.0.1:2379",
+		"--cacert=" + dir + "/ca.crt",
+		"--cert=" + dir + "/healthcheck-client.crt",
+		"--key=" + dir + "/healthcheck-client.key",
+		"endpoint", "health", "-w", "json",
+	}, calls[0].Args)
+
+	m.sh.ResetCalls()
+	second := datastoretest.NewUpdate(ca, serverID, peerID, clientID)
+	require.Nil(t, run(m, options, second))
+	for i, name := range []string{"server", "peer", "healthcheck-client"} {
+		assert.True(t, second.Svids[i].Certificates[0].Equal(leaf(t, m, name)), name)
+	}
+	calls = m.sh.CallsTo(fakeshell.RunCmd)
+	require.Len(t, calls, 2)
+	assert.Equal(t, "--cluster", calls[0].Args[len(calls[0].Args)-1])
+
+	// An SVID that isn't in the update
+	outputs := run(m, options, datastoretest.NewUpdate(ca, serverID, clientID))
+	require.NotEmpty(t, outputs)
+	assert.Equal(t, "SVID_NOT_FOUND", string(outputs[0].Errors.Errors[0].Code))
+}
+
+func TestOneSVIDForEverything(t *testing.T) {
+	m := newFakeMember(dir)
+	m.server = "member"
+	ca := spiffetest.NewCA(t)
+	update := datastoretest.NewUpdate(ca, serverID)
+	require.Nil(t, run(m, "&server=member&peer=member&client=member", update))
+	assert.True(t, update.Svids[0].Certificates[0].Equal(leaf(t, m, "member")))
+	assert.ElementsMatch(t, []string{dir + "/ca.crt", dir + "/member.crt", dir + "/member.key"}, pathsOf(datastoretest.CredentialWrites(m.sh)))
+}
+
+func pathsOf(calls []fakeshell.Call) []string {
+	var paths []string
+	for _, call := range calls {
+		paths = append(paths, call.Path)
+	}
+	return paths
+}
+
+func TestUnhealthy(t *testing.T) {
+	m := newFakeMember(dir)
+	ca := spiffetest.NewCA(t)
+	require.Nil(t, run(m, "", datastoretest.NewUpdate(ca, serverID)))
+
+	// Another member is down, so this one isn't changed
+	m.others["https://10.0.0.3:2379"] = false
+	m.sh.ResetCalls()
+	outputs := run(m, "", datastoretest.NewUpdate(ca, serverID))
+	require.NotEmpty(t, outputs)
+	assert.Equal(t, "ETCD_UNHEALTHY", string(outputs[0].Errors.Errors[0].Code))
+	calls := m.sh.CallsTo(fakeshell.RunCmd)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "--cluster", calls[0].Args[len(calls[0].Args)-1])
+	assert.Empty(t, datastoretest.CredentialWrites(m.sh))
+
+	// Unless the check is turned off
+	update := datastoretest.NewUpdate(ca, serverID)
+	require.Nil(t, run(m, "&clusterCheck=false", update))
+	assert.True(t, update.Svids[0].Certificates[0].Equal(leaf(t, m, "server")))
+
+	// The member doesn't come back with the new certificates
+	m.down = true
+	outputs = run(m, "&clusterCheck=false", datastoretest.NewUpdate(ca, serverID))
+	require.NotEmpty(t, outputs)
+	last := outputs[len(outputs)-1]
+	assert.Equal(t, "post", last.Stage)
+	assert.Equal(t, "ETCD_UNHEALTHY", string(last.Errors.Errors[0].Code))
+}
+
+func TestGroup(t *testing.T) {
+	store := &etcd.Etcd{}
+	member := func(connectionString string) config.DatabaseConfig {
+		return config.DatabaseConfig{Type: "etcd", ConnectionString: connectionString}
+	}
+	assert.Equal(t, "etcd/main", store.Group(member("etcd://10.0.0.1?dir=/etc/etcd&cluster=main")))
+	assert.Equal(t, "etcd/main", store.Group(member("etcd://10.0.0.2?dir=/etc/etcd&cluster=main")))
+	assert.Equal(t, "etcd/events", store.Group(member("etcd://10.0.0.3?dir=/etc/etcd&cluster=events")))
+	// Members without a cluster can change alongside any other
+	assert.Equal(t, "", store.Group(member("etcd://10.0.0.4?dir=/etc/etcd")))
+	assert.Equal(t, "", store.Group(member("etcd://10.0.0.5")))
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := etcd.ParseOptions("etcd://10.0.0.1?dir=/etc/etcd/pki/&server=member&peer=member&client=etcdctl&ca=trusted.crt&peerID=spiffe://example.org/etcd-peer&clusterCheck=false&bin=/opt/etcd")
+	require.Error(t, err, "server and peer share a file but not an SVID")
+
+	opts, err = etcd.ParseOptions("etcd://10.0.0.1?dir=/etc/etcd/pki/&server=member&peer=member&client=etcdctl&ca=trusted.crt&clientID=spiffe://example.org/etcdctl&clusterCheck=false&bin=/opt/etcd")
+	require.NoError(t, err)
+	assert.Equal(t, etcd.Options{
+		Address:      "10.0.0.1:2379",
+		Dir:          "/etc/etcd/pki",
+		Server:       "member",
+		Peer:         "member",
+		Client:       "etcdctl",
+		CA:           "trusted.crt",
+		ClientID:     "spiffe://example.org/etcdctl",
+		ClusterCheck: false,
+		BinDir:       "/opt/etcd",
+	}, opts)
+
+	opts, err = etcd.ParseOptions("etcd://etcd1:12379?dir=/etc/kubernetes/pki/etcd")
+	require.NoError(t, err)
+	assert.Equal(t, "etcd1:12379", opts.Address)
+	assert.Equal(t, etcd.DefaultClient, opts.Client)
+	assert.True(t, opts.ClusterCheck)
+
+	opts, err = etcd.ParseOptions("etcd://etcd1?dir=/etc/kubernetes/pki/etcd&cluster=main")
+	require.NoError(t, err)
+	assert.Equal(t, "main", opts.Cluster)
+
+	for _, invalid := range []string{
+		"/etc/kubernetes/pki/etcd",
+		"https://10.0.0.1:2379?dir=/etc/kubernetes/pki/etcd",
+		"etcd://10.0.0.1",
+		"etcd://10.0.0.1?dir=pki",
+		"etcd://10.0.0.1?dir=/etc/etcd&server=certs/server",
+		"etcd://10.0.0.1?dir=/etc/etcd&ca=server.crt",
+		"etcd://10.0.0.1?dir=/etc/etcd&peerID=etcd-peer",
+		"etcd://10.0.0.1?dir=/etc/etcd&clusterCheck=no",
+		"etcd://10.0.0.1?dir=/etc/etcd&endpoints=https://10.0.0.2:2379",
+	} {
+		_, err := etcd.ParseOptions(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
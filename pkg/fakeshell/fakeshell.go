@@ -0,0 +1,579 @@
+package fakeshell
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a ShellContext for tests. It has an in-memory filesystem with owners and modes, and runs fake
+// executables, so datastores can be tested without touching the real system or running Docker.
+// Tests script it before the run and check its call log after:
+//
+//	sh := fakeshell.NewFakeShell()
+//	sh.MkdirAll("/etc/db", 0755)
+//	sh.OnCommand([]string{"/usr/bin/dbctl", "reload"}, fakeshell.Response{Output: "ok"})
+//	... run the steps ...
+//	assert.Len(t, sh.CallsTo(fakeshell.RunCmd), 1)
+
+// Method names, as used in Call, Failure and SetLatency
+const (
+	FindExecutable     = "FindExecutable"
+	CheckExecutable    = "CheckExecutable"
+	FindPaths          = "FindPaths"
+	RunCmd             = "RunCmd"
+	CheckPathWriteable = "CheckPathWriteable"
+	ReadFile           = "ReadFile"
+	WriteFile          = "WriteFile"
+	RemoveFile         = "RemoveFile"
+)
+
+// The user a new FakeShell runs as. Use SetUser to run as root or someone else.
+const (
+	DefaultUID = 1000
+	DefaultGID = 1000
+)
+
+// FileInfo describes a file or directory in the fake filesystem.
+type FileInfo struct {
+	Path string
+	Dir  bool
+	Data []byte
+	Mode fs.FileMode
+	UID  int
+	GID  int
+}
+
+// CommandFunc is a fake executable. It gets the arguments and environment RunCmd was called with, and
+// returns the command's output.
+type CommandFunc func(ctx context.Context, args []string, environ []string) (string, error)
+
+// Response is a scripted result for a command.
+type Response struct {
+	Output string
+	Err    error
+	// How long the command takes. A command that takes longer than its timeout times out.
+	Latency time.Duration
+}
+
+// Failure makes calls fail with Err instead of doing anything.
+type Failure struct {
+	// The method that fails, or "" for every method
+	Method string
+	// The path the call is for, or "" for any path. For RunCmd and CheckExecutable this is the executable,
+	// and for FindExecutable it is the name looked for.
+	Path string
+	Err  error
+	// How many calls fail before the failure is used up. 0 means every call fails.
+	Times int
+}
+
+// Call is an entry in the call log.
+type Call struct {
+	Method string
+	// The path the call was for. For FindExecutable this is the name looked for.
+	Path string
+	// The search paths for FindExecutable and FindPaths, or the command's arguments for RunCmd
+	Args    []string
+	Environ []string
+	// The data and permissions for WriteFile
+	Data []byte
+	Perm fs.FileMode
+	// What the call returned
+	Output string
+	Err    error
+}
+
+type FakeShell struct {
+	mu          sync.Mutex
+	uid         int
+	gid         int
+	nodes       map[string]*FileInfo
+	executables map[string]CommandFunc
+	responses   map[string][]Response
+	failures    []*Failure
+	latency     map[string]time.Duration
+	calls       []Call
+}
+
+func NewFakeShell() *FakeShell {
+	return &FakeShell{
+		uid: DefaultUID,
+		gid: DefaultGID,
+		nodes: map[string]*FileInfo{
+			"/": {Path: "/", Dir: true, Mode: fs.ModeDir | 0755},
+		},
+		executables: make(map[string]CommandFunc),
+		responses:   make(map[string][]Response),
+		latency:     make(map[string]time.Duration),
+	}
+}
+
+// SetUser sets the user the shell runs as. Files it creates are owned by this user, and permissions are
+// checked against it. UID 0 can read and write anything, like root.
+func (f *FakeShell) SetUser(uid int, gid int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uid, f.gid = uid, gid
+}
+
+// MkdirAll creates a directory and any missing parents, owned by the shell's user.
+func (f *FakeShell) MkdirAll(p string, perm fs.FileMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mkdirAll(clean(p), perm)
+}
+
+func (f *FakeShell) mkdirAll(p string, perm fs.FileMode) {
+	if node, ok := f.nodes[p]; ok && node.Dir {
+		return
+	}
+	f.mkdirAll(path.Dir(p), perm)
+	f.nodes[p] = &FileInfo{Path: p, Dir: true, Mode: fs.ModeDir | perm.Perm(), UID: f.uid, GID: f.gid}
+}
+
+// AddFile creates or replaces a file, and any missing parent directories, owned by the shell's user.
+// Unlike WriteFile it ignores permissions, and isn't logged.
+func (f *FakeShell) AddFile(p string, data []byte, perm fs.FileMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = clean(p)
+	f.mkdirAll(path.Dir(p), 0755)
+	f.nodes[p] = &FileInfo{Path: p, Data: append([]byte(nil), data...), Mode: perm.Perm(), UID: f.uid, GID: f.gid}
+}
+
+// AddExecutable creates an executable file, mode 0755, that runs fn.
+func (f *FakeShell) AddExecutable(p string, fn CommandFunc) {
+	f.AddFile(p, nil, 0755)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executables[clean(p)] = fn
+}
+
+// Chown changes the owner of a file or directory.
+func (f *FakeShell) Chown(p string, uid int, gid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[clean(p)]
+	if !ok {
+		return &fs.PathError{Op: "chown", Path: p, Err: fs.ErrNotExist}
+	}
+	node.UID, node.GID = uid, gid
+	return nil
+}
+
+// Chmod changes the permissions of a file or directory.
+func (f *FakeShell) Chmod(p string, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[clean(p)]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: p, Err: fs.ErrNotExist}
+	}
+	node.Mode = node.Mode&fs.ModeDir | perm.Perm()
+	return nil
+}
+
+// Stat returns a copy of a file or directory, and false if it doesn't exist.
+func (f *FakeShell) Stat(p string) (FileInfo, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[clean(p)]
+	if !ok {
+		return FileInfo{}, false
+	}
+	info := *node
+	info.Data = append([]byte(nil), node.Data...)
+	return info, true
+}
+
+// Files returns the paths of every file, not directory, in the filesystem, sorted.
+func (f *FakeShell) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paths []string
+	for p, node := range f.nodes {
+		if !node.Dir {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// OnCommand scripts the responses to a command, given as the executable's path followed by its arguments.
+// Each call gets the next response, and the last one is repeated. A scripted command is used instead of the
+// executable's CommandFunc, but the executable still has to exist.
+func (f *FakeShell) OnCommand(argv []string, responses ...Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[commandKey(argv)] = append(f.responses[commandKey(argv)], responses...)
+}
+
+// Fail injects a failure.
+func (f *FakeShell) Fail(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &failure)
+}
+
+// SetLatency makes every call to a method, or every call if method is "", take at least d. A call stops
+// waiting if its context is done.
+func (f *FakeShell) SetLatency(method string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[method] = d
+}
+
+// Calls returns the call log, oldest first.
+func (f *FakeShell) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls to one method, oldest first.
+func (f *FakeShell) CallsTo(method string) []Call {
+	var calls []Call
+	for _, call := range f.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// ResetCalls clears the call log.
+func (f *FakeShell) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+// Arguments can contain spaces, so they are joined with a character that can't be in them
+func commandKey(argv []string) string {
+	return strings.Join(argv, "\x00")
+}
+
+func (f *FakeShell) record(call Call) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+// Start a call: wait out any latency, then return an injected failure if there is one
+func (f *FakeShell) begin(ctx context.Context, method string, p string) error {
+	f.mu.Lock()
+	latency, ok := f.latency[method]
+	if !ok {
+		latency = f.latency[""]
+	}
+	f.mu.Unlock()
+	if err := sleep(ctx, latency); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, failure := range f.failures {
+		if failure.Method != "" && failure.Method != method {
+			continue
+		}
+		if failure.Path != "" && failure.Path != p {
+			continue
+		}
+		if failure.Times < 0 {
+			continue
+		}
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				// Used up
+				failure.Times = -1
+			}
+		}
+		return failure.Err
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Whether the shell's user has a permission on a node: 4 is read, 2 is write and 1 is execute
+func (f *FakeShell) allowed(node *FileInfo, perm fs.FileMode) bool {
+	mode := node.Mode.Perm()
+	if f.uid == 0 {
+		// root can do anything, except run files that nobody can execute
+		return perm != 1 || node.Dir || mode&0111 != 0
+	}
+	switch {
+	case node.UID == f.uid:
+		return mode>>6&perm != 0
+	case node.GID == f.gid:
+		return mode>>3&perm != 0
+	default:
+		return mode&perm != 0
+	}
+}
+
+// Check the parent directory of p exists and the user can create and remove files in it
+func (f *FakeShell) checkParentWriteable(op string, p string) error {
+	parent, ok := f.nodes[path.Dir(p)]
+	if !ok || !parent.Dir {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	if !f.allowed(parent, 2) {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *FakeShell) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
+	call := Call{Method: FindExecutable, Path: name, Args: paths}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, FindExecutable, name); call.Err != nil {
+		return "", call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, dir := range paths {
+		execPath := clean(path.Join(dir, name))
+		if node, ok := f.nodes[execPath]; ok && !node.Dir {
+			if node.Mode&0111 == 0 {
+				call.Err = fmt.Errorf("%s is not executable", execPath)
+				return "", call.Err
+			}
+			call.Output = execPath
+			return execPath, nil
+		}
+	}
+	call.Err = fmt.Errorf("executable %s not found in paths", name)
+	return "", call.Err
+}
+
+func (f *FakeShell) CheckExecutable(ctx context.Context, execPath string) error {
+	call := Call{Method: CheckExecutable, Path: execPath}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, CheckExecutable, execPath); call.Err != nil {
+		return call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call.Err = f.checkExecutable(execPath)
+	return call.Err
+}
+
+func (f *FakeShell) checkExecutable(execPath string) error {
+	node, ok := f.nodes[clean(execPath)]
+	if !ok {
+		return &fs.PathError{Op: "stat", Path: execPath, Err: fs.ErrNotExist}
+	}
+	if node.Dir || !f.allowed(node, 1) {
+		return fmt.Errorf("current user does not have execute permission for '%s'", execPath)
+	}
+	return nil
+}
+
+func (f *FakeShell) FindPaths(ctx context.Context, paths []string) ([]string, error) {
+	call := Call{Method: FindPaths, Args: paths}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, FindPaths, ""); call.Err != nil {
+		return nil, call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var validPaths []string
+	for _, p := range paths {
+		if _, ok := f.nodes[clean(p)]; ok {
+			validPaths = append(validPaths, p)
+		}
+	}
+	call.Output = strings.Join(validPaths, "\n")
+	return validPaths, nil
+}
+
+// RunCmd runs a scripted response for the command if there is one, and the executable's CommandFunc if not.
+// The executable has to exist and be executable by the shell's user either way.
+func (f *FakeShell) RunCmd(ctx context.Context, execPath string, args []string, environ []string, timeout time.Duration) (string, error) {
+	call := Call{Method: RunCmd, Path: execPath, Args: args, Environ: environ}
+	defer func() { f.record(call) }()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	timedOut := func() (string, error) {
+		call.Err = fmt.Errorf("command timed out")
+		return "", call.Err
+	}
+
+	if call.Err = f.begin(ctx, RunCmd, execPath); call.Err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return timedOut()
+		}
+		return "", call.Err
+	}
+	f.mu.Lock()
+	if err := f.checkExecutable(execPath); err != nil {
+		f.mu.Unlock()
+		call.Err = fmt.Errorf("command failed: %w", err)
+		return "", call.Err
+	}
+	key := commandKey(append([]string{clean(execPath)}, args...))
+	responses, scripted := f.responses[key]
+	var response Response
+	if scripted {
+		response = responses[0]
+		if len(responses) > 1 {
+			f.responses[key] = responses[1:]
+		}
+	}
+	fn := f.executables[clean(execPath)]
+	f.mu.Unlock()
+
+	var output string
+	var err error
+	switch {
+	case scripted:
+		if err := sleep(ctx, response.Latency); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return timedOut()
+			}
+			call.Err = err
+			return "", err
+		}
+		output, err = response.Output, response.Err
+	case fn != nil:
+		output, err = fn(ctx, args, environ)
+	default:
+		err = fmt.Errorf("no response scripted for %s", strings.Join(append([]string{execPath}, args...), " "))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return timedOut()
+	}
+	if err != nil {
+		call.Output = output
+		call.Err = fmt.Errorf("command failed: %w", err)
+		return "", call.Err
+	}
+	call.Output = output
+	return output, nil
+}
+
+func (f *FakeShell) CheckPathWriteable(ctx context.Context, p string) error {
+	call := Call{Method: CheckPathWriteable, Path: p}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, CheckPathWriteable, p); call.Err != nil {
+		return call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if node, ok := f.nodes[clean(p)]; ok {
+		if !f.allowed(node, 2) {
+			call.Err = fmt.Errorf("file %s is not writable: %w", p, fs.ErrPermission)
+		}
+		return call.Err
+	}
+	if err := f.checkParentWriteable("open", clean(p)); err != nil {
+		call.Err = fmt.Errorf("parent directory %s is not writable: %w", path.Dir(clean(p)), err)
+	}
+	return call.Err
+}
+
+func (f *FakeShell) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	call := Call{Method: ReadFile, Path: p}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, ReadFile, p); call.Err != nil {
+		return nil, call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[clean(p)]
+	switch {
+	case !ok:
+		call.Err = &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+	case node.Dir:
+		call.Err = &fs.PathError{Op: "read", Path: p, Err: fmt.Errorf("is a directory")}
+	case !f.allowed(node, 4):
+		call.Err = &fs.PathError{Op: "open", Path: p, Err: fs.ErrPermission}
+	}
+	if call.Err != nil {
+		return nil, call.Err
+	}
+	return append([]byte(nil), node.Data...), nil
+}
+
+// WriteFile replaces the file, like LocalShellContext renaming a new file over it, so the file ends up owned
+// by the shell's user with the given permissions.
+func (f *FakeShell) WriteFile(ctx context.Context, p string, data []byte, perm os.FileMode) error {
+	call := Call{Method: WriteFile, Path: p, Data: append([]byte(nil), data...), Perm: perm}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, WriteFile, p); call.Err != nil {
+		return call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = clean(p)
+	if call.Err = f.checkParentWriteable("open", p); call.Err != nil {
+		return call.Err
+	}
+	uid, gid := f.uid, f.gid
+	if node, ok := f.nodes[p]; ok {
+		if node.Dir {
+			call.Err = &fs.PathError{Op: "rename", Path: p, Err: fmt.Errorf("is a directory")}
+			return call.Err
+		}
+		// A file that is replaced keeps its owner and group, which only root can give away
+		if f.uid != 0 && (node.UID != f.uid || node.GID != f.gid) {
+			call.Err = &fs.PathError{Op: "chown", Path: p, Err: fs.ErrPermission}
+			return call.Err
+		}
+		uid, gid = node.UID, node.GID
+	}
+	f.nodes[p] = &FileInfo{Path: p, Data: append([]byte(nil), data...), Mode: perm.Perm(), UID: uid, GID: gid}
+	return nil
+}
+
+func (f *FakeShell) RemoveFile(ctx context.Context, p string) error {
+	call := Call{Method: RemoveFile, Path: p}
+	defer func() { f.record(call) }()
+	if call.Err = f.begin(ctx, RemoveFile, p); call.Err != nil {
+		return call.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p = clean(p)
+	node, ok := f.nodes[p]
+	if !ok {
+		return nil
+	}
+	if node.Dir {
+		call.Err = &fs.PathError{Op: "remove", Path: p, Err: fmt.Errorf("is a directory")}
+		return call.Err
+	}
+	if call.Err = f.checkParentWriteable("remove", p); call.Err != nil {
+		return call.Err
+	}
+	delete(f.nodes, p)
+	delete(f.executables, p)
+	return nil
+}
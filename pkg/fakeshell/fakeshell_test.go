@@ -0,0 +1,223 @@
+package fakeshell
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ shell.ShellContext = (*FakeShell)(nil)
+
+func TestFindExecutable(t *testing.T) {
+	shell := NewFakeShell()
+	shell.AddExecutable("/usr/bin/dbctl", nil)
+	shell.AddFile("/usr/local/bin/notes", []byte("text"), 0644)
+
+	foundPath, err := shell.FindExecutable(context.TODO(), []string{"/bin", "/usr/bin"}, "dbctl")
+	assert.NoError(t, err)
+	assert.Equal(t, "/usr/bin/dbctl", foundPath)
+
+	_, err = shell.FindExecutable(context.TODO(), []string{"/usr/local/bin"}, "notes")
+	assert.Error(t, err)
+	_, err = shell.FindExecutable(context.TODO(), []string{"/usr/bin"}, "nonexistent")
+	assert.Error(t, err)
+}
+
+func TestCheckExecutableUsesOwnership(t *testing.T) {
+	shell := NewFakeShell()
+	shell.AddFile("/opt/db/bin/owner-only", nil, 0700)
+	shell.AddFile("/opt/db/bin/group-only", nil, 0710)
+
+	assert.NoError(t, shell.CheckExecutable(context.TODO(), "/opt/db/bin/owner-only"))
+	require.NoError(t, shell.Chown("/opt/db/bin/owner-only", 0, 0))
+	assert.Error(t, shell.CheckExecutable(context.TODO(), "/opt/db/bin/owner-only"))
+
+	require.NoError(t, shell.Chown("/opt/db/bin/group-only", 0, DefaultGID))
+	assert.NoError(t, shell.CheckExecutable(context.TODO(), "/opt/db/bin/group-only"))
+
+	// root can run anything that has an execute bit
+	shell.SetUser(0, 0)
+	require.NoError(t, shell.Chown("/opt/db/bin/owner-only", 1234, 1234))
+	assert.NoError(t, shell.CheckExecutable(context.TODO(), "/opt/db/bin/owner-only"))
+}
+
+func TestFindPaths(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+
+	paths, err := shell.FindPaths(context.TODO(), []string{"/etc/db", "/nonexistentpath"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/etc/db"}, paths)
+}
+
+func TestFiles(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	ctx := context.TODO()
+
+	_, err := shell.ReadFile(ctx, "/etc/db/cert.pem")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	require.NoError(t, shell.WriteFile(ctx, "/etc/db/cert.pem", []byte("cert"), 0640))
+	data, err := shell.ReadFile(ctx, "/etc/db/cert.pem")
+	require.NoError(t, err)
+	assert.Equal(t, "cert", string(data))
+	info, ok := shell.Stat("/etc/db/cert.pem")
+	require.True(t, ok)
+	assert.Equal(t, fs.FileMode(0640), info.Mode)
+	assert.Equal(t, DefaultUID, info.UID)
+
+	// The parent directory has to exist
+	err = shell.WriteFile(ctx, "/etc/other/cert.pem", []byte("cert"), 0640)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	require.NoError(t, shell.RemoveFile(ctx, "/etc/db/cert.pem"))
+	require.NoError(t, shell.RemoveFile(ctx, "/etc/db/cert.pem"))
+	assert.Empty(t, shell.Files())
+}
+
+func TestPermissions(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	shell.AddFile("/etc/db/key.pem", []byte("key"), 0600)
+	require.NoError(t, shell.Chown("/etc/db", 0, 0))
+	require.NoError(t, shell.Chown("/etc/db/key.pem", 0, 0))
+	ctx := context.TODO()
+
+	_, err := shell.ReadFile(ctx, "/etc/db/key.pem")
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+	err = shell.WriteFile(ctx, "/etc/db/cert.pem", []byte("cert"), 0644)
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+	assert.Error(t, shell.CheckPathWriteable(ctx, "/etc/db"))
+	assert.Error(t, shell.CheckPathWriteable(ctx, "/etc/db/cert.pem"))
+
+	shell.SetUser(0, 0)
+	_, err = shell.ReadFile(ctx, "/etc/db/key.pem")
+	assert.NoError(t, err)
+	assert.NoError(t, shell.CheckPathWriteable(ctx, "/etc/db/cert.pem"))
+}
+
+// A replaced file keeps its owner, like LocalShellContext and DockerContext, so the database can still read it
+func TestWriteFileKeepsOwner(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	shell.AddFile("/etc/db/key.pem", []byte("old"), 0600)
+	require.NoError(t, shell.Chown("/etc/db/key.pem", 999, 999))
+	ctx := context.TODO()
+
+	// Only root can give the new file to someone else
+	err := shell.WriteFile(ctx, "/etc/db/key.pem", []byte("new"), 0600)
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+
+	shell.SetUser(0, 0)
+	require.NoError(t, shell.WriteFile(ctx, "/etc/db/key.pem", []byte("new"), 0600))
+	info, _ := shell.Stat("/etc/db/key.pem")
+	assert.Equal(t, 999, info.UID)
+	assert.Equal(t, 999, info.GID)
+	assert.Equal(t, "new", string(info.Data))
+}
+
+func TestRunCmd(t *testing.T) {
+	shell := NewFakeShell()
+	shell.AddExecutable("/usr/bin/dbctl", func(ctx context.Context, args []string, environ []string) (string, error) {
+		return "ran " + strings.Join(args, " "), nil
+	})
+	shell.OnCommand([]string{"/usr/bin/dbctl", "status"},
+		Response{Output: "starting"},
+		Response{Output: "ready"})
+
+	output, err := shell.RunCmd(context.TODO(), "/usr/bin/dbctl", []string{"reload", "--all"}, nil, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "ran reload --all", output)
+
+	// Scripted responses come in order, and the last one repeats
+	for _, want := range []string{"starting", "ready", "ready"} {
+		output, err = shell.RunCmd(context.TODO(), "/usr/bin/dbctl", []string{"status"}, nil, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, want, output)
+	}
+
+	// A scripted command still needs its executable
+	shell.OnCommand([]string{"/usr/bin/missing"}, Response{Output: "ok"})
+	_, err = shell.RunCmd(context.TODO(), "/usr/bin/missing", nil, nil, time.Second)
+	assert.Error(t, err)
+
+	// Scripted errors are returned like a failed command
+	shell.OnCommand([]string{"/usr/bin/dbctl", "stop"}, Response{Err: errors.New("exit status 1")})
+	_, err = shell.RunCmd(context.TODO(), "/usr/bin/dbctl", []string{"stop"}, nil, time.Second)
+	assert.ErrorContains(t, err, "command failed")
+}
+
+func TestRunCmdTimeout(t *testing.T) {
+	shell := NewFakeShell()
+	shell.AddExecutable("/usr/bin/dbctl", nil)
+	shell.OnCommand([]string{"/usr/bin/dbctl", "restart"}, Response{Output: "ok", Latency: time.Minute})
+
+	start := time.Now()
+	_, err := shell.RunCmd(context.TODO(), "/usr/bin/dbctl", []string{"restart"}, nil, 10*time.Millisecond)
+	assert.EqualError(t, err, "command timed out")
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestInjectedFailures(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	diskFull := errors.New("no space left on device")
+	shell.Fail(Failure{Method: WriteFile, Path: "/etc/db/key.pem", Err: diskFull, Times: 1})
+	ctx := context.TODO()
+
+	assert.NoError(t, shell.WriteFile(ctx, "/etc/db/cert.pem", []byte("cert"), 0644))
+	assert.Equal(t, diskFull, shell.WriteFile(ctx, "/etc/db/key.pem", []byte("key"), 0600))
+	// The failure is used up
+	assert.NoError(t, shell.WriteFile(ctx, "/etc/db/key.pem", []byte("key"), 0600))
+
+	shell.Fail(Failure{Err: diskFull})
+	assert.Equal(t, diskFull, shell.RemoveFile(ctx, "/etc/db/key.pem"))
+	_, err := shell.ReadFile(ctx, "/etc/db/cert.pem")
+	assert.Equal(t, diskFull, err)
+}
+
+func TestLatencyRespectsContext(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	shell.SetLatency(ReadFile, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := shell.ReadFile(ctx, "/etc/db/cert.pem")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	// Other methods aren't slowed down
+	assert.NoError(t, shell.CheckPathWriteable(context.TODO(), "/etc/db"))
+}
+
+func TestCallLog(t *testing.T) {
+	shell := NewFakeShell()
+	shell.MkdirAll("/etc/db", 0755)
+	shell.AddExecutable("/usr/bin/dbctl", nil)
+	shell.OnCommand([]string{"/usr/bin/dbctl", "reload"}, Response{Output: "ok"})
+	ctx := context.TODO()
+
+	require.NoError(t, shell.WriteFile(ctx, "/etc/db/cert.pem", []byte("cert"), 0644))
+	_, err := shell.RunCmd(ctx, "/usr/bin/dbctl", []string{"reload"}, []string{"DB_HOME=/etc/db"}, time.Second)
+	require.NoError(t, err)
+	_, err = shell.ReadFile(ctx, "/etc/db/missing.pem")
+	require.Error(t, err)
+
+	calls := shell.Calls()
+	require.Len(t, calls, 3)
+	assert.Equal(t, Call{Method: WriteFile, Path: "/etc/db/cert.pem", Data: []byte("cert"), Perm: 0644}, calls[0])
+	assert.Equal(t, Call{Method: RunCmd, Path: "/usr/bin/dbctl", Args: []string{"reload"}, Environ: []string{"DB_HOME=/etc/db"}, Output: "ok"}, calls[1])
+	assert.Equal(t, ReadFile, calls[2].Method)
+	assert.Error(t, calls[2].Err)
+	assert.Len(t, shell.CallsTo(RunCmd), 1)
+
+	shell.ResetCalls()
+	assert.Empty(t, shell.Calls())
+}
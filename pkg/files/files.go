@@ -0,0 +1,284 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+)
+
+// The files datastore writes the SVID, its key and the trust bundle to files in a directory, through the
+// ShellContext, for software that reads its certificates from disk. The connection string is the directory,
+// optionally followed by the format and the file names to use. PEM is the default:
+//
+//	/etc/myapp/tls?cert=tls.crt&key=tls.key&bundle=ca.crt&combined=tls.pem
+//
+// JVM-based software wants a keystore and truststore instead, in PKCS#12 or Java KeyStore format, protected with
+// a password that should be a secret reference:
+//
+//	/etc/kafka/ssl?format=pkcs12&keystore=server.p12&truststore=ca.p12&password=${env:KEYSTORE_PASSWORD}
+//
+// Each file is replaced in one step, so readers never see a partly written file, and files that already
+// hold the credentials are left alone.
+
+// Formats, and the default file names in each, relative to the directory
+const (
+	FormatPEM    = "pem"
+	FormatPKCS12 = "pkcs12"
+	FormatJKS    = "jks"
+
+	DefaultCertFile   = "svid.pem"
+	DefaultKeyFile    = "svid_key.pem"
+	DefaultBundleFile = "bundle.pem"
+
+	DefaultPKCS12Keystore   = "keystore.p12"
+	DefaultPKCS12Truststore = "truststore.p12"
+	DefaultJKSKeystore      = "keystore.jks"
+	DefaultJKSTruststore    = "truststore.jks"
+)
+
+// State key prefix for the backups of the files as they were before Execute, so Undo can put them back
+const backupsKey = "files.backups."
+
+type Files struct {
+}
+
+func (*Files) GetName() string {
+	return "files"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	Dir    string
+	Format string
+	// PEM files. CombinedFile, with the key and chain together, is only written if it is set.
+	CertFile     string
+	KeyFile      string
+	BundleFile   string
+	CombinedFile string
+	// Keystore files, and the password they are protected with, which may be a secret reference
+	KeystoreFile   string
+	TruststoreFile string
+	Password       string
+	Alias          string
+}
+
+func (o Options) CertPath() string {
+	return path.Join(o.Dir, o.CertFile)
+}
+
+func (o Options) KeyPath() string {
+	return path.Join(o.Dir, o.KeyFile)
+}
+
+func (o Options) BundlePath() string {
+	return path.Join(o.Dir, o.BundleFile)
+}
+
+func (o Options) KeystorePath() string {
+	return path.Join(o.Dir, o.KeystoreFile)
+}
+
+func (o Options) TruststorePath() string {
+	return path.Join(o.Dir, o.TruststoreFile)
+}
+
+// The files with the SVID. The key is written before the certificate, so a reader that sees the new
+// certificate finds its key.
+func (o Options) svidFiles() []file {
+	switch o.Format {
+	case FormatPKCS12:
+		return []file{{path: o.KeystorePath(), format: credformat.PKCS12Keystore}}
+	case FormatJKS:
+		return []file{{path: o.KeystorePath(), format: credformat.JKSKeystore}}
+	}
+	files := []file{
+		{path: o.KeyPath(), format: credformat.PEMKey},
+		{path: o.CertPath(), format: credformat.PEMChain},
+	}
+	if o.CombinedFile != "" {
+		files = append(files, file{path: path.Join(o.Dir, o.CombinedFile), format: credformat.PEMCombined})
+	}
+	return files
+}
+
+// The files with the trust bundle
+func (o Options) bundleFiles() []file {
+	switch o.Format {
+	case FormatPKCS12:
+		return []file{{path: o.TruststorePath(), format: credformat.PKCS12Truststore}}
+	case FormatJKS:
+		return []file{{path: o.TruststorePath(), format: credformat.JKSTruststore}}
+	}
+	return []file{{path: o.BundlePath(), format: credformat.PEMBundle}}
+}
+
+// ParseOptions parses a files connection string. Secret references in the password are left as they are.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{Format: FormatPEM, CertFile: DefaultCertFile, KeyFile: DefaultKeyFile, BundleFile: DefaultBundleFile}
+	dir, query, _ := strings.Cut(connectionString, "?")
+	if !path.IsAbs(dir) {
+		return opts, fmt.Errorf("the directory %s is not an absolute path", dir)
+	}
+	opts.Dir = path.Clean(dir)
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	if format, ok := values["format"]; ok {
+		if len(format) != 1 || (format[0] != FormatPEM && format[0] != FormatPKCS12 && format[0] != FormatJKS) {
+			return opts, fmt.Errorf("format must be %s, %s or %s", FormatPEM, FormatPKCS12, FormatJKS)
+		}
+		opts.Format = format[0]
+	}
+	switch opts.Format {
+	case FormatPKCS12:
+		opts.KeystoreFile, opts.TruststoreFile = DefaultPKCS12Keystore, DefaultPKCS12Truststore
+	case FormatJKS:
+		opts.KeystoreFile, opts.TruststoreFile = DefaultJKSKeystore, DefaultJKSTruststore
+	}
+	keystore := opts.Format != FormatPEM
+	for name, value := range values {
+		var option *string
+		isFile := true
+		switch {
+		case name == "format":
+			continue
+		case name == "cert" && !keystore:
+			option = &opts.CertFile
+		case name == "key" && !keystore:
+			option = &opts.KeyFile
+		case name == "bundle" && !keystore:
+			option = &opts.BundleFile
+		case name == "combined" && !keystore:
+			option = &opts.CombinedFile
+		case name == "keystore" && keystore:
+			option = &opts.KeystoreFile
+		case name == "truststore" && keystore:
+			option = &opts.TruststoreFile
+		case name == "password" && keystore:
+			option, isFile = &opts.Password, false
+		case name == "alias" && keystore:
+			option, isFile = &opts.Alias, false
+		default:
+			return opts, fmt.Errorf("unknown option %s for format %s", name, opts.Format)
+		}
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		// Files go in the directory, not somewhere under or above it
+		if isFile && strings.Contains(value[0], "/") {
+			return opts, fmt.Errorf("option %s must be a single file name", name)
+		}
+		*option = value[0]
+	}
+	if keystore && opts.Password == "" {
+		return opts, fmt.Errorf("a password is needed for format %s", opts.Format)
+	}
+	return opts, nil
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+}
+
+// The files a step writes
+type filesFunc func(opts Options) []file
+
+func (*Files) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "files",
+		ID:            "files",
+		Steps: []step.Step{
+			fileStep("Write the trust bundle", "WRITE_BUNDLE", "FILES_WRITE_BUNDLE", Options.bundleFiles),
+			fileStep("Write the SVID and key", "WRITE_SVID", "FILES_WRITE_SVID", Options.svidFiles),
+		},
+	}
+}
+
+// A step that replaces some files, and puts the old ones back on Undo
+func fileStep(name string, id string, telemetryID string, which filesFunc) step.Step {
+	stateKey := backupsKey + id
+	return step.Step{
+		Name:        name,
+		Id:          id,
+		TelemetryID: telemetryID,
+		CheckDependencies: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+			if err != nil {
+				return step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+			}
+			if err := sfi.ShellContext.CheckPathWriteable(ctx, opts.Dir); err != nil {
+				return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+			}
+			return step.StepFuncOutputMessage{}
+		},
+		Pre: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			if _, err := ParseOptions(sfi.Dbc.ConnectionString); err != nil {
+				return step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+			}
+			if _, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID); err != nil {
+				return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+			}
+			return step.StepFuncOutputMessage{}
+		},
+		Execute: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			files, output := prepare(ctx, sfi, which)
+			if !output.Errors.Empty() {
+				return output
+			}
+			if output := credfiles.Save(ctx, sfi, stateKey, credfiles.Targets(files)); !output.Errors.Empty() {
+				return output
+			}
+			return credfiles.Write(ctx, sfi, files)
+		},
+		Post: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			files, output := prepare(ctx, sfi, which)
+			if !output.Errors.Empty() {
+				return output
+			}
+			return credfiles.Check(ctx, sfi, files)
+		},
+		Undo: func(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+			_, output := credfiles.Restore(ctx, sfi, stateKey)
+			return output
+		},
+		// Writing the same files again is harmless
+		Idempotent: true,
+	}
+}
+
+// Parse the options, select the credentials and resolve the keystore password for a stage, and return the files
+// it writes
+func prepare(ctx context.Context, sfi step.StepFuncInput, files filesFunc) ([]credfiles.File, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return nil, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	renderOpts := credformat.Options{Alias: opts.Alias}
+	if opts.Password != "" {
+		if renderOpts.Password, err = credformat.ResolvePassword(ctx, sfi.Sl.Logger, opts.Password); err != nil {
+			return nil, step.Failed(err)
+		}
+	}
+	var result []credfiles.File
+	for _, f := range files(opts) {
+		result = append(result, credfiles.File{Path: f.path, Format: f.format, Creds: creds, Opts: renderOpts})
+	}
+	return result, step.StepFuncOutputMessage{}
+}
@@ -0,0 +1,190 @@
+package files_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/datastore/datastoretest"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/files"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := files.ParseOptions("/etc/myapp/tls/")
+	require.NoError(t, err)
+	assert.Equal(t, files.Options{Dir: "/etc/myapp/tls", Format: files.FormatPEM, CertFile: "svid.pem", KeyFile: "svid_key.pem", BundleFile: "bundle.pem"}, opts)
+
+	opts, err = files.ParseOptions("/etc/myapp/tls?cert=tls.crt&key=tls.key&bundle=ca.crt")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/myapp/tls/tls.crt", opts.CertPath())
+	assert.Equal(t, "/etc/myapp/tls/tls.key", opts.KeyPath())
+	assert.Equal(t, "/etc/myapp/tls/ca.crt", opts.BundlePath())
+
+	opts, err = files.ParseOptions("/etc/kafka/ssl?format=jks&password=${env:KEYSTORE_PASSWORD}&alias=kafka")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/kafka/ssl/keystore.jks", opts.KeystorePath())
+	assert.Equal(t, "/etc/kafka/ssl/truststore.jks", opts.TruststorePath())
+	assert.Equal(t, "${env:KEYSTORE_PASSWORD}", opts.Password)
+	assert.Equal(t, "kafka", opts.Alias)
+
+	opts, err = files.ParseOptions("/etc/kafka/ssl?format=pkcs12&keystore=server.p12&truststore=ca.p12&password=changeit")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/kafka/ssl/server.p12", opts.KeystorePath())
+	assert.Equal(t, "/etc/kafka/ssl/ca.p12", opts.TruststorePath())
+
+	for _, invalid := range []string{
+		"tls",
+		"/etc/myapp/tls?cert=../tls.crt",
+		"/etc/myapp/tls?cert=",
+		"/etc/myapp/tls?cert=a&cert=b",
+		"/etc/myapp/tls?chain=chain.pem",
+		"/etc/myapp/tls?format=der",
+		"/etc/myapp/tls?password=changeit",
+		"/etc/kafka/ssl?format=pkcs12",
+		"/etc/kafka/ssl?format=jks&password=changeit&cert=tls.crt",
+	} {
+		_, err := files.ParseOptions(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for format, query := range map[string]string{
+		files.FormatPEM:    "?cert=tls.crt&key=tls.key&bundle=ca.crt&combined=tls.pem",
+		files.FormatPKCS12: "?format=pkcs12&password=changeit",
+		files.FormatJKS:    "?format=jks&password=changeit",
+	} {
+		query := query
+		t.Run(format, func(t *testing.T) {
+			datastoretest.Run(t, datastoretest.Suite{
+				Datastore: &files.Files{},
+				Config: func(dir string) config.DatabaseConfig {
+					return config.DatabaseConfig{Type: "files", ConnectionString: dir + query}
+				},
+				NewShell: func(t *testing.T, dir string) shell.ShellContext {
+					sh := fakeshell.NewFakeShell()
+					sh.MkdirAll(dir, 0755)
+					return sh
+				},
+				Certificate: certificate,
+			})
+		})
+	}
+}
+
+// The certificate in the files, or nil if there isn't one yet
+func certificate(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) {
+	opts, err := files.ParseOptions(dbc.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	path, format := opts.CertPath(), credformat.PEMChain
+	switch opts.Format {
+	case files.FormatPKCS12:
+		path, format = opts.KeystorePath(), credformat.PKCS12Keystore
+	case files.FormatJKS:
+		path, format = opts.KeystorePath(), credformat.JKSKeystore
+	}
+	data, err := sc.ReadFile(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credformat.Leaf(format, data, credformat.Options{Password: opts.Password})
+}
+
+func TestUnchangedFilesAreNotRewritten(t *testing.T) {
+	for _, query := range []string{"", "?format=pkcs12&password=changeit", "?format=jks&password=changeit"} {
+		sh := fakeshell.NewFakeShell()
+		sh.MkdirAll("/etc/myapp/tls", 0755)
+		dbc := config.DatabaseConfig{Name: "myapp", Type: "files", ConnectionString: "/etc/myapp/tls" + query, SpiffeID: "spiffe://example.org/myapp"}
+		dbc.ParsedSpiffeID = spiffeid.RequireFromString(dbc.SpiffeID)
+		ca := spiffetest.NewCA(t)
+		update := datastoretest.NewUpdate(ca, dbc.ParsedSpiffeID)
+		run := func(update spiffelinkcore.SpiffeLinkUpdate) {
+			sl := &spiffelinkcore.SpiffeLinkCore{Logger: logrus.New(), Config: &config.Config{}}
+			steps := (&files.Files{}).GetUpdateSteps(context.Background(), dbc, sh, update)
+			runner := step.Runner{Sl: sl, Dbc: &dbc, Update: &update, ShellContext: sh}
+			require.Nil(t, runner.Run(context.Background(), steps.Steps, step.Execute), query)
+		}
+
+		run(update)
+		if query == "" {
+			// The certificate, key and bundle
+			assert.Len(t, datastoretest.CredentialWrites(sh), 3, query)
+		} else {
+			assert.Len(t, datastoretest.CredentialWrites(sh), 2, query)
+		}
+		// The same credentials again
+		sh.ResetCalls()
+		run(update)
+		assert.Empty(t, datastoretest.CredentialWrites(sh), query)
+		// A new SVID, with the same bundle
+		sh.ResetCalls()
+		run(datastoretest.NewUpdate(ca, dbc.ParsedSpiffeID))
+		writes := datastoretest.CredentialWrites(sh)
+		if query == "" {
+			// The key and certificate
+			assert.Len(t, writes, 2, query)
+		} else {
+			require.Len(t, writes, 1, query)
+			assert.Contains(t, writes[0].Path, "keystore", query)
+		}
+	}
+}
+
+// The database testdata/rotate.jsonl was recorded for
+var recordedConfig = config.DatabaseConfig{
+	Name:             "myapp",
+	Type:             "files",
+	ConnectionString: "/etc/myapp/tls?cert=tls.crt&key=tls.key&bundle=ca.crt",
+	SpiffeID:         "spiffe://example.org/myapp",
+}
+
+func TestReplay(t *testing.T) {
+	sessions, err := shell.LoadRecording("testdata/rotate.jsonl")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	outputs, _ := datastoretest.Replay(t, &files.Files{}, recordedConfig, sessions[0], step.Execute)
+	assert.Nil(t, outputs)
+}
+
+func TestReplayWriteFailure(t *testing.T) {
+	sessions, err := shell.LoadRecording("testdata/rotate.jsonl")
+	require.NoError(t, err)
+	// The certificate couldn't be written, so nothing after that happened
+	session := sessions[0]
+	for i, call := range session.Calls {
+		if call.Method == shell.MethodWriteFile && call.Path == "/etc/myapp/tls/tls.crt" {
+			session.Calls[i].Err = &shell.RecordedError{Message: "open /etc/myapp/tls/tls.crt: read-only file system"}
+			session.Calls = session.Calls[:i+1]
+			break
+		}
+	}
+
+	outputs, _ := datastoretest.Replay(t, &files.Files{}, recordedConfig, session, step.Execute)
+	var codes []slerror.ErrorCode
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			codes = append(codes, err.Code)
+		}
+	}
+	assert.Equal(t, []slerror.ErrorCode{"CREDENTIAL_WRITE_FAILED"}, codes)
+}
@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// The health package serves an optional HTTP listener with:
+//   /metrics   Prometheus metrics, read from the status Tracker and the task manager on each scrape
+//   /healthz   200 while the process is running
+//   /readyz    200 once SL is connected to the agent and every database has been rotated at least once
+// It is enabled by setting health.listenAddress in the config file.
+
+const (
+	MetricLastSuccess         = "spiffelink_database_last_success_timestamp_seconds"
+	MetricSvidExpiry          = "spiffelink_database_svid_expiry_timestamp_seconds"
+	MetricConsecutiveFailures = "spiffelink_database_consecutive_failures"
+	MetricRunningTasks        = "spiffelink_running_tasks"
+	MetricQueueDepth          = "spiffelink_task_queue_depth"
+	MetricAgentConnected      = "spiffelink_workload_api_connected"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+var (
+	lastSuccessDesc = prometheus.NewDesc(MetricLastSuccess,
+		"Unix time of the last successful rotation of the database. 0 if it has never been rotated.",
+		[]string{"database"}, nil)
+	svidExpiryDesc = prometheus.NewDesc(MetricSvidExpiry,
+		"Unix time at which the SVID applied to the database expires. 0 if no SVID has been applied.",
+		[]string{"database"}, nil)
+	consecutiveFailuresDesc = prometheus.NewDesc(MetricConsecutiveFailures,
+		"Number of rotations of the database that have failed since the last success.",
+		[]string{"database"}, nil)
+	runningTasksDesc = prometheus.NewDesc(MetricRunningTasks,
+		"Number of tasks currently running, by task type.",
+		[]string{"type"}, nil)
+	queueDepthDesc = prometheus.NewDesc(MetricQueueDepth,
+		"Number of tasks waiting for a free slot in the worker pool.",
+		nil, nil)
+	agentConnectedDesc = prometheus.NewDesc(MetricAgentConnected,
+		"1 if SPIFFE Link is receiving updates from the Workload API, 0 otherwise.",
+		nil, nil)
+)
+
+// collector is a prometheus.Collector that reads the current values whenever it is scraped.
+type collector struct {
+	tracker *status.Tracker
+	tm      taskmanager.ManagerInterface
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSuccessDesc
+	ch <- svidExpiryDesc
+	ch <- consecutiveFailuresDesc
+	ch <- runningTasksDesc
+	ch <- queueDepthDesc
+	ch <- agentConnectedDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.tracker.Snapshot()
+	for _, db := range snapshot.Databases {
+		ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, unixSeconds(db.LastSuccess), db.Name)
+		ch <- prometheus.MustNewConstMetric(svidExpiryDesc, prometheus.GaugeValue, unixSeconds(db.SvidExpiry), db.Name)
+		ch <- prometheus.MustNewConstMetric(consecutiveFailuresDesc, prometheus.GaugeValue, float64(db.ConsecutiveFailures), db.Name)
+	}
+
+	running := make(map[string]int)
+	for _, task := range c.tm.GetRunningTasks() {
+		running[task.Type]++
+	}
+	for taskType, count := range running {
+		ch <- prometheus.MustNewConstMetric(runningTasksDesc, prometheus.GaugeValue, float64(count), taskType)
+	}
+
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(c.tm.QueueDepth()))
+
+	connected := 0.0
+	if snapshot.AgentConnected {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(agentConnectedDesc, prometheus.GaugeValue, connected)
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+type Server struct {
+	server *http.Server
+	logger *logrus.Logger
+}
+
+// NewHandler returns the handler for all the health and metrics endpoints.
+func NewHandler(tracker *status.Tracker, tm taskmanager.ManagerInterface) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&collector{tracker: tracker, tm: tm})
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := tracker.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+func NewServer(listenAddress string, tracker *status.Tracker, tm taskmanager.ManagerInterface, logger *logrus.Logger) *Server {
+	return &Server{
+		server: &http.Server{
+			Addr:              listenAddress,
+			Handler:           NewHandler(tracker, tm),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		logger: logger,
+	}
+}
+
+// Start listens on the configured address and serves requests in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return slerror.HealthListenFailedError(s.logger, s.server.Addr, err)
+	}
+	s.logger.Infof("Serving health checks and metrics on %s", listener.Addr())
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("Health server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,65 @@
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/status"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockLogger() *logrus.Logger {
+	ml := logrus.New()
+	ml.Out = ioutil.Discard // Ensures that the logger does not print anything
+	return ml
+}
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	return recorder.Code, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	tracker := status.NewTracker()
+	tracker.AddDatabase("db1", "spiffe://example.org/db1")
+	tm := taskmanager.NewManager(newMockLogger())
+	defer tm.Shutdown(context.Background())
+	handler := NewHandler(tracker, tm)
+
+	code, _ := get(t, handler, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get(t, handler, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "Workload API")
+
+	tracker.AgentUpdate()
+	tracker.RecordRotation("db1", nil, nil)
+	code, _ = get(t, handler, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	done := make(chan struct{})
+	_, err := tm.NewTask("databaseUpdate", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		<-done
+	})
+	require.NoError(t, err)
+	defer close(done)
+
+	code, body = get(t, handler, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, MetricLastSuccess+`{database="db1"}`)
+	assert.Contains(t, body, MetricConsecutiveFailures+`{database="db1"} 0`)
+	assert.Contains(t, body, MetricRunningTasks+`{type="databaseUpdate"} 1`)
+	assert.Contains(t, body, MetricAgentConnected+" 1")
+}
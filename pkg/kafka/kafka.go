@@ -0,0 +1,640 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+)
+
+// The kafka datastore rotates a Kafka broker's TLS keystore and truststore without restarting it. Brokers
+// can change ssl.keystore.location and ssl.truststore.location at runtime through kafka-configs, and load the
+// new files straight away. Each rotation writes the credentials to new files, named after their fingerprint,
+// then points each listener at them. The broker never reads a file while it is being replaced, and Undo only
+// has to point the listeners back at the files they used before. Once the broker is using the new files,
+// the ones it used before are removed.
+//
+// The connection string is the broker's address, followed by options:
+//
+//	kafka://broker1:9093?broker=1&listeners=SSL,INTERNAL&dir=/etc/kafka/ssl&password=${env:KAFKA_KEYSTORE_PASSWORD}
+//
+//	broker         the broker's ID (required)
+//	listeners      the listeners to reconfigure, separated by commas (SSL by default)
+//	dir            the directory the keystores are written to (required)
+//	format         pkcs12 (the default) or jks
+//	legacyPKCS12   true to encrypt PKCS#12 keystores with 3DES, for brokers on JVMs older than 8u301
+//	password       the password for the keystores and the key, preferably a secret reference (required)
+//	commandConfig  a properties file with the settings kafka-configs connects with, like its own TLS settings
+//	bin            the directory kafka-configs is in, if it isn't in one of DefaultBinDirs
+
+// Keystore formats
+const (
+	FormatPKCS12 = "pkcs12"
+	FormatJKS    = "jks"
+)
+
+// The listener that is reconfigured if the connection string doesn't name any
+const DefaultListener = "SSL"
+
+// Where kafka-configs is looked for if the connection string doesn't say. Apache Kafka ships it as
+// kafka-configs.sh, and Confluent Platform as kafka-configs.
+var (
+	DefaultBinDirs    = []string{"/opt/kafka/bin", "/usr/local/kafka/bin", "/usr/bin", "/usr/local/bin"}
+	kafkaConfigsNames = []string{"kafka-configs.sh", "kafka-configs"}
+)
+
+// How long one kafka-configs command may take. It starts a JVM, so it is slow even when the broker isn't.
+const commandTimeout = 2 * time.Minute
+
+// State keys
+const (
+	// The broker's dynamic settings for the listeners before the rotation
+	previousConfigKey = "kafka.previous"
+	// The keystore files that didn't exist before the rotation, so Undo removes them
+	createdFilesKey = "kafka.created"
+	// The backups of the files the broker used before the rotation, so Undo can put them back after they are
+	// removed
+	oldFilesKey = "kafka.old"
+)
+
+// Names of the versioned files this datastore writes
+var versionedFile = regexp.MustCompile(`^(keystore|truststore)-[0-9a-f]{16}\.(p12|jks)$`)
+
+var validListener = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Kafka struct {
+}
+
+func (*Kafka) GetName() string {
+	return "kafka"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	BootstrapServer string
+	Broker          string
+	Listeners       []string
+	Dir             string
+	Format          string
+	LegacyPKCS12    bool
+	// May be a secret reference
+	Password      string
+	CommandConfig string
+	BinDir        string
+}
+
+// ParseOptions parses a kafka connection string. Secret references in the password are left as they are.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{Format: FormatPKCS12, Listeners: []string{DefaultListener}}
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "kafka" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like kafka://host:port?broker=...")
+	}
+	opts.BootstrapServer = u.Host
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "broker":
+			opts.Broker = v
+		case "listeners":
+			opts.Listeners = strings.Split(v, ",")
+			for _, listener := range opts.Listeners {
+				if !validListener.MatchString(listener) {
+					return opts, fmt.Errorf("invalid listener name %q", listener)
+				}
+			}
+		case "dir":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("the directory %s is not an absolute path", v)
+			}
+			opts.Dir = path.Clean(v)
+		case "format":
+			if v != FormatPKCS12 && v != FormatJKS {
+				return opts, fmt.Errorf("format must be %s or %s", FormatPKCS12, FormatJKS)
+			}
+			opts.Format = v
+		case "legacyPKCS12":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("legacyPKCS12 must be true or false")
+			}
+			opts.LegacyPKCS12 = v == "true"
+		case "password":
+			opts.Password = v
+		case "commandConfig":
+			opts.CommandConfig = v
+		case "bin":
+			opts.BinDir = v
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	switch {
+	case opts.Broker == "":
+		return opts, fmt.Errorf("the broker option is required")
+	case opts.Dir == "":
+		return opts, fmt.Errorf("the dir option is required")
+	case opts.Password == "":
+		return opts, fmt.Errorf("the password option is required")
+	}
+	return opts, nil
+}
+
+// The keystore type, as Kafka spells it
+func (o Options) storeType() string {
+	if o.Format == FormatJKS {
+		return "JKS"
+	}
+	return "PKCS12"
+}
+
+func (o Options) formats() (keystore credformat.Format, truststore credformat.Format) {
+	if o.Format == FormatJKS {
+		return credformat.JKSKeystore, credformat.JKSTruststore
+	}
+	return credformat.PKCS12Keystore, credformat.PKCS12Truststore
+}
+
+// The file a version of the credentials is written to. The name comes from the fingerprint of what is in it,
+// so the same credentials always go to the same file, and a new SVID or bundle goes to a new one.
+func (o Options) versionPath(kind string, f credformat.Format, creds credformat.Credentials) (string, error) {
+	fingerprint, err := credformat.Fingerprint(f, creds)
+	if err != nil {
+		return "", err
+	}
+	ext := "p12"
+	if o.Format == FormatJKS {
+		ext = "jks"
+	}
+	return path.Join(o.Dir, fmt.Sprintf("%s-%s.%s", kind, fingerprint[:16], ext)), nil
+}
+
+// Whether a file is one of the versioned files this datastore writes
+func (o Options) isVersioned(p string) bool {
+	return path.Dir(p) == o.Dir && versionedFile.MatchString(path.Base(p))
+}
+
+// The name of a listener's setting in the broker's dynamic configuration
+func setting(listener string, name string) string {
+	return "listener.name." + strings.ToLower(listener) + "." + name
+}
+
+// The settings this datastore changes for a listener
+func settings(listener string) []string {
+	return []string{
+		setting(listener, "ssl.keystore.location"),
+		setting(listener, "ssl.keystore.type"),
+		setting(listener, "ssl.keystore.password"),
+		setting(listener, "ssl.key.password"),
+		setting(listener, "ssl.truststore.location"),
+		setting(listener, "ssl.truststore.type"),
+		setting(listener, "ssl.truststore.password"),
+	}
+}
+
+func isPassword(name string) bool {
+	return strings.HasSuffix(name, ".password")
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+}
+
+// Everything a stage needs to work on the broker
+type broker struct {
+	opts       Options
+	exe        string
+	creds      credformat.Credentials
+	renderOpts credformat.Options
+	keystore   file
+	truststore file
+}
+
+func (*Kafka) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "kafka",
+		ID:            "kafka",
+		Steps: []step.Step{
+			{
+				Name:              "Write the keystore and truststore",
+				Id:                "WRITE_KEYSTORES",
+				TelemetryID:       "KAFKA_WRITE_KEYSTORES",
+				CheckDependencies: checkDependencies,
+				Pre:               readBrokerConfig,
+				Execute:           writeKeystores,
+				Post:              checkKeystores,
+				Undo:              removeKeystores,
+				// The files are only written if they don't already hold the credentials
+				Idempotent: true,
+			},
+			{
+				Name:        "Point the listeners at the new keystores",
+				Id:          "RECONFIGURE_LISTENERS",
+				TelemetryID: "KAFKA_RECONFIGURE_LISTENERS",
+				Execute:     reconfigureListeners,
+				Post:        checkListeners,
+				Undo:        restoreListeners,
+				// Setting the same locations again is harmless
+				Idempotent: true,
+			},
+			{
+				Name:        "Remove the keystores the broker used before",
+				Id:          "REMOVE_OLD_KEYSTORES",
+				TelemetryID: "KAFKA_REMOVE_OLD_KEYSTORES",
+				Execute:     removeOldKeystores,
+				Undo:        restoreOldKeystores,
+				Idempotent:  true,
+			},
+		},
+	}
+}
+
+// Find kafka-configs, in the directory from the connection string or one of the usual ones
+func findKafkaConfigs(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	dirs := DefaultBinDirs
+	if opts.BinDir != "" {
+		dirs = []string{opts.BinDir}
+	}
+	var err error
+	for _, name := range kafkaConfigsNames {
+		var exe string
+		if exe, err = sfi.ShellContext.FindExecutable(ctx, dirs, name); err == nil {
+			return exe, step.StepFuncOutputMessage{}
+		}
+	}
+	return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, "kafka-configs", err))
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	if err := sfi.ShellContext.CheckPathWriteable(ctx, opts.Dir); err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+	}
+	_, output := findKafkaConfigs(ctx, sfi, opts)
+	return output
+}
+
+// Parse the options, find kafka-configs, resolve the password and work out the files for a stage
+func prepare(ctx context.Context, sfi step.StepFuncInput) (*broker, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return nil, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	b := &broker{opts: opts}
+	var output step.StepFuncOutputMessage
+	if b.exe, output = findKafkaConfigs(ctx, sfi, opts); !output.Errors.Empty() {
+		return nil, output
+	}
+	b.creds, err = credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	b.renderOpts.LegacyPKCS12 = opts.LegacyPKCS12
+	b.renderOpts.Password, err = credformat.ResolvePassword(ctx, sfi.Sl.Logger, opts.Password)
+	if err != nil {
+		return nil, step.Failed(err)
+	}
+	keystoreFormat, truststoreFormat := opts.formats()
+	b.keystore.format, b.truststore.format = keystoreFormat, truststoreFormat
+	if b.keystore.path, err = opts.versionPath("keystore", keystoreFormat, b.creds); err == nil {
+		b.truststore.path, err = opts.versionPath("truststore", truststoreFormat, b.creds)
+	}
+	if err != nil {
+		return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+	}
+	return b, step.StepFuncOutputMessage{}
+}
+
+// The keystore and truststore, and what goes in them
+func (b *broker) files() []credfiles.File {
+	return []credfiles.File{
+		{Path: b.keystore.path, Format: b.keystore.format, Creds: b.creds, Opts: b.renderOpts},
+		{Path: b.truststore.path, Format: b.truststore.format, Creds: b.creds, Opts: b.renderOpts},
+	}
+}
+
+// The arguments to kafka-configs for this broker, followed by the action
+func (b *broker) args(action ...string) []string {
+	args := []string{"--bootstrap-server", b.opts.BootstrapServer}
+	if b.opts.CommandConfig != "" {
+		args = append(args, "--command-config", b.opts.CommandConfig)
+	}
+	args = append(args, "--entity-type", "brokers", "--entity-name", b.opts.Broker)
+	return append(args, action...)
+}
+
+// The broker's dynamic configuration. Kafka reports passwords as null.
+func (b *broker) describe(ctx context.Context, sfi step.StepFuncInput) (map[string]string, step.StepFuncOutputMessage) {
+	output, err := sfi.ShellContext.RunCmd(ctx, b.exe, b.args("--describe"), nil, commandTimeout)
+	if err != nil {
+		return nil, step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "kafka-configs --describe", err))
+	}
+	return parseDescribe(output), step.StepFuncOutputMessage{}
+}
+
+// kafka-configs --describe prints a line for each dynamic setting:
+//
+//	Dynamic configs for broker 1 are:
+//	  listener.name.ssl.ssl.keystore.location=/etc/kafka/ssl/keystore-0123456789abcdef.p12 sensitive=false synonyms={...}
+func parseDescribe(output string) map[string]string {
+	configs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		entry, _, found := strings.Cut(strings.TrimSpace(line), " sensitive=")
+		if !found {
+			continue
+		}
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			configs[name] = value
+		}
+	}
+	return configs
+}
+
+// Change the broker's dynamic configuration. The new values are passed in a properties file rather than with
+// --add-config, since they include the keystore passwords.
+func (b *broker) alter(ctx context.Context, sfi step.StepFuncInput, add map[string]string, remove []string) step.StepFuncOutputMessage {
+	run := func(action ...string) error {
+		action = append([]string{"--alter"}, action...)
+		if len(remove) > 0 {
+			sort.Strings(remove)
+			action = append(action, "--delete-config", strings.Join(remove, ","))
+		}
+		_, err := sfi.ShellContext.RunCmd(ctx, b.exe, b.args(action...), nil, commandTimeout)
+		return err
+	}
+	var err error
+	if len(add) > 0 {
+		err = credfiles.WithSecretFile(ctx, sfi, b.opts.Dir, "kafka-configs", properties(add), func(path string) error {
+			return run("--add-config-file", path)
+		})
+	} else {
+		err = run()
+	}
+	if err != nil {
+		return step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "kafka-configs --alter", err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// The settings as a properties file. java.util.Properties reads it as ISO 8859-1, so anything else is escaped.
+func properties(settings map[string]string) []byte {
+	var lines []string
+	for name, value := range settings {
+		var escaped strings.Builder
+		for i, r := range value {
+			switch {
+			case r == '\\':
+				escaped.WriteString(`\\`)
+			case r == ' ' && i == 0:
+				// Leading spaces would be taken as part of the separator
+				escaped.WriteString(`\ `)
+			case r < 0x20 || r > 0x7e:
+				for _, u := range utf16.Encode([]rune{r}) {
+					fmt.Fprintf(&escaped, `\u%04x`, u)
+				}
+			default:
+				escaped.WriteRune(r)
+			}
+		}
+		lines = append(lines, name+"="+escaped.String())
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// The settings that point a listener at the new files
+func (b *broker) wanted(listener string) map[string]string {
+	return map[string]string{
+		setting(listener, "ssl.keystore.location"):   b.keystore.path,
+		setting(listener, "ssl.keystore.type"):       b.opts.storeType(),
+		setting(listener, "ssl.keystore.password"):   b.renderOpts.Password,
+		setting(listener, "ssl.key.password"):        b.renderOpts.Password,
+		setting(listener, "ssl.truststore.location"): b.truststore.path,
+		setting(listener, "ssl.truststore.type"):     b.opts.storeType(),
+		setting(listener, "ssl.truststore.password"): b.renderOpts.Password,
+	}
+}
+
+// Save the listeners' settings as they are now, and note which of the new files don't exist yet
+func readBrokerConfig(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := b.describe(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	previous := make(map[string]string)
+	for _, listener := range b.opts.Listeners {
+		for _, name := range settings(listener) {
+			if value, ok := configs[name]; ok {
+				previous[name] = value
+			}
+		}
+	}
+	if err := step.Put(sfi.State, previousConfigKey, previous); err != nil {
+		return step.Failed(err)
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// The versioned files are new unless the broker already has these credentials, so only the files that don't
+// exist yet are recorded, for Undo to remove. Files that were already there are left for whatever uses them.
+func writeKeystores(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if output := credfiles.SaveNew(ctx, sfi, createdFilesKey, []string{b.keystore.path, b.truststore.path}); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, b.files())
+}
+
+func checkKeystores(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, b.files())
+}
+
+func removeKeystores(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, createdFilesKey)
+	return output
+}
+
+// Point each listener at the new files, one listener at a time, unless it already uses them
+func reconfigureListeners(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := b.describe(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, listener := range b.opts.Listeners {
+		if configs[setting(listener, "ssl.keystore.location")] == b.keystore.path &&
+			configs[setting(listener, "ssl.truststore.location")] == b.truststore.path {
+			sfi.Logger.Debugf("Listener %s already uses %s", listener, b.keystore.path)
+			continue
+		}
+		sfi.Logger.Infof("Pointing listener %s of broker %s at %s", listener, b.opts.Broker, b.keystore.path)
+		if output := b.alter(ctx, sfi, b.wanted(listener), nil); !output.Errors.Empty() {
+			return output
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Check that the broker reports the new files for every listener
+func checkListeners(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := b.describe(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, listener := range b.opts.Listeners {
+		for _, f := range []file{b.keystore, b.truststore} {
+			name := setting(listener, "ssl.keystore.location")
+			if f == b.truststore {
+				name = setting(listener, "ssl.truststore.location")
+			}
+			if configs[name] != f.path {
+				return step.Failed(slerror.KafkaConfigNotAppliedError(sfi.Sl.Logger, b.opts.Broker, name, f.path))
+			}
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Put the listeners' settings back the way Pre found them. Settings that weren't set dynamically before are
+// deleted, so the listener goes back to the broker's static configuration. Kafka doesn't report passwords,
+// so a password that was set before is set to the current one.
+func restoreListeners(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	previous, ok := step.Get[map[string]string](sfi.State, previousConfigKey)
+	if !ok {
+		return step.StepFuncOutputMessage{}
+	}
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, listener := range b.opts.Listeners {
+		add := make(map[string]string)
+		var remove []string
+		for _, name := range settings(listener) {
+			value, existed := previous[name]
+			switch {
+			case !existed:
+				remove = append(remove, name)
+			case isPassword(name):
+				add[name] = b.renderOpts.Password
+			default:
+				add[name] = value
+			}
+		}
+		sfi.Logger.Infof("Restoring the keystore settings of listener %s of broker %s", listener, b.opts.Broker)
+		if output := b.alter(ctx, sfi, add, remove); !output.Errors.Empty() {
+			return output
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Remove the versioned files the listeners used before, other than the new ones, after copying them so Undo
+// can put them back. The rotation has already succeeded, so a file that can't be removed is only logged.
+func removeOldKeystores(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	b, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	previous, _ := step.Get[map[string]string](sfi.State, previousConfigKey)
+	old := make(map[string]bool)
+	for name, value := range previous {
+		if strings.HasSuffix(name, ".location") && b.opts.isVersioned(value) &&
+			value != b.keystore.path && value != b.truststore.path {
+			old[value] = true
+		}
+	}
+	if output := credfiles.Save(ctx, sfi, oldFilesKey, b.opts.oldKeystoreTargets(old)); !output.Errors.Empty() {
+		return output
+	}
+	backups, _ := credfiles.Saved(sfi, oldFilesKey)
+	for _, backup := range backups {
+		if !backup.Existed() {
+			continue
+		}
+		if err := sfi.ShellContext.RemoveFile(ctx, backup.Path); err != nil {
+			sfi.Logger.Warnf("Unable to remove the old keystore %s: %v", backup.Path, err)
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// The old files to copy before they are removed. The copies are named after the kind of file rather than
+// its version, so the next rotation replaces them instead of adding more. Listeners that used different
+// files of the same kind get a copy each.
+func (o Options) oldKeystoreTargets(old map[string]bool) []credfiles.Target {
+	paths := make([]string, 0, len(old))
+	for p := range old {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	keystoreFormat, truststoreFormat := o.formats()
+	seen := make(map[string]int)
+	var targets []credfiles.Target
+	for _, p := range paths {
+		m := versionedFile.FindStringSubmatch(path.Base(p))
+		kind, ext := m[1], m[2]
+		name := kind + "." + ext
+		if n := seen[kind]; n > 0 {
+			name = fmt.Sprintf("%s-%d.%s", kind, n, ext)
+		}
+		seen[kind]++
+		perm := keystoreFormat.Perm()
+		if kind == "truststore" {
+			perm = truststoreFormat.Perm()
+		}
+		targets = append(targets, credfiles.Target{Path: p, Perm: perm, Copy: path.Join(o.Dir, name+credfiles.BackupSuffix)})
+	}
+	return targets
+}
+
+func restoreOldKeystores(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, oldFilesKey)
+	return output
+}
@@ -0,0 +1,364 @@
+package kafka_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/datastore/datastoretest"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/kafka"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const kafkaConfigs = "/opt/kafka/bin/kafka-configs.sh"
+
+// A broker that keeps its dynamic configuration in memory. Like a real broker, it loads a listener's keystore
+// through the shell when its location changes, and refuses the change if the keystore can't be loaded.
+type fakeBroker struct {
+	sh      *fakeshell.FakeShell
+	mu      sync.Mutex
+	configs map[string]string
+	// The certificate the SSL listener serves, or nil if it uses its static configuration
+	cert *x509.Certificate
+	// The settings of each alter command, as name=value separated by commas
+	added []string
+}
+
+func newFakeBroker(dir string) *fakeBroker {
+	b := &fakeBroker{sh: fakeshell.NewFakeShell(), configs: make(map[string]string)}
+	b.sh.MkdirAll(dir, 0755)
+	b.sh.AddExecutable(kafkaConfigs, b.run)
+	return b
+}
+
+func (b *fakeBroker) run(ctx context.Context, args []string, environ []string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var describe bool
+	var add map[string]string
+	var remove string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--describe":
+			describe = true
+		case "--add-config-file":
+			i++
+			data, err := b.sh.ReadFile(ctx, args[i])
+			if err != nil {
+				return "", err
+			}
+			add = parseProperties(string(data))
+		case "--delete-config":
+			i++
+			remove = args[i]
+		}
+	}
+	if describe {
+		var lines []string
+		for name, value := range b.configs {
+			sensitive := strings.HasSuffix(name, ".password")
+			if sensitive {
+				value = "null"
+			}
+			lines = append(lines, fmt.Sprintf("  %s=%s sensitive=%t synonyms={DYNAMIC_BROKER_CONFIG:%s=%s}", name, value, sensitive, name, value))
+		}
+		sort.Strings(lines)
+		return "Dynamic configs for broker 1 are:\n" + strings.Join(lines, "\n") + "\n", nil
+	}
+
+	configs := make(map[string]string)
+	for name, value := range b.configs {
+		configs[name] = value
+	}
+	if remove != "" {
+		for _, name := range strings.Split(remove, ",") {
+			delete(configs, name)
+		}
+	}
+	if add != nil {
+		var entries []string
+		for name, value := range add {
+			configs[name] = value
+			entries = append(entries, name+"="+value)
+		}
+		sort.Strings(entries)
+		b.added = append(b.added, strings.Join(entries, ","))
+	}
+	cert := b.cert
+	location, ok := configs["listener.name.ssl.ssl.keystore.location"]
+	switch {
+	case !ok:
+		cert = nil
+	case location != b.configs["listener.name.ssl.ssl.keystore.location"]:
+		data, err := b.sh.ReadFile(ctx, location)
+		if err != nil {
+			return "", fmt.Errorf("Invalid config value for resource ConfigResource(type=BROKER, name='1'): %w", err)
+		}
+		format := credformat.PKCS12Keystore
+		if configs["listener.name.ssl.ssl.keystore.type"] == "JKS" {
+			format = credformat.JKSKeystore
+		}
+		cert, err = credformat.Leaf(format, data, credformat.Options{Password: configs["listener.name.ssl.ssl.keystore.password"]})
+		if err != nil {
+			return "", fmt.Errorf("Validation of dynamic config update of SSLFactory failed: %w", err)
+		}
+	}
+	b.configs, b.cert = configs, cert
+	return "Completed updating config for broker 1.\n", nil
+}
+
+// The settings of the alter commands since the last reset, in order
+func (b *fakeBroker) alters() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.added
+}
+
+func (b *fakeBroker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.added = nil
+	b.sh.ResetCalls()
+}
+
+// Read a properties file the way java.util.Properties does, for the escapes kafka-configs writes
+func parseProperties(data string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(data, "\n") {
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		var units []uint16
+		for i := 0; i < len(value); i++ {
+			if value[i] != '\\' {
+				units = append(units, uint16(value[i]))
+				continue
+			}
+			i++
+			if value[i] == 'u' {
+				u, _ := strconv.ParseUint(value[i+1:i+5], 16, 16)
+				units = append(units, uint16(u))
+				i += 4
+			} else {
+				units = append(units, uint16(value[i]))
+			}
+		}
+		props[name] = string(utf16.Decode(units))
+	}
+	return props
+}
+
+func (b *fakeBroker) certificate() *x509.Certificate {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cert
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := kafka.ParseOptions("kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl/&password=${env:KAFKA_KEYSTORE_PASSWORD}")
+	require.NoError(t, err)
+	assert.Equal(t, kafka.Options{
+		BootstrapServer: "broker1:9093",
+		Broker:          "1",
+		Listeners:       []string{"SSL"},
+		Dir:             "/etc/kafka/ssl",
+		Format:          kafka.FormatPKCS12,
+		Password:        "${env:KAFKA_KEYSTORE_PASSWORD}",
+	}, opts)
+
+	opts, err = kafka.ParseOptions("kafka://broker1:9093?broker=1&listeners=SSL,INTERNAL&dir=/etc/kafka/ssl&format=jks&password=changeit&commandConfig=/etc/kafka/admin.properties&bin=/usr/share/kafka/bin")
+	require.NoError(t, err)
+	assert.False(t, opts.LegacyPKCS12)
+	assert.Equal(t, []string{"SSL", "INTERNAL"}, opts.Listeners)
+	assert.Equal(t, kafka.FormatJKS, opts.Format)
+	assert.Equal(t, "/etc/kafka/admin.properties", opts.CommandConfig)
+	assert.Equal(t, "/usr/share/kafka/bin", opts.BinDir)
+
+	opts, err = kafka.ParseOptions("kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit&legacyPKCS12=true")
+	require.NoError(t, err)
+	assert.True(t, opts.LegacyPKCS12)
+
+	for _, invalid := range []string{
+		"/etc/kafka/ssl",
+		"postgres://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit",
+		"kafka://broker1:9093?dir=/etc/kafka/ssl&password=changeit",
+		"kafka://broker1:9093?broker=1&password=changeit",
+		"kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl",
+		"kafka://broker1:9093?broker=1&dir=ssl&password=changeit",
+		"kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit&format=pem",
+		"kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit&listeners=SSL,",
+		"kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit&keystore=server.p12",
+		"kafka://broker1:9093?broker=1&dir=/etc/kafka/ssl&password=changeit&legacyPKCS12=1",
+	} {
+		_, err := kafka.ParseOptions(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, format := range []string{kafka.FormatPKCS12, kafka.FormatJKS} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			var mu sync.Mutex
+			brokers := make(map[shell.ShellContext]*fakeBroker)
+			datastoretest.Run(t, datastoretest.Suite{
+				Datastore: &kafka.Kafka{},
+				Config: func(dir string) config.DatabaseConfig {
+					return config.DatabaseConfig{Type: "kafka", ConnectionString: "kafka://localhost:9093?broker=1&password=changeit&format=" + format + "&dir=" + dir}
+				},
+				NewShell: func(t *testing.T, dir string) shell.ShellContext {
+					b := newFakeBroker(dir)
+					mu.Lock()
+					defer mu.Unlock()
+					brokers[b.sh] = b
+					return b.sh
+				},
+				Certificate: func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return brokers[sc].certificate(), nil
+				},
+				// --describe only looks at the broker
+				Mutating: func(path string, args []string) bool {
+					for _, arg := range args {
+						if arg == "--alter" {
+							return true
+						}
+					}
+					return false
+				},
+			})
+		})
+	}
+}
+
+const connectionString = "kafka://localhost:9093?broker=1&listeners=SSL,INTERNAL&dir=/etc/kafka/ssl&password=changeit&commandConfig=/etc/kafka/admin.properties"
+
+func run(t *testing.T, sh shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) []step.StepFuncOutputMessage {
+	dbc := config.DatabaseConfig{Name: "kafka1", Type: "kafka", ConnectionString: connectionString, SpiffeID: "spiffe://example.org/kafka"}
+	return datastoretest.RunSteps(context.Background(), &kafka.Kafka{}, dbc, sh, update)
+}
+
+func TestRotation(t *testing.T) {
+	b := newFakeBroker("/etc/kafka/ssl")
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/kafka")
+	first := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, b.sh, first))
+	assert.True(t, first.Svids[0].Certificates[0].Equal(b.certificate()))
+
+	// Each listener is reconfigured on its own, with the connection settings from the connection string
+	added := b.alters()
+	require.Len(t, added, 2)
+	assert.Contains(t, added[0], "listener.name.ssl.ssl.keystore.location=/etc/kafka/ssl/keystore-")
+	assert.Contains(t, added[0], "listener.name.ssl.ssl.keystore.type=PKCS12")
+	assert.Contains(t, added[1], "listener.name.internal.ssl.truststore.location=/etc/kafka/ssl/truststore-")
+	for _, call := range b.sh.CallsTo(fakeshell.RunCmd) {
+		assert.Equal(t, []string{"--bootstrap-server", "localhost:9093", "--command-config", "/etc/kafka/admin.properties", "--entity-type", "brokers", "--entity-name", "1"}, call.Args[:8])
+	}
+	firstFiles := b.sh.Files()
+
+	// Nothing changes when the same credentials come again
+	b.reset()
+	require.Nil(t, run(t, b.sh, first))
+	assert.Empty(t, b.alters())
+	assert.Empty(t, datastoretest.CredentialWrites(b.sh))
+	assert.Equal(t, firstFiles, b.sh.Files())
+
+	// A new SVID gets a new keystore, the truststore stays, and the old keystore is removed
+	b.reset()
+	second := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, b.sh, second))
+	assert.True(t, second.Svids[0].Certificates[0].Equal(b.certificate()))
+	writes := datastoretest.CredentialWrites(b.sh)
+	require.Len(t, writes, 1)
+	assert.Contains(t, writes[0].Path, "/etc/kafka/ssl/keystore-")
+	var removes []fakeshell.Call
+	for _, call := range b.sh.CallsTo(fakeshell.RemoveFile) {
+		if !strings.HasSuffix(call.Path, credfiles.SecretFileSuffix) {
+			removes = append(removes, call)
+		}
+	}
+	require.Len(t, removes, 1)
+	assert.Contains(t, firstFiles, removes[0].Path)
+	// A copy of it is kept, so a later failure can put it back
+	assert.Len(t, b.sh.Files(), len(firstFiles)+1)
+	assert.Contains(t, b.sh.Files(), "/etc/kafka/ssl/keystore.p12"+credfiles.BackupSuffix)
+}
+
+// The passwords go to kafka-configs in a file only its owner can read, which is removed afterwards, since
+// anyone on the host can see its arguments
+func TestPasswordsNotInArguments(t *testing.T) {
+	b := newFakeBroker("/etc/kafka/ssl")
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/kafka")
+	// With characters java.util.Properties needs escaped
+	const password = ` pa\ss wörd`
+	dbc := config.DatabaseConfig{
+		Name:             "kafka1",
+		Type:             "kafka",
+		ConnectionString: "kafka://localhost:9093?broker=1&dir=/etc/kafka/ssl&password=" + url.QueryEscape(password),
+		SpiffeID:         "spiffe://example.org/kafka",
+	}
+	update := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, datastoretest.RunSteps(context.Background(), &kafka.Kafka{}, dbc, b.sh, update))
+	assert.True(t, update.Svids[0].Certificates[0].Equal(b.certificate()))
+
+	require.NotEmpty(t, b.alters())
+	assert.Contains(t, b.alters()[0], "listener.name.ssl.ssl.keystore.password="+password)
+	for _, call := range b.sh.CallsTo(fakeshell.RunCmd) {
+		for _, arg := range call.Args {
+			assert.NotContains(t, arg, "wörd")
+		}
+	}
+	for _, call := range b.sh.CallsTo(fakeshell.WriteFile) {
+		if strings.HasSuffix(call.Path, credfiles.SecretFileSuffix) {
+			assert.Equal(t, "-rw-------", call.Perm.String())
+		}
+	}
+	for _, path := range b.sh.Files() {
+		assert.NotContains(t, path, credfiles.SecretFileSuffix)
+	}
+}
+
+func TestBrokerUnreachable(t *testing.T) {
+	b := newFakeBroker("/etc/kafka/ssl")
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/kafka")
+	first := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, b.sh, first))
+
+	// kafka-configs can't reach the broker, so nothing is written
+	b.sh.Fail(fakeshell.Failure{Method: fakeshell.RunCmd, Path: kafkaConfigs, Err: errors.New("exit status 1"), Times: 1})
+	b.sh.ResetCalls()
+	outputs := run(t, b.sh, datastoretest.NewUpdate(ca, id))
+	require.NotNil(t, outputs)
+	var codes []string
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			codes = append(codes, string(err.Code))
+		}
+	}
+	assert.Equal(t, []string{"COMMAND_FAILED"}, codes)
+	assert.Empty(t, datastoretest.CredentialWrites(b.sh))
+	assert.True(t, first.Svids[0].Certificates[0].Equal(b.certificate()))
+}
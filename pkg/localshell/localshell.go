@@ -94,6 +94,9 @@ func (lsc *LocalShellContext) RunCmd(ctx context.Context, path string, args []st
 	defer cancel()
 	// Create the command
 	cmd := exec.CommandContext(ctx, path, args...)
+	if environ != nil {
+		cmd.Env = append(os.Environ(), environ...)
+	}
 
 	// Capture stdout and stderr
 	var stdout, stderr bytes.Buffer
@@ -146,3 +149,76 @@ func (lsc *LocalShellContext) CheckPathWriteable(ctx context.Context, path strin
 
 	return nil
 }
+
+func (lsc *LocalShellContext) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// The file is written next to its destination and renamed over it, so it is replaced in one step. A file
+// that is replaced keeps its owner and group, so the database that reads it still can; writing a file owned
+// by someone else therefore needs root. The data and the rename are flushed to disk before WriteFile returns,
+// so a crash doesn't leave an empty file behind a journal that says it was written.
+func (lsc *LocalShellContext) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := keepOwner(path, tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Flush a directory's entries to disk, so a file renamed into it stays there after a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Give tmp the owner and group of the file at path, if there is one
+func keepOwner(path string, tmp string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Chown(tmp, int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("unable to keep the owner of %s: %w", path, err)
+	}
+	return nil
+}
+
+func (lsc *LocalShellContext) RemoveFile(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
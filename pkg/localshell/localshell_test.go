@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -79,6 +80,11 @@ func TestRunCmd(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "hello\n", output)
 
+	// The environment is added to spiffelink's own
+	output, err = shell.RunCmd(context.TODO(), "/bin/sh", []string{"-c", "echo $SPIFFELINK_TEST_VAR $PATH"}, []string{"SPIFFELINK_TEST_VAR=hello"}, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello "+os.Getenv("PATH")+"\n", output)
+
 	// Test with a timeout
 	_, err = shell.RunCmd(context.TODO(), "sleep", []string{"10"}, nil, 1*time.Second)
 	assert.Error(t, err)
@@ -98,3 +104,23 @@ func TestCheckPathWriteable(t *testing.T) {
 	err = shell.CheckPathWriteable(context.TODO(), "/xyz")
 	assert.Error(t, err)
 }
+
+func TestWriteFileKeepsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a file needs root")
+	}
+	shell := NewLocalShell(newMockLogger())
+	path := filepath.Join(t.TempDir(), "server.key")
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0640))
+	assert.NoError(t, os.Chown(path, 1234, 5678))
+
+	assert.NoError(t, shell.WriteFile(context.TODO(), path, []byte("new"), 0600))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	st := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1234), st.Uid)
+	assert.Equal(t, uint32(5678), st.Gid)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "new", string(data))
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strings"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+	logrussyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// The logging package sets up the global logger from the log section of the config file.
+// Every log entry written while updating a database carries the fields below, so the entries
+// for one rotation can be found in a mixed log stream (or filtered on in a JSON log pipeline).
+
+const (
+	FieldTaskID   = "task_id"
+	FieldDatabase = "database"
+	FieldStep     = "step"
+	FieldStage    = "stage"
+	FieldSpiffeID = "spiffe_id"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	OutputStderr = "stderr"
+	OutputFile   = "file"
+	OutputSyslog = "syslog"
+)
+
+const (
+	defaultMaxSizeMB  = 100
+	defaultMaxBackups = 5
+	defaultSyslogTag  = "spiffelink"
+)
+
+// Configure applies the format and output settings to the logger. The level is handled when the config is parsed.
+// The returned io.Closer releases the log file or syslog connection, and should be closed on exit.
+func Configure(log *logrus.Logger, conf config.LogConfig) (io.Closer, error) {
+	formatter, err := newFormatter(log, conf.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(conf.Output) {
+	case "", OutputStderr:
+		log.SetFormatter(formatter)
+		log.SetOutput(os.Stderr)
+		return ioutil.NopCloser(nil), nil
+	case OutputFile:
+		file, err := NewRotatingFile(conf.File)
+		if err != nil {
+			return nil, slerror.LogFileUnwritableError(log, conf.File.Path, err)
+		}
+		log.SetFormatter(formatter)
+		log.SetOutput(file)
+		return file, nil
+	case OutputSyslog:
+		tag := conf.Syslog.Tag
+		if tag == "" {
+			tag = defaultSyslogTag
+		}
+		hook, err := logrussyslog.NewSyslogHook(conf.Syslog.Network, conf.Syslog.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return nil, slerror.SyslogUnavailableError(log, conf.Syslog.Address, err)
+		}
+		// The syslog hook formats entries itself, so nothing is written to the logger's own output
+		log.SetFormatter(formatter)
+		log.SetOutput(ioutil.Discard)
+		log.AddHook(hook)
+		return hook.Writer, nil
+	default:
+		return nil, slerror.LogOutputInvalidError(log, conf.Output)
+	}
+}
+
+func newFormatter(log *logrus.Logger, format string) (logrus.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return &logrus.TextFormatter{FullTimestamp: true}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, slerror.LogFormatInvalidError(log, format)
+	}
+}
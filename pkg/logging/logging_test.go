@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockLogger() *logrus.Logger {
+	ml := logrus.New()
+	ml.Out = ioutil.Discard // Ensures that the logger does not print anything
+	return ml
+}
+
+func TestConfigureJSONFile(t *testing.T) {
+	logger := newMockLogger()
+	path := filepath.Join(t.TempDir(), "spiffelink.log")
+
+	closer, err := Configure(logger, config.LogConfig{
+		Format: "json",
+		Output: "file",
+		File:   config.LogFileConfig{Path: path},
+	})
+	require.NoError(t, err)
+
+	logger.WithField(FieldDatabase, "db1").Info("hello")
+	require.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &entry))
+	assert.Equal(t, "hello", entry["msg"])
+	assert.Equal(t, "db1", entry[FieldDatabase])
+}
+
+func TestConfigureInvalid(t *testing.T) {
+	_, err := Configure(newMockLogger(), config.LogConfig{Format: "xml"})
+	assert.Error(t, err)
+
+	_, err = Configure(newMockLogger(), config.LogConfig{Output: "printer"})
+	assert.Error(t, err)
+
+	_, err = Configure(newMockLogger(), config.LogConfig{Output: "file"})
+	assert.Error(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spiffelink.log")
+	rf, err := NewRotatingFile(config.LogFileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	require.NoError(t, err)
+	defer rf.Close()
+
+	// Each write is a quarter of the maximum size, so this rotates several times
+	line := []byte(strings.Repeat("x", 256*1024))
+	for i := 0; i < 20; i++ {
+		_, err := rf.Write(line)
+		require.NoError(t, err)
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Len(t, backups, 2)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(1024*1024))
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+)
+
+// RotatingFile is an io.Writer that writes to a log file and rotates it once it reaches MaxSizeMB.
+// Rotated files are renamed to <path>.<timestamp>, and old ones are removed based on MaxBackups and MaxAgeDays.
+// The log file is written by SL itself, so unlike everything else on disk it does not go through a ShellContext.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotatingFile(conf config.LogFileConfig) (*RotatingFile, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("no log file path given")
+	}
+	maxSizeMB := conf.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+	maxBackups := conf.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultMaxBackups
+	}
+	rf := &RotatingFile{
+		path:       conf.Path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		maxAge:     time.Duration(conf.MaxAgeDays) * 24 * time.Hour,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", rf.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.removeOldBackups()
+	return nil
+}
+
+// Removal errors are ignored: a leftover backup is better than failing to log.
+func (rf *RotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	// The timestamp suffix sorts in time order, newest last
+	sort.Strings(backups)
+	for i, backup := range backups {
+		tooMany := i < len(backups)-rf.maxBackups
+		tooOld := false
+		if rf.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > rf.maxAge {
+				tooOld = true
+			}
+		}
+		if (tooMany || tooOld) && strings.HasPrefix(backup, rf.path+".") {
+			os.Remove(backup)
+		}
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
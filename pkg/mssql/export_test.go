@@ -0,0 +1,24 @@
+package mssql
+
+import "net"
+
+// The parts of TDS and mssql.conf the tests need to fake SQL Server
+
+var (
+	ReadTDS        = readTDS
+	WriteTDS       = writeTDS
+	EncodePrelogin = encodePrelogin
+	ParseConf      = parseConf
+)
+
+const (
+	TDSReply           = tdsReply
+	PreloginVersion    = preloginVersion
+	PreloginEncryption = preloginEncryption
+	EncryptOn          = encryptOn
+	EncryptNotSup      = encryptNotSup
+)
+
+func NewTDSConn(conn net.Conn) net.Conn {
+	return &tdsConn{Conn: conn}
+}
@@ -0,0 +1,697 @@
+package mssql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/tlscheck"
+)
+
+// The mssql datastore installs the SVID in SQL Server on Linux. It writes the certificate and key, points
+// SQL Server at them with mssql-conf, and forces encryption. SQL Server only reads its certificate when it
+// starts, so it then has to be restarted, and how that happens is set explicitly in the connection string:
+//
+//	immediate  restart as soon as the new certificate is in place
+//	deferred   never restart. The new certificate is used after whoever runs SQL Server next restarts it.
+//	window     restart only during a maintenance window. A rotation outside the window is deferred, and
+//	           spiffelink runs the rotation again when the next window starts, which restarts SQL Server if
+//	           it isn't serving the SVID yet. SVIDs have to last longer than the time between windows.
+//
+// After a restart, Post connects to SQL Server and checks that the TLS handshake presents the new SVID.
+//
+// The connection string is the server's address, followed by options:
+//
+//	mssql://localhost:1433?restart=window&window=Sat,Sun+02:00-04:00
+//
+//	restart         immediate, deferred or window (required)
+//	window          when SQL Server may be restarted, in spiffelink's local time, like "02:00-04:00" for every
+//	                day or "Sat,Sun 02:00-04:00". A window may run past midnight.
+//	restartCommand  the command that restarts SQL Server (systemctl restart mssql-server by default)
+//	cert            where the certificate chain is written (/etc/ssl/certs/mssql.pem by default)
+//	key             where the key is written (/etc/ssl/private/mssql.key by default)
+//	conf            the mssql.conf that mssql-conf changes (/var/opt/mssql/mssql.conf by default)
+//	bin             the directory mssql-conf is in (/opt/mssql/bin by default)
+//	strict          true if SQL Server uses strict encryption (TDS 8.0), so connections start with TLS
+//	startTimeout    how long SQL Server gets to serve the new certificate after a restart (2m by default)
+//
+// The shell has to run as a user that can run mssql-conf and the restart command. A replaced file keeps its
+// owner, but a new one would belong to the shell's user, which SQL Server couldn't read the key from. So the
+// key file has to exist before the first rotation, owned by the mssql user, and spiffelink refuses to create
+// it.
+
+// Restart modes
+const (
+	RestartImmediate = "immediate"
+	RestartDeferred  = "deferred"
+	RestartWindow    = "window"
+)
+
+// Defaults for the options
+const (
+	DefaultCertFile       = "/etc/ssl/certs/mssql.pem"
+	DefaultKeyFile        = "/etc/ssl/private/mssql.key"
+	DefaultConfFile       = "/var/opt/mssql/mssql.conf"
+	DefaultBinDir         = "/opt/mssql/bin"
+	DefaultRestartCommand = "systemctl restart mssql-server"
+	DefaultStartTimeout   = 2 * time.Minute
+)
+
+// Where the restart command is looked for if it isn't an absolute path
+var commandDirs = []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin", "/usr/local/bin"}
+
+// How long mssql-conf and the restart command may take
+const commandTimeout = 2 * time.Minute
+
+// How long the handshake that checks whether SQL Server already serves the SVID may take
+const probeTimeout = 10 * time.Second
+
+// How often Post tries a handshake while it waits for SQL Server to start
+const probeInterval = 2 * time.Second
+
+// State keys
+const (
+	backupsKey          = "mssql.backups"
+	previousSettingsKey = "mssql.previousSettings"
+	restartedKey        = "mssql.restarted"
+)
+
+// The settings this datastore changes
+const (
+	settingCert            = "network.tlscert"
+	settingKey             = "network.tlskey"
+	settingForceEncryption = "network.forceencryption"
+)
+
+var settingNames = []string{settingCert, settingKey, settingForceEncryption}
+
+type MSSQL struct {
+}
+
+func (*MSSQL) GetName() string {
+	return "mssql"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	Address        string
+	Restart        string
+	Window         Window
+	RestartCommand []string
+	CertFile       string
+	KeyFile        string
+	ConfFile       string
+	BinDir         string
+	Strict         bool
+	StartTimeout   time.Duration
+}
+
+// ParseOptions parses an mssql connection string.
+func ParseOptions(connectionString string) (Options, error) {
+	opts := Options{
+		RestartCommand: strings.Fields(DefaultRestartCommand),
+		CertFile:       DefaultCertFile,
+		KeyFile:        DefaultKeyFile,
+		ConfFile:       DefaultConfFile,
+		BinDir:         DefaultBinDir,
+		StartTimeout:   DefaultStartTimeout,
+	}
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if u.Scheme != "mssql" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like mssql://host:port?restart=...")
+	}
+	opts.Address = u.Host
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	var window string
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "restart":
+			if v != RestartImmediate && v != RestartDeferred && v != RestartWindow {
+				return opts, fmt.Errorf("restart must be %s, %s or %s", RestartImmediate, RestartDeferred, RestartWindow)
+			}
+			opts.Restart = v
+		case "window":
+			window = v
+		case "restartCommand":
+			opts.RestartCommand = strings.Fields(v)
+		case "cert", "key", "conf":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("option %s must be an absolute path", name)
+			}
+			switch name {
+			case "cert":
+				opts.CertFile = path.Clean(v)
+			case "key":
+				opts.KeyFile = path.Clean(v)
+			case "conf":
+				opts.ConfFile = path.Clean(v)
+			}
+		case "bin":
+			opts.BinDir = v
+		case "strict":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("strict must be true or false")
+			}
+			opts.Strict = v == "true"
+		case "startTimeout":
+			if opts.StartTimeout, err = time.ParseDuration(v); err != nil || opts.StartTimeout <= 0 {
+				return opts, fmt.Errorf("startTimeout must be a duration like 2m")
+			}
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	switch {
+	case opts.Restart == "":
+		return opts, fmt.Errorf("the restart option is required: %s, %s or %s", RestartImmediate, RestartDeferred, RestartWindow)
+	case opts.Restart == RestartWindow && window == "":
+		return opts, fmt.Errorf("the window option is required with restart=%s", RestartWindow)
+	case opts.Restart != RestartWindow && window != "":
+		return opts, fmt.Errorf("the window option is only used with restart=%s", RestartWindow)
+	case len(opts.RestartCommand) == 0:
+		return opts, fmt.Errorf("restartCommand is empty")
+	}
+	if window != "" {
+		if opts.Window, err = ParseWindow(window); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// Window is a maintenance window, the time of day when SQL Server may be restarted.
+type Window struct {
+	// The days the window starts on. Empty means every day.
+	Days []time.Weekday
+	// Since midnight. If End is before Start, the window runs past midnight into the next day.
+	Start time.Duration
+	End   time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindow parses a window like "02:00-04:00" or "Sat,Sun 23:00-01:00".
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	if len(fields) == 2 {
+		for _, day := range strings.Split(fields[0], ",") {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return w, fmt.Errorf("invalid day %q in window %q", day, s)
+			}
+			w.Days = append(w.Days, weekday)
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return w, fmt.Errorf("invalid window %q", s)
+	}
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid window %q", s)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(start); err == nil {
+		w.End, err = parseTimeOfDay(end)
+	}
+	if err != nil {
+		return w, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns whether t is in the window.
+func (w Window) Contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+	var in bool
+	if w.Start < w.End {
+		in = sinceMidnight >= w.Start && sinceMidnight < w.End
+	} else if sinceMidnight >= w.Start {
+		in = true
+	} else if sinceMidnight < w.End {
+		// The window started the day before
+		in, day = true, (day+6)%7
+	}
+	return in && w.startsOn(day)
+}
+
+// NextStart returns when the window next starts after t.
+func (w Window) NextStart(t time.Time) time.Time {
+	// A week later is always the same day, so the loop always returns
+	for d := 0; ; d++ {
+		// time.Date, not Add, so the start stays at the same time of day across daylight saving changes
+		start := time.Date(t.Year(), t.Month(), t.Day()+d, int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute), 0, 0, t.Location())
+		if start.After(t) && w.startsOn(start.Weekday()) {
+			return start
+		}
+	}
+}
+
+func (w Window) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// The settings that make SQL Server use the new files
+func (o Options) wanted() map[string]string {
+	return map[string]string{settingCert: o.CertFile, settingKey: o.KeyFile, settingForceEncryption: "1"}
+}
+
+func (o Options) handshakeOptions() tlscheck.Options {
+	if o.Strict {
+		return tlscheck.Options{NextProtos: []string{"tds/8.0"}}
+	}
+	return tlscheck.Options{Wrap: prelogin}
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+}
+
+func (o Options) files() []file {
+	// The key first, so SQL Server never finds a certificate without its key
+	return []file{{path: o.KeyFile, format: credformat.PEMKey}, {path: o.CertFile, format: credformat.PEMChain}}
+}
+
+// NextRun returns the start of the next maintenance window with restart=window. The rotation that runs then
+// restarts SQL Server if a rotation outside the window deferred it, even when the SVIDs haven't changed since.
+func (*MSSQL) NextRun(conf config.DatabaseConfig, now time.Time) (time.Time, bool) {
+	opts, err := ParseOptions(conf.ConnectionString)
+	if err != nil || opts.Restart != RestartWindow {
+		return time.Time{}, false
+	}
+	return opts.Window.NextStart(now), true
+}
+
+func (*MSSQL) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "mssql",
+		ID:            "mssql",
+		Steps: []step.Step{
+			{
+				Name:              "Write the certificate and key",
+				Id:                "WRITE_CERTIFICATE",
+				TelemetryID:       "MSSQL_WRITE_CERTIFICATE",
+				CheckDependencies: checkDependencies,
+				Pre:               checkCredentials,
+				Execute:           writeFiles,
+				Post:              checkFiles,
+				Undo:              restoreFiles,
+				// The files are only written if they don't already hold the credentials
+				Idempotent: true,
+			},
+			{
+				Name:        "Configure SQL Server to use the certificate",
+				Id:          "CONFIGURE_TLS",
+				TelemetryID: "MSSQL_CONFIGURE_TLS",
+				Pre:         readSettings,
+				Execute:     setSettings,
+				Post:        checkSettings,
+				Undo:        restoreSettings,
+				Idempotent:  true,
+			},
+			{
+				Name:        "Restart SQL Server",
+				Id:          "RESTART",
+				TelemetryID: "MSSQL_RESTART",
+				Execute:     restart,
+				Post:        checkHandshake,
+				// Restarting again is harmless. Undo is done by restoreFiles, once everything else is put back.
+				Idempotent: true,
+			},
+		},
+	}
+}
+
+func parse(sfi step.StepFuncInput) (Options, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return opts, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	return opts, step.StepFuncOutputMessage{}
+}
+
+func findMssqlConf(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	exe, err := sfi.ShellContext.FindExecutable(ctx, []string{opts.BinDir}, "mssql-conf")
+	if err != nil {
+		return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, "mssql-conf", err))
+	}
+	return exe, step.StepFuncOutputMessage{}
+}
+
+func findRestartCommand(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	name := opts.RestartCommand[0]
+	if path.IsAbs(name) {
+		if err := sfi.ShellContext.CheckExecutable(ctx, name); err != nil {
+			return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, name, err))
+		}
+		return name, step.StepFuncOutputMessage{}
+	}
+	exe, err := sfi.ShellContext.FindExecutable(ctx, commandDirs, name)
+	if err != nil {
+		return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, name, err))
+	}
+	return exe, step.StepFuncOutputMessage{}
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, f := range opts.files() {
+		if err := sfi.ShellContext.CheckPathWriteable(ctx, path.Dir(f.path)); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, f.path, err))
+		}
+	}
+	if _, output := findMssqlConf(ctx, sfi, opts); !output.Errors.Empty() {
+		return output
+	}
+	_, output = findRestartCommand(ctx, sfi, opts)
+	return output
+}
+
+// Check that the update has an SVID for the database, and that the key file is there to put its key in,
+// before anything is changed
+func checkCredentials(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if _, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID); err != nil {
+		return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	if _, err := sfi.ShellContext.ReadFile(ctx, opts.KeyFile); errors.Is(err, fs.ErrNotExist) {
+		return step.Failed(slerror.MssqlKeyMissingError(sfi.Sl.Logger, opts.KeyFile))
+	} else if err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.KeyFile, err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// The files the credentials go in, with the SVID for the database
+func credentialFiles(sfi step.StepFuncInput, opts Options) ([]credfiles.File, step.StepFuncOutputMessage) {
+	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	var files []credfiles.File
+	for _, f := range opts.files() {
+		files = append(files, credfiles.File{Path: f.path, Format: f.format, Creds: creds})
+	}
+	return files, step.StepFuncOutputMessage{}
+}
+
+func writeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files, output := credentialFiles(sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if output := credfiles.Save(ctx, sfi, backupsKey, credfiles.Targets(files)); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, files)
+}
+
+func checkFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files, output := credentialFiles(sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, files)
+}
+
+// Put the files back the way Execute found them. SQL Server only reads them when it starts, so if it was
+// restarted with the new ones, it is restarted again. By the time this runs, mssql.conf is back too.
+func restoreFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	backups, output := credfiles.Restore(ctx, sfi, backupsKey)
+	if !output.Errors.Empty() || backups == nil {
+		return output
+	}
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if restarted, _ := step.Get[bool](sfi.State, restartedKey); restarted {
+		sfi.Logger.Info("Restarting SQL Server with the previous certificate")
+		return runRestart(ctx, sfi, opts)
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Read mssql.conf. mssql-conf keeps network.tlscert as tlscert in the [network] section.
+func readConf(ctx context.Context, sfi step.StepFuncInput, opts Options) (map[string]string, step.StepFuncOutputMessage) {
+	data, err := sfi.ShellContext.ReadFile(ctx, opts.ConfFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		// SQL Server is using its defaults
+		return map[string]string{}, step.StepFuncOutputMessage{}
+	}
+	if err != nil {
+		return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.ConfFile, err))
+	}
+	return parseConf(data), step.StepFuncOutputMessage{}
+}
+
+func parseConf(data []byte) map[string]string {
+	settings := make(map[string]string)
+	var section string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+		default:
+			if name, value, ok := strings.Cut(line, "="); ok {
+				settings[section+"."+strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return settings
+}
+
+func readSettings(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	settings, output := readConf(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	previous := make(map[string]string)
+	for _, name := range settingNames {
+		if value, ok := settings[name]; ok {
+			previous[name] = value
+		}
+	}
+	if err := step.Put(sfi.State, previousSettingsKey, previous); err != nil {
+		return step.Failed(err)
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+func mssqlConf(ctx context.Context, sfi step.StepFuncInput, opts Options, args ...string) step.StepFuncOutputMessage {
+	exe, output := findMssqlConf(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if _, err := sfi.ShellContext.RunCmd(ctx, exe, args, nil, commandTimeout); err != nil {
+		return step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "mssql-conf "+strings.Join(args, " "), err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+func setSettings(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	settings, output := readConf(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	wanted := opts.wanted()
+	for _, name := range settingNames {
+		if settings[name] == wanted[name] {
+			continue
+		}
+		if output := mssqlConf(ctx, sfi, opts, "set", name, wanted[name]); !output.Errors.Empty() {
+			return output
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+func checkSettings(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	settings, output := readConf(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	wanted := opts.wanted()
+	for _, name := range settingNames {
+		if settings[name] != wanted[name] {
+			return step.Failed(slerror.MssqlConfigNotAppliedError(sfi.Sl.Logger, name, wanted[name]))
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Put the settings back the way Pre found them. Settings that weren't set are unset.
+func restoreSettings(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	previous, ok := step.Get[map[string]string](sfi.State, previousSettingsKey)
+	if !ok {
+		return step.StepFuncOutputMessage{}
+	}
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	settings, output := readConf(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for _, name := range settingNames {
+		value, existed := previous[name]
+		current, set := settings[name]
+		switch {
+		case existed && (!set || current != value):
+			output = mssqlConf(ctx, sfi, opts, "set", name, value)
+		case !existed && set:
+			output = mssqlConf(ctx, sfi, opts, "unset", name)
+		}
+		if !output.Errors.Empty() {
+			return output
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+func runRestart(ctx context.Context, sfi step.StepFuncInput, opts Options) step.StepFuncOutputMessage {
+	exe, output := findRestartCommand(ctx, sfi, opts)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if _, err := sfi.ShellContext.RunCmd(ctx, exe, opts.RestartCommand[1:], nil, commandTimeout); err != nil {
+		return step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, strings.Join(opts.RestartCommand, " "), err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Restart SQL Server if it isn't serving the SVID yet, and the restart mode allows it now
+func restart(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	chain, err := tlscheck.Handshake(probeCtx, opts.Address, opts.handshakeOptions())
+	cancel()
+	if err == nil && chain[0].Equal(creds.SVID.Certificates[0]) {
+		sfi.Logger.Info("SQL Server already serves the SVID, so it isn't restarted")
+		return step.StepFuncOutputMessage{}
+	}
+	switch {
+	case opts.Restart == RestartDeferred:
+		sfi.Logger.Warn("SQL Server will use the new certificate once it is restarted (restart=deferred)")
+		return step.StepFuncOutputMessage{}
+	case opts.Restart == RestartWindow && !opts.Window.Contains(time.Now()):
+		sfi.Logger.Warn("SQL Server will be restarted to use the new certificate when its maintenance window starts")
+		return step.StepFuncOutputMessage{}
+	}
+	sfi.Logger.Info("Restarting SQL Server to use the new certificate")
+	// Set first, since the restart may do something even if it fails
+	if err := step.Put(sfi.State, restartedKey, true); err != nil {
+		return step.Failed(err)
+	}
+	return runRestart(ctx, sfi, opts)
+}
+
+// Check that SQL Server presents the SVID, if it was restarted to use it
+func checkHandshake(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	if restarted, _ := step.Get[bool](sfi.State, restartedKey); !restarted {
+		return step.StepFuncOutputMessage{}
+	}
+	opts, output := parse(sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	creds, err := credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	leaf := creds.SVID.Certificates[0]
+	waitCtx, cancel := context.WithTimeout(ctx, opts.StartTimeout)
+	defer cancel()
+	if err := tlscheck.WaitFor(waitCtx, opts.Address, opts.handshakeOptions(), leaf, probeInterval); err != nil {
+		return step.Failed(slerror.TLSCertificateNotServedError(sfi.Sl.Logger, opts.Address, leaf.SerialNumber.String(), err))
+	}
+	return step.StepFuncOutputMessage{}
+}
@@ -0,0 +1,379 @@
+package mssql_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/datastore/datastoretest"
+	"github.com/dfeldman/spiffelink/pkg/fakeshell"
+	"github.com/dfeldman/spiffelink/pkg/mssql"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A SQL Server that answers PRELOGIN and does the TLS handshake inside it, like a real one. It has mssql-conf
+// and a restart command in its shell, and loads the certificate and key mssql.conf names when it restarts.
+// Until it has a certificate, it says it doesn't support encryption.
+type fakeServer struct {
+	address string
+	sh      *fakeshell.FakeShell
+	dir     string
+	mu      sync.Mutex
+	cert    *tls.Certificate
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	s := &fakeServer{address: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, _, err := mssql.ReadTDS(conn); err != nil {
+		return
+	}
+	s.mu.Lock()
+	cert := s.cert
+	s.mu.Unlock()
+	encryption := byte(mssql.EncryptNotSup)
+	if cert != nil {
+		encryption = mssql.EncryptOn
+	}
+	reply := mssql.EncodePrelogin(map[byte][]byte{mssql.PreloginVersion: {16, 0, 0, 0, 0, 0}, mssql.PreloginEncryption: {encryption}})
+	if err := mssql.WriteTDS(conn, mssql.TDSReply, reply); err != nil || cert == nil {
+		return
+	}
+	_ = tls.Server(mssql.NewTDSConn(conn), &tls.Config{Certificates: []tls.Certificate{*cert}}).Handshake()
+}
+
+// Set up the shell. Everything lives in dir. The key file is created empty, as the operator does so that it
+// belongs to the mssql user.
+func (s *fakeServer) install(dir string) {
+	s.sh, s.dir = fakeshell.NewFakeShell(), dir
+	s.sh.MkdirAll(dir, 0755)
+	s.sh.AddFile(dir+"/mssql.key", nil, 0600)
+	s.sh.AddExecutable(dir+"/mssql-conf", s.mssqlConf)
+	s.sh.AddExecutable(dir+"/restart-mssql", s.restart)
+}
+
+func (s *fakeServer) mssqlConf(ctx context.Context, args []string, environ []string) (string, error) {
+	data, _ := s.sh.ReadFile(ctx, s.dir+"/mssql.conf")
+	settings := mssql.ParseConf(data)
+	switch {
+	case len(args) == 3 && args[0] == "set":
+		settings[args[1]] = args[2]
+	case len(args) == 2 && args[0] == "unset":
+		delete(settings, args[1])
+	default:
+		return "", fmt.Errorf("unexpected arguments %q", args)
+	}
+	// mssql-conf keeps one section per prefix
+	sections := make(map[string][]string)
+	for name, value := range settings {
+		section, key, _ := strings.Cut(name, ".")
+		sections[section] = append(sections[section], key+" = "+value)
+	}
+	var names []string
+	for section := range sections {
+		names = append(names, section)
+	}
+	sort.Strings(names)
+	var conf strings.Builder
+	for _, section := range names {
+		sort.Strings(sections[section])
+		fmt.Fprintf(&conf, "[%s]\n%s\n\n", section, strings.Join(sections[section], "\n"))
+	}
+	return "SQL Server needs to be restarted in order to apply this setting.\n", s.sh.WriteFile(ctx, s.dir+"/mssql.conf", []byte(conf.String()), 0644)
+}
+
+func (s *fakeServer) restart(ctx context.Context, args []string, environ []string) (string, error) {
+	data, _ := s.sh.ReadFile(ctx, s.dir+"/mssql.conf")
+	settings := mssql.ParseConf(data)
+	var cert *tls.Certificate
+	if settings["network.tlscert"] != "" {
+		certPEM, err := s.sh.ReadFile(ctx, settings["network.tlscert"])
+		if err != nil {
+			return "", err
+		}
+		keyPEM, err := s.sh.ReadFile(ctx, settings["network.tlskey"])
+		if err != nil {
+			return "", err
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return "", fmt.Errorf("SQL Server failed to start: %w", err)
+		}
+		cert = &pair
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = cert
+	return "", nil
+}
+
+func (s *fakeServer) certificate() (*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert == nil {
+		return nil, nil
+	}
+	return x509.ParseCertificate(s.cert.Certificate[0])
+}
+
+func connectionString(s *fakeServer, dir string, restart string) string {
+	return fmt.Sprintf("mssql://%s?restart=%s&restartCommand=%s/restart-mssql&cert=%s/mssql.pem&key=%s/mssql.key&conf=%s/mssql.conf&bin=%s&startTimeout=10s",
+		s.address, restart, dir, dir, dir, dir, dir)
+}
+
+func TestConformance(t *testing.T) {
+	var mu sync.Mutex
+	servers := make(map[string]*fakeServer)
+	datastoretest.Run(t, datastoretest.Suite{
+		Datastore: &mssql.MSSQL{},
+		Config: func(dir string) config.DatabaseConfig {
+			s := newFakeServer(t)
+			mu.Lock()
+			defer mu.Unlock()
+			servers[dir] = s
+			return config.DatabaseConfig{Type: "mssql", ConnectionString: connectionString(s, dir, mssql.RestartImmediate)}
+		},
+		NewShell: func(t *testing.T, dir string) shell.ShellContext {
+			mu.Lock()
+			defer mu.Unlock()
+			servers[dir].install(dir)
+			return servers[dir].sh
+		},
+		Certificate: func(ctx context.Context, sc shell.ShellContext, dbc config.DatabaseConfig) (*x509.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, s := range servers {
+				if s.sh == sc {
+					return s.certificate()
+				}
+			}
+			return nil, fmt.Errorf("unknown shell")
+		},
+		// mssql-conf is only run to change settings, and the restart command restarts SQL Server
+		Mutating: func(path string, args []string) bool { return true },
+	})
+}
+
+func run(t *testing.T, s *fakeServer, restart string, update spiffelinkcore.SpiffeLinkUpdate) []step.StepFuncOutputMessage {
+	dbc := config.DatabaseConfig{Name: "mssql1", Type: "mssql", ConnectionString: connectionString(s, s.dir, restart), SpiffeID: "spiffe://example.org/mssql"}
+	return datastoretest.RunSteps(context.Background(), &mssql.MSSQL{}, dbc, s.sh, update)
+}
+
+func restarts(s *fakeServer) int {
+	var n int
+	for _, call := range s.sh.CallsTo(fakeshell.RunCmd) {
+		if strings.HasSuffix(call.Path, "/restart-mssql") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRotation(t *testing.T) {
+	s := newFakeServer(t)
+	s.install("/var/opt/mssql")
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/mssql")
+	first := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, s, mssql.RestartImmediate, first))
+	cert, err := s.certificate()
+	require.NoError(t, err)
+	assert.True(t, first.Svids[0].Certificates[0].Equal(cert))
+	assert.Equal(t, 1, restarts(s))
+	conf, err := s.sh.ReadFile(context.Background(), "/var/opt/mssql/mssql.conf")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"network.tlscert":         "/var/opt/mssql/mssql.pem",
+		"network.tlskey":          "/var/opt/mssql/mssql.key",
+		"network.forceencryption": "1",
+	}, mssql.ParseConf(conf))
+
+	// SQL Server already serves the SVID, so nothing is changed and it isn't restarted
+	s.sh.ResetCalls()
+	require.Nil(t, run(t, s, mssql.RestartImmediate, first))
+	assert.Empty(t, datastoretest.CredentialWrites(s.sh))
+	assert.Empty(t, s.sh.CallsTo(fakeshell.RunCmd))
+}
+
+// A key file spiffelink created would belong to the shell's user, so SQL Server couldn't read it and would fail
+// to start. Nothing is changed until the operator has created it.
+func TestKeyFileMissing(t *testing.T) {
+	s := newFakeServer(t)
+	s.install("/var/opt/mssql")
+	require.NoError(t, s.sh.RemoveFile(context.Background(), "/var/opt/mssql/mssql.key"))
+	s.sh.ResetCalls()
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/mssql")
+
+	outputs := run(t, s, mssql.RestartImmediate, datastoretest.NewUpdate(ca, id))
+	require.NotNil(t, outputs)
+	var codes []string
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			codes = append(codes, string(err.Code))
+		}
+	}
+	assert.Equal(t, []string{"MSSQL_KEY_MISSING"}, codes)
+	assert.Empty(t, s.sh.CallsTo(fakeshell.WriteFile))
+	assert.Empty(t, s.sh.CallsTo(fakeshell.RunCmd))
+	assert.NotContains(t, s.sh.Files(), "/var/opt/mssql/mssql.key")
+}
+
+func TestDeferredRestart(t *testing.T) {
+	s := newFakeServer(t)
+	s.install("/var/opt/mssql")
+	ca := spiffetest.NewCA(t)
+	id := spiffeid.RequireFromString("spiffe://example.org/mssql")
+	first := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, s, mssql.RestartImmediate, first))
+
+	// The files and settings change, but SQL Server keeps the old certificate until someone restarts it
+	s.sh.ResetCalls()
+	second := datastoretest.NewUpdate(ca, id)
+	require.Nil(t, run(t, s, mssql.RestartDeferred, second))
+	assert.Len(t, datastoretest.CredentialWrites(s.sh), 2)
+	assert.Equal(t, 0, restarts(s))
+	cert, err := s.certificate()
+	require.NoError(t, err)
+	assert.True(t, first.Svids[0].Certificates[0].Equal(cert))
+
+	_, err = s.restart(context.Background(), nil, nil)
+	require.NoError(t, err)
+	cert, err = s.certificate()
+	require.NoError(t, err)
+	assert.True(t, second.Svids[0].Certificates[0].Equal(cert))
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := mssql.ParseOptions("mssql://localhost:1433?restart=immediate")
+	require.NoError(t, err)
+	assert.Equal(t, mssql.Options{
+		Address:        "localhost:1433",
+		Restart:        mssql.RestartImmediate,
+		RestartCommand: []string{"systemctl", "restart", "mssql-server"},
+		CertFile:       mssql.DefaultCertFile,
+		KeyFile:        mssql.DefaultKeyFile,
+		ConfFile:       mssql.DefaultConfFile,
+		BinDir:         mssql.DefaultBinDir,
+		StartTimeout:   mssql.DefaultStartTimeout,
+	}, opts)
+
+	opts, err = mssql.ParseOptions("mssql://db1:1433?restart=window&window=Sat,Sun+02:00-04:00&restartCommand=/usr/local/bin/restart-sql&strict=true&startTimeout=5m&cert=/etc/mssql/tls/cert.pem")
+	require.NoError(t, err)
+	assert.Equal(t, mssql.Window{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: 2 * time.Hour, End: 4 * time.Hour}, opts.Window)
+	assert.Equal(t, []string{"/usr/local/bin/restart-sql"}, opts.RestartCommand)
+	assert.True(t, opts.Strict)
+	assert.Equal(t, 5*time.Minute, opts.StartTimeout)
+	assert.Equal(t, "/etc/mssql/tls/cert.pem", opts.CertFile)
+
+	for _, invalid := range []string{
+		"localhost:1433",
+		"mssql://localhost:1433",
+		"mssql://localhost:1433?restart=later",
+		"mssql://localhost:1433?restart=window",
+		"mssql://localhost:1433?restart=immediate&window=02:00-04:00",
+		"mssql://localhost:1433?restart=window&window=02:00",
+		"mssql://localhost:1433?restart=window&window=Someday+02:00-04:00",
+		"mssql://localhost:1433?restart=window&window=02:00-02:00",
+		"mssql://localhost:1433?restart=immediate&cert=mssql.pem",
+		"mssql://localhost:1433?restart=immediate&restartCommand=+",
+		"mssql://localhost:1433?restart=immediate&strict=yes",
+		"mssql://localhost:1433?restart=immediate&startTimeout=soon",
+		"mssql://localhost:1433?restart=immediate&database=master",
+	} {
+		_, err := mssql.ParseOptions(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.Local)
+	}
+	daily, err := mssql.ParseWindow("02:00-04:00")
+	require.NoError(t, err)
+	assert.True(t, daily.Contains(at(3, 2, 0)))
+	assert.True(t, daily.Contains(at(3, 3, 59)))
+	assert.False(t, daily.Contains(at(3, 4, 0)))
+	assert.False(t, daily.Contains(at(3, 1, 59)))
+
+	weekend, err := mssql.ParseWindow("Sat,Sun 02:00-04:00")
+	require.NoError(t, err)
+	assert.True(t, weekend.Contains(at(1, 3, 0)))
+	assert.True(t, weekend.Contains(at(2, 3, 0)))
+	assert.False(t, weekend.Contains(at(3, 3, 0)))
+
+	// Past midnight, the window belongs to the day it started on
+	overnight, err := mssql.ParseWindow("sun 23:00-01:00")
+	require.NoError(t, err)
+	assert.True(t, overnight.Contains(at(2, 23, 30)))
+	assert.True(t, overnight.Contains(at(3, 0, 30)))
+	assert.False(t, overnight.Contains(at(2, 0, 30)))
+	assert.False(t, overnight.Contains(at(3, 23, 30)))
+}
+
+func TestWindowNextStart(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.Local)
+	}
+	daily, err := mssql.ParseWindow("02:00-04:00")
+	require.NoError(t, err)
+	assert.Equal(t, at(3, 2, 0), daily.NextStart(at(3, 1, 0)))
+	// Inside the window, or at its start, it is the next day's
+	assert.Equal(t, at(4, 2, 0), daily.NextStart(at(3, 2, 0)))
+	assert.Equal(t, at(4, 2, 0), daily.NextStart(at(3, 3, 0)))
+
+	weekend, err := mssql.ParseWindow("Sat,Sun 02:00-04:00")
+	require.NoError(t, err)
+	assert.Equal(t, at(2, 2, 0), weekend.NextStart(at(1, 3, 0)))
+	assert.Equal(t, at(8, 2, 0), weekend.NextStart(at(3, 0, 0)))
+
+	saturday, err := mssql.ParseWindow("sat 23:00-01:00")
+	require.NoError(t, err)
+	assert.Equal(t, at(8, 23, 0), saturday.NextStart(at(1, 23, 30)))
+}
+
+func TestNextRun(t *testing.T) {
+	store := &mssql.MSSQL{}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	next, ok := store.NextRun(config.DatabaseConfig{ConnectionString: "mssql://localhost:1433?restart=window&window=02:00-04:00"}, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 2, 2, 0, 0, 0, time.Local), next)
+
+	for _, connectionString := range []string{"mssql://localhost:1433?restart=immediate", "mssql://localhost:1433?restart=deferred", "mssql://localhost:1433"} {
+		_, ok := store.NextRun(config.DatabaseConfig{ConnectionString: connectionString}, now)
+		assert.False(t, ok, connectionString)
+	}
+}
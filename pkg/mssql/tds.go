@@ -0,0 +1,195 @@
+package mssql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// Before TDS 8.0, SQL Server doesn't start a connection with TLS. The client sends a PRELOGIN message saying
+// it wants encryption, and the TLS handshake is then carried inside PRELOGIN packets. This is just enough of
+// TDS to get to the server's certificate.
+
+// Packet types and status
+const (
+	tdsPrelogin  = 0x12
+	tdsReply     = 0x04
+	tdsEOM       = 0x01
+	tdsHeaderLen = 8
+	// The packet size before the client and server agree on one
+	tdsMaxPacket = 4096
+)
+
+// PRELOGIN options
+const (
+	preloginVersion    = 0x00
+	preloginEncryption = 0x01
+	preloginInstOpt    = 0x02
+	preloginThreadID   = 0x03
+	preloginMARS       = 0x04
+	preloginTerminator = 0xFF
+)
+
+// Values of the encryption option
+const (
+	encryptOff    = 0x00
+	encryptOn     = 0x01
+	encryptNotSup = 0x02
+	encryptReq    = 0x03
+)
+
+// Write a message as TDS packets
+func writeTDS(w io.Writer, packetType byte, payload []byte) error {
+	var packetID byte
+	for {
+		n := len(payload)
+		if n > tdsMaxPacket-tdsHeaderLen {
+			n = tdsMaxPacket - tdsHeaderLen
+		}
+		packetID++
+		var status byte
+		if n == len(payload) {
+			status = tdsEOM
+		}
+		header := []byte{packetType, status, 0, 0, 0, 0, packetID, 0}
+		binary.BigEndian.PutUint16(header[2:4], uint16(tdsHeaderLen+n))
+		if _, err := w.Write(append(header, payload[:n]...)); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if status == tdsEOM {
+			return nil
+		}
+	}
+}
+
+// Read a message made of one or more TDS packets
+func readTDS(r io.Reader) (byte, []byte, error) {
+	var payload []byte
+	for {
+		var header [tdsHeaderLen]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < tdsHeaderLen {
+			return 0, nil, fmt.Errorf("invalid TDS packet length %d", length)
+		}
+		data := make([]byte, length-tdsHeaderLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, nil, err
+		}
+		payload = append(payload, data...)
+		if header[1]&tdsEOM != 0 {
+			return header[0], payload, nil
+		}
+	}
+}
+
+// A PRELOGIN message is a list of (option, offset, length) followed by the options' values
+func encodePrelogin(options map[byte][]byte) []byte {
+	var tokens []int
+	for token := range options {
+		tokens = append(tokens, int(token))
+	}
+	sort.Ints(tokens)
+	offset := 5*len(tokens) + 1
+	var list, data []byte
+	for _, token := range tokens {
+		value := options[byte(token)]
+		list = append(list, byte(token), byte(offset>>8), byte(offset), byte(len(value)>>8), byte(len(value)))
+		data = append(data, value...)
+		offset += len(value)
+	}
+	return append(append(list, preloginTerminator), data...)
+}
+
+func decodePrelogin(payload []byte) (map[byte][]byte, error) {
+	options := make(map[byte][]byte)
+	for i := 0; ; i += 5 {
+		if i >= len(payload) {
+			return nil, errors.New("PRELOGIN message has no terminator")
+		}
+		if payload[i] == preloginTerminator {
+			return options, nil
+		}
+		if i+5 > len(payload) {
+			return nil, errors.New("PRELOGIN message is truncated")
+		}
+		offset := int(binary.BigEndian.Uint16(payload[i+1:]))
+		length := int(binary.BigEndian.Uint16(payload[i+3:]))
+		if offset+length > len(payload) {
+			return nil, errors.New("PRELOGIN option is out of range")
+		}
+		options[payload[i]] = payload[offset : offset+length]
+	}
+}
+
+// Carries TLS records in PRELOGIN packets. The server's side of the handshake comes the same way.
+type tdsConn struct {
+	net.Conn
+	// What is left of the packet being read
+	remaining int
+}
+
+func (c *tdsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		var header [tdsHeaderLen]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < tdsHeaderLen {
+			return 0, fmt.Errorf("invalid TDS packet length %d", length)
+		}
+		c.remaining = length - tdsHeaderLen
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *tdsConn) Write(b []byte) (int, error) {
+	if err := writeTDS(c.Conn, tdsPrelogin, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// prelogin asks the server for encryption, and returns the connection to do the TLS handshake over. It is a
+// tlscheck.Wrap.
+func prelogin(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	request := encodePrelogin(map[byte][]byte{
+		preloginVersion:    {0, 0, 0, 0, 0, 0},
+		preloginEncryption: {encryptOn},
+		preloginInstOpt:    {0},
+		preloginThreadID:   {0, 0, 0, 0},
+		preloginMARS:       {0},
+	})
+	if err := writeTDS(conn, tdsPrelogin, request); err != nil {
+		return nil, err
+	}
+	packetType, payload, err := readTDS(conn)
+	if err != nil {
+		return nil, err
+	}
+	if packetType != tdsReply {
+		return nil, fmt.Errorf("unexpected TDS packet type %#x in reply to PRELOGIN", packetType)
+	}
+	options, err := decodePrelogin(payload)
+	if err != nil {
+		return nil, err
+	}
+	encryption := options[preloginEncryption]
+	if len(encryption) != 1 || encryption[0] == encryptNotSup {
+		return nil, errors.New("the server doesn't support encryption, so it has no certificate")
+	}
+	return &tdsConn{Conn: conn}, nil
+}
@@ -0,0 +1,650 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/credfiles"
+	"github.com/dfeldman/spiffelink/pkg/credformat"
+	"github.com/dfeldman/spiffelink/pkg/secret"
+	"github.com/dfeldman/spiffelink/pkg/shell"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/tlscheck"
+)
+
+// The redis datastore rotates the TLS certificate of Redis 6 or later without a restart. Redis loads new TLS
+// files when tls-cert-file, tls-key-file or tls-ca-cert-file is changed with CONFIG SET. Like the kafka
+// datastore, each rotation writes the credentials to new files named after their fingerprint, and points
+// Redis at them, so Undo only has to point Redis back at the files it used before. Once Redis uses the new
+// files, the old ones are removed. Post checks that a new TLS connection gets the new certificate.
+//
+// Redis 7 takes all the parameters in one CONFIG SET and checks them together. Redis 6 takes one parameter at
+// a time, and reloads the certificate and key after each, so it refuses a certificate whose key isn't loaded
+// yet. For Redis 6, the new certificate and key files first get a copy of the ones Redis is using, Redis is
+// pointed at them, and then they are overwritten with the new credentials and Redis is told to reload them.
+//
+// The connection string is the address redis-cli connects to, with rediss:// if Redis only accepts TLS,
+// followed by options:
+//
+//	rediss://localhost:6379?dir=/etc/redis/tls&user=spiffelink&password=${env:REDIS_PASSWORD}&cacert=/etc/redis/tls/admin-ca.crt&cert=/etc/redis/tls/admin.crt&key=/etc/redis/tls/admin.key
+//
+//	dir         the directory the certificate, key and CA bundle are written to (required)
+//	user        the ACL user redis-cli authenticates as
+//	password    its password, preferably a secret reference
+//	cacert      with rediss, the CA bundle redis-cli verifies Redis with
+//	cert, key   with rediss, the client certificate redis-cli presents, if Redis asks for one
+//	rewrite     true to save the new settings to redis.conf with CONFIG REWRITE
+//	tlsAddress  where Redis accepts TLS, for the handshake Post does. Required with redis://, and the same
+//	            address by default with rediss://.
+//	bin         the directory redis-cli is in, if it isn't in one of DefaultBinDirs
+
+// Where redis-cli is looked for if the connection string doesn't say
+var DefaultBinDirs = []string{"/usr/bin", "/usr/local/bin", "/opt/redis/bin"}
+
+// How long one redis-cli command may take
+const commandTimeout = 30 * time.Second
+
+// How long Redis gets to present the new certificate, and how often Post checks
+const (
+	handshakeTimeout  = 30 * time.Second
+	handshakeInterval = time.Second
+)
+
+// State keys
+const (
+	// The TLS parameters before the rotation
+	previousConfigKey = "redis.previous"
+	// The files that didn't exist before the rotation, so Undo removes them
+	createdFilesKey = "redis.created"
+	// The backups of the files Redis used before the rotation, so Undo can put them back after they are
+	// removed
+	oldFilesKey = "redis.old"
+)
+
+// The parameters this datastore sets
+const (
+	paramCert = "tls-cert-file"
+	paramKey  = "tls-key-file"
+	paramCA   = "tls-ca-cert-file"
+)
+
+var params = []string{paramCert, paramKey, paramCA}
+
+// Names of the versioned files this datastore writes
+var versionedFile = regexp.MustCompile(`^(redis|ca)-[0-9a-f]{16}\.(crt|key)$`)
+
+type Redis struct {
+}
+
+func (*Redis) GetName() string {
+	return "redis"
+}
+
+// Options are parsed from the connection string.
+type Options struct {
+	// host:port for redis-cli
+	Address    string
+	TLS        bool
+	User       string
+	Password   string
+	CACert     string
+	Cert       string
+	Key        string
+	Dir        string
+	Rewrite    bool
+	TLSAddress string
+	BinDir     string
+}
+
+// ParseOptions parses a redis connection string.
+func ParseOptions(connectionString string) (Options, error) {
+	var opts Options
+	address, query, _ := strings.Cut(connectionString, "?")
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, err
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return opts, fmt.Errorf("the connection string must look like redis://host:port?dir=... or rediss://host:port?dir=...")
+	}
+	opts.Address, opts.TLS = u.Host, u.Scheme == "rediss"
+	if u.Port() == "" {
+		opts.Address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" {
+			return opts, fmt.Errorf("option %s must have a single value", name)
+		}
+		v := value[0]
+		switch name {
+		case "dir":
+			if !path.IsAbs(v) {
+				return opts, fmt.Errorf("dir must be an absolute path")
+			}
+			opts.Dir = path.Clean(v)
+		case "user":
+			opts.User = v
+		case "password":
+			opts.Password = v
+		case "cacert":
+			opts.CACert = v
+		case "cert":
+			opts.Cert = v
+		case "key":
+			opts.Key = v
+		case "rewrite":
+			if v != "true" && v != "false" {
+				return opts, fmt.Errorf("rewrite must be true or false")
+			}
+			opts.Rewrite = v == "true"
+		case "tlsAddress":
+			if _, _, err := net.SplitHostPort(v); err != nil {
+				return opts, fmt.Errorf("tlsAddress must be a host and port: %w", err)
+			}
+			opts.TLSAddress = v
+		case "bin":
+			opts.BinDir = v
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	switch {
+	case opts.Dir == "":
+		return opts, fmt.Errorf("the dir option is required")
+	case !opts.TLS && (opts.CACert != "" || opts.Cert != "" || opts.Key != ""):
+		return opts, fmt.Errorf("cacert, cert and key are only used with rediss://")
+	case (opts.Cert == "") != (opts.Key == ""):
+		return opts, fmt.Errorf("cert and key must be set together")
+	case opts.TLSAddress == "" && !opts.TLS:
+		return opts, fmt.Errorf("the tlsAddress option is required with redis://")
+	case opts.TLSAddress == "":
+		opts.TLSAddress = opts.Address
+	}
+	return opts, nil
+}
+
+// A file a step writes
+type file struct {
+	path   string
+	format credformat.Format
+}
+
+// Everything a stage needs to work on Redis
+type server struct {
+	opts     Options
+	exe      string
+	password string
+	creds    credformat.Credentials
+	cert     file
+	key      file
+	ca       file
+}
+
+// The file each parameter is set to
+func (s *server) wanted() map[string]string {
+	return map[string]string{paramCert: s.cert.path, paramKey: s.key.path, paramCA: s.ca.path}
+}
+
+// The files the credentials go in, and what goes in each. The key comes first, so a certificate is never on
+// disk without its key.
+func (s *server) files() []credfiles.File {
+	var files []credfiles.File
+	for _, f := range []file{s.key, s.cert, s.ca} {
+		files = append(files, credfiles.File{Path: f.path, Format: f.format, Creds: s.creds})
+	}
+	return files
+}
+
+// The file a version of the credentials is written to. The certificate and key are named after the
+// certificate, so they always go together.
+func versionPath(dir string, prefix string, ext string, f credformat.Format, creds credformat.Credentials) (string, error) {
+	fingerprint, err := credformat.Fingerprint(f, creds)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, fmt.Sprintf("%s-%s.%s", prefix, fingerprint[:16], ext)), nil
+}
+
+// Whether a file is one of the versioned files this datastore writes
+func (o Options) isVersioned(p string) bool {
+	return path.Dir(p) == o.Dir && versionedFile.MatchString(path.Base(p))
+}
+
+func (*Redis) GetUpdateSteps(ctx context.Context, conf config.DatabaseConfig, shellContext shell.ShellContext, update spiffelinkcore.SpiffeLinkUpdate) step.StepList {
+	return step.StepList{
+		DatastoreName: "redis",
+		ID:            "redis",
+		Steps: []step.Step{
+			{
+				Name:              "Write the certificate, key and CA bundle",
+				Id:                "WRITE_FILES",
+				TelemetryID:       "REDIS_WRITE_FILES",
+				CheckDependencies: checkDependencies,
+				Pre:               readConfig,
+				Execute:           writeFiles,
+				Post:              checkFiles,
+				Undo:              removeFiles,
+				// Files that already hold the credentials aren't rewritten
+				Idempotent: true,
+			},
+			{
+				Name:        "Point Redis at the new files",
+				Id:          "SET_TLS_CONFIG",
+				TelemetryID: "REDIS_SET_TLS_CONFIG",
+				Execute:     setConfig,
+				Post:        checkConfig,
+				Undo:        restoreConfig,
+				Idempotent:  true,
+			},
+			{
+				Name:        "Remove the files Redis used before",
+				Id:          "REMOVE_OLD_FILES",
+				TelemetryID: "REDIS_REMOVE_OLD_FILES",
+				Execute:     removeOldFiles,
+				Undo:        restoreOldFiles,
+				Idempotent:  true,
+			},
+		},
+	}
+}
+
+func findRedisCli(ctx context.Context, sfi step.StepFuncInput, opts Options) (string, step.StepFuncOutputMessage) {
+	dirs := DefaultBinDirs
+	if opts.BinDir != "" {
+		dirs = []string{opts.BinDir}
+	}
+	exe, err := sfi.ShellContext.FindExecutable(ctx, dirs, "redis-cli")
+	if err != nil {
+		return "", step.Failed(slerror.ExecutableNotFoundError(sfi.Sl.Logger, "redis-cli", err))
+	}
+	return exe, step.StepFuncOutputMessage{}
+}
+
+func checkDependencies(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	if err := sfi.ShellContext.CheckPathWriteable(ctx, opts.Dir); err != nil {
+		return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+	}
+	_, output := findRedisCli(ctx, sfi, opts)
+	return output
+}
+
+// Parse the options, find redis-cli, resolve the password and work out the files for a stage
+func prepare(ctx context.Context, sfi step.StepFuncInput) (*server, step.StepFuncOutputMessage) {
+	opts, err := ParseOptions(sfi.Dbc.ConnectionString)
+	if err != nil {
+		return nil, step.Failed(slerror.ConnectionStringInvalidError(sfi.Sl.Logger, sfi.Dbc.ConnectionString))
+	}
+	s := &server{opts: opts}
+	var output step.StepFuncOutputMessage
+	if s.exe, output = findRedisCli(ctx, sfi, opts); !output.Errors.Empty() {
+		return nil, output
+	}
+	s.creds, err = credformat.Select(*sfi.Update, sfi.Dbc.SpiffeID)
+	if err != nil {
+		return nil, step.Failed(slerror.SvidNotFoundError(sfi.Sl.Logger, sfi.Dbc.SpiffeID))
+	}
+	if opts.Password != "" {
+		if s.password, err = secret.Resolve(ctx, sfi.Sl.Logger, opts.Password); err != nil {
+			return nil, step.Failed(err)
+		}
+	}
+	s.cert.format, s.key.format, s.ca.format = credformat.PEMChain, credformat.PEMKey, credformat.PEMBundle
+	if s.cert.path, err = versionPath(opts.Dir, "redis", "crt", credformat.PEMChain, s.creds); err == nil {
+		if s.ca.path, err = versionPath(opts.Dir, "ca", "crt", credformat.PEMBundle, s.creds); err == nil {
+			s.key.path = strings.TrimSuffix(s.cert.path, ".crt") + ".key"
+		}
+	}
+	if err != nil {
+		return nil, step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, opts.Dir, err))
+	}
+	return s, step.StepFuncOutputMessage{}
+}
+
+// The arguments to redis-cli, followed by the command. The password isn't one of them, since anyone on the
+// host can see the arguments with ps.
+func (s *server) args(command ...string) []string {
+	host, port, _ := net.SplitHostPort(s.opts.Address)
+	args := []string{"-h", host, "-p", port}
+	if s.opts.User != "" {
+		args = append(args, "--user", s.opts.User)
+	}
+	if s.opts.TLS {
+		args = append(args, "--tls")
+		for _, flag := range []struct{ name, value string }{{"--cacert", s.opts.CACert}, {"--cert", s.opts.Cert}, {"--key", s.opts.Key}} {
+			if flag.value != "" {
+				args = append(args, flag.name, flag.value)
+			}
+		}
+	}
+	return append(args, command...)
+}
+
+// redis-cli's environment, which has the password
+func (s *server) environ() []string {
+	if s.password == "" {
+		return nil
+	}
+	return []string{"REDISCLI_AUTH=" + s.password}
+}
+
+// Run a command with redis-cli. Depending on its version, redis-cli may exit successfully when Redis replies
+// with an error, so the reply is checked too.
+func (s *server) run(ctx context.Context, sfi step.StepFuncInput, command ...string) (string, step.StepFuncOutputMessage) {
+	output, err := sfi.ShellContext.RunCmd(ctx, s.exe, s.args(command...), s.environ(), commandTimeout)
+	if err == nil && isError(output) {
+		err = errors.New(strings.TrimSpace(output))
+	}
+	if err != nil {
+		return "", step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "redis-cli "+command[0]+" "+command[1], err))
+	}
+	return output, step.StepFuncOutputMessage{}
+}
+
+func isError(reply string) bool {
+	reply = strings.TrimPrefix(strings.TrimSpace(reply), "(error) ")
+	return strings.HasPrefix(reply, "ERR") || strings.HasPrefix(reply, "NOAUTH") || strings.HasPrefix(reply, "NOPERM") ||
+		strings.HasPrefix(reply, "WRONGPASS")
+}
+
+// The TLS parameters. redis-cli prints the name and value of each on their own line.
+func (s *server) config(ctx context.Context, sfi step.StepFuncInput) (map[string]string, step.StepFuncOutputMessage) {
+	output, out := s.run(ctx, sfi, "CONFIG", "GET", "tls-*")
+	if !out.Errors.Empty() {
+		return nil, out
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	configs := make(map[string]string)
+	for i := 0; i+1 < len(lines); i += 2 {
+		configs[lines[i]] = lines[i+1]
+	}
+	return configs, step.StepFuncOutputMessage{}
+}
+
+// The major version of Redis, from INFO server
+func (s *server) version(ctx context.Context, sfi step.StepFuncInput) (int, step.StepFuncOutputMessage) {
+	output, out := s.run(ctx, sfi, "INFO", "server")
+	if !out.Errors.Empty() {
+		return 0, out
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "redis_version:") {
+			major, _, _ := strings.Cut(strings.TrimPrefix(line, "redis_version:"), ".")
+			if n, err := strconv.Atoi(major); err == nil {
+				return n, step.StepFuncOutputMessage{}
+			}
+		}
+	}
+	return 0, step.Failed(slerror.CommandFailedError(sfi.Sl.Logger, "redis-cli INFO server", errors.New("the reply has no redis_version")))
+}
+
+func (s *server) set(ctx context.Context, sfi step.StepFuncInput, pairs ...string) step.StepFuncOutputMessage {
+	_, output := s.run(ctx, sfi, append([]string{"CONFIG", "SET"}, pairs...)...)
+	return output
+}
+
+// Point Redis at the target files, which must already hold what Redis should load. current is what Redis
+// uses now.
+func (s *server) switchFiles(ctx context.Context, sfi step.StepFuncInput, current map[string]string, target map[string]string) step.StepFuncOutputMessage {
+	var pairs []string
+	for _, name := range params {
+		if current[name] != target[name] {
+			pairs = append(pairs, name, target[name])
+		}
+	}
+	if len(pairs) == 0 {
+		return step.StepFuncOutputMessage{}
+	}
+	major, output := s.version(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	if major >= 7 || len(pairs) == 2 {
+		output = s.set(ctx, sfi, pairs...)
+	} else {
+		output = s.switchFilesOneByOne(ctx, sfi, current, target)
+	}
+	if !output.Errors.Empty() {
+		return output
+	}
+	if s.opts.Rewrite {
+		_, output = s.run(ctx, sfi, "CONFIG", "REWRITE")
+	}
+	return output
+}
+
+// Redis 6 checks the certificate against the key after each CONFIG SET. The target files are given a copy of
+// the current ones, so each CONFIG SET leaves a matching pair, and then their own contents are put back and
+// reloaded by setting tls-cert-file again.
+func (s *server) switchFilesOneByOne(ctx context.Context, sfi step.StepFuncInput, current map[string]string, target map[string]string) step.StepFuncOutputMessage {
+	if current[paramCA] != target[paramCA] {
+		if output := s.set(ctx, sfi, paramCA, target[paramCA]); !output.Errors.Empty() {
+			return output
+		}
+	}
+	if current[paramCert] == target[paramCert] && current[paramKey] == target[paramKey] {
+		return step.StepFuncOutputMessage{}
+	}
+	if current[paramCert] == "" || target[paramCert] == "" {
+		// TLS isn't set up on one side, so Redis doesn't load the pair until both are set
+		order := []string{paramKey, paramCert}
+		if target[paramCert] == "" {
+			order = []string{paramCert, paramKey}
+		}
+		for _, name := range order {
+			if output := s.set(ctx, sfi, name, target[name]); !output.Errors.Empty() {
+				return output
+			}
+		}
+		return step.StepFuncOutputMessage{}
+	}
+	staged := []struct {
+		f        file
+		from     string
+		contents []byte
+	}{
+		// The key first, so a certificate is never on disk without its key
+		{f: file{path: target[paramKey], format: credformat.PEMKey}, from: current[paramKey]},
+		{f: file{path: target[paramCert], format: credformat.PEMChain}, from: current[paramCert]},
+	}
+	for i := range staged {
+		var err error
+		if staged[i].contents, err = sfi.ShellContext.ReadFile(ctx, staged[i].f.path); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, staged[i].f.path, err))
+		}
+		using, err := sfi.ShellContext.ReadFile(ctx, staged[i].from)
+		if err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, staged[i].from, err))
+		}
+		if err := sfi.ShellContext.WriteFile(ctx, staged[i].f.path, using, staged[i].f.format.Perm()); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, staged[i].f.path, err))
+		}
+	}
+	for _, name := range []string{paramCert, paramKey} {
+		if output := s.set(ctx, sfi, name, target[name]); !output.Errors.Empty() {
+			return output
+		}
+	}
+	for _, st := range staged {
+		if err := sfi.ShellContext.WriteFile(ctx, st.f.path, st.contents, st.f.format.Perm()); err != nil {
+			return step.Failed(slerror.CredentialWriteFailedError(sfi.Sl.Logger, st.f.path, err))
+		}
+	}
+	return s.set(ctx, sfi, paramCert, target[paramCert])
+}
+
+// Save the TLS parameters as they are now
+func readConfig(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := s.config(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	previous := make(map[string]string)
+	for _, name := range params {
+		previous[name] = configs[name]
+	}
+	if err := step.Put(sfi.State, previousConfigKey, previous); err != nil {
+		return step.Failed(err)
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// The versioned files are new unless Redis already has these credentials, so only the files that don't exist
+// yet are recorded, for Undo to remove. Files that were already there are left for whatever uses them.
+func writeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	files := s.files()
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	if output := credfiles.SaveNew(ctx, sfi, createdFilesKey, paths); !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Write(ctx, sfi, files)
+}
+
+func checkFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	return credfiles.Check(ctx, sfi, s.files())
+}
+
+func removeFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, createdFilesKey)
+	return output
+}
+
+func setConfig(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := s.config(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	sfi.Logger.Infof("Pointing Redis at %s at %s", s.opts.Address, s.cert.path)
+	return s.switchFiles(ctx, sfi, configs, s.wanted())
+}
+
+// Check that Redis reports the new files, and presents the new certificate to new connections
+func checkConfig(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := s.config(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	for name, value := range s.wanted() {
+		if configs[name] != value {
+			return step.Failed(slerror.RedisConfigNotAppliedError(sfi.Sl.Logger, s.opts.Address, name, value))
+		}
+	}
+	leaf := s.creds.SVID.Certificates[0]
+	// Redis may ask for a client certificate, and the SVID is one it now trusts
+	clientCert := &tls.Certificate{PrivateKey: s.creds.SVID.PrivateKey, Leaf: leaf}
+	for _, cert := range s.creds.SVID.Certificates {
+		clientCert.Certificate = append(clientCert.Certificate, cert.Raw)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	err := tlscheck.WaitFor(waitCtx, s.opts.TLSAddress, tlscheck.Options{ClientCertificate: clientCert}, leaf, handshakeInterval)
+	if err != nil {
+		return step.Failed(slerror.TLSCertificateNotServedError(sfi.Sl.Logger, s.opts.TLSAddress, leaf.SerialNumber.String(), err))
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+// Point Redis back at the files Pre found it using
+func restoreConfig(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	previous, ok := step.Get[map[string]string](sfi.State, previousConfigKey)
+	if !ok {
+		return step.StepFuncOutputMessage{}
+	}
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	configs, output := s.config(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	sfi.Logger.Infof("Pointing Redis at %s back at %s", s.opts.Address, previous[paramCert])
+	return s.switchFiles(ctx, sfi, configs, previous)
+}
+
+// Remove the versioned files Redis used before, other than the new ones, after copying them so Undo can put
+// them back. The rotation has already succeeded, so a file that can't be removed is only logged.
+func removeOldFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	s, output := prepare(ctx, sfi)
+	if !output.Errors.Empty() {
+		return output
+	}
+	previous, _ := step.Get[map[string]string](sfi.State, previousConfigKey)
+	wanted := s.wanted()
+	var targets []credfiles.Target
+	for _, name := range params {
+		p := previous[name]
+		if !s.opts.isVersioned(p) || p == wanted[name] {
+			continue
+		}
+		// The copy is named after the kind of file rather than its version, so the next rotation replaces it
+		// instead of adding another
+		m := versionedFile.FindStringSubmatch(path.Base(p))
+		perm := credformat.PEMChain.Perm()
+		if name == paramKey {
+			perm = credformat.PEMKey.Perm()
+		}
+		targets = append(targets, credfiles.Target{Path: p, Perm: perm, Copy: path.Join(s.opts.Dir, m[1]+"."+m[2]+credfiles.BackupSuffix)})
+	}
+	if output := credfiles.Save(ctx, sfi, oldFilesKey, targets); !output.Errors.Empty() {
+		return output
+	}
+	backups, _ := credfiles.Saved(sfi, oldFilesKey)
+	for _, backup := range backups {
+		if !backup.Existed() {
+			continue
+		}
+		if err := sfi.ShellContext.RemoveFile(ctx, backup.Path); err != nil {
+			sfi.Logger.Warnf("Unable to remove the old file %s: %v", backup.Path, err)
+		}
+	}
+	return step.StepFuncOutputMessage{}
+}
+
+func restoreOldFiles(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	_, output := credfiles.Restore(ctx, sfi, oldFilesKey)
+	return output
+}
@@ -0,0 +1,124 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dfeldman/spiffelink/pkg/redact"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+)
+
+// The secret package lets configuration values refer to secrets instead of containing them.
+// A reference looks like ${provider:ref}, for example:
+//   oracle://user:${env:ORACLE_PASSWORD}@localhost/db1
+//   postgres://user:${file:/run/secrets/pg}@localhost/db2
+// References are validated when the config file is parsed, but they are only resolved by the
+// steps that actually need the secret, so the plain text value never sits in Config.
+// Every resolved value is registered with the redact package so it can't leak into logs.
+
+// Provider looks up the value of a secret reference. The ref is everything after "provider:".
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ProviderFunc adapts a function to the Provider interface.
+type ProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f ProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var referencePattern = regexp.MustCompile(`\$\{([a-zA-Z0-9_-]+):([^}]+)\}`)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{
+		"env":  ProviderFunc(resolveEnv),
+		"file": ProviderFunc(resolveFile),
+	}
+)
+
+// RegisterProvider makes a secret provider available under the given name, replacing any
+// existing provider with that name. This is how external secret stores are plugged in.
+func RegisterProvider(name string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+func getProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// HasReferences reports whether s contains at least one secret reference.
+func HasReferences(s string) bool {
+	return referencePattern.MatchString(s)
+}
+
+// Validate checks that every reference in s is well-formed and uses a known provider,
+// without resolving anything.
+func Validate(log *logrus.Logger, s string) error {
+	// Anything left over after removing valid references must not look like the start of one
+	if strings.Contains(referencePattern.ReplaceAllString(s, ""), "${") {
+		return slerror.SecretReferenceInvalidError(log, s)
+	}
+	for _, match := range referencePattern.FindAllStringSubmatch(s, -1) {
+		if _, ok := getProvider(match[1]); !ok {
+			return slerror.SecretProviderUnknownError(log, match[0], match[1])
+		}
+	}
+	return nil
+}
+
+// Resolve replaces every secret reference in s with the secret it refers to.
+// Strings without references are returned unchanged.
+func Resolve(ctx context.Context, log *logrus.Logger, s string) (string, error) {
+	if err := Validate(log, s); err != nil {
+		return "", err
+	}
+
+	var resolveErr error
+	resolved := referencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if resolveErr != nil {
+			return ref
+		}
+		match := referencePattern.FindStringSubmatch(ref)
+		provider, _ := getProvider(match[1])
+		value, err := provider.Resolve(ctx, match[2])
+		if err != nil {
+			resolveErr = slerror.SecretResolutionFailedError(log, ref, err)
+			return ref
+		}
+		redact.AddSecret(value)
+		return value
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+func resolveEnv(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+func resolveFile(ctx context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	// Files written by secret managers usually end with a newline that isn't part of the secret
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,250 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dfeldman/spiffelink/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// RecordingShellContext wraps another ShellContext and appends every call, with its arguments and results, to a
+// file as one JSON Record per line. A session recorded against a real database can then be served back by a
+// ReplayShellContext, so the bug it shows becomes a unit test that doesn't need the database.
+//
+// Recordings are meant to be shared, so nothing secret goes in them. Command arguments, environment values,
+// output and file contents are redacted like log messages, and private keys in PEM are replaced. Binary
+// files, like keystores, are left out entirely, and only their digest is kept.
+type RecordingShellContext struct {
+	inner   ShellContext
+	path    string
+	session string
+	logger  *logrus.Logger
+
+	mu     sync.Mutex
+	seq    int
+	failed bool
+}
+
+// Record is one call in a recording.
+type Record struct {
+	// Every ShellContext recorded into the same file has its own session, which is what is replayed
+	Session string `json:"session"`
+	Seq     int    `json:"seq"`
+	Method  string `json:"method"`
+	// The file or executable the call was for. For FindExecutable this is the name looked for.
+	Path    string        `json:"path,omitempty"`
+	Paths   []string      `json:"paths,omitempty"`
+	Args    []string      `json:"args,omitempty"`
+	Environ []string      `json:"environ,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Perm    fs.FileMode   `json:"perm,omitempty"`
+	// The data written by WriteFile or returned by ReadFile. DataOmitted is set when it wasn't safe to keep.
+	Data        string `json:"data,omitempty"`
+	DataOmitted bool   `json:"dataOmitted,omitempty"`
+	// The SHA-256 of the real data, before redaction
+	Digest string `json:"digest,omitempty"`
+	// The output of RunCmd, or the path found by FindExecutable
+	Output string         `json:"output,omitempty"`
+	Found  []string       `json:"found,omitempty"`
+	Err    *RecordedError `json:"error,omitempty"`
+}
+
+// RecordedError is an error returned by a recorded call.
+type RecordedError struct {
+	Message string `json:"message"`
+	// The file didn't exist, so the replayed error wraps fs.ErrNotExist
+	NotExist bool `json:"notExist,omitempty"`
+}
+
+// Method names, as used in Record
+const (
+	MethodFindExecutable     = "FindExecutable"
+	MethodCheckExecutable    = "CheckExecutable"
+	MethodFindPaths          = "FindPaths"
+	MethodRunCmd             = "RunCmd"
+	MethodCheckPathWriteable = "CheckPathWriteable"
+	MethodReadFile           = "ReadFile"
+	MethodWriteFile          = "WriteFile"
+	MethodRemoveFile         = "RemoveFile"
+)
+
+// Replaces a private key in PEM, whatever kind it is
+var privateKeyPEM = regexp.MustCompile(`(?s)-----BEGIN ([A-Z0-9 ]*PRIVATE KEY)-----.*?-----END ([A-Z0-9 ]*PRIVATE KEY)-----`)
+
+// Environment variables whose names contain one of these have their values left out
+var secretEnvNames = []string{"PASS", "PWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "AUTH"}
+
+// Sessions recorded by this process, so two shells created in the same instant get different sessions
+var sessionCounter uint64
+
+// NewRecordingShellContext records the calls made to inner by appending them to the file at path, which is
+// created if it doesn't exist. A recording that can't be written is logged, and doesn't fail the calls.
+func NewRecordingShellContext(inner ShellContext, path string, logger *logrus.Logger) *RecordingShellContext {
+	session := fmt.Sprintf("%s-%d-%d", time.Now().UTC().Format("20060102T150405.000"), os.Getpid(), atomic.AddUint64(&sessionCounter, 1))
+	return &RecordingShellContext{
+		inner:   inner,
+		path:    path,
+		session: session,
+		logger:  logger,
+	}
+}
+
+// Session returns the session the calls are recorded under.
+func (rsc *RecordingShellContext) Session() string {
+	return rsc.session
+}
+
+// Append a call to the file. The file is opened for each call, since a ShellContext has no Close, and a
+// single write keeps lines from different sessions apart.
+func (rsc *RecordingShellContext) record(rec Record, err error) {
+	if err != nil {
+		rec.Err = &RecordedError{Message: redact.String(err.Error()), NotExist: errors.Is(err, fs.ErrNotExist)}
+	}
+	rsc.mu.Lock()
+	defer rsc.mu.Unlock()
+	rsc.seq++
+	rec.Session = rsc.session
+	rec.Seq = rsc.seq
+	line, marshalErr := json.Marshal(rec)
+	if marshalErr == nil {
+		marshalErr = appendLine(rsc.path, append(line, '\n'))
+	}
+	// Only the first failure is logged, so a broken recording doesn't flood the log
+	if marshalErr != nil && !rsc.failed {
+		rsc.failed = true
+		rsc.logger.Warnf("Unable to record shell calls to %s: %v", rsc.path, marshalErr)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Fill in the data fields of a record, leaving out anything secret
+func recordData(rec *Record, data []byte) {
+	sum := sha256.Sum256(data)
+	rec.Digest = hex.EncodeToString(sum[:])
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		rec.DataOmitted = true
+		return
+	}
+	rec.Data = redactText(string(data))
+}
+
+func redactArgs(args []string) []string {
+	if args == nil {
+		return nil
+	}
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redact.String(arg)
+	}
+	return redacted
+}
+
+func redactEnviron(environ []string) []string {
+	if environ == nil {
+		return nil
+	}
+	redacted := make([]string, len(environ))
+	for i, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+		upper := strings.ToUpper(name)
+		for _, secret := range secretEnvNames {
+			if strings.Contains(upper, secret) {
+				value = redact.Placeholder
+				break
+			}
+		}
+		redacted[i] = name + "=" + redact.String(value)
+	}
+	return redacted
+}
+
+// Private keys are replaced as well as the usual secrets, since files and command output can hold them
+func redactText(s string) string {
+	return redact.String(privateKeyPEM.ReplaceAllString(s, "-----BEGIN $1-----\n"+redact.Placeholder+"\n-----END $2-----"))
+}
+
+func (rsc *RecordingShellContext) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
+	path, err := rsc.inner.FindExecutable(ctx, paths, name)
+	rsc.record(Record{Method: MethodFindExecutable, Path: name, Paths: paths, Output: path}, err)
+	return path, err
+}
+
+func (rsc *RecordingShellContext) CheckExecutable(ctx context.Context, execPath string) error {
+	err := rsc.inner.CheckExecutable(ctx, execPath)
+	rsc.record(Record{Method: MethodCheckExecutable, Path: execPath}, err)
+	return err
+}
+
+func (rsc *RecordingShellContext) FindPaths(ctx context.Context, paths []string) ([]string, error) {
+	found, err := rsc.inner.FindPaths(ctx, paths)
+	rsc.record(Record{Method: MethodFindPaths, Paths: paths, Found: found}, err)
+	return found, err
+}
+
+func (rsc *RecordingShellContext) RunCmd(ctx context.Context, path string, args []string, environ []string, timeout time.Duration) (string, error) {
+	output, err := rsc.inner.RunCmd(ctx, path, args, environ, timeout)
+	rsc.record(Record{
+		Method:  MethodRunCmd,
+		Path:    path,
+		Args:    redactArgs(args),
+		Environ: redactEnviron(environ),
+		Timeout: timeout,
+		Output:  redactText(output),
+	}, err)
+	return output, err
+}
+
+func (rsc *RecordingShellContext) CheckPathWriteable(ctx context.Context, path string) error {
+	err := rsc.inner.CheckPathWriteable(ctx, path)
+	rsc.record(Record{Method: MethodCheckPathWriteable, Path: path}, err)
+	return err
+}
+
+func (rsc *RecordingShellContext) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	data, err := rsc.inner.ReadFile(ctx, path)
+	rec := Record{Method: MethodReadFile, Path: path}
+	if err == nil {
+		recordData(&rec, data)
+	}
+	rsc.record(rec, err)
+	return data, err
+}
+
+func (rsc *RecordingShellContext) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	err := rsc.inner.WriteFile(ctx, path, data, perm)
+	rec := Record{Method: MethodWriteFile, Path: path, Perm: perm}
+	recordData(&rec, data)
+	rsc.record(rec, err)
+	return err
+}
+
+func (rsc *RecordingShellContext) RemoveFile(ctx context.Context, path string) error {
+	err := rsc.inner.RemoveFile(ctx, path)
+	rsc.record(Record{Method: MethodRemoveFile, Path: path}, err)
+	return err
+}
@@ -0,0 +1,275 @@
+package shell
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/redact"
+)
+
+// ReplayShellContext serves the results of a recorded session back, without touching the system, so a run
+// that was recorded with RecordingShellContext can be repeated in a test.
+//
+// Each call is matched to the first call in the recording, not yet used, with the same method, path and
+// redacted arguments. Calls may come in a different order, as they do when steps run in parallel. The data
+// written by WriteFile isn't compared, since the test's SVID is not the one that was recorded. When the
+// recording has a ReadFile of a file the session wrote, the data written in the replay is returned instead,
+// so a Post stage that reads back what Execute wrote still passes.
+//
+// A call that isn't in the recording fails with ErrNotRecorded. Unexpected and Unused tell the test how the
+// replay differed from the recording.
+type ReplayShellContext struct {
+	// MatchArgs decides whether the arguments of a RunCmd match a recorded call. The recorded arguments are
+	// redacted, and so are the ones given. The default requires them to be equal, which fails for arguments
+	// that depend on the SVID, like a serial number.
+	MatchArgs func(recorded []string, actual []string) bool
+
+	mu         sync.Mutex
+	calls      []Record
+	used       []bool
+	unexpected []Record
+	// What the replay wrote to each file, with the digest of what the recorded session wrote there
+	written map[string]replayedWrite
+}
+
+type replayedWrite struct {
+	recordedDigest string
+	data           []byte
+}
+
+// ErrNotRecorded is returned for a call that isn't in the recording.
+var ErrNotRecorded = errors.New("call not in the recording")
+
+// Session is the calls made through one RecordingShellContext, in order.
+type Session struct {
+	ID    string
+	Calls []Record
+}
+
+// LoadRecording reads the sessions in a recording file.
+func LoadRecording(path string) ([]Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+// ReadRecording reads the sessions in a recording, in the order they start.
+func ReadRecording(r io.Reader) ([]Session, error) {
+	var sessions []Session
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	// File contents can make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		i, ok := index[rec.Session]
+		if !ok {
+			i = len(sessions)
+			index[rec.Session] = i
+			sessions = append(sessions, Session{ID: rec.Session})
+		}
+		sessions[i].Calls = append(sessions[i].Calls, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// NewReplayShellContext replays a recorded session.
+func NewReplayShellContext(session Session) *ReplayShellContext {
+	return &ReplayShellContext{
+		MatchArgs: equalArgs,
+		calls:     session.Calls,
+		used:      make([]bool, len(session.Calls)),
+		written:   make(map[string]replayedWrite),
+	}
+}
+
+// Empty lists are left out of the recording, so nil and empty are the same
+func equalArgs(recorded []string, actual []string) bool {
+	if len(recorded) != len(actual) {
+		return false
+	}
+	for i := range recorded {
+		if recorded[i] != actual[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Unexpected returns the calls that weren't in the recording.
+func (r *ReplayShellContext) Unexpected() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Record(nil), r.unexpected...)
+}
+
+// Unused returns the recorded calls that haven't been made.
+func (r *ReplayShellContext) Unused() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []Record
+	for i, rec := range r.calls {
+		if !r.used[i] {
+			unused = append(unused, rec)
+		}
+	}
+	return unused
+}
+
+// Find the recorded call for a call, and mark it used. Must be called with mu held.
+func (r *ReplayShellContext) match(call Record) (Record, error) {
+	for i, rec := range r.calls {
+		if r.used[i] || rec.Method != call.Method || rec.Path != call.Path || !equalArgs(rec.Paths, call.Paths) {
+			continue
+		}
+		if call.Method == MethodRunCmd && !r.MatchArgs(rec.Args, call.Args) {
+			continue
+		}
+		r.used[i] = true
+		return rec, nil
+	}
+	r.unexpected = append(r.unexpected, call)
+	return Record{}, fmt.Errorf("%s %s: %w", call.Method, call.Path, ErrNotRecorded)
+}
+
+func (r *ReplayShellContext) replay(ctx context.Context, call Record) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.match(call)
+}
+
+// The error a recorded call returned
+func (rec Record) error() error {
+	if rec.Err == nil {
+		return nil
+	}
+	if rec.Err.NotExist {
+		return fmt.Errorf("%s: %w", rec.Err.Message, fs.ErrNotExist)
+	}
+	return errors.New(rec.Err.Message)
+}
+
+func (r *ReplayShellContext) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
+	rec, err := r.replay(ctx, Record{Method: MethodFindExecutable, Path: name, Paths: paths})
+	if err != nil {
+		return "", err
+	}
+	return rec.Output, rec.error()
+}
+
+func (r *ReplayShellContext) CheckExecutable(ctx context.Context, execPath string) error {
+	rec, err := r.replay(ctx, Record{Method: MethodCheckExecutable, Path: execPath})
+	if err != nil {
+		return err
+	}
+	return rec.error()
+}
+
+func (r *ReplayShellContext) FindPaths(ctx context.Context, paths []string) ([]string, error) {
+	rec, err := r.replay(ctx, Record{Method: MethodFindPaths, Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+	return rec.Found, rec.error()
+}
+
+func (r *ReplayShellContext) RunCmd(ctx context.Context, path string, args []string, environ []string, timeout time.Duration) (string, error) {
+	rec, err := r.replay(ctx, Record{Method: MethodRunCmd, Path: path, Args: redactArgs(args), Environ: redactEnviron(environ), Timeout: timeout})
+	if err != nil {
+		return "", err
+	}
+	return rec.Output, rec.error()
+}
+
+func (r *ReplayShellContext) CheckPathWriteable(ctx context.Context, path string) error {
+	rec, err := r.replay(ctx, Record{Method: MethodCheckPathWriteable, Path: path})
+	if err != nil {
+		return err
+	}
+	return rec.error()
+}
+
+func (r *ReplayShellContext) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, err := r.match(Record{Method: MethodReadFile, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if rec.Err != nil {
+		return nil, rec.error()
+	}
+	// The recorded session read back what it wrote, so this one does too
+	if w, ok := r.written[path]; ok && w.recordedDigest == rec.Digest {
+		return append([]byte(nil), w.data...), nil
+	}
+	// Redacted contents are returned as they are, which is enough for steps that only back a file up
+	if rec.DataOmitted {
+		return []byte(redact.Placeholder), nil
+	}
+	return []byte(rec.Data), nil
+}
+
+func (r *ReplayShellContext) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sum := sha256.Sum256(data)
+	rec, err := r.match(Record{Method: MethodWriteFile, Path: path, Perm: perm, Digest: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return err
+	}
+	if rec.Err != nil {
+		return rec.error()
+	}
+	r.written[path] = replayedWrite{recordedDigest: rec.Digest, data: append([]byte(nil), data...)}
+	return nil
+}
+
+func (r *ReplayShellContext) RemoveFile(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, err := r.match(Record{Method: MethodRemoveFile, Path: path})
+	if err != nil {
+		return err
+	}
+	if rec.Err == nil {
+		delete(r.written, path)
+	}
+	return rec.error()
+}
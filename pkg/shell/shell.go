@@ -2,6 +2,7 @@ package shell
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/dfeldman/spiffelink/pkg/config"
@@ -30,18 +31,38 @@ type ShellContext interface {
 	FindPaths(ctx context.Context, paths []string) ([]string, error)
 	// Run an executable
 	// The path must be complete as returned by FindExecutable
+	// environ holds variables, as KEY=value, that the command gets on top of the shell's own environment. Secrets
+	// are passed there rather than in args, which anyone on the host can see with ps.
 	RunCmd(ctx context.Context, path string, args []string, environ []string, timeout time.Duration) (string, error)
 	// Check that a path is writeable (for writing the client cert)
 	CheckPathWriteable(ctx context.Context, path string) error
+	// Read a whole file. The error wraps fs.ErrNotExist if the file doesn't exist.
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+	// Write a whole file with the given permissions, replacing it if it exists, so that readers never see
+	// a partly written file. A file that is replaced keeps its owner and group.
+	WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error
+	// Remove a file. Removing a file that doesn't exist is not an error.
+	RemoveFile(ctx context.Context, path string) error
 }
 
+// Every ShellContext is wrapped in a TracingShellContext, so each call shows up in the rotation's trace.
+// If the config asks for it, the calls are also recorded to a file by a RecordingShellContext.
 func GetShellContextFromConfig(conf config.ShellContextConfig, logger *logrus.Logger) (ShellContext, error) {
+	var inner ShellContext
 	switch conf.ShellType {
 	case "LocalShell":
-		return localshell.NewLocalShell(logger), nil
+		inner = localshell.NewLocalShell(logger)
 	case "DockerShell":
-		return dockershell.NewDockerContext(conf.ContainerID, logger)
+		dc, err := dockershell.NewDockerContext(conf.ContainerID, logger)
+		if err != nil {
+			return nil, err
+		}
+		inner = dc
 	default:
-		return localshell.NewLocalShell(logger), nil
+		inner = localshell.NewLocalShell(logger)
 	}
+	if conf.Record != "" {
+		inner = NewRecordingShellContext(inner, conf.Record, logger)
+	}
+	return NewTracingShellContext(inner, conf.ShellType), nil
 }
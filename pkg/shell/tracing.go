@@ -0,0 +1,101 @@
+package shell
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/redact"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingShellContext wraps another ShellContext and records each call as a span. The spans are children of
+// whatever span is in the context, which is normally the stage of the step that made the call.
+// Command arguments are redacted, since they may include passwords.
+type TracingShellContext struct {
+	inner     ShellContext
+	shellType string
+}
+
+func NewTracingShellContext(inner ShellContext, shellType string) *TracingShellContext {
+	return &TracingShellContext{
+		inner:     inner,
+		shellType: shellType,
+	}
+}
+
+func (tsc *TracingShellContext) start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("shell.type", tsc.shellType))
+	return telemetry.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, redact.String(err.Error()))
+	}
+	span.End()
+}
+
+func (tsc *TracingShellContext) FindExecutable(ctx context.Context, paths []string, name string) (string, error) {
+	ctx, span := tsc.start(ctx, "shell.FindExecutable", attribute.String("shell.name", name))
+	path, err := tsc.inner.FindExecutable(ctx, paths, name)
+	end(span, err)
+	return path, err
+}
+
+func (tsc *TracingShellContext) CheckExecutable(ctx context.Context, execPath string) error {
+	ctx, span := tsc.start(ctx, "shell.CheckExecutable", attribute.String("shell.path", execPath))
+	err := tsc.inner.CheckExecutable(ctx, execPath)
+	end(span, err)
+	return err
+}
+
+func (tsc *TracingShellContext) FindPaths(ctx context.Context, paths []string) ([]string, error) {
+	ctx, span := tsc.start(ctx, "shell.FindPaths", attribute.StringSlice("shell.paths", paths))
+	found, err := tsc.inner.FindPaths(ctx, paths)
+	end(span, err)
+	return found, err
+}
+
+func (tsc *TracingShellContext) RunCmd(ctx context.Context, path string, args []string, environ []string, timeout time.Duration) (string, error) {
+	ctx, span := tsc.start(ctx, "shell.RunCmd",
+		attribute.String("shell.path", path),
+		attribute.String("shell.args", redact.String(strings.Join(args, " "))),
+	)
+	output, err := tsc.inner.RunCmd(ctx, path, args, environ, timeout)
+	end(span, err)
+	return output, err
+}
+
+func (tsc *TracingShellContext) CheckPathWriteable(ctx context.Context, path string) error {
+	ctx, span := tsc.start(ctx, "shell.CheckPathWriteable", attribute.String("shell.path", path))
+	err := tsc.inner.CheckPathWriteable(ctx, path)
+	end(span, err)
+	return err
+}
+
+func (tsc *TracingShellContext) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	ctx, span := tsc.start(ctx, "shell.ReadFile", attribute.String("shell.path", path))
+	data, err := tsc.inner.ReadFile(ctx, path)
+	end(span, err)
+	return data, err
+}
+
+func (tsc *TracingShellContext) WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+	ctx, span := tsc.start(ctx, "shell.WriteFile", attribute.String("shell.path", path))
+	err := tsc.inner.WriteFile(ctx, path, data, perm)
+	end(span, err)
+	return err
+}
+
+func (tsc *TracingShellContext) RemoveFile(ctx context.Context, path string) error {
+	ctx, span := tsc.start(ctx, "shell.RemoveFile", attribute.String("shell.path", path))
+	err := tsc.inner.RemoveFile(ctx, path)
+	end(span, err)
+	return err
+}
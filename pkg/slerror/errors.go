@@ -2,7 +2,9 @@ package slerror
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/dfeldman/spiffelink/pkg/redact"
 	"github.com/sirupsen/logrus"
 )
 
@@ -82,6 +84,7 @@ var connStrInvalid = `
 The connection string %s is invalid. Check the configuration file for the correct connection string.`
 
 func ConnectionStringInvalidError(log *logrus.Logger, connStr string) SLError {
+	connStr = redact.String(connStr)
 	return SLError{
 		Code:            "CONFIG_CONNECTION_STRING_INVALID",
 		Err:             fmt.Errorf("invalid connection string %s", connStr),
@@ -95,6 +98,7 @@ var cantConnect = `
 Cannot connect to the database using connection string %s. Please verify the database is running and the connection string is correct.`
 
 func ConnectionFailedError(log *logrus.Logger, connStr string) error {
+	connStr = redact.String(connStr)
 	return LogAndReturn(log, SLError{
 		Code:            "DATABASE_CONNECTION_FAILED",
 		Err:             fmt.Errorf("cannot connect to the database using connection string %s", connStr),
@@ -258,3 +262,511 @@ func CantParseConfigFile(err error, log *logrus.Logger) SLError {
 		Severity:        "Fatal",
 	})
 }
+
+var secretReferenceInvalid = `
+The secret reference %s could not be parsed. Secret references look like ${env:VARIABLE_NAME} or
+${file:/path/to/file}. Check the configuration file for a missing brace or provider name.`
+
+func SecretReferenceInvalidError(log *logrus.Logger, ref string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "SECRET_REFERENCE_INVALID",
+		Err:             fmt.Errorf("invalid secret reference %s", ref),
+		Heading:         "Invalid secret reference",
+		DetailedMessage: fmt.Sprintf(secretReferenceInvalid, ref),
+		Severity:        "Fatal",
+	})
+}
+
+var secretProviderUnknown = `
+The secret reference %s uses the provider %s, which is not available. The built-in providers are
+"env" and "file".`
+
+func SecretProviderUnknownError(log *logrus.Logger, ref string, provider string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "SECRET_PROVIDER_UNKNOWN",
+		Err:             fmt.Errorf("unknown secret provider %s in %s", provider, ref),
+		Heading:         "Unknown secret provider",
+		DetailedMessage: fmt.Sprintf(secretProviderUnknown, ref, provider),
+		Severity:        "Fatal",
+	})
+}
+
+var secretResolutionFailed = `
+The secret reference %s could not be resolved. Check that the environment variable is set or that
+the file exists and is readable by SPIFFE Link.`
+
+func SecretResolutionFailedError(log *logrus.Logger, ref string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "SECRET_RESOLUTION_FAILED",
+		Err:             fmt.Errorf("unable to resolve secret %s: %w", ref, err),
+		Heading:         "Unable to resolve secret",
+		DetailedMessage: fmt.Sprintf(secretResolutionFailed, ref),
+		Severity:        "Fatal",
+	})
+}
+
+var logFormatInvalid = `
+The log format %s is not supported. Supported formats are "text" and "json".`
+
+func LogFormatInvalidError(log *logrus.Logger, format string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CONFIG_LOG_FORMAT_INVALID",
+		Err:             fmt.Errorf("invalid log format %s", format),
+		Heading:         "Invalid log format",
+		DetailedMessage: fmt.Sprintf(logFormatInvalid, format),
+		Severity:        "Fatal",
+	})
+}
+
+var logOutputInvalid = `
+The log output %s is not supported. Supported outputs are "stderr", "file" and "syslog".`
+
+func LogOutputInvalidError(log *logrus.Logger, output string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CONFIG_LOG_OUTPUT_INVALID",
+		Err:             fmt.Errorf("invalid log output %s", output),
+		Heading:         "Invalid log output",
+		DetailedMessage: fmt.Sprintf(logOutputInvalid, output),
+		Severity:        "Fatal",
+	})
+}
+
+var logFileUnwritable = `
+Unable to open the log file %s for writing. Check that the directory exists and that SPIFFE Link
+has permission to write to it, or set log.file.path to a different location.`
+
+func LogFileUnwritableError(log *logrus.Logger, path string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "LOG_FILE_UNWRITABLE",
+		Err:             fmt.Errorf("unable to open log file %s: %w", path, err),
+		Heading:         "Unable to open log file",
+		DetailedMessage: fmt.Sprintf(logFileUnwritable, path),
+		Severity:        "Fatal",
+	})
+}
+
+var syslogUnavailable = `
+Unable to connect to syslog at %s. Check log.syslog.network and log.syslog.address, or leave them
+empty to use the local syslog daemon.`
+
+func SyslogUnavailableError(log *logrus.Logger, address string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "LOG_SYSLOG_UNAVAILABLE",
+		Err:             fmt.Errorf("unable to connect to syslog at %s: %w", address, err),
+		Heading:         "Unable to connect to syslog",
+		DetailedMessage: fmt.Sprintf(syslogUnavailable, address),
+		Severity:        "Fatal",
+	})
+}
+
+var telemetryDurationInvalid = `
+The OpenTelemetry setting %s has the value %s, which is not a valid duration. Durations look like
+"500ms", "10s" or "1m".`
+
+func TelemetryDurationInvalidError(log *logrus.Logger, setting string, value string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CONFIG_TELEMETRY_DURATION_INVALID",
+		Err:             fmt.Errorf("invalid duration %s for %s", value, setting),
+		Heading:         "Invalid OpenTelemetry duration",
+		DetailedMessage: fmt.Sprintf(telemetryDurationInvalid, setting, value),
+		Severity:        "Fatal",
+	})
+}
+
+var taskManagerDurationInvalid = `
+The task setting %s has the value %s, which is not a valid duration. Durations look like
+"30m", "24h" or "1h30m".`
+
+func TaskManagerDurationInvalidError(log *logrus.Logger, setting string, value string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CONFIG_TASKS_DURATION_INVALID",
+		Err:             fmt.Errorf("invalid duration %s for %s", value, setting),
+		Heading:         "Invalid task duration",
+		DetailedMessage: fmt.Sprintf(taskManagerDurationInvalid, setting, value),
+		Severity:        "Fatal",
+	})
+}
+
+var telemetryExporterFailed = `
+Unable to create the OpenTelemetry OTLP exporter for %s. Check the opentelemetry.otlpExporter section
+of the configuration file.`
+
+func TelemetryExporterFailedError(log *logrus.Logger, endpoint string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "TELEMETRY_EXPORTER_FAILED",
+		Err:             fmt.Errorf("unable to create OTLP exporter for %s: %w", endpoint, err),
+		Heading:         "Unable to create OpenTelemetry exporter",
+		DetailedMessage: fmt.Sprintf(telemetryExporterFailed, endpoint),
+		Severity:        "Fatal",
+	})
+}
+
+var healthListenFailed = `
+Unable to listen on %s for health checks and metrics. Check that health.listenAddress is a valid
+host:port and that nothing else is using the port.`
+
+func HealthListenFailedError(log *logrus.Logger, address string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "HEALTH_LISTEN_FAILED",
+		Err:             fmt.Errorf("unable to listen on %s: %w", address, err),
+		Heading:         "Unable to start health server",
+		DetailedMessage: fmt.Sprintf(healthListenFailed, address),
+		Severity:        "Fatal",
+	})
+}
+
+var adminListenFailed = `
+Unable to listen on the admin socket %s. Check that its directory can be created and written to by
+the user running spiffelink, and that no other spiffelink process is using it. Set admin.socketPath to
+use a different socket, or admin.disabled to turn the admin API off.`
+
+func AdminListenFailedError(log *logrus.Logger, socketPath string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ADMIN_LISTEN_FAILED",
+		Err:             fmt.Errorf("unable to listen on %s: %w", socketPath, err),
+		Heading:         "Unable to start admin API",
+		DetailedMessage: fmt.Sprintf(adminListenFailed, socketPath),
+		Severity:        "Fatal",
+	})
+}
+
+var adminConnectFailed = `
+Unable to connect to the spiffelink admin socket %s. Check that spiffelink is running, that you are
+the user it runs as, and that --socket matches admin.socketPath in its config file.`
+
+func AdminConnectFailedError(log *logrus.Logger, socketPath string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ADMIN_CONNECT_FAILED",
+		Err:             fmt.Errorf("unable to connect to %s: %w", socketPath, err),
+		Heading:         "Unable to connect to spiffelink",
+		DetailedMessage: fmt.Sprintf(adminConnectFailed, socketPath),
+		Severity:        "Fatal",
+	})
+}
+
+// Codes for a step that was stopped before it finished. The step runner checks for these to decide
+// whether to undo the steps that already ran.
+const (
+	StepCancelledCode ErrorCode = "STEP_CANCELLED"
+	StepTimedOutCode  ErrorCode = "STEP_TIMED_OUT"
+	StepAbandonedCode ErrorCode = "STEP_ABANDONED"
+)
+
+var stepCancelled = `
+The step "%s" was stopped during its %s stage because the rotation was cancelled (%v). This happens when
+the task is killed, runs past the database's timeout, or spiffelink is shutting down. The steps that had
+already finished are undone.`
+
+func StepCancelledError(log *logrus.Logger, stepName string, stage string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            StepCancelledCode,
+		Err:             fmt.Errorf("step %s cancelled during %s: %w", stepName, stage, err),
+		Heading:         "Step cancelled",
+		DetailedMessage: fmt.Sprintf(stepCancelled, stepName, stage, err),
+		Severity:        "Fatal",
+	})
+}
+
+var stepTimedOut = `
+The step "%s" did not finish its %s stage within its time limit of %v. The command it was running may be
+hanging, or the database may be slow to respond. The steps that had already finished are undone.`
+
+func StepTimedOutError(log *logrus.Logger, stepName string, stage string, timeout time.Duration) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            StepTimedOutCode,
+		Err:             fmt.Errorf("step %s timed out after %v during %s", stepName, timeout, stage),
+		Heading:         "Step timed out",
+		DetailedMessage: fmt.Sprintf(stepTimedOut, stepName, stage, timeout),
+		Severity:        "Fatal",
+	})
+}
+
+var stepAbandoned = `
+The step "%s" was stopped during its %s stage, but was still running %v later. It was left running in the
+background, and is not undone, since its undo could run at the same time and be overwritten by it. The
+database may be left with part of the new credentials; check it, and rotate it again once the step has
+finished.`
+
+func StepAbandonedError(log *logrus.Logger, stepName string, stage string, wait time.Duration) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            StepAbandonedCode,
+		Err:             fmt.Errorf("step %s still running %v after it was stopped during %s", stepName, wait, stage),
+		Heading:         "Step abandoned",
+		DetailedMessage: fmt.Sprintf(stepAbandoned, stepName, stage, wait),
+		Severity:        "Fatal",
+	})
+}
+
+var stepGraphInvalid = `
+The steps for %s can't be run because their dependencies are invalid: %v. This is a bug in the
+datastore that built the steps.`
+
+func StepGraphInvalidError(log *logrus.Logger, stepListID string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "STEP_GRAPH_INVALID",
+		Err:             fmt.Errorf("invalid dependencies in step list %s: %w", stepListID, err),
+		Heading:         "Invalid step dependencies",
+		DetailedMessage: fmt.Sprintf(stepGraphInvalid, stepListID, err),
+		Severity:        "Fatal",
+	})
+}
+
+var journalFailed = `
+Unable to use the step journal at %s. Check that the journal directory can be created and written to by
+the user running spiffelink. Set journal.dir to use a different directory, or journal.disabled to turn
+the journal off. Without the journal, a rotation interrupted by a crash can't be recovered.`
+
+func JournalFailedError(log *logrus.Logger, path string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "JOURNAL_FAILED",
+		Err:             fmt.Errorf("unable to use journal %s: %w", path, err),
+		Heading:         "Unable to use step journal",
+		DetailedMessage: fmt.Sprintf(journalFailed, path),
+		Severity:        "Fatal",
+	})
+}
+
+var svidNotFound = `
+The update from the SPIFFE Workload API has no SVID for %s. Check that a registration entry gives
+spiffelink this SPIFFE ID, and that spiffeID in the database config is spelled correctly.`
+
+func SvidNotFoundError(log *logrus.Logger, spiffeID string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "SVID_NOT_FOUND",
+		Err:             fmt.Errorf("no SVID for %s in the update", spiffeID),
+		Heading:         "SVID not found",
+		DetailedMessage: fmt.Sprintf(svidNotFound, spiffeID),
+		Severity:        "Fatal",
+	})
+}
+
+var credentialWriteFailed = `
+Unable to write or read the credential file %s. Check that its directory exists and can be written to
+by the user the database's shell runs as.`
+
+func CredentialWriteFailedError(log *logrus.Logger, path string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CREDENTIAL_WRITE_FAILED",
+		Err:             fmt.Errorf("unable to write %s: %w", path, err),
+		Heading:         "Unable to write credentials",
+		DetailedMessage: fmt.Sprintf(credentialWriteFailed, path),
+		Severity:        "Fatal",
+	})
+}
+
+var credentialNotApplied = `
+The credential file %s doesn't have the SVID with serial %s after it was written. Something else may be
+writing to the same file, or the write was lost.`
+
+func CredentialNotAppliedError(log *logrus.Logger, path string, serial string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CREDENTIAL_NOT_APPLIED",
+		Err:             fmt.Errorf("%s does not have the SVID with serial %s", path, serial),
+		Heading:         "Credentials not applied",
+		DetailedMessage: fmt.Sprintf(credentialNotApplied, path, serial),
+		Severity:        "Fatal",
+	})
+}
+
+var keystorePasswordMissing = `
+Keystores and truststores are protected with a password, and the database's password is empty. Set it in
+the connection string, preferably as a secret reference like ${env:KEYSTORE_PASSWORD}.`
+
+func KeystorePasswordMissingError(log *logrus.Logger) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "KEYSTORE_PASSWORD_MISSING",
+		Err:             fmt.Errorf("the keystore password is empty"),
+		Heading:         "Keystore password missing",
+		DetailedMessage: keystorePasswordMissing,
+		Severity:        "Fatal",
+	})
+}
+
+var executableNotFound = `
+The command %s was not found on the database's host. Check that it is installed, and set the directory it is
+in through the connection string if it isn't in one of the usual places.`
+
+func ExecutableNotFoundError(log *logrus.Logger, name string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "EXECUTABLE_NOT_FOUND",
+		Err:             fmt.Errorf("unable to find %s: %w", name, err),
+		Heading:         "Command not found",
+		DetailedMessage: fmt.Sprintf(executableNotFound, name),
+		Severity:        "Fatal",
+	})
+}
+
+var commandFailed = `
+The command "%s" failed on the database's host. Its output is in the error. Check that the database is
+running and that the user the database's shell runs as is allowed to manage it.`
+
+func CommandFailedError(log *logrus.Logger, command string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "COMMAND_FAILED",
+		Err:             fmt.Errorf("%s failed: %w", command, err),
+		Heading:         "Command failed",
+		DetailedMessage: fmt.Sprintf(commandFailed, command),
+		Severity:        "Fatal",
+	})
+}
+
+var kafkaConfigNotApplied = `
+Broker %s doesn't report %s as %s after it was changed. The broker may have rejected the new keystore, or
+another tool may be changing the broker's dynamic configuration at the same time.`
+
+func KafkaConfigNotAppliedError(log *logrus.Logger, broker string, setting string, value string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "KAFKA_CONFIG_NOT_APPLIED",
+		Err:             fmt.Errorf("broker %s does not have %s=%s", broker, setting, value),
+		Heading:         "Kafka configuration not applied",
+		DetailedMessage: fmt.Sprintf(kafkaConfigNotApplied, broker, setting, value),
+		Severity:        "Fatal",
+	})
+}
+
+var tlsCertificateNotServed = `
+The database at %s doesn't present the SVID with serial %s in a TLS handshake. It may not have started
+yet, it may have failed to load the new certificate, or it may still be using the old one. Check the
+database's log.`
+
+func TLSCertificateNotServedError(log *logrus.Logger, address string, serial string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "TLS_CERTIFICATE_NOT_SERVED",
+		Err:             fmt.Errorf("%s does not serve the SVID with serial %s: %w", address, serial, err),
+		Heading:         "New certificate not served",
+		DetailedMessage: fmt.Sprintf(tlsCertificateNotServed, address, serial),
+		Severity:        "Fatal",
+	})
+}
+
+var mssqlConfigNotApplied = `
+mssql.conf doesn't have %s set to %s after mssql-conf set it. Check that mssql-conf and spiffelink use the
+same mssql.conf, and that nothing else is changing it.`
+
+func MssqlConfigNotAppliedError(log *logrus.Logger, setting string, value string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "MSSQL_CONFIG_NOT_APPLIED",
+		Err:             fmt.Errorf("mssql.conf does not have %s=%s", setting, value),
+		Heading:         "SQL Server configuration not applied",
+		DetailedMessage: fmt.Sprintf(mssqlConfigNotApplied, setting, value),
+		Severity:        "Fatal",
+	})
+}
+
+var mssqlKeyMissing = `
+%s doesn't exist. SQL Server runs as the mssql user and has to be able to read its key, and spiffelink only
+replaces the key, keeping its owner. Create it once, owned by mssql, for example with
+install -o mssql -g mssql -m 600 /dev/null %[1]s`
+
+func MssqlKeyMissingError(log *logrus.Logger, path string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "MSSQL_KEY_MISSING",
+		Err:             fmt.Errorf("%s does not exist", path),
+		Heading:         "SQL Server key file missing",
+		DetailedMessage: fmt.Sprintf(mssqlKeyMissing, path),
+		Severity:        "Fatal",
+	})
+}
+
+var redisConfigNotApplied = `
+Redis at %s doesn't report %s as %s after CONFIG SET. Redis may have rejected the new files, or another
+client may be changing its configuration at the same time.`
+
+func RedisConfigNotAppliedError(log *logrus.Logger, address string, setting string, value string) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "REDIS_CONFIG_NOT_APPLIED",
+		Err:             fmt.Errorf("redis at %s does not have %s=%s", address, setting, value),
+		Heading:         "Redis configuration not applied",
+		DetailedMessage: fmt.Sprintf(redisConfigNotApplied, address, setting, value),
+		Severity:        "Fatal",
+	})
+}
+
+var elasticsearchRequestFailed = `
+The request to %s failed. Check that the node is running, that spiffelink can reach it, that the cacert
+option names the CA it uses for HTTP, and that the user has the cluster monitor privilege.`
+
+func ElasticsearchRequestFailedError(log *logrus.Logger, url string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ELASTICSEARCH_REQUEST_FAILED",
+		Err:             fmt.Errorf("request to %s failed: %w", url, err),
+		Heading:         "Elasticsearch request failed",
+		DetailedMessage: fmt.Sprintf(elasticsearchRequestFailed, url),
+		Severity:        "Fatal",
+	})
+}
+
+var elasticsearchReloadFailed = `
+The node at %s refused to reload its %s certificates. The security plugin needs
+plugins.security.ssl_cert_reload_enabled set to true, the request needs the admin certificate or a user
+allowed to call the reload API, and the new certificate must have the same subject and issuer as the old one.`
+
+func ElasticsearchReloadFailedError(log *logrus.Logger, address string, layer string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ELASTICSEARCH_RELOAD_FAILED",
+		Err:             fmt.Errorf("%s did not reload its %s certificates: %w", address, layer, err),
+		Heading:         "Certificate reload failed",
+		DetailedMessage: fmt.Sprintf(elasticsearchReloadFailed, address, layer),
+		Severity:        "Fatal",
+	})
+}
+
+var elasticsearchCertificateNotLoaded = `
+The node at %s doesn't report the SVID with serial %s as one of its certificates. It may not have noticed
+the new files yet, or it may have refused them. Check the node's log.`
+
+func ElasticsearchCertificateNotLoadedError(log *logrus.Logger, address string, serial string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ELASTICSEARCH_CERTIFICATE_NOT_LOADED",
+		Err:             fmt.Errorf("%s does not report the SVID with serial %s: %w", address, serial, err),
+		Heading:         "New certificate not loaded",
+		DetailedMessage: fmt.Sprintf(elasticsearchCertificateNotLoaded, address, serial),
+		Severity:        "Fatal",
+	})
+}
+
+var elasticsearchConfigInvalid = `
+spiffelink reads %s to find out where the node keeps its certificates and keys. Check that the file exists
+and is valid YAML, that TLS is enabled for the transport or HTTP layer, and that each layer spiffelink
+rotates names its key and certificate, or its keystore.`
+
+func ElasticsearchConfigInvalidError(log *logrus.Logger, path string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ELASTICSEARCH_CONFIG_INVALID",
+		Err:             fmt.Errorf("unable to use the TLS settings in %s: %w", path, err),
+		Heading:         "Node configuration unusable",
+		DetailedMessage: fmt.Sprintf(elasticsearchConfigInvalid, path),
+		Severity:        "Fatal",
+	})
+}
+
+var cassandraConfigInvalid = `
+spiffelink reads %s to find out where the node keeps its keystores or certificates. Check that the file
+exists and is valid YAML, that server_encryption_options or client_encryption_options is enabled, and that
+it names the files on disk rather than holding the credentials inline.`
+
+func CassandraConfigInvalidError(log *logrus.Logger, path string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "CASSANDRA_CONFIG_INVALID",
+		Err:             fmt.Errorf("unable to use the encryption options in %s: %w", path, err),
+		Heading:         "Node configuration unusable",
+		DetailedMessage: fmt.Sprintf(cassandraConfigInvalid, path),
+		Severity:        "Fatal",
+	})
+}
+
+var etcdUnhealthy = `
+etcdctl endpoint health reports that %s isn't healthy. Before a member's certificates are changed, the whole
+cluster must be healthy, so a rollout stops at the first member that breaks. After a change, the member must
+accept the new client certificate and present a server certificate signed by the new CA bundle. Check the
+member's log, and that the server SVID has the member's DNS names or IP addresses.`
+
+func EtcdUnhealthyError(log *logrus.Logger, endpoints string, err error) SLError {
+	return LogAndReturn(log, SLError{
+		Code:            "ETCD_UNHEALTHY",
+		Err:             fmt.Errorf("%s is not healthy: %w", endpoints, err),
+		Heading:         "etcd not healthy",
+		DetailedMessage: fmt.Sprintf(etcdUnhealthy, endpoints),
+		Severity:        "Fatal",
+	})
+}
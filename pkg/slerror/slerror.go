@@ -6,6 +6,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/dfeldman/spiffelink/pkg/redact"
 	"github.com/sirupsen/logrus"
 
 	"github.com/fatih/color"
@@ -53,8 +54,9 @@ type SLErrorList struct {
 	Errors []SLError
 }
 
+// The message is always redacted, since the underlying error may include a connection string.
 func (slerr SLError) FmtError() string {
-	return fmt.Sprintf("Error %s: %s. At: %v. %s: %s", slerr.Code, slerr.Err.Error(), slerr.Time, slerr.Heading, slerr.DetailedMessage)
+	return redact.String(fmt.Sprintf("Error %s: %s. At: %v. %s: %s", slerr.Code, slerr.Err.Error(), slerr.Time, slerr.Heading, slerr.DetailedMessage))
 }
 
 func (slerr SLError) Error() string {
@@ -114,9 +116,9 @@ func PrintErrors(errors []error) {
 		}
 
 		if !color.NoColor {
-			color.New(color.Bold).Printf("%s: %s\n", slErr.Heading, slErr.DetailedMessage)
+			color.New(color.Bold).Printf("%s: %s\n", slErr.Heading, redact.String(slErr.DetailedMessage))
 		} else {
-			fmt.Printf("%s: %s\n", slErr.Heading, slErr.DetailedMessage)
+			fmt.Printf("%s: %s\n", slErr.Heading, redact.String(slErr.DetailedMessage))
 		}
 	}
 }
@@ -124,17 +126,17 @@ func PrintErrors(errors []error) {
 func LogError(log *logrus.Logger, err error) {
 	slErr, ok := err.(*SLError)
 	if !ok {
-		log.Error(err)
+		log.Error(redact.String(err.Error()))
 		return
 	}
 
 	log.WithFields(logrus.Fields{
 		"code":             slErr.Code,
-		"error":            slErr.Err.Error(),
+		"error":            redact.String(slErr.Err.Error()),
 		"heading":          slErr.Heading,
-		"detailed_message": slErr.DetailedMessage,
+		"detailed_message": redact.String(slErr.DetailedMessage),
 		"severity":         slErr.Severity,
-	}).Error(slErr.Err.Error())
+	}).Error(redact.String(slErr.Err.Error()))
 }
 
 func LogAndReturn(log *logrus.Logger, err SLError) SLError {
@@ -0,0 +1,149 @@
+package status
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// The status package keeps track of what SL has done so far: whether it is connected to the Workload API,
+// and for each database, when it was last rotated and which SVID it has. The updater records into a Tracker,
+// and the health endpoints, metrics and admin API read from it.
+
+// DatabaseStatus is the rotation status of one database.
+type DatabaseStatus struct {
+	Name     string
+	SpiffeID string
+	// Time the last rotation finished, whether or not it succeeded
+	LastAttempt time.Time
+	// Time the last successful rotation finished. Zero if the database has never been rotated.
+	LastSuccess time.Time
+	// Number of rotations that have failed since the last success
+	ConsecutiveFailures int
+	// The error from the last failed rotation
+	LastError string
+	// The SVID that was applied in the last successful rotation
+	SvidSerial string
+	SvidExpiry time.Time
+}
+
+// Status is a snapshot of the Tracker.
+type Status struct {
+	AgentConnected bool
+	// Time the last update was received from the Workload API
+	LastAgentUpdate time.Time
+	Databases       []DatabaseStatus
+}
+
+type Tracker struct {
+	mu              sync.RWMutex
+	agentConnected  bool
+	lastAgentUpdate time.Time
+	databases       map[string]*DatabaseStatus
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		databases: make(map[string]*DatabaseStatus),
+	}
+}
+
+// AddDatabase registers a configured database, so it is reported (and counted for readiness) before its first rotation.
+func (t *Tracker) AddDatabase(name string, spiffeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.getDatabase(name).SpiffeID = spiffeID
+}
+
+// Must be called with the lock held.
+func (t *Tracker) getDatabase(name string) *DatabaseStatus {
+	db, ok := t.databases[name]
+	if !ok {
+		db = &DatabaseStatus{Name: name}
+		t.databases[name] = db
+	}
+	return db
+}
+
+// AgentUpdate records that an update was received from the Workload API.
+func (t *Tracker) AgentUpdate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agentConnected = true
+	t.lastAgentUpdate = time.Now()
+}
+
+// AgentError records that the connection to the Workload API failed.
+func (t *Tracker) AgentError() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agentConnected = false
+}
+
+// RecordRotation records the outcome of a rotation. The SVID is the one that was sent to the database,
+// and may be nil if there wasn't one for its SPIFFE ID.
+func (t *Tracker) RecordRotation(name string, svid *x509svid.SVID, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	db := t.getDatabase(name)
+	db.LastAttempt = time.Now()
+	if err != nil {
+		db.ConsecutiveFailures++
+		db.LastError = err.Error()
+		return
+	}
+	db.LastSuccess = db.LastAttempt
+	db.ConsecutiveFailures = 0
+	db.LastError = ""
+	if svid != nil && len(svid.Certificates) > 0 {
+		db.SvidSerial = svid.Certificates[0].SerialNumber.String()
+		db.SvidExpiry = svid.Certificates[0].NotAfter
+	}
+}
+
+// Get returns the status of one database.
+func (t *Tracker) Get(name string) (DatabaseStatus, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	db, ok := t.databases[name]
+	if !ok {
+		return DatabaseStatus{}, false
+	}
+	return *db, true
+}
+
+// Snapshot returns a copy of the current status, with databases sorted by name.
+func (t *Tracker) Snapshot() Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	status := Status{
+		AgentConnected:  t.agentConnected,
+		LastAgentUpdate: t.lastAgentUpdate,
+		Databases:       make([]DatabaseStatus, 0, len(t.databases)),
+	}
+	for _, db := range t.databases {
+		status.Databases = append(status.Databases, *db)
+	}
+	sort.Slice(status.Databases, func(i, j int) bool {
+		return status.Databases[i].Name < status.Databases[j].Name
+	})
+	return status
+}
+
+// Ready reports whether SL is connected to the agent and every database has been rotated at least once.
+// If not, the error says why.
+func (t *Tracker) Ready() error {
+	status := t.Snapshot()
+	if !status.AgentConnected {
+		return fmt.Errorf("not connected to the SPIFFE Workload API")
+	}
+	for _, db := range status.Databases {
+		if db.LastSuccess.IsZero() {
+			return fmt.Errorf("database %s has not been rotated yet", db.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package status
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	tracker.AddDatabase("db1", "spiffe://example.org/db1")
+	tracker.AddDatabase("db2", "spiffe://example.org/db2")
+
+	// Not ready until the agent is connected and every database has been rotated
+	assert.Error(t, tracker.Ready())
+	tracker.AgentUpdate()
+	assert.Error(t, tracker.Ready())
+
+	ca := spiffetest.NewCA(t)
+	certs, key := ca.CreateX509SVID("spiffe://example.org/db1")
+	svid := &x509svid.SVID{ID: spiffeid.RequireFromString("spiffe://example.org/db1"), Certificates: certs, PrivateKey: key}
+
+	tracker.RecordRotation("db1", svid, nil)
+	tracker.RecordRotation("db2", nil, errors.New("failed"))
+	tracker.RecordRotation("db2", nil, errors.New("failed again"))
+	assert.Error(t, tracker.Ready())
+
+	db1, ok := tracker.Get("db1")
+	require.True(t, ok)
+	assert.False(t, db1.LastSuccess.IsZero())
+	assert.Equal(t, certs[0].NotAfter, db1.SvidExpiry)
+	assert.Equal(t, certs[0].SerialNumber.String(), db1.SvidSerial)
+
+	db2, ok := tracker.Get("db2")
+	require.True(t, ok)
+	assert.Equal(t, 2, db2.ConsecutiveFailures)
+	assert.Equal(t, "failed again", db2.LastError)
+
+	tracker.RecordRotation("db2", nil, nil)
+	assert.NoError(t, tracker.Ready())
+
+	// Losing the agent connection makes SL not ready again
+	tracker.AgentError()
+	assert.Error(t, tracker.Ready())
+
+	snapshot := tracker.Snapshot()
+	require.Len(t, snapshot.Databases, 2)
+	assert.Equal(t, "db1", snapshot.Databases[0].Name)
+	assert.Equal(t, 0, snapshot.Databases[1].ConsecutiveFailures)
+}
@@ -0,0 +1,138 @@
+package step
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+)
+
+// A step list is run as a graph. If no step sets DependsOn, each step depends on the one before it, so the
+// steps run one at a time in order. Otherwise each step depends only on the steps in its DependsOn, and
+// steps whose dependencies have all finished run in parallel.
+
+// graph is the dependencies between the steps of a list, by index.
+type graph struct {
+	// deps[i] are the steps that must finish before step i starts
+	deps [][]int
+	// dependents[i] are the steps that wait for step i
+	dependents [][]int
+}
+
+func isSequence(steps []Step) bool {
+	for _, step := range steps {
+		if len(step.DependsOn) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Build the graph for a list of steps. Returns an error if a step depends on an unknown step or itself, if
+// two steps have the same Id, or if the dependencies have a cycle.
+func newGraph(steps []Step) (*graph, error) {
+	g := &graph{
+		deps:       make([][]int, len(steps)),
+		dependents: make([][]int, len(steps)),
+	}
+	if isSequence(steps) {
+		for i := 1; i < len(steps); i++ {
+			g.addEdge(i-1, i)
+		}
+		return g, nil
+	}
+
+	ids := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if step.Id == "" {
+			continue
+		}
+		if _, exists := ids[step.Id]; exists {
+			return nil, fmt.Errorf("two steps have the ID %s", step.Id)
+		}
+		ids[step.Id] = i
+	}
+	for i, step := range steps {
+		for _, id := range step.DependsOn {
+			dep, ok := ids[id]
+			if !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %s", stepLogID(step), id)
+			}
+			if dep == i {
+				return nil, fmt.Errorf("step %s depends on itself", stepLogID(step))
+			}
+			g.addEdge(dep, i)
+		}
+	}
+	if cycle := g.findCycle(steps); cycle != nil {
+		return nil, fmt.Errorf("steps depend on each other in a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+func (g *graph) addEdge(from int, to int) {
+	g.deps[to] = append(g.deps[to], from)
+	g.dependents[from] = append(g.dependents[from], to)
+}
+
+// Returns the IDs of the steps in a cycle, or nil if there isn't one.
+func (g *graph) findCycle(steps []Step) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(steps))
+	var path []int
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		path = append(path, i)
+		for _, next := range g.dependents[i] {
+			switch state[next] {
+			case visiting:
+				// The cycle is the part of the path from next onwards
+				var cycle []string
+				for j := len(path) - 1; j >= 0; j-- {
+					if path[j] == next {
+						for _, k := range path[j:] {
+							cycle = append(cycle, stepLogID(steps[k]))
+						}
+						break
+					}
+				}
+				return append(cycle, stepLogID(steps[next]))
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range steps {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Reverse the graph, so that every step waits for the steps that depend on it. This is the order to undo in.
+func (g *graph) reversed() *graph {
+	return &graph{deps: g.dependents, dependents: g.deps}
+}
+
+// Validate checks that the dependencies between the steps make sense, so a datastore can't build a list
+// that would never finish.
+func (sl StepList) Validate(log *logrus.Logger) error {
+	if _, err := newGraph(sl.Steps); err != nil {
+		return slerror.StepGraphInvalidError(log, sl.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package step
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callLog records StepFunc calls from steps running in parallel
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) record(name string) StepFunc {
+	return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.calls = append(l.calls, name)
+		return StepFuncOutputMessage{}
+	}
+}
+
+func (l *callLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.calls...)
+}
+
+func newTestRunner(maxParallel int) Runner {
+	return Runner{
+		Sl:          &spiffelinkcore.SpiffeLinkCore{Logger: newMockLogger()},
+		Dbc:         &config.DatabaseConfig{Name: "db1"},
+		MaxParallel: maxParallel,
+		// Stages that ignore their context are given up on quickly
+		AbandonAfter: 50 * time.Millisecond,
+	}
+}
+
+func TestValidateStepList(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Step
+		valid bool
+	}{
+		{"no dependencies", []Step{{Id: "A"}, {Id: "B"}, {}}, true},
+		{"diamond", []Step{{Id: "A"}, {Id: "B", DependsOn: []string{"A"}}, {Id: "C", DependsOn: []string{"A"}}, {Id: "D", DependsOn: []string{"B", "C"}}}, true},
+		{"unknown step", []Step{{Id: "A"}, {Id: "B", DependsOn: []string{"Z"}}}, false},
+		{"depends on itself", []Step{{Id: "A", DependsOn: []string{"A"}}}, false},
+		{"duplicate ID", []Step{{Id: "A"}, {Id: "A"}, {Id: "B", DependsOn: []string{"A"}}}, false},
+		{"cycle", []Step{{Id: "A", DependsOn: []string{"C"}}, {Id: "B", DependsOn: []string{"A"}}, {Id: "C", DependsOn: []string{"B"}}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := StepList{ID: "test", Steps: test.steps}.Validate(newMockLogger())
+			if test.valid {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, slerror.ErrorCode("STEP_GRAPH_INVALID"), err.(slerror.SLError).Code)
+		})
+	}
+}
+
+func TestRunInvalidGraph(t *testing.T) {
+	r := newTestRunner(0)
+	failed := r.Run(context.Background(), []Step{{Id: "A", TelemetryID: "A", DependsOn: []string{"B"}}}, Execute)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "validate", failed[0].Stage)
+}
+
+func TestRunGraphInParallel(t *testing.T) {
+	log := &callLog{}
+	// B and C both wait for each other to start, so they only finish if they run at the same time
+	var started sync.WaitGroup
+	started.Add(2)
+	parallel := func(name string) StepFunc {
+		return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+			started.Done()
+			started.Wait()
+			return log.record(name)(ctx, sfi)
+		}
+	}
+	steps := []Step{
+		{Id: "D", TelemetryID: "D", Execute: log.record("D"), DependsOn: []string{"B", "C"}},
+		{Id: "A", TelemetryID: "A", Execute: log.record("A")},
+		{Id: "B", TelemetryID: "B", Execute: parallel("B"), DependsOn: []string{"A"}},
+		{Id: "C", TelemetryID: "C", Execute: parallel("C"), DependsOn: []string{"A"}},
+	}
+	r := newTestRunner(2)
+	done := make(chan []StepFuncOutputMessage)
+	go func() { done <- r.Run(context.Background(), steps, Execute) }()
+	select {
+	case failed := <-done:
+		assert.Nil(t, failed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("B and C did not run in parallel")
+	}
+	calls := log.get()
+	assert.Equal(t, "A", calls[0])
+	assert.Equal(t, "D", calls[3])
+}
+
+func TestRunGraphLimitsParallelism(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	counting := func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return StepFuncOutputMessage{}
+	}
+	steps := []Step{{Id: "ROOT", TelemetryID: "ROOT", Execute: counting}}
+	for _, id := range []string{"A", "B", "C", "D", "E", "F"} {
+		steps = append(steps, Step{Id: id, TelemetryID: id, Execute: counting, DependsOn: []string{"ROOT"}})
+	}
+	r := newTestRunner(3)
+	assert.Nil(t, r.Run(context.Background(), steps, Execute))
+	assert.Equal(t, 3, maxRunning)
+}
+
+func TestRunGraphFailureStopsDependents(t *testing.T) {
+	log := &callLog{}
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Execute: failingStepFunc},
+		{Id: "B", TelemetryID: "B", Execute: log.record("B"), DependsOn: []string{"A"}},
+	}
+	r := newTestRunner(0)
+	failed := r.Run(context.Background(), steps, Execute)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "A", failed[0].Id)
+	assert.Empty(t, log.get())
+}
+
+func TestRunGraphRollsBackInReverseOrder(t *testing.T) {
+	log := &callLog{}
+	release := make(chan struct{})
+	defer close(release)
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Execute: log.record("A"), Undo: log.record("undo A")},
+		{Id: "B", TelemetryID: "B", Execute: log.record("B"), Undo: log.record("undo B"), DependsOn: []string{"A"}},
+		{Id: "C", TelemetryID: "C", Execute: log.record("C"), Undo: log.record("undo C"), DependsOn: []string{"B"}},
+		{Id: "HANGS", TelemetryID: "HANGS", Pre: hangingStepFunc(release), StageTimeout: 20 * time.Millisecond, DependsOn: []string{"C"}},
+	}
+	r := newTestRunner(0)
+	failed := r.Run(context.Background(), steps, Execute)
+	assert.Equal(t, slerror.StepTimedOutCode, lastError(failed, "pre").Code)
+	assert.Equal(t, []string{"A", "B", "C", "undo C", "undo B", "undo A"}, log.get())
+}
+
+func TestUndoModeReversesGraph(t *testing.T) {
+	log := &callLog{}
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Undo: log.record("undo A")},
+		{Id: "B", TelemetryID: "B", Undo: log.record("undo B"), DependsOn: []string{"A"}},
+		{Id: "C", TelemetryID: "C", Undo: log.record("undo C"), DependsOn: []string{"B"}},
+	}
+	r := newTestRunner(0)
+	assert.Nil(t, r.Run(context.Background(), steps, Undo))
+	assert.Equal(t, []string{"undo C", "undo B", "undo A"}, log.get())
+}
@@ -0,0 +1,278 @@
+package step
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+)
+
+// The journal records every stage of a run to disk before and after it happens, so that if spiffelink dies in
+// the middle of a run, the next spiffelink knows which steps were done and can finish the run or undo them.
+// Each run is a file of JSON entries, one per line, in the journal directory. The file is deleted when the
+// run ends, so any file left in the directory is a run that was interrupted. The format is described in
+// doc/journal.md.
+
+// Entry types
+const (
+	JournalBegin = "begin"
+	JournalStage = "stage"
+	JournalStep  = "step"
+	JournalEnd   = "end"
+)
+
+// Entry statuses
+const (
+	JournalStarted     = "started"
+	JournalSucceeded   = "succeeded"
+	JournalFailed      = "failed"
+	JournalInterrupted = "interrupted"
+)
+
+const journalSuffix = ".journal"
+
+// JournalEntry is one line of a journal file. Which fields are set depends on the Type.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Set on the begin entry
+	Database   string `json:"database,omitempty"`
+	Datastore  string `json:"datastore,omitempty"`
+	StepList   string `json:"stepList,omitempty"`
+	Mode       Mode   `json:"mode,omitempty"`
+	SvidSerial string `json:"svidSerial,omitempty"`
+	// Set on stage and step entries
+	Step  string `json:"step,omitempty"`
+	Stage string `json:"stage,omitempty"`
+	// Set on stage, step and end entries
+	Status string `json:"status,omitempty"`
+	// The State of the run after a stage or step succeeded
+	State  json.RawMessage `json:"state,omitempty"`
+	Errors []string        `json:"errors,omitempty"`
+}
+
+// Journal is the directory that runs are journaled in.
+type Journal struct {
+	dir    string
+	logger *logrus.Logger
+}
+
+func NewJournal(dir string, logger *logrus.Logger) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, slerror.JournalFailedError(logger, dir, err)
+	}
+	return &Journal{dir: dir, logger: logger}, nil
+}
+
+// JournalWriter records one run. Its methods do nothing on a nil JournalWriter, so a Runner doesn't need one.
+// Failing to write the journal is logged but doesn't stop the run.
+type JournalWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	logger *logrus.Logger
+}
+
+// Begin starts the journal for a run.
+func (j *Journal) Begin(database string, datastore string, stepList string, mode Mode, svidSerial string) (*JournalWriter, error) {
+	// The time comes first so the files sort in the order the runs started
+	name := fmt.Sprintf("%d-%s%s", time.Now().UnixNano(), strings.ReplaceAll(database, string(filepath.Separator), "_"), journalSuffix)
+	path := filepath.Join(j.dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, slerror.JournalFailedError(j.logger, path, err)
+	}
+	w := &JournalWriter{file: file, path: path, logger: j.logger}
+	w.write(JournalEntry{
+		Type:       JournalBegin,
+		Database:   database,
+		Datastore:  datastore,
+		StepList:   stepList,
+		Mode:       mode,
+		SvidSerial: svidSerial,
+	})
+	return w, nil
+}
+
+// Write an entry and sync it to disk, so it is there even if spiffelink dies right after.
+func (w *JournalWriter) write(entry JournalEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		w.logger.Errorf("Unable to write journal %s: %v", w.path, err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return
+	}
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		w.logger.Errorf("Unable to write journal %s: %v", w.path, err)
+		return
+	}
+	if err := w.file.Sync(); err != nil {
+		w.logger.Errorf("Unable to sync journal %s: %v", w.path, err)
+	}
+}
+
+// Convert a State to JSON for the journal. An empty State is left out.
+func (w *JournalWriter) encodeState(state *State) json.RawMessage {
+	if state.Len() == 0 {
+		return nil
+	}
+	data, err := state.MarshalJSON()
+	if err != nil {
+		w.logger.Errorf("Unable to journal state: %v", err)
+		return nil
+	}
+	return data
+}
+
+func errorStrings(errs slerror.SLErrorList) []string {
+	var messages []string
+	for _, err := range errs.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %v", err.Code, err.Err))
+	}
+	return messages
+}
+
+func (w *JournalWriter) stageStarted(step Step, stage string) {
+	if w == nil {
+		return
+	}
+	w.write(JournalEntry{Type: JournalStage, Step: stepLogID(step), Stage: stage, Status: JournalStarted})
+}
+
+func (w *JournalWriter) stageEnded(step Step, stage string, state *State, output StepFuncOutputMessage) {
+	if w == nil {
+		return
+	}
+	entry := JournalEntry{Type: JournalStage, Step: stepLogID(step), Stage: stage, Status: JournalSucceeded}
+	if output.Errors.Empty() {
+		entry.State = w.encodeState(state)
+	} else {
+		entry.Status = JournalFailed
+		entry.Errors = errorStrings(output.Errors)
+	}
+	w.write(entry)
+}
+
+func (w *JournalWriter) stepEnded(step Step, state *State, outputs []StepFuncOutputMessage) {
+	if w == nil {
+		return
+	}
+	entry := JournalEntry{Type: JournalStep, Step: stepLogID(step), Status: JournalSucceeded}
+	if outputs == nil {
+		entry.State = w.encodeState(state)
+	} else {
+		entry.Status = JournalFailed
+		if interrupted(outputs) {
+			entry.Status = JournalInterrupted
+		}
+	}
+	w.write(entry)
+}
+
+// End records how the run ended, with the outputs returned by Runner.Run, and deletes the journal since
+// there is nothing left to recover.
+func (w *JournalWriter) End(outputs []StepFuncOutputMessage) {
+	if w == nil {
+		return
+	}
+	status := JournalSucceeded
+	if outputs != nil {
+		status = JournalFailed
+		if interrupted(outputs) {
+			status = JournalInterrupted
+		}
+	}
+	w.write(JournalEntry{Type: JournalEnd, Status: status})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.file.Close()
+	w.file = nil
+	if err := os.Remove(w.path); err != nil {
+		w.logger.Errorf("Unable to remove journal %s: %v", w.path, err)
+	}
+}
+
+// JournalRun is a run read back from a journal file.
+type JournalRun struct {
+	Path    string
+	Begin   JournalEntry
+	Entries []JournalEntry
+}
+
+// Ended returns whether the run recorded its end, which means there is nothing to recover.
+func (run JournalRun) Ended() bool {
+	return len(run.Entries) > 0 && run.Entries[len(run.Entries)-1].Type == JournalEnd
+}
+
+// Incomplete returns the runs that were interrupted before they ended, oldest first.
+func (j *Journal) Incomplete() ([]JournalRun, error) {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "*"+journalSuffix))
+	if err != nil {
+		return nil, slerror.JournalFailedError(j.logger, j.dir, err)
+	}
+	sort.Strings(paths)
+	var runs []JournalRun
+	for _, path := range paths {
+		run, err := readJournal(path)
+		if err != nil {
+			return nil, slerror.JournalFailedError(j.logger, path, err)
+		}
+		if run.Ended() {
+			// spiffelink died after ending the run but before removing the file
+			j.Discard(run)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func readJournal(path string) (JournalRun, error) {
+	run := JournalRun{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return run, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line is cut short if spiffelink died while writing it
+			break
+		}
+		run.Entries = append(run.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return run, err
+	}
+	if len(run.Entries) == 0 || run.Entries[0].Type != JournalBegin {
+		return run, fmt.Errorf("journal does not start with a begin entry")
+	}
+	run.Begin = run.Entries[0]
+	return run, nil
+}
+
+// Discard deletes the journal of a run once it has been recovered.
+func (j *Journal) Discard(run JournalRun) error {
+	if err := os.Remove(run.Path); err != nil && !os.IsNotExist(err) {
+		return slerror.JournalFailedError(j.logger, run.Path, err)
+	}
+	return nil
+}
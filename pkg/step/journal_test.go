@@ -0,0 +1,151 @@
+package step
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putStepFunc stores a value in the state
+func putStepFunc(log *callLog, name string, key string, value string) StepFunc {
+	return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		sfi.State.Put(key, value)
+		return log.record(name)(ctx, sfi)
+	}
+}
+
+// getStepFunc reads a value from the state
+func getStepFunc(log *callLog, name string, key string, got *string) StepFunc {
+	return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		*got, _ = Get[string](sfi.State, key)
+		return log.record(name)(ctx, sfi)
+	}
+}
+
+func TestJournalRecordsRun(t *testing.T) {
+	journal, err := NewJournal(t.TempDir(), newMockLogger())
+	require.NoError(t, err)
+	w, err := journal.Begin("db1", "oracle", "oracle-update", Execute, "1234")
+	require.NoError(t, err)
+
+	log := &callLog{}
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Pre: log.record("pre A"), Execute: putStepFunc(log, "A", "backup", "a.bak")},
+		{Id: "B", TelemetryID: "B", Execute: failingStepFunc},
+	}
+	r := newTestRunner(0)
+	r.Journal = w
+	failed := r.Run(context.Background(), steps, Execute)
+	require.NotNil(t, failed)
+
+	runs, err := journal.Incomplete()
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	run := runs[0]
+	assert.Equal(t, "db1", run.Begin.Database)
+	assert.Equal(t, "1234", run.Begin.SvidSerial)
+	var types []string
+	for _, entry := range run.Entries {
+		types = append(types, entry.Type+" "+entry.Step+" "+entry.Stage+" "+entry.Status)
+	}
+	assert.Equal(t, []string{
+		"begin   ",
+		"stage A pre started",
+		"stage A pre succeeded",
+		"stage A execute started",
+		"stage A execute succeeded",
+		"step A  succeeded",
+		"stage B execute started",
+		"stage B execute failed",
+		"step B  failed",
+	}, types)
+	assert.JSONEq(t, `{"backup":"a.bak"}`, string(run.Entries[5].State))
+
+	w.End(failed)
+	runs, err = journal.Incomplete()
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+}
+
+// Journal a run that died while step B was executing, after A had finished
+func interruptedRun(t *testing.T, journal *Journal, steps []Step) JournalRun {
+	w, err := journal.Begin("db1", "oracle", "oracle-update", Execute, "1234")
+	require.NoError(t, err)
+	state := NewState()
+	require.NoError(t, state.Put("backup", "a.bak"))
+	w.stageStarted(steps[0], "execute")
+	w.stageEnded(steps[0], "execute", state, StepFuncOutputMessage{})
+	w.stepEnded(steps[0], state, nil)
+	w.stageStarted(steps[1], "execute")
+	runs, err := journal.Incomplete()
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	return runs[0]
+}
+
+func TestRecoverResumesRun(t *testing.T) {
+	journal, err := NewJournal(t.TempDir(), newMockLogger())
+	require.NoError(t, err)
+	log := &callLog{}
+	var resumedState string
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Execute: log.record("A"), Undo: log.record("undo A")},
+		{Id: "B", TelemetryID: "B", Execute: getStepFunc(log, "B", "backup", &resumedState), Undo: log.record("undo B")},
+		{Id: "C", TelemetryID: "C", Execute: log.record("C"), Undo: log.record("undo C")},
+	}
+	run := interruptedRun(t, journal, steps)
+
+	r := newTestRunner(0)
+	outputs, finished, err := r.Recover(context.Background(), steps, run, "1234")
+	require.NoError(t, err)
+	assert.True(t, finished)
+	assert.Nil(t, outputs)
+	// B was part way through, so it is undone and run again. A isn't run again.
+	assert.Equal(t, []string{"undo B", "B", "C"}, log.get())
+	// The state is restored from the journal
+	assert.Equal(t, "a.bak", resumedState)
+}
+
+func TestRecoverRollsBackRun(t *testing.T) {
+	journal, err := NewJournal(t.TempDir(), newMockLogger())
+	require.NoError(t, err)
+	log := &callLog{}
+	var undoState string
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Execute: log.record("A"), Undo: getStepFunc(log, "undo A", "backup", &undoState)},
+		{Id: "B", TelemetryID: "B", Execute: log.record("B"), Undo: log.record("undo B")},
+		{Id: "C", TelemetryID: "C", Execute: log.record("C"), Undo: log.record("undo C")},
+	}
+	run := interruptedRun(t, journal, steps)
+
+	// The SVID has changed since, so the run isn't finished
+	r := newTestRunner(0)
+	_, finished, err := r.Recover(context.Background(), steps, run, "5678")
+	require.NoError(t, err)
+	assert.False(t, finished)
+	assert.Equal(t, []string{"undo B", "undo A"}, log.get())
+	assert.Equal(t, "a.bak", undoState)
+}
+
+func TestRecoverInvalidSteps(t *testing.T) {
+	journal, err := NewJournal(t.TempDir(), newMockLogger())
+	require.NoError(t, err)
+	log := &callLog{}
+	steps := []Step{
+		{Id: "A", TelemetryID: "A", Execute: log.record("A"), Undo: log.record("undo A")},
+		{Id: "B", TelemetryID: "B", Execute: log.record("B"), Undo: log.record("undo B")},
+		{Id: "C", TelemetryID: "C", Execute: log.record("C"), Undo: log.record("undo C")},
+	}
+	run := interruptedRun(t, journal, steps)
+
+	// The steps are invalid now, so nothing can be run or undone
+	steps[2].DependsOn = []string{"Z"}
+	r := newTestRunner(0)
+	outputs, finished, err := r.Recover(context.Background(), steps, run, "1234")
+	require.Error(t, err)
+	assert.False(t, finished)
+	assert.Empty(t, outputs)
+	assert.Empty(t, log.get())
+}
@@ -0,0 +1,130 @@
+package step
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/dfeldman/spiffelink/pkg/logging"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+)
+
+// What a journal says about one step of an interrupted run
+type journaledStep struct {
+	// The step finished, and its dependents may have started
+	finished bool
+	// The step got past Pre, so it may have changed something
+	changed bool
+}
+
+// Read the steps of a run from its journal, the order they finished in, and the last State journaled.
+func journaledSteps(run JournalRun) (map[string]*journaledStep, []string, *State) {
+	steps := make(map[string]*journaledStep)
+	var order []string
+	var lastState json.RawMessage
+	for _, entry := range run.Entries {
+		if entry.State != nil {
+			lastState = entry.State
+		}
+		if entry.Step == "" {
+			continue
+		}
+		js, ok := steps[entry.Step]
+		if !ok {
+			js = &journaledStep{}
+			steps[entry.Step] = js
+		}
+		switch {
+		case entry.Type == JournalStage && entry.Stage != "pre" && entry.Stage != "undo":
+			js.changed = true
+		case entry.Type == JournalStep && entry.Status == JournalSucceeded:
+			js.finished = true
+			order = append(order, entry.Step)
+		}
+	}
+	state := NewState()
+	if lastState != nil {
+		// A State is only journaled if it could be marshaled, so it can be unmarshaled
+		state.UnmarshalJSON(lastState)
+	}
+	return steps, order, state
+}
+
+// Recover deals with a run that was interrupted by spiffelink dying, as recorded in its journal.
+// Steps that were part way through are undone first, since there is no knowing how far they got. Then, if the
+// run was delivering the SVID with the given serial, which means the steps are still the right ones, the run
+// is finished: the steps that hadn't finished are run, and the output is the same as Run's. Otherwise the
+// steps that finished are undone, most recent first, and the caller should start a new run. Recover returns
+// whether the run was finished, and the output messages of the steps it ran.
+// If the steps are invalid nothing can be undone, so Recover returns an error, and the caller should keep the
+// journal so the run can be recovered once the steps are fixed.
+func (r *Runner) Recover(ctx context.Context, steps []Step, run JournalRun, svidSerial string) ([]StepFuncOutputMessage, bool, error) {
+	log := r.Sl.Logger.WithField(logging.FieldDatabase, run.Begin.Database)
+	// Dry runs don't change anything, and undo runs are started by hand, so neither is resumed
+	if run.Begin.Mode != Execute {
+		log.Infof("Not recovering interrupted %s run", run.Begin.Mode)
+		return nil, false, nil
+	}
+	if _, err := newGraph(steps); err != nil {
+		return nil, false, slerror.StepGraphInvalidError(r.Sl.Logger, run.Begin.StepList, err)
+	}
+
+	journaled, order, state := journaledSteps(run)
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		index[stepLogID(step)] = i
+	}
+	resume := svidSerial != "" && run.Begin.SvidSerial == svidSerial
+	for id := range journaled {
+		if _, ok := index[id]; !ok {
+			// The datastore builds different steps now, probably after an upgrade
+			log.Warnf("Interrupted run has step %s which no longer exists, so it can't be resumed", id)
+			resume = false
+		}
+	}
+
+	var partial []finishedStep
+	for _, step := range steps {
+		js, ok := journaled[stepLogID(step)]
+		if !ok || js.finished || !js.changed {
+			continue
+		}
+		partial = append(partial, r.restoredStep(step, state))
+	}
+	outputs := []StepFuncOutputMessage{}
+	if len(partial) > 0 {
+		log.Infof("Undoing %d steps that were interrupted part way through", len(partial))
+		outputs = append(outputs, r.rollback(ctx, partial)...)
+	}
+	for _, output := range outputs {
+		if !output.Errors.Empty() {
+			log.Warn("Not resuming interrupted run since a step that was part way through couldn't be undone")
+			resume = false
+		}
+	}
+
+	if resume {
+		log.Infof("Resuming interrupted run from %s, %d steps had finished", run.Begin.Time, len(order))
+		done := make(map[int]bool, len(order))
+		for _, id := range order {
+			done[index[id]] = true
+		}
+		return r.run(ctx, steps, Execute, state, done), true, nil
+	}
+
+	log.Infof("Rolling back interrupted run from %s, %d steps had finished", run.Begin.Time, len(order))
+	var finished []finishedStep
+	for _, id := range order {
+		if i, ok := index[id]; ok {
+			finished = append(finished, r.restoredStep(steps[i], state))
+		}
+	}
+	outputs = append(outputs, r.rollback(ctx, finished)...)
+	return outputs, false, nil
+}
+
+// The input to undo a step with, with the State restored from the journal.
+func (r *Runner) restoredStep(step Step, state *State) finishedStep {
+	sfi := r.newInput()
+	sfi.State = state
+	return finishedStep{step, &sfi}
+}
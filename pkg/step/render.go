@@ -0,0 +1,181 @@
+package step
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Step lists can be rendered for review, so operators can see what a datastore will do before it does it.
+
+// Output formats for Render
+const (
+	FormatText    = "text"
+	FormatJSON    = "json"
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+var Formats = []string{FormatText, FormatJSON, FormatDOT, FormatMermaid}
+
+// StepInfo describes a Step without its functions, in a form that can be sent as JSON.
+type StepInfo struct {
+	Name        string `json:"name"`
+	Id          string `json:"id,omitempty"`
+	TelemetryID string `json:"telemetryId"`
+	// Which StepFuncs the step defines
+	CheckDependencies bool     `json:"checkDependencies"`
+	Pre               bool     `json:"pre"`
+	Execute           bool     `json:"execute"`
+	Post              bool     `json:"post"`
+	Undo              bool     `json:"undo"`
+	DependsOn         []string `json:"dependsOn,omitempty"`
+}
+
+// StepListInfo describes a StepList. Edges are the dependencies between steps, by index into Steps: each edge
+// is [from, to], and step to starts after step from finishes.
+type StepListInfo struct {
+	DatastoreName string     `json:"datastore"`
+	ID            string     `json:"id"`
+	Steps         []StepInfo `json:"steps"`
+	Edges         [][2]int   `json:"edges"`
+}
+
+// Describe returns the description of a step list. Returns an error if the dependencies are invalid,
+// like Validate.
+func (sl StepList) Describe() (StepListInfo, error) {
+	g, err := newGraph(sl.Steps)
+	if err != nil {
+		return StepListInfo{}, err
+	}
+	info := StepListInfo{DatastoreName: sl.DatastoreName, ID: sl.ID, Steps: []StepInfo{}, Edges: [][2]int{}}
+	for i, step := range sl.Steps {
+		info.Steps = append(info.Steps, StepInfo{
+			Name:              step.Name,
+			Id:                step.Id,
+			TelemetryID:       step.TelemetryID,
+			CheckDependencies: step.CheckDependencies != nil,
+			Pre:               step.Pre != nil,
+			Execute:           step.Execute != nil,
+			Post:              step.Post != nil,
+			Undo:              step.Undo != nil,
+			DependsOn:         step.DependsOn,
+		})
+		for _, dep := range g.deps[i] {
+			info.Edges = append(info.Edges, [2]int{dep, i})
+		}
+	}
+	return info, nil
+}
+
+// The StepFuncs a step defines, in the order they run
+func (s StepInfo) stages() []string {
+	var stages []string
+	for _, stage := range []struct {
+		name    string
+		defined bool
+	}{
+		{"checkDependencies", s.CheckDependencies},
+		{"pre", s.Pre},
+		{"execute", s.Execute},
+		{"post", s.Post},
+		{"undo", s.Undo},
+	} {
+		if stage.defined {
+			stages = append(stages, stage.name)
+		}
+	}
+	return stages
+}
+
+// Render writes a step list in one of Formats.
+func (info StepListInfo) Render(w io.Writer, format string) error {
+	switch format {
+	case FormatText:
+		return info.renderText(w)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	case FormatDOT:
+		return info.renderDOT(w)
+	case FormatMermaid:
+		return info.renderMermaid(w)
+	}
+	return fmt.Errorf("unknown format %s, use one of %s", format, strings.Join(Formats, ", "))
+}
+
+func (info StepListInfo) renderText(w io.Writer) error {
+	fmt.Fprintf(w, "Datastore: %s\nStep list: %s\n\n", info.DatastoreName, info.ID)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tNAME\tID\tTELEMETRY ID\tCHECK\tPRE\tEXECUTE\tPOST\tUNDO\tDEPENDS ON")
+	mark := func(defined bool) string {
+		if defined {
+			return "yes"
+		}
+		return "-"
+	}
+	for i, step := range info.Steps {
+		id := step.Id
+		if id == "" {
+			id = "-"
+		}
+		dependsOn := strings.Join(step.DependsOn, ", ")
+		if dependsOn == "" {
+			dependsOn = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, step.Name, id, step.TelemetryID,
+			mark(step.CheckDependencies), mark(step.Pre), mark(step.Execute), mark(step.Post), mark(step.Undo), dependsOn)
+	}
+	return tw.Flush()
+}
+
+// The label of a step in a graph: its name, ID and the StepFuncs it defines, one per line
+func (s StepInfo) label() []string {
+	id := s.Id
+	if id == "" {
+		id = s.TelemetryID
+	}
+	return []string{s.Name, id, strings.Join(s.stages(), ", ")}
+}
+
+func (info StepListInfo) renderDOT(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", info.ID)
+	b.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+	for i, step := range info.Steps {
+		var lines []string
+		for _, line := range step.label() {
+			// %q escapes quotes and backslashes the same way DOT does
+			quoted := fmt.Sprintf("%q", line)
+			lines = append(lines, quoted[1:len(quoted)-1])
+		}
+		fmt.Fprintf(&b, "  s%d [label=\"%s\"];\n", i, strings.Join(lines, `\n`))
+	}
+	for _, edge := range info.Edges {
+		fmt.Fprintf(&b, "  s%d -> s%d;\n", edge[0], edge[1])
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (info StepListInfo) renderMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for i, step := range info.Steps {
+		var lines []string
+		for _, line := range step.label() {
+			// Mermaid labels are quoted, and quotes inside them are written as entities
+			lines = append(lines, strings.ReplaceAll(line, `"`, "#quot;"))
+		}
+		fmt.Fprintf(&b, "  s%d[\"%s\"]\n", i, strings.Join(lines, "<br/>"))
+	}
+	for _, edge := range info.Edges {
+		fmt.Fprintf(&b, "  s%d --> s%d\n", edge[0], edge[1])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,74 @@
+package step
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func renderTestList() StepList {
+	return StepList{
+		DatastoreName: "oracle",
+		ID:            "oracle-update",
+		Steps: []Step{
+			{Name: "Write wallet", Id: "WRITE_WALLET", TelemetryID: "ORACLE_WRITE_WALLET", Pre: successfulStepFunc, Execute: successfulStepFunc, Undo: successfulStepFunc},
+			{Name: `Reload "listener"`, Id: "RELOAD", TelemetryID: "ORACLE_RELOAD", Execute: successfulStepFunc, Post: successfulStepFunc, DependsOn: []string{"WRITE_WALLET"}},
+			{Name: "Check", TelemetryID: "ORACLE_CHECK", CheckDependencies: successfulStepFunc, DependsOn: []string{"WRITE_WALLET"}},
+		},
+	}
+}
+
+func render(t *testing.T, format string) string {
+	info, err := renderTestList().Describe()
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, info.Render(&b, format))
+	return b.String()
+}
+
+func TestDescribe(t *testing.T) {
+	info, err := renderTestList().Describe()
+	require.NoError(t, err)
+	require.Len(t, info.Steps, 3)
+	assert.Equal(t, []string{"pre", "execute", "undo"}, info.Steps[0].stages())
+	assert.Equal(t, [][2]int{{0, 1}, {0, 2}}, info.Edges)
+
+	// Without DependsOn, each step follows the one before it
+	sl := StepList{Steps: []Step{{TelemetryID: "A"}, {TelemetryID: "B"}}}
+	info, err = sl.Describe()
+	require.NoError(t, err)
+	assert.Equal(t, [][2]int{{0, 1}}, info.Edges)
+
+	sl.Steps[0].DependsOn = []string{"MISSING"}
+	_, err = sl.Describe()
+	assert.Error(t, err)
+}
+
+func TestRenderFormats(t *testing.T) {
+	text := render(t, FormatText)
+	assert.Contains(t, text, "Step list: oracle-update")
+	assert.Regexp(t, `1\s+Write wallet\s+WRITE_WALLET\s+ORACLE_WRITE_WALLET\s+-\s+yes\s+yes\s+-\s+yes\s+-`, text)
+	assert.Regexp(t, `3\s+Check\s+-\s+ORACLE_CHECK\s+yes\s+-\s+-\s+-\s+-\s+WRITE_WALLET`, text)
+
+	var decoded StepListInfo
+	require.NoError(t, json.Unmarshal([]byte(render(t, FormatJSON)), &decoded))
+	assert.Equal(t, "RELOAD", decoded.Steps[1].Id)
+	assert.True(t, decoded.Steps[1].Post)
+
+	dot := render(t, FormatDOT)
+	assert.Contains(t, dot, `digraph "oracle-update" {`)
+	assert.Contains(t, dot, `s1 [label="Reload \"listener\"\nRELOAD\nexecute, post"];`)
+	assert.Contains(t, dot, "s0 -> s2;")
+
+	mermaid := render(t, FormatMermaid)
+	assert.Contains(t, mermaid, "flowchart LR\n")
+	assert.Contains(t, mermaid, `s1["Reload #quot;listener#quot;<br/>RELOAD<br/>execute, post"]`)
+	assert.Contains(t, mermaid, "s0 --> s1\n")
+
+	info, err := renderTestList().Describe()
+	require.NoError(t, err)
+	assert.Error(t, info.Render(&bytes.Buffer{}, "yaml"))
+}
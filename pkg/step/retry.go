@@ -0,0 +1,65 @@
+package step
+
+import (
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+)
+
+// RetryPolicy says how a step is retried when one of its stages fails. A retry runs the whole step again,
+// starting from Pre.
+type RetryPolicy struct {
+	// Total number of attempts, including the first. 0 or 1 means the step is not retried.
+	Attempts int
+	// Wait before the first retry. It doubles after every retry, up to MaxBackoff if that is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Only errors with these codes are retried, like a locked wallet or a busy listener. If it is empty,
+	// nothing is retried. A step that was cancelled or timed out is never retried.
+	RetryableCodes []slerror.ErrorCode
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// Whether every error in the list can be retried.
+func (p *RetryPolicy) retryable(errs slerror.SLErrorList) bool {
+	if p == nil || len(p.RetryableCodes) == 0 {
+		return false
+	}
+	for _, err := range errs.Errors {
+		if err.Code == slerror.StepCancelledCode || err.Code == slerror.StepTimedOutCode {
+			return false
+		}
+		found := false
+		for _, code := range p.RetryableCodes {
+			if err.Code == code {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// The wait before the given retry. The first retry is retry 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < retry; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return wait
+}
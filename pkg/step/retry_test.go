@@ -0,0 +1,152 @@
+package step
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const walletLocked slerror.ErrorCode = "WALLET_LOCKED"
+
+// flakyStepFunc fails with the given code the first failures times it is called, and records every call.
+func flakyStepFunc(failures int, code slerror.ErrorCode, calls *[]string, name string) StepFunc {
+	return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		*calls = append(*calls, name)
+		if failures > 0 {
+			failures--
+			return StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{
+				{Code: code, Err: fmt.Errorf("transient failure")},
+			}}}
+		}
+		return StepFuncOutputMessage{}
+	}
+}
+
+func recordingStepFunc(calls *[]string, name string) StepFunc {
+	return flakyStepFunc(0, "", calls, name)
+}
+
+func runWithOutputs(t *testing.T, steps []Step) ([]StepFuncOutputMessage, []StepFuncOutputMessage) {
+	out := make(chan StepFuncOutputMessage, 100)
+	r := Runner{
+		Sl:     &spiffelinkcore.SpiffeLinkCore{Logger: newMockLogger()},
+		Dbc:    &config.DatabaseConfig{Name: "db1"},
+		Output: out,
+		// Stages that ignore their context are given up on quickly
+		AbandonAfter: 50 * time.Millisecond,
+	}
+	failed := r.Run(context.Background(), steps, Execute)
+	close(out)
+	var sent []StepFuncOutputMessage
+	for output := range out {
+		sent = append(sent, output)
+	}
+	return failed, sent
+}
+
+func TestRetryIdempotentStep(t *testing.T) {
+	var calls []string
+	steps := []Step{{
+		Name:        "Reload listener",
+		TelemetryID: "TEST_RELOAD",
+		Pre:         recordingStepFunc(&calls, "pre"),
+		Execute:     flakyStepFunc(2, walletLocked, &calls, "execute"),
+		Undo:        recordingStepFunc(&calls, "undo"),
+		Idempotent:  true,
+		Retry:       &RetryPolicy{Attempts: 3, Backoff: time.Millisecond, RetryableCodes: []slerror.ErrorCode{walletLocked}},
+	}}
+
+	failed, sent := runWithOutputs(t, steps)
+	assert.Nil(t, failed)
+	// Idempotent steps are retried without undoing them
+	assert.Equal(t, []string{"pre", "execute", "pre", "execute", "pre", "execute"}, calls)
+	require.Len(t, sent, 6)
+	assert.Equal(t, 1, sent[1].Attempt)
+	assert.False(t, sent[1].Errors.Empty())
+	assert.Equal(t, 3, sent[5].Attempt)
+	assert.True(t, sent[5].Errors.Empty())
+}
+
+func TestRetryUndoesNonIdempotentStep(t *testing.T) {
+	var calls []string
+	steps := []Step{{
+		Name:        "Write wallet",
+		TelemetryID: "TEST_WRITE",
+		Execute:     flakyStepFunc(1, walletLocked, &calls, "execute"),
+		Undo:        recordingStepFunc(&calls, "undo"),
+		Retry:       &RetryPolicy{Attempts: 2, Backoff: time.Millisecond, RetryableCodes: []slerror.ErrorCode{walletLocked}},
+	}}
+
+	failed, sent := runWithOutputs(t, steps)
+	assert.Nil(t, failed)
+	assert.Equal(t, []string{"execute", "undo", "execute"}, calls)
+	require.Len(t, sent, 3)
+	assert.Equal(t, "undo", sent[1].Stage)
+	assert.Equal(t, 1, sent[1].Attempt)
+	assert.Equal(t, 2, sent[2].Attempt)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var calls []string
+	steps := []Step{{
+		Name:        "Write wallet",
+		TelemetryID: "TEST_WRITE",
+		Execute:     flakyStepFunc(5, walletLocked, &calls, "execute"),
+		Undo:        recordingStepFunc(&calls, "undo"),
+		Idempotent:  true,
+		Retry:       &RetryPolicy{Attempts: 3, Backoff: time.Millisecond, RetryableCodes: []slerror.ErrorCode{walletLocked}},
+	}}
+	failed, _ := runWithOutputs(t, steps)
+	// Every attempt is in the output
+	assert.Len(t, failed, 3)
+	assert.Equal(t, []string{"execute", "execute", "execute"}, calls)
+
+	// An error that isn't retryable fails the step straight away
+	calls = nil
+	steps[0].Execute = flakyStepFunc(1, "LISTENER_MISSING", &calls, "execute")
+	failed, _ = runWithOutputs(t, steps)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, []string{"execute"}, calls)
+
+	// Without any retryable codes, nothing is retried
+	calls = nil
+	steps[0].Execute = flakyStepFunc(1, walletLocked, &calls, "execute")
+	steps[0].Retry.RetryableCodes = nil
+	failed, _ = runWithOutputs(t, steps)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, []string{"execute"}, calls)
+
+	// Neither is a stage that timed out, even if its code is listed
+	calls = nil
+	steps[0].Execute = flakyStepFunc(1, slerror.StepTimedOutCode, &calls, "execute")
+	steps[0].Retry.RetryableCodes = []slerror.ErrorCode{slerror.StepTimedOutCode}
+	runWithOutputs(t, steps)
+	// The timeout is an interruption, so the step is undone instead
+	assert.Equal(t, []string{"execute", "undo"}, calls)
+	steps[0].Retry.RetryableCodes = []slerror.ErrorCode{walletLocked}
+
+	// A step that isn't idempotent and has no undo can't be retried safely
+	calls = nil
+	steps[0].Execute = flakyStepFunc(1, walletLocked, &calls, "execute")
+	steps[0].Idempotent = false
+	steps[0].Undo = nil
+	failed, _ = runWithOutputs(t, steps)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, []string{"execute"}, calls)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, p.backoff(1))
+	assert.Equal(t, 2*time.Second, p.backoff(2))
+	assert.Equal(t, 4*time.Second, p.backoff(3))
+	assert.Equal(t, 5*time.Second, p.backoff(4))
+	assert.Equal(t, 1, (*RetryPolicy)(nil).attempts())
+}
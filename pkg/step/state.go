@@ -0,0 +1,130 @@
+package step
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// State is the data the steps of a list keep while they run, like the path of a backup that Undo restores.
+// There is one State for each run of a step list, shared by every stage of every step, so values flow from
+// Pre to Execute to Post to Undo, and from one step to the steps after it. Steps that run in parallel should
+// use different keys.
+//
+// Values are stored as JSON, so a State can be written to the journal and restored if the run has to be
+// recovered after a restart. Use Put to store a value and Get to read it back as its type.
+type State struct {
+	mu     sync.Mutex
+	values map[string]json.RawMessage
+}
+
+func NewState() *State {
+	return &State{values: make(map[string]json.RawMessage)}
+}
+
+// Put stores a value under a key, replacing any value already there. Returns an error if the value can't be
+// converted to JSON.
+func (s *State) Put(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("unable to store %s in step state: %w", key, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = data
+	return nil
+}
+
+// Put stores a value under a key in a State. It is the same as State.Put, and is here to go with Get.
+func Put[T any](s *State, key string, value T) error {
+	return s.Put(key, value)
+}
+
+// Get reads the value stored under a key as a T. Returns false if there is no value, or if it isn't a T.
+func Get[T any](s *State, key string) (T, bool) {
+	var value T
+	data, ok := s.raw(key)
+	if !ok {
+		return value, false
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return value, false
+	}
+	return value, true
+}
+
+func (s *State) raw(key string) (json.RawMessage, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.values[key]
+	return data, ok
+}
+
+func (s *State) Has(key string) bool {
+	_, ok := s.raw(key)
+	return ok
+}
+
+func (s *State) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// Keys returns the keys that have values, sorted.
+func (s *State) Keys() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *State) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+// MarshalJSON writes the State as a JSON object of its keys and values.
+func (s *State) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s.values)
+}
+
+func (s *State) UnmarshalJSON(data []byte) error {
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = values
+	return nil
+}
+
+// String returns the State as JSON, for debugging output.
+func (s *State) String() string {
+	if s == nil {
+		return "{}"
+	}
+	data, err := s.MarshalJSON()
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return string(data)
+}
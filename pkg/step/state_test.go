@@ -0,0 +1,81 @@
+package step
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type walletBackup struct {
+	Path   string `json:"path"`
+	Serial string `json:"serial"`
+}
+
+func TestStateGetPut(t *testing.T) {
+	state := NewState()
+	require.NoError(t, Put(state, "backup", walletBackup{Path: "/opt/wallet.bak", Serial: "1234"}))
+	require.NoError(t, state.Put("attempts", 2))
+
+	backup, ok := Get[walletBackup](state, "backup")
+	assert.True(t, ok)
+	assert.Equal(t, walletBackup{Path: "/opt/wallet.bak", Serial: "1234"}, backup)
+	attempts, ok := Get[int](state, "attempts")
+	assert.True(t, ok)
+	assert.Equal(t, 2, attempts)
+
+	// Missing keys and values of the wrong type
+	_, ok = Get[string](state, "missing")
+	assert.False(t, ok)
+	_, ok = Get[int](state, "backup")
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"attempts", "backup"}, state.Keys())
+	state.Delete("attempts")
+	assert.False(t, state.Has("attempts"))
+
+	// Values that can't be converted to JSON are refused
+	assert.Error(t, state.Put("callback", func() {}))
+}
+
+func TestStateJSON(t *testing.T) {
+	state := NewState()
+	require.NoError(t, state.Put("backup", walletBackup{Path: "/opt/wallet.bak"}))
+	data, err := json.Marshal(state)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"backup":{"path":"/opt/wallet.bak","serial":""}}`, string(data))
+	assert.JSONEq(t, string(data), state.String())
+
+	restored := NewState()
+	require.NoError(t, json.Unmarshal(data, restored))
+	backup, ok := Get[walletBackup](restored, "backup")
+	assert.True(t, ok)
+	assert.Equal(t, "/opt/wallet.bak", backup.Path)
+}
+
+func TestStateFlowsThroughStages(t *testing.T) {
+	var undone string
+	steps := []Step{
+		{
+			Name:        "Write wallet",
+			TelemetryID: "WRITE_WALLET",
+			Pre: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+				sfi.State.Put("backup", "/opt/wallet.bak")
+				return StepFuncOutputMessage{}
+			},
+			Execute: failingStepFunc,
+			Undo: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+				undone, _ = Get[string](sfi.State, "backup")
+				return StepFuncOutputMessage{}
+			},
+			Retry: &RetryPolicy{Attempts: 2, RetryableCodes: []slerror.ErrorCode{"ERROR_UNKNOWN"}},
+		},
+	}
+	r := newTestRunner(0)
+	assert.NotNil(t, r.Run(context.Background(), steps, Execute))
+	// The step is undone before it is retried, with the state from Pre
+	assert.Equal(t, "/opt/wallet.bak", undone)
+}
@@ -2,17 +2,21 @@ package step
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/logging"
 	"github.com/dfeldman/spiffelink/pkg/shell"
 	"github.com/dfeldman/spiffelink/pkg/slerror"
 	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type State interface{}
-
 // TODO move StepFuncOutputMessage to spiffelinkcore and give it a better name
 
 // Each StepFunc in a Step gets the same inputs. There are a lot
@@ -22,13 +26,13 @@ type StepFuncInput struct {
 	Sl *spiffelinkcore.SpiffeLinkCore
 	// This is the database config for the currently executing database.
 	Dbc *config.DatabaseConfig
-	// This is an opaque State interface that can be used for whatever state needs to be saved.
-	// Most of the time, this is nil.
-	// For example, if we need to generate an ID to store the certificate under, we can store the ID
-	// temporarily here.
-	State State
-	// This is a pointer to the global logger.
-	Logger *logrus.Logger
+	// This is the state shared by every step in the list, for whatever needs to be saved between stages.
+	// For example, if we need to generate an ID to store the certificate under, we can Put the ID here
+	// in Execute and Get it back in Undo. See State.
+	State *State
+	// This is the logger for the currently executing stage. Its entries carry the step and stage fields,
+	// plus the task fields if the step list is running in a task.
+	Logger *logrus.Entry
 	// This is the update from the SPIFFE workload API that we are currently processing.
 	//   The format of this struct is: type SpiffeLinkUpdate struct {
 	//     Bundles []*x509bundle.Bundle
@@ -40,9 +44,11 @@ type StepFuncInput struct {
 }
 
 type StepFuncOutputMessage struct {
-	Name     string
-	Id       string
-	Stage    string
+	Name  string
+	Id    string
+	Stage string
+	// Which attempt at the step this is, starting from 1. See RetryPolicy.
+	Attempt  int
 	Time     time.Time
 	Complete bool
 	Errors   slerror.SLErrorList
@@ -53,7 +59,7 @@ func (sfi *StepFuncOutputMessage) success() bool {
 }
 
 // This is the signature for the StepFuncs that are called.
-type StepFunc func(ctx context.Context, sfi StepFuncInput) (State, StepFuncOutputMessage)
+type StepFunc func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage
 
 // The goal of the Step package is to make a series of Steps that can be called.
 // Each Step consists of well-defined, preconditions, postconditions, execution, and
@@ -78,6 +84,18 @@ type Step struct {
 	Post StepFunc
 	// Undo the step
 	Undo StepFunc
+	// Retry the step if it fails. Nil means the step is not retried.
+	Retry *RetryPolicy
+	// Execute and Post can safely be run again after they fail. If this is false, the step is undone
+	// before it is retried, and it is not retried at all if it has no Undo.
+	Idempotent bool
+	// Limit on the whole step, including retries. 0 means no limit other than the task's.
+	Timeout time.Duration
+	// Limit on each call to a StepFunc. 0 means no limit other than the step's.
+	StageTimeout time.Duration
+	// The Ids of the steps that must finish before this one starts. If no step in a list sets DependsOn,
+	// the steps run one at a time in order.
+	DependsOn []string
 }
 
 // Several Steps make a StepList
@@ -95,101 +113,465 @@ const (
 	Undo    Mode = "undo"
 )
 
+// How long each undo gets when steps are rolled back after an interruption, if the step has no StageTimeout
+const rollbackTimeout = time.Minute
+
+// How many steps Runner runs at once if MaxParallel isn't set
+const DefaultMaxParallel = 4
+
+// How long Runner waits for a stage to return after it is stopped, if AbandonAfter isn't set
+const DefaultAbandonAfter = 10 * time.Second
+
 type StepBuilder interface {
 	BuildSteps(sl spiffelinkcore.SpiffeLinkCore, dbc *config.DatabaseConfig) (StepList, slerror.SLError)
 }
 
-func NullStepFunc(state State, update spiffelinkcore.SpiffeLinkUpdate) (State, StepFuncOutputMessage) {
-	return state, StepFuncOutputMessage{}
+func NullStepFunc(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+	return StepFuncOutputMessage{}
+}
+
+// Failed is the output of a stage that failed with err. An error that isn't an SLError, and doesn't wrap one,
+// becomes one with slerror.New.
+func Failed(err error) StepFuncOutputMessage {
+	var slErr slerror.SLError
+	if !errors.As(err, &slErr) {
+		slErr = slerror.New(err.Error())
+	}
+	return StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{slErr}}}
+}
+
+// Runner runs step lists. Every output message is sent on Output (if it is set) as soon as its stage finishes,
+// so the caller can follow progress while the steps are running.
+type Runner struct {
+	Sl           *spiffelinkcore.SpiffeLinkCore
+	Dbc          *config.DatabaseConfig
+	Update       *spiffelinkcore.SpiffeLinkUpdate
+	ShellContext shell.ShellContext
+	Output       chan<- StepFuncOutputMessage
+	// How many steps can run at once when the steps declare DependsOn. 0 means DefaultMaxParallel.
+	MaxParallel int
+	// How long a stage gets to return after it is cancelled or times out. A stage that is still running
+	// after that is abandoned, and its step isn't undone. 0 means DefaultAbandonAfter.
+	AbandonAfter time.Duration
+	// Records every stage, so the run can be recovered if spiffelink dies in the middle of it. Optional.
+	Journal *JournalWriter
 }
 
 // Run a list of steps
-// TODO This code is incomplete. It should:
-// 1: Supply output messages on an output channel
-// 2: Actually check if the context has been cancelled after calling each sub-step.
 func Run(ctx context.Context, sl *spiffelinkcore.SpiffeLinkCore, dbc *config.DatabaseConfig, steps []Step, mode Mode) []StepFuncOutputMessage {
-	logger := sl.Logger
-	sfi := StepFuncInput{
-		Logger: logger,
-		State:  nil,
-		Dbc:    dbc,
-		Sl:     sl,
-		Update: nil,
-	}
-	var state State
-	for _, step := range steps {
-		logger.Printf("Running step: %s", step.Name)
-		outputs := []StepFuncOutputMessage{}
-		output := StepFuncOutputMessage{}
-		switch mode {
-		case Execute:
-			if step.Pre != nil {
-				state, output := runWithLogging(ctx, step.Pre, sfi, "pre")
-				output.Stage = "Pre"
-				outputs = append(outputs, output)
-				if !output.Errors.Empty() {
-
-					return outputs
-				}
-				sfi.State = &state
+	r := Runner{Sl: sl, Dbc: dbc}
+	return r.Run(ctx, steps, mode)
+}
+
+// A step that has been run, with the input it ran with, so it can be undone.
+type finishedStep struct {
+	step Step
+	sfi  *StepFuncInput
+}
+
+// The result of running one step of the graph
+type stepResult struct {
+	index   int
+	sfi     *StepFuncInput
+	outputs []StepFuncOutputMessage
+}
+
+// Run a list of steps. Returns nil if every step succeeded, or the output messages of the steps that failed.
+// Each step starts once the steps it depends on have finished (see graph.go), with at most MaxParallel steps
+// running at once. In Undo mode the graph is reversed, so a step is undone after the steps that depend on it.
+// Once a step fails no more steps are started, but the ones already running are left to finish.
+// If ctx is cancelled or a step times out, the steps that already finished are undone in the reverse of the
+// order they finished in, and their undo output messages are returned too.
+func (r *Runner) Run(ctx context.Context, steps []Step, mode Mode) []StepFuncOutputMessage {
+	return r.run(ctx, steps, mode, NewState(), nil)
+}
+
+// Run a list of steps with the given state, skipping the steps in done, which finished in an earlier run.
+func (r *Runner) run(ctx context.Context, steps []Step, mode Mode, state *State, done map[int]bool) []StepFuncOutputMessage {
+	g, err := newGraph(steps)
+	if err != nil {
+		output := StepFuncOutputMessage{
+			Name:     "Validate steps",
+			Stage:    "validate",
+			Time:     time.Now(),
+			Complete: true,
+			Errors:   slerror.SLErrorList{Errors: []slerror.SLError{slerror.StepGraphInvalidError(r.Sl.Logger, r.Dbc.Name, err)}},
+		}
+		r.send(output)
+		return []StepFuncOutputMessage{output}
+	}
+	if mode == Undo {
+		g = g.reversed()
+	}
+	maxParallel := r.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = DefaultMaxParallel
+	}
+
+	// Every step shares the state, but has its own input since the logger is per step
+	inputFor := func() *StepFuncInput {
+		sfi := r.newInput()
+		sfi.State = state
+		return &sfi
+	}
+
+	// Nil until a step fails
+	var failed []StepFuncOutputMessage
+	var finished []finishedStep
+	waiting := make([]int, len(steps))
+	for i := range steps {
+		waiting[i] = len(g.deps[i])
+	}
+	// Steps that already finished count as finished for this run too, in list order so that steps in a
+	// sequence come out in order
+	for i := range steps {
+		if !done[i] {
+			continue
+		}
+		finished = append(finished, finishedStep{steps[i], inputFor()})
+		r.Journal.stepEnded(steps[i], state, nil)
+		for _, next := range g.dependents[i] {
+			waiting[next]--
+		}
+	}
+	var ready []int
+	for i := range steps {
+		if !done[i] && waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	results := make(chan stepResult)
+	running := 0
+	for len(ready) > 0 || running > 0 {
+		for failed == nil && len(ready) > 0 && running < maxParallel {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			stepSfi := inputFor()
+			go func() {
+				outputs := r.runStep(ctx, steps[i], stepSfi, mode)
+				results <- stepResult{index: i, sfi: stepSfi, outputs: outputs}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		step := steps[result.index]
+		r.Journal.stepEnded(step, state, result.outputs)
+		if result.outputs != nil {
+			// A step interrupted after Pre may have done part of its work. A step that is still running
+			// can't be undone, since it could overwrite whatever its undo puts back.
+			if interrupted(result.outputs) && !abandoned(result.outputs) && result.outputs[len(result.outputs)-1].Stage != "pre" {
+				finished = append(finished, finishedStep{step, result.sfi})
 			}
-			if step.Execute != nil {
-				state, output = runWithLogging(ctx, step.Execute, sfi, "execute")
-				output.Stage = "Execute"
-				outputs = append(outputs, output)
-				if !output.Errors.Empty() {
-					return outputs
-				}
-				sfi.State = &state
+			if failed == nil {
+				failed = []StepFuncOutputMessage{}
 			}
-			if step.Post != nil {
-				_, output = runWithLogging(ctx, step.Post, sfi, "post")
-				output.Stage = "post"
-				outputs = append(outputs, output)
-				if !output.Errors.Empty() {
-					return outputs
-				}
+			failed = append(failed, result.outputs...)
+			continue
+		}
+		finished = append(finished, finishedStep{step, result.sfi})
+		for _, next := range g.dependents[result.index] {
+			waiting[next]--
+			if waiting[next] == 0 {
+				ready = append(ready, next)
 			}
-		case DryRun:
-			if step.Pre != nil {
-				_, output := runWithLogging(ctx, step.Pre, sfi, "pre")
-				output.Stage = "pre"
-				outputs = append(outputs, output)
-				if !output.Errors.Empty() {
-					return outputs
-				}
+		}
+	}
+	if failed != nil && mode == Execute && interrupted(failed) {
+		failed = append(failed, r.rollback(ctx, finished)...)
+	}
+	return failed
+}
+
+func (r *Runner) newInput() StepFuncInput {
+	return StepFuncInput{
+		State:        nil,
+		Dbc:          r.Dbc,
+		Sl:           r.Sl,
+		Update:       r.Update,
+		ShellContext: r.ShellContext,
+	}
+}
+
+// Whether a step failed because it was cancelled or timed out, rather than because of an error.
+func interrupted(outputs []StepFuncOutputMessage) bool {
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			if err.Code == slerror.StepCancelledCode || err.Code == slerror.StepTimedOutCode {
+				return true
 			}
-		case Undo:
-			if step.Undo != nil {
-				_, output := runWithLogging(ctx, step.Undo, sfi, "undo")
-				output.Stage = "undo"
-				outputs = append(outputs, output)
-				if !output.Errors.Empty() {
-					return outputs
-				}
+		}
+	}
+	return false
+}
+
+// Whether a stage of the step was left running in the background. See callWithContext.
+func abandoned(outputs []StepFuncOutputMessage) bool {
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			if err.Code == slerror.StepAbandonedCode {
+				return true
 			}
+		}
+	}
+	return false
+}
+
+// Undo steps, most recent first, after a run was interrupted. A step always finishes after the steps it
+// depends on, so this undoes the graph in reverse topological order. The run's context is already done, so
+// each undo gets a new one, limited by the step's StageTimeout or rollbackTimeout. Every step is undone even
+// if an earlier undo fails.
+func (r *Runner) rollback(ctx context.Context, steps []finishedStep) []StepFuncOutputMessage {
+	outputs := []StepFuncOutputMessage{}
+	span := trace.SpanFromContext(ctx)
+	for i := len(steps) - 1; i >= 0; i-- {
+		step, sfi := steps[i].step, steps[i].sfi
+		if step.Undo == nil {
+			continue
+		}
+		timeout := step.StageTimeout
+		if timeout == 0 {
+			timeout = rollbackTimeout
+		}
+		undoCtx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), span), timeout)
+		sfi.Logger = sfi.Sl.Logger.WithField(logging.FieldStep, stepLogID(step))
+		sfi.Logger.Infof("Undoing step after interruption: %s", step.Name)
+		output := r.runWithLogging(undoCtx, step, step.Undo, *sfi, "undo", func(stage string) slerror.SLError {
+			return slerror.StepTimedOutError(sfi.Sl.Logger, step.Name, stage, timeout)
+		})
+		cancel()
+		output.Stage = "undo"
+		outputs = append(outputs, output)
+		r.send(output)
+	}
+	return outputs
+}
+
+func (r *Runner) send(output StepFuncOutputMessage) {
+	if r.Output != nil {
+		r.Output <- output
+	}
+}
+
+// Run the stages of one step, retrying it according to its RetryPolicy. Returns nil if every stage
+// succeeded, like Run, or the output messages of every attempt if it failed.
+// Each step is a span named by its TelemetryID.
+func (r *Runner) runStep(parent context.Context, step Step, sfi *StepFuncInput, mode Mode) []StepFuncOutputMessage {
+	ctx, span := telemetry.Tracer().Start(parent, step.TelemetryID, trace.WithAttributes(
+		attribute.String(telemetry.AttrStep, stepLogID(step)),
+		attribute.String(telemetry.AttrDatabase, sfi.Dbc.Name),
+		attribute.String("mode", string(mode)),
+	))
+	defer span.End()
+
+	sfi.Logger = sfi.Sl.Logger.WithField(logging.FieldStep, stepLogID(step))
+	sfi.Logger.Infof("Running step: %s", step.Name)
+	if mode != Execute && mode != DryRun && mode != Undo {
+		span.SetStatus(codes.Error, "unknown mode")
+		return []StepFuncOutputMessage{}
+	}
+
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+	// The error for a stage that was stopped, depending on what stopped it
+	interrupt := func(stage string) slerror.SLError {
+		switch {
+		case parent.Err() != nil:
+			return slerror.StepCancelledError(sfi.Sl.Logger, step.Name, stage, parent.Err())
+		case ctx.Err() != nil:
+			return slerror.StepTimedOutError(sfi.Sl.Logger, step.Name, stage, step.Timeout)
 		default:
+			return slerror.StepTimedOutError(sfi.Sl.Logger, step.Name, stage, step.StageTimeout)
+		}
+	}
+
+	outputs := []StepFuncOutputMessage{}
+	for attempt := 1; ; attempt++ {
+		attemptOutputs, failedStage := r.runStages(ctx, step, sfi, mode, attempt, interrupt)
+		outputs = append(outputs, attemptOutputs...)
+		if failedStage == "" {
+			return nil
+		}
+		span.SetStatus(codes.Error, failedStage+" failed")
+		failure := attemptOutputs[len(attemptOutputs)-1]
+		// Once the step or the whole run is out of time, there is no point retrying
+		if attempt >= step.Retry.attempts() || !step.Retry.retryable(failure.Errors) || ctx.Err() != nil {
 			return outputs
 		}
+
+		// Execute or Post may have changed something before failing. Unless they are safe to repeat,
+		// put things back the way they were before trying again.
+		if mode == Execute && !step.Idempotent && failedStage != "pre" {
+			if step.Undo == nil {
+				sfi.Logger.Warn("Not retrying step since it is not idempotent and can't be undone")
+				return outputs
+			}
+			output := r.runWithLogging(ctx, step, step.Undo, *sfi, "undo", interrupt)
+			output.Stage = "undo"
+			output.Attempt = attempt
+			outputs = append(outputs, output)
+			r.send(output)
+			if !output.Errors.Empty() {
+				return outputs
+			}
+		}
+
+		wait := step.Retry.backoff(attempt)
+		sfi.Logger.WithField("attempt", attempt+1).Infof("Retrying step in %v", wait)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt+1)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return outputs
+		}
+	}
+}
+
+// Run the stages of one attempt at a step. Returns the output messages, and the stage that failed, or ""
+// if they all succeeded.
+func (r *Runner) runStages(ctx context.Context, step Step, sfi *StepFuncInput, mode Mode, attempt int, interrupt interruption) ([]StepFuncOutputMessage, string) {
+	outputs := []StepFuncOutputMessage{}
+	// Run one stage, and report whether it succeeded
+	runStage := func(fn StepFunc, stage string) bool {
+		output := r.runWithLogging(ctx, step, fn, *sfi, stage, interrupt)
+		output.Stage = stage
+		output.Attempt = attempt
+		outputs = append(outputs, output)
+		r.send(output)
+		return output.Errors.Empty()
+	}
+	switch mode {
+	case Execute:
+		if step.Pre != nil && !runStage(step.Pre, "pre") {
+			return outputs, "pre"
+		}
+		if step.Execute != nil && !runStage(step.Execute, "execute") {
+			return outputs, "execute"
+		}
+		if step.Post != nil && !runStage(step.Post, "post") {
+			return outputs, "post"
+		}
+	case DryRun:
+		if step.Pre != nil && !runStage(step.Pre, "pre") {
+			return outputs, "pre"
+		}
+	case Undo:
+		if step.Undo != nil && !runStage(step.Undo, "undo") {
+			return outputs, "undo"
+		}
+	}
+	return outputs, ""
+}
+
+// The ID used for a step in log entries. Not every step sets an Id, but they all have a TelemetryID.
+func stepLogID(step Step) string {
+	if step.Id != "" {
+		return step.Id
 	}
-	return nil
+	return step.TelemetryID
 }
 
-func runWithLogging(ctx context.Context, fn StepFunc, sfi StepFuncInput, stage string) (State, StepFuncOutputMessage) {
+// Makes the error for a stage that was stopped by its context before it finished.
+type interruption func(stage string) slerror.SLError
+
+// Run one stage of a step, with logging and telemetry. Each stage is a span named <TelemetryID>/<stage>,
+// and the StepFunc gets the span's context so that ShellContext calls show up under it.
+// The stage is stopped when ctx is done or after the step's StageTimeout. A StepFunc that doesn't return
+// within AbandonAfter of its context being done is left running in the background, and its result is ignored.
+// The stage is journaled before it starts and after it ends.
+func (r *Runner) runWithLogging(ctx context.Context, step Step, fn StepFunc, sfi StepFuncInput, stage string, interrupt interruption) StepFuncOutputMessage {
+	ctx, span := telemetry.Tracer().Start(ctx, step.TelemetryID+"/"+stage, trace.WithAttributes(
+		attribute.String(telemetry.AttrStage, stage),
+	))
+	defer span.End()
+	if step.StageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.StageTimeout)
+		defer cancel()
+	}
+
+	sfi.Logger = sfi.Logger.WithField(logging.FieldStage, stage)
+	r.Journal.stageStarted(step, stage)
 	start := time.Now()
-	state, output := fn(ctx, sfi)
+	abandonAfter := r.AbandonAfter
+	if abandonAfter <= 0 {
+		abandonAfter = DefaultAbandonAfter
+	}
+	output, stillRunning := callWithContext(ctx, fn, sfi, stage, interrupt, abandonAfter)
+	if stillRunning {
+		output.Errors.Errors = append(output.Errors.Errors, slerror.StepAbandonedError(sfi.Sl.Logger, step.Name, stage, abandonAfter))
+	}
 	duration := time.Since(start)
+	r.Journal.stageEnded(step, stage, sfi.State, output)
+	// Fill in whatever the StepFunc left out, so the message can be shown on its own
+	if output.Name == "" {
+		output.Name = step.Name
+	}
+	if output.Id == "" {
+		output.Id = stepLogID(step)
+	}
+	if output.Time.IsZero() {
+		output.Time = time.Now()
+	}
+	output.Complete = true
+	telemetry.RecordStageDuration(ctx, sfi.Dbc.Name, step.TelemetryID, stage, duration, output.Errors.Empty())
 	if !output.Errors.Empty() {
-		sfi.Logger.WithFields(logrus.Fields{
-			"stage":    stage,
-			"duration": duration,
-		}).Error("Error executing stage")
-
-		return state, output
-	}
-	sfi.Logger.WithFields(logrus.Fields{
-		"stage":    stage,
-		"duration": duration,
-	}).Info("Successfully executed stage")
-	return state, output
+		for _, err := range output.Errors.Errors {
+			span.RecordError(err, trace.WithAttributes(attribute.String(telemetry.AttrCode, string(err.Code))))
+		}
+		span.SetStatus(codes.Error, output.Errors.Error())
+		sfi.Logger.WithField("duration", duration).Error("Error executing stage")
+
+		return output
+	}
+	sfi.Logger.WithField("duration", duration).Info("Successfully executed stage")
+	// Only the keys, since datastores keep things like backup paths and serials in the State
+	sfi.Logger.WithField("stateKeys", sfi.State.Keys()).Debug("State after stage")
+	return output
+}
+
+// Call a StepFunc, but stop waiting for it when ctx is done. The StepFunc isn't called at all if ctx is
+// already done, which is how a cancelled run stops between stages. A StepFunc that fails after ctx is done
+// most likely failed because of it, for example because the ShellContext refused to run a command, so the
+// interruption is added to its errors.
+// Once ctx is done the StepFunc gets up to abandonAfter to return, so that nothing undoes the step while it
+// is still changing the database. If it is still running after that, callWithContext gives up on it and
+// reports that it is still running.
+func callWithContext(ctx context.Context, fn StepFunc, sfi StepFuncInput, stage string, interrupt interruption, abandonAfter time.Duration) (StepFuncOutputMessage, bool) {
+	stopped := func() StepFuncOutputMessage {
+		return StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{interrupt(stage)}}}
+	}
+	finished := func(output StepFuncOutputMessage) StepFuncOutputMessage {
+		if !output.Errors.Empty() && ctx.Err() != nil {
+			output.Errors.Errors = append(output.Errors.Errors, interrupt(stage))
+		}
+		return output
+	}
+	if ctx.Err() != nil {
+		return stopped(), false
+	}
+	done := make(chan StepFuncOutputMessage, 1)
+	go func() {
+		done <- fn(ctx, sfi)
+	}()
+	select {
+	case output := <-done:
+		return finished(output), false
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(abandonAfter)
+	defer timer.Stop()
+	select {
+	case output := <-done:
+		return finished(output), false
+	case <-timer.C:
+		sfi.Logger.Errorf("Stage is still running %v after it was stopped, leaving it in the background", abandonAfter)
+		return stopped(), true
+	}
 }
@@ -2,6 +2,8 @@ package step
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"testing"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // // Mock logger
@@ -32,13 +35,13 @@ func newMockLogger() *logrus.Logger {
 }
 
 // Mock step function that always succeeds
-func successfulStepFunc(ctx context.Context, sfi StepFuncInput) (State, StepFuncOutputMessage) {
-	return nil, StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{}}}
+func successfulStepFunc(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+	return StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{}}}
 }
 
 // Mock step function that always fails
-func failingStepFunc(ctx context.Context, sfi StepFuncInput) (State, StepFuncOutputMessage) {
-	return nil, StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{
+func failingStepFunc(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+	return StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{
 		slerror.New("Mock error"),
 	}}}
 }
@@ -80,3 +83,14 @@ func TestRun(t *testing.T) {
 	err = Run(ctx, sl, dbc, steps, Execute)
 	assert.NotNil(t, err)
 }
+
+func TestFailed(t *testing.T) {
+	slErr := slerror.SLError{Code: "TEST_FAILED", Err: errors.New("test")}
+	output := Failed(fmt.Errorf("wrapped: %w", slErr))
+	require.Len(t, output.Errors.Errors, 1)
+	assert.Equal(t, slerror.ErrorCode("TEST_FAILED"), output.Errors.Errors[0].Code)
+
+	output = Failed(errors.New("plain"))
+	require.Len(t, output.Errors.Errors, 1)
+	assert.Equal(t, "plain", output.Errors.Errors[0].Err.Error())
+}
@@ -0,0 +1,197 @@
+package step
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingStepFunc never returns on its own, and ignores its context
+func hangingStepFunc(release chan struct{}) StepFunc {
+	return func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+		<-release
+		return StepFuncOutputMessage{}
+	}
+}
+
+func lastError(outputs []StepFuncOutputMessage, stage string) slerror.SLError {
+	for i := len(outputs) - 1; i >= 0; i-- {
+		if outputs[i].Stage == stage && !outputs[i].Errors.Empty() {
+			return outputs[i].Errors.Errors[0]
+		}
+	}
+	return slerror.SLError{}
+}
+
+func TestStageTimeoutUndoesFinishedSteps(t *testing.T) {
+	var calls []string
+	release := make(chan struct{})
+	defer close(release)
+	steps := []Step{
+		{Name: "First", TelemetryID: "TEST_FIRST", Execute: recordingStepFunc(&calls, "first"), Undo: recordingStepFunc(&calls, "undo first")},
+		{Name: "Second", TelemetryID: "TEST_SECOND", Execute: recordingStepFunc(&calls, "second"), Undo: recordingStepFunc(&calls, "undo second")},
+		{
+			Name:         "Hangs",
+			TelemetryID:  "TEST_HANGS",
+			Pre:          hangingStepFunc(release),
+			Undo:         recordingStepFunc(&calls, "undo hangs"),
+			StageTimeout: 20 * time.Millisecond,
+		},
+		{Name: "Never runs", TelemetryID: "TEST_NEVER", Execute: recordingStepFunc(&calls, "never")},
+	}
+
+	start := time.Now()
+	failed, _ := runWithOutputs(t, steps)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, slerror.StepTimedOutCode, lastError(failed, "pre").Code)
+	// The step that timed out in Pre hadn't done anything, so only the finished ones are undone
+	assert.Equal(t, []string{"first", "second", "undo second", "undo first"}, calls)
+}
+
+func TestCancelBetweenStages(t *testing.T) {
+	var calls []string
+	ctx, cancel := context.WithCancel(context.Background())
+	steps := []Step{
+		{
+			Name:        "First",
+			TelemetryID: "TEST_FIRST",
+			Execute: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+				calls = append(calls, "first")
+				// The task is killed while this stage is running
+				cancel()
+				return StepFuncOutputMessage{}
+			},
+			Post: recordingStepFunc(&calls, "post first"),
+			Undo: recordingStepFunc(&calls, "undo first"),
+		},
+		{Name: "Second", TelemetryID: "TEST_SECOND", Execute: recordingStepFunc(&calls, "second")},
+	}
+
+	r := Runner{Sl: &spiffelinkcore.SpiffeLinkCore{Logger: newMockLogger()}, Dbc: &config.DatabaseConfig{Name: "db1"}}
+	failed := r.Run(ctx, steps, Execute)
+	require.NotNil(t, failed)
+	assert.Equal(t, slerror.StepCancelledCode, lastError(failed, "post").Code)
+	// Post never ran, and First was undone since its Execute had finished
+	assert.Equal(t, []string{"first", "undo first"}, calls)
+	assert.Equal(t, "undo", failed[len(failed)-1].Stage)
+	assert.True(t, failed[len(failed)-1].Errors.Empty())
+}
+
+func TestFailureAfterCancelIsInterruption(t *testing.T) {
+	var calls []string
+	ctx, cancel := context.WithCancel(context.Background())
+	steps := []Step{
+		{Name: "First", TelemetryID: "TEST_FIRST", Execute: recordingStepFunc(&calls, "first"), Undo: recordingStepFunc(&calls, "undo first")},
+		{
+			Name:        "Second",
+			TelemetryID: "TEST_SECOND",
+			Execute: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+				calls = append(calls, "second")
+				// The shell refuses to run anything once the task is killed, so the stage fails with its own error
+				cancel()
+				return failingStepFunc(ctx, sfi)
+			},
+			Undo: recordingStepFunc(&calls, "undo second"),
+		},
+	}
+
+	r := Runner{Sl: &spiffelinkcore.SpiffeLinkCore{Logger: newMockLogger()}, Dbc: &config.DatabaseConfig{Name: "db1"}}
+	failed := r.Run(ctx, steps, Execute)
+	require.NotNil(t, failed)
+	var codes []slerror.ErrorCode
+	for _, err := range failed[0].Errors.Errors {
+		codes = append(codes, err.Code)
+	}
+	assert.Contains(t, codes, slerror.StepCancelledCode)
+	// The failure counts as an interruption, so both steps are rolled back
+	assert.Equal(t, []string{"first", "second", "undo second", "undo first"}, calls)
+}
+
+func TestStepTimeoutStopsRetries(t *testing.T) {
+	var calls []string
+	steps := []Step{{
+		Name:        "Flaky",
+		TelemetryID: "TEST_FLAKY",
+		Execute:     flakyStepFunc(100, walletLocked, &calls, "execute"),
+		Idempotent:  true,
+		Retry:       &RetryPolicy{Attempts: 100, Backoff: 20 * time.Millisecond, RetryableCodes: []slerror.ErrorCode{walletLocked}},
+		Timeout:     50 * time.Millisecond,
+	}}
+
+	start := time.Now()
+	failed, _ := runWithOutputs(t, steps)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.NotNil(t, failed)
+	assert.Less(t, len(calls), 10)
+}
+
+func TestUndoWaitsForInterruptedStage(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	steps := []Step{{
+		Name:        "Slow write",
+		TelemetryID: "TEST_SLOW",
+		Execute: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+			// The task is killed, but the write ignores it for a while, like a command that can't be interrupted
+			cancel()
+			time.Sleep(100 * time.Millisecond)
+			record("write")
+			return StepFuncOutputMessage{}
+		},
+		Post: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+			record("post")
+			return StepFuncOutputMessage{}
+		},
+		Undo: func(ctx context.Context, sfi StepFuncInput) StepFuncOutputMessage {
+			record("undo")
+			return StepFuncOutputMessage{}
+		},
+	}}
+	r := newTestRunner(0)
+	r.AbandonAfter = 5 * time.Second
+	failed := r.Run(ctx, steps, Execute)
+	require.NotNil(t, failed)
+	// The undo runs after the write, so the write can't land on top of it
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"write", "undo"}, calls)
+}
+
+func TestAbandonedStageIsNotUndone(t *testing.T) {
+	var calls []string
+	release := make(chan struct{})
+	defer close(release)
+	steps := []Step{
+		{Name: "First", TelemetryID: "TEST_FIRST", Execute: recordingStepFunc(&calls, "first"), Undo: recordingStepFunc(&calls, "undo first")},
+		{
+			Name:         "Hangs",
+			TelemetryID:  "TEST_HANGS",
+			Execute:      hangingStepFunc(release),
+			Undo:         recordingStepFunc(&calls, "undo hangs"),
+			StageTimeout: 20 * time.Millisecond,
+		},
+	}
+	failed, _ := runWithOutputs(t, steps)
+	var codes []slerror.ErrorCode
+	for _, output := range failed {
+		for _, err := range output.Errors.Errors {
+			codes = append(codes, err.Code)
+		}
+	}
+	assert.Contains(t, codes, slerror.StepAbandonedCode)
+	// The step that is still running is left alone, but the one before it is undone
+	assert.Equal(t, []string{"first", "undo first"}, calls)
+}
@@ -0,0 +1,63 @@
+package taskmanager
+
+import (
+	"time"
+)
+
+const (
+	DefaultHistorySize   = 100
+	DefaultHistoryMaxAge = 24 * time.Hour
+)
+
+// history is a ring of finished tasks. It keeps at most size tasks, and drops tasks that finished more
+// than maxAge ago. It is protected by the manager's lock.
+type history struct {
+	size   int
+	maxAge time.Duration
+	// Tasks in the order they finished. Once the ring is full, next is the position of the oldest task.
+	tasks []*Task
+	next  int
+}
+
+func newHistory(size int, maxAge time.Duration) *history {
+	return &history{
+		size:   size,
+		maxAge: maxAge,
+	}
+}
+
+func (h *history) add(task *Task) {
+	if h.size <= 0 {
+		return
+	}
+	if len(h.tasks) < h.size {
+		h.tasks = append(h.tasks, task)
+		return
+	}
+	h.tasks[h.next] = task
+	h.next = (h.next + 1) % h.size
+}
+
+// list returns the tasks that are not too old, most recent first.
+func (h *history) list() []*Task {
+	cutoff := time.Now().Add(-h.maxAge)
+	tasks := make([]*Task, 0, len(h.tasks))
+	for i := 0; i < len(h.tasks); i++ {
+		// Walk backwards from the most recent task
+		task := h.tasks[(h.next-1-i+2*len(h.tasks))%len(h.tasks)]
+		if h.maxAge > 0 && task.EndTime.Before(cutoff) {
+			// Everything older than this has expired too
+			break
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// WithHistory sets how many finished tasks are kept, and for how long. A maxAge of 0 keeps them
+// until they are pushed out by newer tasks.
+func WithHistory(size int, maxAge time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.history = newHistory(size, maxAge)
+	}
+}
@@ -0,0 +1,42 @@
+package taskmanager
+
+import (
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+)
+
+// Parse a duration from the tasks section of the config file, or return def if it isn't set.
+func parseDuration(log *logrus.Logger, setting string, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, slerror.TaskManagerDurationInvalidError(log, setting, value)
+	}
+	return d, nil
+}
+
+// OptionsFromConfig returns the manager options set in the tasks section of the config file.
+func OptionsFromConfig(log *logrus.Logger, conf config.TaskManagerConfig) ([]ManagerOption, error) {
+	size := DefaultHistorySize
+	if conf.HistorySize != 0 {
+		size = conf.HistorySize
+	}
+	maxAge, err := parseDuration(log, "tasks.historyMaxAge", conf.HistoryMaxAge, DefaultHistoryMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return []ManagerOption{
+		WithHistory(size, maxAge),
+		WithConcurrency(conf.MaxConcurrency, conf.ShellTargetLimits),
+	}, nil
+}
+
+// ShutdownGracePeriodFromConfig returns how long to wait for tasks to finish when spiffelink is stopped.
+func ShutdownGracePeriodFromConfig(log *logrus.Logger, conf config.TaskManagerConfig) (time.Duration, error) {
+	return parseDuration(log, "tasks.shutdownGracePeriod", conf.ShutdownGracePeriod, DefaultShutdownGracePeriod)
+}
@@ -0,0 +1,185 @@
+package taskmanager
+
+import (
+	"sort"
+	"strings"
+)
+
+// Priority decides which queued task starts first when the pool is full.
+type Priority int
+
+const (
+	// Routine work that can wait, like sending a refreshed trust bundle
+	PriorityLow Priority = iota
+	PriorityNormal
+	// Work that must not wait behind routine work, like delivering a new or expiring certificate
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// WithPriority sets the priority of the task in the queue. Tasks are PriorityNormal by default.
+func WithPriority(p Priority) TaskOption {
+	return func(t *Task) {
+		t.Priority = p
+	}
+}
+
+// WithShellTarget records the shared infrastructure the task uses, like a Docker daemon or SSH bastion,
+// so the task counts against that target's concurrency limit.
+func WithShellTarget(target string) TaskOption {
+	return func(t *Task) {
+		t.ShellTarget = target
+	}
+}
+
+// WithGroup puts the task in a group whose tasks run one at a time, in the order they were created, whatever
+// their priority. Groups are for tasks that must not overlap even though they use different shell targets,
+// like rotations of the members of one cluster.
+func WithGroup(group string) TaskOption {
+	return func(t *Task) {
+		t.Group = group
+	}
+}
+
+// WithConcurrency limits how many tasks run at once. max limits all tasks, and targetLimits limits the
+// tasks for each shell target. A limit of 0 means no limit. Target names are not case sensitive.
+func WithConcurrency(max int, targetLimits map[string]int) ManagerOption {
+	return func(m *Manager) {
+		m.pool = newPool(max, targetLimits)
+	}
+}
+
+// pool keeps track of the running tasks and the queue of tasks waiting for a slot.
+// It is protected by the manager's lock.
+type pool struct {
+	max          int
+	targetLimits map[string]int
+	running      int
+	// Running tasks for each shell target
+	targetRunning map[string]int
+	// Groups with a running task
+	groupRunning map[string]bool
+	// Waiting tasks, highest priority first and then in the order they were queued
+	queue   []*Task
+	lastSeq uint64
+}
+
+func newPool(max int, targetLimits map[string]int) pool {
+	limits := make(map[string]int, len(targetLimits))
+	for target, limit := range targetLimits {
+		limits[strings.ToLower(target)] = limit
+	}
+	return pool{
+		max:           max,
+		targetLimits:  limits,
+		targetRunning: make(map[string]int),
+		groupRunning:  make(map[string]bool),
+	}
+}
+
+func (p *pool) enqueue(task *Task) {
+	p.lastSeq++
+	task.seq = p.lastSeq
+	p.queue = append(p.queue, task)
+	sort.SliceStable(p.queue, func(i, j int) bool {
+		if p.queue[i].Priority != p.queue[j].Priority {
+			return p.queue[i].Priority > p.queue[j].Priority
+		}
+		return p.queue[i].seq < p.queue[j].seq
+	})
+}
+
+// Whether there is a free slot for the task, overall, for its shell target and in its group.
+func (p *pool) hasSlot(task *Task) bool {
+	if p.max > 0 && p.running >= p.max {
+		return false
+	}
+	if task.Group != "" && p.groupRunning[task.Group] {
+		return false
+	}
+	target := strings.ToLower(task.ShellTarget)
+	if limit := p.targetLimits[target]; limit > 0 && p.targetRunning[target] >= limit {
+		return false
+	}
+	return true
+}
+
+func (p *pool) acquire(task *Task) {
+	p.running++
+	p.targetRunning[strings.ToLower(task.ShellTarget)]++
+	if task.Group != "" {
+		p.groupRunning[task.Group] = true
+	}
+}
+
+func (p *pool) release(task *Task) {
+	p.running--
+	p.targetRunning[strings.ToLower(task.ShellTarget)]--
+	delete(p.groupRunning, task.Group)
+}
+
+// Remove a task from the queue. Returns false if it wasn't queued.
+func (p *pool) remove(task *Task) bool {
+	for i, queued := range p.queue {
+		if queued == task {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pool) isQueued(task *Task) bool {
+	for _, queued := range p.queue {
+		if queued == task {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pool) queued() []*Task {
+	tasks := make([]*Task, len(p.queue))
+	copy(tasks, p.queue)
+	return tasks
+}
+
+// Empty the queue, and return the tasks that were in it.
+func (p *pool) drain() []*Task {
+	tasks := p.queue
+	p.queue = nil
+	return tasks
+}
+
+// Start every queued task that has a free slot, in priority order. A task waiting on a busy shell target
+// doesn't hold up tasks for other targets. Only the first task created in each group may start, so a group's
+// tasks keep their order. Must be called with the manager's lock held.
+func (m *Manager) dispatchLocked() {
+	first := make(map[string]uint64)
+	for _, task := range m.pool.queue {
+		if seq, ok := first[task.Group]; task.Group != "" && (!ok || task.seq < seq) {
+			first[task.Group] = task.seq
+		}
+	}
+	var waiting []*Task
+	for _, task := range m.pool.queue {
+		if m.shuttingDown || !m.pool.hasSlot(task) || (task.Group != "" && first[task.Group] != task.seq) {
+			waiting = append(waiting, task)
+			continue
+		}
+		m.pool.acquire(task)
+		m.startLocked(task)
+	}
+	m.pool.queue = waiting
+}
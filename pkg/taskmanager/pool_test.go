@@ -0,0 +1,166 @@
+package taskmanager
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingTasks makes task functions that wait until released, and records the order they started in.
+type blockingTasks struct {
+	mu      sync.Mutex
+	started []string
+	release chan struct{}
+}
+
+func newBlockingTasks() *blockingTasks {
+	return &blockingTasks{release: make(chan struct{})}
+}
+
+func (b *blockingTasks) fn(name string) TaskFunc {
+	return func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		b.mu.Lock()
+		b.started = append(b.started, name)
+		b.mu.Unlock()
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (b *blockingTasks) order() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string{}, b.started...)
+}
+
+func TestPoolLimitsAndPriority(t *testing.T) {
+	manager := NewManager(newMockLogger(), WithConcurrency(1, nil))
+	defer manager.Shutdown(context.Background())
+	b := newBlockingTasks()
+
+	first, err := manager.NewTask("sample", time.Minute, b.fn("first"))
+	require.NoError(t, err)
+	low, err := manager.NewTask("sample", time.Minute, b.fn("low"), WithPriority(PriorityLow))
+	require.NoError(t, err)
+	normal, err := manager.NewTask("sample", time.Minute, b.fn("normal"))
+	require.NoError(t, err)
+	high, err := manager.NewTask("sample", time.Minute, b.fn("high"), WithPriority(PriorityHigh))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusRunning, first.GetStatus())
+	assert.Equal(t, 3, manager.QueueDepth())
+	assert.Equal(t, []*Task{high, normal, low}, manager.GetQueuedTasks())
+	assert.Equal(t, []*Task{first}, manager.GetRunningTasks())
+	assert.True(t, low.GetStartTime().IsZero())
+
+	close(b.release)
+	for _, task := range []*Task{first, low, normal, high} {
+		<-task.Done()
+	}
+	assert.Equal(t, []string{"first", "high", "normal", "low"}, b.order())
+	assert.Equal(t, 0, manager.QueueDepth())
+}
+
+func TestPoolShellTargetLimits(t *testing.T) {
+	// Target names are matched without case, since viper lowercases map keys
+	manager := NewManager(newMockLogger(), WithConcurrency(0, map[string]int{"dockershell": 1}))
+	defer manager.Shutdown(context.Background())
+	b := newBlockingTasks()
+	defer close(b.release)
+
+	docker1, err := manager.NewTask("sample", time.Minute, b.fn("docker1"), WithShellTarget("DockerShell"))
+	require.NoError(t, err)
+	docker2, err := manager.NewTask("sample", time.Minute, b.fn("docker2"), WithShellTarget("DockerShell"))
+	require.NoError(t, err)
+	// A task for another target isn't held up by the busy one
+	local, err := manager.NewTask("sample", time.Minute, b.fn("local"), WithShellTarget("LocalShell"))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusRunning, docker1.GetStatus())
+	assert.Equal(t, StatusQueued, docker2.GetStatus())
+	assert.Equal(t, StatusRunning, local.GetStatus())
+
+	// Killing the running task frees the slot for the queued one
+	require.NoError(t, manager.KillTask(docker1.ID))
+	<-docker1.Done()
+	assert.Eventually(t, func() bool { return docker2.GetStatus() == StatusRunning }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPoolGroups(t *testing.T) {
+	manager := NewManager(newMockLogger())
+	defer manager.Shutdown(context.Background())
+	b := newBlockingTasks()
+	defer close(b.release)
+
+	member1, err := manager.NewTask("sample", time.Minute, b.fn("member1"), WithGroup("etcd/main"), WithShellTarget("host1"))
+	require.NoError(t, err)
+	member2, err := manager.NewTask("sample", time.Minute, b.fn("member2"), WithGroup("etcd/main"), WithShellTarget("host2"))
+	require.NoError(t, err)
+	// A later task in the group waits for the earlier ones, whatever its priority
+	member3, err := manager.NewTask("sample", time.Minute, b.fn("member3"), WithGroup("etcd/main"), WithShellTarget("host3"), WithPriority(PriorityHigh))
+	require.NoError(t, err)
+	// Tasks in other groups, or in none, aren't held up
+	other, err := manager.NewTask("sample", time.Minute, b.fn("other"), WithGroup("etcd/other"), WithShellTarget("host2"))
+	require.NoError(t, err)
+	ungrouped, err := manager.NewTask("sample", time.Minute, b.fn("ungrouped"), WithShellTarget("host3"))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusRunning, member1.GetStatus())
+	assert.Equal(t, StatusQueued, member2.GetStatus())
+	assert.Equal(t, StatusQueued, member3.GetStatus())
+	assert.Equal(t, StatusRunning, other.GetStatus())
+	assert.Equal(t, StatusRunning, ungrouped.GetStatus())
+
+	require.NoError(t, manager.KillTask(member1.ID))
+	<-member1.Done()
+	assert.Eventually(t, func() bool { return member2.GetStatus() == StatusRunning }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, StatusQueued, member3.GetStatus())
+
+	require.NoError(t, manager.KillTask(member2.ID))
+	<-member2.Done()
+	assert.Eventually(t, func() bool { return member3.GetStatus() == StatusRunning }, 5*time.Second, 10*time.Millisecond)
+	var members []string
+	for _, name := range b.order() {
+		if strings.HasPrefix(name, "member") {
+			members = append(members, name)
+		}
+	}
+	assert.Equal(t, []string{"member1", "member2", "member3"}, members)
+}
+
+func TestKillQueuedTask(t *testing.T) {
+	manager := NewManager(newMockLogger(), WithConcurrency(1, nil))
+	b := newBlockingTasks()
+
+	running, err := manager.NewTask("sample", time.Minute, b.fn("running"))
+	require.NoError(t, err)
+	queued, err := manager.NewTask("sample", time.Minute, b.fn("queued"))
+	require.NoError(t, err)
+
+	require.NoError(t, manager.KillTask(queued.ID))
+	<-queued.Done()
+	assert.Equal(t, StatusCancelled, queued.GetStatus())
+	assert.Equal(t, 0, manager.QueueDepth())
+	assert.Equal(t, []*Task{queued}, manager.GetHistory())
+
+	// Queued tasks are cancelled at shutdown rather than started
+	another, err := manager.NewTask("sample", time.Minute, b.fn("another"))
+	require.NoError(t, err)
+	shutdown := make(chan error)
+	go func() { shutdown <- manager.Shutdown(context.Background()) }()
+	<-another.Done()
+	close(b.release)
+	require.NoError(t, <-shutdown)
+	assert.Equal(t, StatusSucceeded, running.GetStatus())
+	assert.Equal(t, StatusCancelled, another.GetStatus())
+	assert.Equal(t, []string{"running"}, b.order())
+}
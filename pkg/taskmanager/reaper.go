@@ -0,0 +1,124 @@
+package taskmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultReaperInterval = time.Second
+	// How long a task has to return after it is cancelled before the reaper flags it as a zombie
+	DefaultCancelGrace = 10 * time.Second
+	// How long Shutdown waits for tasks by default
+	DefaultShutdownGracePeriod = 30 * time.Second
+	// How long Shutdown waits for tasks to return once it has cancelled them, so they can run their undo
+	shutdownCancelWait = 5 * time.Second
+)
+
+type reaperConfig struct {
+	interval    time.Duration
+	cancelGrace time.Duration
+}
+
+// WithReaper sets how often the reaper checks the running tasks, and how long a task has to return after
+// it is cancelled before it is flagged as a zombie.
+func WithReaper(interval time.Duration, cancelGrace time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.reaper = reaperConfig{interval: interval, cancelGrace: cancelGrace}
+	}
+}
+
+// The reaper runs until the manager is shut down. Every interval it cancels the tasks that are past their
+// timeout, and flags the tasks that are still running long after they were cancelled. A task can't be
+// stopped from outside, so a zombie keeps running, but it is logged and shown as one.
+func (m *Manager) runReaper() {
+	ticker := time.NewTicker(m.reaper.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-ticker.C:
+			m.KillOverdueTasks()
+			m.flagZombies()
+		}
+	}
+}
+
+func (m *Manager) flagZombies() {
+	for _, task := range m.GetRunningTasks() {
+		task.mu.Lock()
+		flag := !task.Zombie && !task.IsCompleted && !task.cancelledAt.IsZero() &&
+			time.Since(task.cancelledAt) > m.reaper.cancelGrace
+		if flag {
+			task.Zombie = true
+		}
+		cancelledAt := task.cancelledAt
+		task.mu.Unlock()
+		if flag {
+			m.globalLogger.WithFields(logrus.Fields{
+				logging.FieldTaskID:   task.ID,
+				logging.FieldDatabase: task.Database,
+			}).Warnf("Task %v is still running %v after it was cancelled", task.ID, time.Since(cancelledAt).Round(time.Second))
+		}
+	}
+}
+
+// Shutdown stops the manager. No new tasks can be started once it is called, and queued tasks are cancelled.
+// Running tasks are given until ctx is done to finish on their own; then they are cancelled, and given a few
+// more seconds to run their undo and return. Returns an error naming any tasks that were still running after that.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if m.shuttingDown {
+		m.mu.Unlock()
+		return nil
+	}
+	m.shuttingDown = true
+	close(m.shutdown)
+	// Queued tasks never get to start
+	for _, task := range m.pool.drain() {
+		m.cancelQueuedLocked(task)
+	}
+	m.mu.Unlock()
+
+	running := m.GetRunningTasks()
+	if len(running) > 0 {
+		m.globalLogger.Infof("Waiting for %d tasks to finish", len(running))
+	}
+	if waitForTasks(ctx, running) {
+		return nil
+	}
+
+	m.globalLogger.Warn("Shutdown grace period is over, cancelling the remaining tasks")
+	m.KillAllTasks()
+	cancelCtx, cancel := context.WithTimeout(context.Background(), shutdownCancelWait)
+	defer cancel()
+	if waitForTasks(cancelCtx, running) {
+		return nil
+	}
+
+	var ids []string
+	for _, task := range running {
+		if !task.Completed() {
+			ids = append(ids, task.ID)
+		}
+	}
+	return fmt.Errorf("tasks still running after shutdown: %s", strings.Join(ids, ", "))
+}
+
+// Wait for all the tasks to finish. Returns false if ctx was done first.
+func waitForTasks(ctx context.Context, tasks []*Task) bool {
+	for _, task := range tasks {
+		select {
+		case <-task.Done():
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
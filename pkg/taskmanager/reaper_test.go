@@ -0,0 +1,81 @@
+package taskmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaperFlagsZombies(t *testing.T) {
+	manager := NewManager(newMockLogger(), WithReaper(10*time.Millisecond, 50*time.Millisecond))
+
+	// This task ignores its context, so it keeps running after it times out
+	release := make(chan struct{})
+	task, err := manager.NewTask("stubborn", 20*time.Millisecond, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		<-release
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, task.IsZombie, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	<-task.Done()
+	assert.Equal(t, StatusTimedOut, task.GetStatus())
+	assert.NoError(t, manager.Shutdown(context.Background()))
+}
+
+func TestShutdownWaitsForTasks(t *testing.T) {
+	manager := NewManager(newMockLogger())
+
+	task, err := manager.NewTask("sample", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+		}
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, manager.Shutdown(ctx))
+	// The task was given time to finish instead of being cancelled
+	assert.Equal(t, StatusSucceeded, task.GetStatus())
+
+	_, err = manager.NewTask("sample", time.Minute, sampleTaskFunc)
+	assert.Equal(t, ErrShuttingDown, err)
+}
+
+func TestShutdownReportsStuckTasks(t *testing.T) {
+	manager := NewManager(newMockLogger())
+
+	release := make(chan struct{})
+	defer close(release)
+	task, err := manager.NewTask("stubborn", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		<-release
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = manager.Shutdown(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), task.ID)
+}
+
+func TestAbandonedStepMakesZombie(t *testing.T) {
+	manager := NewManager(newMockLogger())
+	task, err := manager.NewTask("databaseUpdate", time.Minute, func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
+		out <- step.StepFuncOutputMessage{Id: "WRITE_WALLET", Stage: "execute", Errors: slerror.SLErrorList{Errors: []slerror.SLError{
+			slerror.StepAbandonedError(logger, "Write wallet", "execute", time.Second),
+		}}}
+	})
+	require.NoError(t, err)
+	<-task.Done()
+	assert.True(t, task.IsZombie())
+	assert.NoError(t, manager.Shutdown(context.Background()))
+}
@@ -3,60 +3,269 @@ package taskmanager
 import (
 	"context"
 	"errors"
+	"io/ioutil"
 	"sync"
 	"time"
 
+	"github.com/dfeldman/spiffelink/pkg/logging"
+	"github.com/dfeldman/spiffelink/pkg/redact"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
 	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ManagerInterface interface {
-	NewTask(taskType string, timeout time.Duration, taskFunc TaskFunc) (*Task, error)
+	NewTask(taskType string, timeout time.Duration, taskFunc TaskFunc, opts ...TaskOption) (*Task, error)
 	KillTask(id string) error
 	KillOverdueTasks()
 	KillAllTasks()
 	GetRunningTasks() []*Task
+	GetQueuedTasks() []*Task
+	QueueDepth() int
 	GetTaskByID(id string) (*Task, error)
 	GetTasksByType(taskType string) []*Task
-	Shutdown()
+	GetHistory() []*Task
+	GetHistoryByDatabase(database string) []*Task
+	GetHistoryByType(taskType string) []*Task
+	Shutdown(ctx context.Context) error
 }
 
+// ErrShuttingDown is returned by NewTask once Shutdown has been called.
+var ErrShuttingDown = errors.New("task manager is shutting down")
+
+// LogEntry is one log entry written by a task, kept with its level and fields so it can be retrieved later.
+type LogEntry struct {
+	Time    time.Time
+	Level   logrus.Level
+	Message string
+	Fields  map[string]interface{}
+}
+
+// Status is the state of a task. Every status except StatusQueued and StatusRunning is final.
+type Status string
+
+const (
+	// The task is waiting for a free slot in the worker pool
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	// At least one output message had errors
+	StatusFailed Status = "failed"
+	// The task was killed
+	StatusCancelled Status = "cancelled"
+	// The task ran past its timeout
+	StatusTimedOut Status = "timed out"
+)
+
 // Task represents a background task with its properties and channels.
 type Task struct {
-	ID          string
-	Type        string
-	StartTime   time.Time
-	Timeout     time.Duration
+	ID       string
+	Type     string
+	Database string
+	// Tasks with a higher priority are started first when the pool is full
+	Priority Priority
+	// The shared infrastructure the task uses, which may have its own concurrency limit
+	ShellTarget string
+	// Tasks in the same group run one at a time, in the order they were created
+	Group string
+	// When the task was created. It may have to wait in the queue before it starts.
+	EnqueueTime time.Time
+	// Zero until the task has started
+	StartTime time.Time
+	// Zero until the task has finished
+	EndTime time.Time
+	Timeout time.Duration
+	// Fields are added to every log entry the task writes
+	Fields      logrus.Fields
 	OutputChan  chan step.StepFuncOutputMessage
 	cancelFunc  context.CancelFunc
 	IsCompleted bool
+	Status      Status
 	Logger      *logrus.Logger
-	Logs        []string
-	Zombie      bool
+	Logs        []LogEntry
+	// Every message the task sends on OutputChan is collected here
+	Outputs []step.StepFuncOutputMessage
+	mu      sync.Mutex
+	done    chan struct{}
+	// The reason the task's context ended, if it ended before the task function returned
+	ctxErr error
+	// When the task was first cancelled, whether it was killed or timed out
+	cancelledAt time.Time
+	// Set when the task is cancelled for running past its timeout
+	overdue bool
+	// Set by the reaper when the task keeps running long after it was cancelled
+	Zombie bool
+	// Kept until the task is started by the pool
+	taskFunc TaskFunc
+	// Order in which the task was queued, so tasks of the same priority start in order
+	seq uint64
+}
+
+// Cancel the task's context, and remember when it was first cancelled. Queued tasks are cancelled by the
+// manager instead, since they don't have a context yet.
+func (t *Task) cancel() {
+	t.mu.Lock()
+	if t.cancelledAt.IsZero() {
+		t.cancelledAt = time.Now()
+	}
+	cancelFunc := t.cancelFunc
+	t.mu.Unlock()
+	if cancelFunc != nil {
+		cancelFunc()
+	}
+}
+
+// IsZombie reports whether the task has ignored its cancellation for longer than the reaper allows.
+func (t *Task) IsZombie() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Zombie
+}
+
+// GetLogs returns a copy of the log entries the task has written so far.
+func (t *Task) GetLogs() []LogEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logs := make([]LogEntry, len(t.Logs))
+	copy(logs, t.Logs)
+	return logs
+}
+
+// GetOutputs returns a copy of the output messages the task has sent so far.
+func (t *Task) GetOutputs() []step.StepFuncOutputMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outputs := make([]step.StepFuncOutputMessage, len(t.Outputs))
+	copy(outputs, t.Outputs)
+	return outputs
+}
+
+// Completed reports whether the task function has returned.
+func (t *Task) Completed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.IsCompleted
+}
+
+// GetStatus returns the status of the task.
+func (t *Task) GetStatus() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Status
+}
+
+// GetStartTime returns when the task started, or the zero time if it is still queued.
+func (t *Task) GetStartTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.StartTime
+}
+
+// Duration returns how long the task ran for, or has been running for if it hasn't finished.
+func (t *Task) Duration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.StartTime.IsZero() {
+		return 0
+	}
+	if t.EndTime.IsZero() {
+		return time.Since(t.StartTime)
+	}
+	return t.EndTime.Sub(t.StartTime)
+}
+
+// Done returns a channel that is closed once the task has finished and all its output has been collected.
+func (t *Task) Done() <-chan struct{} {
+	return t.done
+}
+
+// The status of a task that has finished. Must be called with the lock held.
+func (t *Task) finalStatus() Status {
+	if t.overdue {
+		return StatusTimedOut
+	}
+	switch t.ctxErr {
+	case context.DeadlineExceeded:
+		return StatusTimedOut
+	case context.Canceled:
+		return StatusCancelled
+	}
+	for _, output := range t.Outputs {
+		if !output.Errors.Empty() {
+			return StatusFailed
+		}
+	}
+	return StatusSucceeded
 }
 
 type TaskFunc func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage)
 
+// TaskOption sets optional properties of a task when it is created.
+type TaskOption func(*Task)
+
+// WithDatabase records the database the task is working on, and adds it to the task's log entries.
+func WithDatabase(name string) TaskOption {
+	return func(t *Task) {
+		t.Database = name
+		t.Fields[logging.FieldDatabase] = name
+	}
+}
+
+// WithFields adds fields to every log entry the task writes.
+func WithFields(fields logrus.Fields) TaskOption {
+	return func(t *Task) {
+		for k, v := range fields {
+			t.Fields[k] = v
+		}
+	}
+}
+
 // Manager manages all the tasks.
 type Manager struct {
 	globalLogger *logrus.Logger
 	tasks        map[string]*Task
 	mu           sync.RWMutex
 	shutdown     chan struct{}
+	history      *history
+	// Set once Shutdown has been called; no new tasks are started after that
+	shuttingDown bool
+	reaper       reaperConfig
+	pool         pool
 }
 
+// ManagerOption sets optional properties of the manager when it is created.
+type ManagerOption func(*Manager)
+
 // NewManager returns a new instance of the task manager.
-func NewManager(logger *logrus.Logger) *Manager {
-	return &Manager{
+func NewManager(logger *logrus.Logger, opts ...ManagerOption) *Manager {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	m := &Manager{
 		tasks:        make(map[string]*Task),
 		shutdown:     make(chan struct{}),
 		globalLogger: logger,
+		history:      newHistory(DefaultHistorySize, DefaultHistoryMaxAge),
+		reaper:       reaperConfig{interval: DefaultReaperInterval, cancelGrace: DefaultCancelGrace},
+		pool:         newPool(0, nil),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	go m.runReaper()
+	return m
 }
 
 // TaskLogHook is a custom Logrus hook to capture logs for a task.
+// It adds the task's fields to each entry, stores the entry in the task, and forwards it to the global logger
+// so that it is written with the configured format and output.
 type TaskLogHook struct {
-	Task *Task
+	Task   *Task
+	Global *logrus.Logger
 }
 
 func (hook *TaskLogHook) Levels() []logrus.Level {
@@ -64,92 +273,201 @@ func (hook *TaskLogHook) Levels() []logrus.Level {
 }
 
 func (hook *TaskLogHook) Fire(entry *logrus.Entry) error {
-	hook.Task.Logs = append(hook.Task.Logs, entry.Message)
-
-	// Forward the log entry to the global logger.
-	switch entry.Level {
-	case logrus.PanicLevel:
-		logrus.Panic(entry.Message)
-	case logrus.FatalLevel:
-		logrus.Fatal(entry.Message)
-	case logrus.ErrorLevel:
-		logrus.Error(entry.Message)
-	case logrus.WarnLevel:
-		logrus.Warn(entry.Message)
-	case logrus.InfoLevel:
-		logrus.Info(entry.Message)
-	case logrus.DebugLevel:
-		logrus.Debug(entry.Message)
-	case logrus.TraceLevel:
-		logrus.Trace(entry.Message)
+	for k, v := range hook.Task.Fields {
+		if _, exists := entry.Data[k]; !exists {
+			entry.Data[k] = v
+		}
 	}
+
+	fields := make(map[string]interface{}, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	hook.Task.mu.Lock()
+	hook.Task.Logs = append(hook.Task.Logs, LogEntry{
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: entry.Message,
+		Fields:  fields,
+	})
+	hook.Task.mu.Unlock()
+
+	// Forward the log entry to the global logger. A panic in a task is logged as an error, since the
+	// task's own logger is the one that panics.
+	level := entry.Level
+	if level == logrus.PanicLevel {
+		level = logrus.ErrorLevel
+	}
+	hook.Global.WithFields(entry.Data).WithTime(entry.Time).Log(level, entry.Message)
 	return nil
 }
 
-// NewTask creates a new task and adds it to the manager.
-func (m *Manager) NewTask(taskType string, timeout time.Duration, taskFunc TaskFunc) (*Task, error) {
+// NewTask creates a new task and adds it to the manager. The task starts right away if the pool has a free
+// slot for it, and is queued otherwise.
+func (m *Manager) NewTask(taskType string, timeout time.Duration, taskFunc TaskFunc, opts ...TaskOption) (*Task, error) {
 	id := taskType + " " + time.Now().String()
-	taskCtx, cancelFunc := context.WithTimeout(context.Background(), timeout)
 
 	// Create a new logger instance and attach the Logrus hook to capture logs.
+	// The task logger doesn't write anything itself; the hook forwards every entry to the global logger.
 	logger := logrus.New()
-	logHook := &TaskLogHook{}
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(m.globalLogger.GetLevel())
+	logger.AddHook(&redact.Hook{})
+	logHook := &TaskLogHook{Global: m.globalLogger}
 	logger.AddHook(logHook)
 
 	task := &Task{
 		ID:          id,
 		Type:        taskType,
-		StartTime:   time.Now(),
+		Priority:    PriorityNormal,
+		EnqueueTime: time.Now(),
 		Timeout:     timeout,
+		Fields:      logrus.Fields{logging.FieldTaskID: id},
 		OutputChan:  make(chan step.StepFuncOutputMessage),
-		cancelFunc:  cancelFunc,
 		IsCompleted: false,
+		Status:      StatusQueued,
 		Logger:      logger,
-		Logs:        []string{},
+		Logs:        []LogEntry{},
+		done:        make(chan struct{}),
+		taskFunc:    taskFunc,
+	}
+	for _, opt := range opts {
+		opt(task)
 	}
 
 	logHook.Task = task
 
-	// Add the task to the manager's tasks map.
+	// Add the task to the manager's tasks map and the queue.
 	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shuttingDown {
+		return nil, ErrShuttingDown
+	}
 	m.tasks[id] = task
-	m.mu.Unlock()
+	m.pool.enqueue(task)
+	m.dispatchLocked()
+	return task, nil
+}
 
+// Start a task that the pool has a slot for. Must be called with the manager's lock held.
+func (m *Manager) startLocked(task *Task) {
+	taskCtx, cancelFunc := context.WithTimeout(context.Background(), task.Timeout)
+	task.mu.Lock()
+	task.StartTime = time.Now()
+	task.Status = StatusRunning
+	task.cancelFunc = cancelFunc
+	taskFunc := task.taskFunc
+	task.taskFunc = nil
+	task.mu.Unlock()
+
+	go m.collectOutputs(task)
 	go func() {
 		defer close(task.OutputChan)
-		defer m.removeTask(id)
-		logrus.Infof("About to start task %v", id)
-		taskFunc(logger, taskCtx, task.OutputChan)
-		logrus.Infof("Completed task %v", id)
+		// Each task is the root of its own trace
+		spanCtx, span := telemetry.Tracer().Start(taskCtx, task.Type, trace.WithNewRoot(), trace.WithAttributes(
+			attribute.String(telemetry.AttrTaskID, task.ID),
+			attribute.String(telemetry.AttrDatabase, task.Database),
+		))
+		defer span.End()
+		task.Logger.Infof("About to start task %v", task.ID)
+		taskFunc(task.Logger, spanCtx, task.OutputChan)
+		if err := taskCtx.Err(); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			task.mu.Lock()
+			task.ctxErr = err
+			task.mu.Unlock()
+		}
+		cancelFunc()
+		task.Logger.Infof("Completed task %v", task.ID)
 	}()
+}
 
-	return task, nil
+// Cancel a task that hasn't started. It goes straight to the history. Must be called with the manager's lock
+// held, after the task has been removed from the queue.
+func (m *Manager) cancelQueuedLocked(task *Task) {
+	task.mu.Lock()
+	task.cancelledAt = time.Now()
+	task.ctxErr = context.Canceled
+	task.taskFunc = nil
+	task.mu.Unlock()
+	close(task.OutputChan)
+	// There is no output to collect, so this only finishes the task. It needs the manager's lock.
+	go m.collectOutputs(task)
+}
+
+// Read the task's output channel until the task closes it, then finish the task. A task with a step that
+// was left running in the background is a zombie, since that step can still change the database.
+func (m *Manager) collectOutputs(task *Task) {
+	for output := range task.OutputChan {
+		task.mu.Lock()
+		task.Outputs = append(task.Outputs, output)
+		flag := !task.Zombie && hasAbandonedStep(output)
+		if flag {
+			task.Zombie = true
+		}
+		task.mu.Unlock()
+		if flag {
+			m.globalLogger.WithFields(logrus.Fields{
+				logging.FieldTaskID:   task.ID,
+				logging.FieldDatabase: task.Database,
+			}).Warnf("Task %v left step %s running in the background", task.ID, output.Id)
+		}
+	}
+	task.mu.Lock()
+	task.IsCompleted = true
+	task.EndTime = time.Now()
+	task.Status = task.finalStatus()
+	task.mu.Unlock()
+	m.removeTask(task)
+	close(task.done)
+}
+
+func hasAbandonedStep(output step.StepFuncOutputMessage) bool {
+	for _, err := range output.Errors.Errors {
+		if err.Code == slerror.StepAbandonedCode {
+			return true
+		}
+	}
+	return false
 }
 
-// removeTask removes a task from the manager after completion or cancellation.
-func (m *Manager) removeTask(id string) {
+// removeTask moves a task from the running tasks to the history after completion or cancellation,
+// and starts the next queued tasks in its place.
+func (m *Manager) removeTask(task *Task) {
 	m.mu.Lock()
-	m.tasks[id].Zombie = true // It can take a moment to shut down the function
 	defer m.mu.Unlock()
 
-	// Remove the task from the tasks map.
-	delete(m.tasks, id)
+	delete(m.tasks, task.ID)
+	m.history.add(task)
+	if !task.StartTime.IsZero() {
+		m.pool.release(task)
+		m.dispatchLocked()
+	}
 
 	// Log the task removal.
-	logrus.WithField("taskID", id).Info("Task removed")
+	m.globalLogger.WithFields(logrus.Fields{
+		logging.FieldTaskID: task.ID,
+		"status":            task.Status,
+		"duration":          task.EndTime.Sub(task.StartTime),
+	}).Info("Task removed")
 }
 
-// KillTask kills a specific task based on its ID.
+// KillTask kills a specific task based on its ID. A queued task is removed from the queue.
 func (m *Manager) KillTask(id string) error {
-	m.mu.RLock()
+	m.mu.Lock()
 	task, exists := m.tasks[id]
-	m.mu.RUnlock()
+	if exists && m.pool.remove(task) {
+		m.cancelQueuedLocked(task)
+		m.mu.Unlock()
+		return nil
+	}
+	m.mu.Unlock()
 
 	if !exists {
 		return errors.New("task not found")
 	}
 
-	task.cancelFunc()
+	task.cancel()
 	return nil
 }
 
@@ -159,38 +477,66 @@ func (m *Manager) KillOverdueTasks() {
 	defer m.mu.RUnlock()
 
 	for _, task := range m.tasks {
-		if time.Since(task.StartTime) > task.Timeout {
-			logrus.Infof("Cancel overdue task %v", task.ID)
-			task.cancelFunc()
+		task.mu.Lock()
+		overdue := !task.StartTime.IsZero() && time.Since(task.StartTime) > task.Timeout && task.cancelledAt.IsZero()
+		if overdue {
+			task.overdue = true
+		}
+		task.mu.Unlock()
+		if overdue {
+			m.globalLogger.WithField(logging.FieldTaskID, task.ID).Infof("Cancel overdue task %v", task.ID)
+			task.cancel()
 		}
 	}
 }
 
-// KillAllTasks kills all the running tasks.
+// KillAllTasks kills all the running tasks, and empties the queue.
 func (m *Manager) KillAllTasks() {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	for _, task := range m.pool.drain() {
+		m.globalLogger.WithField(logging.FieldTaskID, task.ID).Infof("Removing queued task %v", task.ID)
+		m.cancelQueuedLocked(task)
+	}
 	for _, task := range m.tasks {
-		logrus.Infof("About to kill task %v", task.ID)
-		task.cancelFunc()
+		m.globalLogger.WithField(logging.FieldTaskID, task.ID).Infof("About to kill task %v", task.ID)
+		task.cancel()
 	}
 }
 
-// GetRunningTasks returns all the currently running tasks.
+// GetRunningTasks returns all the currently running tasks. Queued tasks are not included.
 func (m *Manager) GetRunningTasks() []*Task {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	tasks := make([]*Task, 0, len(m.tasks))
 	for _, task := range m.tasks {
-		tasks = append(tasks, task)
+		if !m.pool.isQueued(task) {
+			tasks = append(tasks, task)
+		}
 	}
 
 	return tasks
 }
 
-// GetTaskByID retrieves a task based on its ID.
+// GetQueuedTasks returns the tasks waiting for a slot, in the order they will be considered.
+func (m *Manager) GetQueuedTasks() []*Task {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.pool.queued()
+}
+
+// QueueDepth returns the number of tasks waiting for a slot.
+func (m *Manager) QueueDepth() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.pool.queue)
+}
+
+// GetTaskByID retrieves a task based on its ID, whether it is queued or running.
 func (m *Manager) GetTaskByID(id string) (*Task, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -218,8 +564,30 @@ func (m *Manager) GetTasksByType(taskType string) []*Task {
 	return tasks
 }
 
-// Shutdown gracefully shuts down the manager and all its tasks.
-func (m *Manager) Shutdown() {
-	m.KillAllTasks()
-	close(m.shutdown)
+// GetHistory returns the finished tasks that are still kept in the history, most recent first.
+func (m *Manager) GetHistory() []*Task {
+	return m.filterHistory(func(task *Task) bool { return true })
+}
+
+// GetHistoryByDatabase returns the finished tasks for a database, most recent first.
+func (m *Manager) GetHistoryByDatabase(database string) []*Task {
+	return m.filterHistory(func(task *Task) bool { return task.Database == database })
+}
+
+// GetHistoryByType returns the finished tasks of a type, most recent first.
+func (m *Manager) GetHistoryByType(taskType string) []*Task {
+	return m.filterHistory(func(task *Task) bool { return task.Type == taskType })
+}
+
+func (m *Manager) filterHistory(match func(*Task) bool) []*Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []*Task
+	for _, task := range m.history.list() {
+		if match(task) {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
 }
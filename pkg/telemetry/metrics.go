@@ -0,0 +1,101 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metric and attribute names. Attributes are kept to a small, bounded set so they are safe to use as labels.
+const (
+	MetricRotations        = "spiffelink.rotations"
+	MetricFailures         = "spiffelink.rotation.failures"
+	MetricStageDuration    = "spiffelink.stage.duration"
+	MetricSvidTimeToExpiry = "spiffelink.svid.time_to_expiry"
+
+	AttrDatabase = "database"
+	AttrOutcome  = "outcome"
+	AttrCode     = "code"
+	AttrStep     = "step"
+	AttrStage    = "stage"
+	AttrTaskID   = "task_id"
+	AttrSpiffeID = "spiffe_id"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type instruments struct {
+	rotations     metric.Int64Counter
+	failures      metric.Int64Counter
+	stageDuration metric.Float64Histogram
+	timeToExpiry  metric.Float64Histogram
+}
+
+var (
+	instrumentsOnce sync.Once
+	inst            instruments
+)
+
+// The instruments are created from the global meter provider, which forwards them to the real provider
+// once Setup installs it. Errors can only come from invalid instrument names, so they are ignored.
+func getInstruments() *instruments {
+	instrumentsOnce.Do(func() {
+		meter := otel.Meter(instrumentationName)
+		inst.rotations, _ = meter.Int64Counter(MetricRotations,
+			metric.WithDescription("Number of database rotations, by outcome"))
+		inst.failures, _ = meter.Int64Counter(MetricFailures,
+			metric.WithDescription("Number of errors that caused a rotation to fail, by SLError code"))
+		inst.stageDuration, _ = meter.Float64Histogram(MetricStageDuration,
+			metric.WithDescription("Time taken by each stage of each step"),
+			metric.WithUnit("s"))
+		inst.timeToExpiry, _ = meter.Float64Histogram(MetricSvidTimeToExpiry,
+			metric.WithDescription("Time left before the SVID expires when it is sent to a database"),
+			metric.WithUnit("s"))
+	})
+	return &inst
+}
+
+func outcome(success bool) string {
+	if success {
+		return OutcomeSuccess
+	}
+	return OutcomeFailure
+}
+
+// RecordRotation counts one finished rotation of a database.
+func RecordRotation(ctx context.Context, database string, success bool) {
+	getInstruments().rotations.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(AttrDatabase, database),
+		attribute.String(AttrOutcome, outcome(success)),
+	))
+}
+
+// RecordFailure counts one error that caused a rotation of a database to fail.
+func RecordFailure(ctx context.Context, database string, code string) {
+	getInstruments().failures.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(AttrDatabase, database),
+		attribute.String(AttrCode, code),
+	))
+}
+
+// RecordStageDuration records how long one stage of a step took.
+func RecordStageDuration(ctx context.Context, database string, step string, stage string, duration time.Duration, success bool) {
+	getInstruments().stageDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(
+		attribute.String(AttrDatabase, database),
+		attribute.String(AttrStep, step),
+		attribute.String(AttrStage, stage),
+		attribute.String(AttrOutcome, outcome(success)),
+	))
+}
+
+// RecordTimeToExpiry records how long the SVID sent to a database has left before it expires.
+func RecordTimeToExpiry(ctx context.Context, database string, timeToExpiry time.Duration) {
+	getInstruments().timeToExpiry.Record(ctx, timeToExpiry.Seconds(), metric.WithAttributes(
+		attribute.String(AttrDatabase, database),
+	))
+}
@@ -0,0 +1,189 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The telemetry package exports traces and metrics over OTLP, as configured in the opentelemetry section
+// of the config file. Instrumented code uses the global OpenTelemetry providers through Tracer() and the
+// Record* functions in metrics.go, so nothing needs to be passed around. Until Setup is called (or if no
+// exporter endpoint is configured) all of it is a no-op.
+//
+// The traces look like this:
+//   databaseUpdate             one trace per rotation, started by the task manager
+//     DUMMY_SAVE_CERTIFICATE   one span per step, named by the step's TelemetryID
+//       DUMMY_SAVE_CERTIFICATE/execute   one span per stage
+//         shell.RunCmd         one span per ShellContext call
+
+const instrumentationName = "github.com/dfeldman/spiffelink"
+
+const serviceName = "spiffelink"
+
+// Metrics are exported on this interval. It is not configurable since rotations are infrequent anyway.
+const metricExportInterval = 30 * time.Second
+
+// Used for retry settings that are enabled but left empty. These are the exporter's own defaults.
+const (
+	defaultRetryInitialInterval = 5 * time.Second
+	defaultRetryMaxInterval     = 30 * time.Second
+	defaultRetryMaxElapsedTime  = time.Minute
+)
+
+// Telemetry holds the providers created by Setup so they can be flushed on exit.
+type Telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+}
+
+// Tracer returns the tracer used for all SL spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup creates OTLP exporters for traces and metrics and installs them as the global providers.
+func Setup(ctx context.Context, log *logrus.Logger, conf config.OpenTelemetryConfig) (*Telemetry, error) {
+	exporterConf := conf.OtlpExporter
+	// ParseConfig already logs that telemetry is disabled in this case
+	if exporterConf.Endpoint == "" {
+		return &Telemetry{}, nil
+	}
+
+	timeout, err := parseDuration(log, "otlpExporter.timeout", exporterConf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := retrySettings(log, exporterConf)
+	if err != nil {
+		return nil, err
+	}
+
+	traceOpts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(exporterConf.Endpoint),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig(retry)),
+	}
+	metricOpts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(exporterConf.Endpoint),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig(retry)),
+	}
+	if exporterConf.Insecure {
+		traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+		metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+	}
+	if timeout > 0 {
+		traceOpts = append(traceOpts, otlptracegrpc.WithTimeout(timeout))
+		metricOpts = append(metricOpts, otlpmetricgrpc.WithTimeout(timeout))
+	}
+
+	traceExporter, err := otlptracegrpc.New(ctx, traceOpts...)
+	if err != nil {
+		return nil, slerror.TelemetryExporterFailedError(log, exporterConf.Endpoint, err)
+	}
+	metricExporter, err := otlpmetricgrpc.New(ctx, metricOpts...)
+	if err != nil {
+		return nil, slerror.TelemetryExporterFailedError(log, exporterConf.Endpoint, err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(spanProcessor(log, exporterConf, traceExporter)),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(metricExportInterval))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+
+	log.Infof("Exporting OpenTelemetry traces and metrics to %s", exporterConf.Endpoint)
+	return &Telemetry{
+		tracerProvider: tracerProvider,
+		meterProvider:  meterProvider,
+	}, nil
+}
+
+// With the sending queue enabled, spans are batched and exported in the background, and spans are dropped once
+// QueueSize are waiting. Without it, each span is exported as soon as it ends.
+func spanProcessor(log *logrus.Logger, conf config.OTLPExporterConfig, exporter sdktrace.SpanExporter) sdktrace.SpanProcessor {
+	queue := conf.SendingQueue
+	if !queue.Enabled {
+		return sdktrace.NewSimpleSpanProcessor(exporter)
+	}
+	var opts []sdktrace.BatchSpanProcessorOption
+	if queue.QueueSize > 0 {
+		opts = append(opts, sdktrace.WithMaxQueueSize(queue.QueueSize))
+	}
+	if queue.NumConsumers > 1 {
+		// The OpenTelemetry SDK always exports a batch at a time from a single goroutine
+		log.Debugf("opentelemetry.otlpExporter.sendingQueue.numConsumers is not supported and is ignored")
+	}
+	return sdktrace.NewBatchSpanProcessor(exporter, opts...)
+}
+
+func retrySettings(log *logrus.Logger, conf config.OTLPExporterConfig) (otlptracegrpc.RetryConfig, error) {
+	retry := conf.RetryOnFailure
+	settings := otlptracegrpc.RetryConfig{Enabled: retry.Enabled}
+	if !retry.Enabled {
+		return settings, nil
+	}
+	var err error
+	if settings.InitialInterval, err = parseDuration(log, "otlpExporter.retryOnFailure.initialInterval", retry.InitialInterval); err != nil {
+		return settings, err
+	}
+	if settings.MaxInterval, err = parseDuration(log, "otlpExporter.retryOnFailure.maxInterval", retry.MaxInterval); err != nil {
+		return settings, err
+	}
+	if settings.MaxElapsedTime, err = parseDuration(log, "otlpExporter.retryOnFailure.maxElapsedTime", retry.MaxElapsedTime); err != nil {
+		return settings, err
+	}
+	if settings.InitialInterval == 0 {
+		settings.InitialInterval = defaultRetryInitialInterval
+	}
+	if settings.MaxInterval == 0 {
+		settings.MaxInterval = defaultRetryMaxInterval
+	}
+	if settings.MaxElapsedTime == 0 {
+		settings.MaxElapsedTime = defaultRetryMaxElapsedTime
+	}
+	return settings, nil
+}
+
+// Empty durations are allowed and mean "use the exporter's default".
+func parseDuration(log *logrus.Logger, setting string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, slerror.TelemetryDurationInvalidError(log, setting, value)
+	}
+	return d, nil
+}
+
+// Shutdown flushes any spans and metrics that haven't been exported yet.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	var err error
+	if t.tracerProvider != nil {
+		err = t.tracerProvider.Shutdown(ctx)
+	}
+	if t.meterProvider != nil {
+		if metricErr := t.meterProvider.Shutdown(ctx); err == nil {
+			err = metricErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package telemetry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/config"
+	"github.com/dfeldman/spiffelink/pkg/slerror"
+	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/step"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// collectorStub is an in-process OTLP collector that keeps the names of the spans and metrics it receives.
+type collectorStub struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mu      sync.Mutex
+	spans   []string
+	metrics []string
+}
+
+func (c *collectorStub) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans = append(c.spans, span.Name)
+			}
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+type metricsService struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	stub *collectorStub
+}
+
+func (m *metricsService) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	m.stub.mu.Lock()
+	defer m.stub.mu.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				m.stub.metrics = append(m.stub.metrics, metric.Name)
+			}
+		}
+	}
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func startCollector(t *testing.T) (*collectorStub, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	stub := &collectorStub{}
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, stub)
+	collectormetrics.RegisterMetricsServiceServer(server, &metricsService{stub: stub})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return stub, listener.Addr().String()
+}
+
+func newMockLogger() *logrus.Logger {
+	ml := logrus.New()
+	ml.Out = ioutil.Discard // Ensures that the logger does not print anything
+	return ml
+}
+
+func successfulStepFunc(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	return step.StepFuncOutputMessage{}
+}
+
+func failingStepFunc(ctx context.Context, sfi step.StepFuncInput) step.StepFuncOutputMessage {
+	return step.StepFuncOutputMessage{Errors: slerror.SLErrorList{Errors: []slerror.SLError{
+		slerror.New("Mock error"),
+	}}}
+}
+
+func TestExportStepTelemetry(t *testing.T) {
+	stub, endpoint := startCollector(t)
+	logger := newMockLogger()
+
+	conf := config.OpenTelemetryConfig{}
+	conf.OtlpExporter.Endpoint = endpoint
+	conf.OtlpExporter.Insecure = true
+	conf.OtlpExporter.Timeout = "5s"
+	conf.OtlpExporter.RetryOnFailure.Enabled = true
+	conf.OtlpExporter.RetryOnFailure.InitialInterval = ".5s"
+	conf.OtlpExporter.SendingQueue.Enabled = true
+	conf.OtlpExporter.SendingQueue.QueueSize = 100
+
+	tel, err := telemetry.Setup(context.Background(), logger, conf)
+	require.NoError(t, err)
+
+	sl := &spiffelinkcore.SpiffeLinkCore{Logger: logger}
+	dbc := &config.DatabaseConfig{Name: "db1"}
+	steps := []step.Step{
+		{
+			Name:        "First step",
+			TelemetryID: "TEST_FIRST",
+			Pre:         successfulStepFunc,
+			Execute:     successfulStepFunc,
+		},
+		{
+			Name:        "Second step",
+			TelemetryID: "TEST_SECOND",
+			Execute:     failingStepFunc,
+		},
+	}
+	outputs := step.Run(context.Background(), sl, dbc, steps, step.Execute)
+	require.NotEmpty(t, outputs)
+	telemetry.RecordRotation(context.Background(), "db1", false)
+	telemetry.RecordFailure(context.Background(), "db1", string(outputs[0].Errors.Errors[0].Code))
+	telemetry.RecordTimeToExpiry(context.Background(), "db1", time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, tel.Shutdown(ctx))
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	assert.Subset(t, stub.spans, []string{"TEST_FIRST", "TEST_FIRST/pre", "TEST_FIRST/execute", "TEST_SECOND", "TEST_SECOND/execute"})
+	assert.Subset(t, stub.metrics, []string{
+		telemetry.MetricRotations,
+		telemetry.MetricFailures,
+		telemetry.MetricStageDuration,
+		telemetry.MetricSvidTimeToExpiry,
+	})
+}
+
+func TestSetupDisabled(t *testing.T) {
+	tel, err := telemetry.Setup(context.Background(), newMockLogger(), config.OpenTelemetryConfig{})
+	require.NoError(t, err)
+	assert.NoError(t, tel.Shutdown(context.Background()))
+}
+
+func TestSetupInvalidDuration(t *testing.T) {
+	conf := config.OpenTelemetryConfig{}
+	conf.OtlpExporter.Endpoint = "localhost:4317"
+	conf.OtlpExporter.Timeout = "ten seconds"
+
+	_, err := telemetry.Setup(context.Background(), newMockLogger(), conf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package tlscheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The tlscheck package checks which certificate a database serves, by connecting to it and doing a TLS
+// handshake. Datastores use it in Post, after the database has been told to use a new SVID, to make sure
+// clients actually get the new certificate.
+//
+// The chain isn't verified. SVIDs usually have no DNS names, so a normal verification would fail, and the
+// point is only to compare the leaf with the SVID that was installed.
+
+// Wrap turns a connection into the one the TLS handshake runs over, for protocols that don't start with TLS
+// straight away, like SQL Server's TDS. It is given the raw connection.
+type Wrap func(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+// Options for a handshake. The zero value dials plain TLS.
+type Options struct {
+	// Set up the connection before the handshake. Nil means the handshake starts as soon as it connects.
+	Wrap Wrap
+	// Offered with ALPN
+	NextProtos []string
+	// A client certificate, for servers that require one
+	ClientCertificate *tls.Certificate
+}
+
+// Handshake connects to address, does a TLS handshake, and returns the chain the server presented.
+func Handshake(ctx context.Context, address string, opts Options) ([]*x509.Certificate, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	tlsConn := conn
+	if opts.Wrap != nil {
+		if tlsConn, err = opts.Wrap(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	conf := &tls.Config{
+		ServerName: host,
+		// Only the leaf is compared, see above
+		InsecureSkipVerify: true,
+		NextProtos:         opts.NextProtos,
+	}
+	if opts.ClientCertificate != nil {
+		conf.Certificates = []tls.Certificate{*opts.ClientCertificate}
+	}
+	client := tls.Client(tlsConn, conf)
+	if err := client.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	chain := client.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, errors.New("the server presented no certificate")
+	}
+	return chain, nil
+}
+
+// WaitFor does handshakes until the server presents want, or ctx is done. Databases take a while to start
+// after a restart, or to notice new files, so the first few handshakes may fail or get the old certificate.
+// Returns the last error, or what the server presented instead.
+func WaitFor(ctx context.Context, address string, opts Options, want *x509.Certificate, interval time.Duration) error {
+	var last error
+	for {
+		chain, err := Handshake(ctx, address, opts)
+		if err != nil && ctx.Err() != nil && last != nil {
+			// The handshake was cut short, and the one before says more about what went wrong
+			return last
+		}
+		if err == nil {
+			if chain[0].Equal(want) {
+				return nil
+			}
+			err = fmt.Errorf("the server presented the certificate with serial %s", chain[0].SerialNumber)
+		}
+		last = err
+		select {
+		case <-ctx.Done():
+			return last
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package tlscheck_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/pkg/tlscheck"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A TLS server whose certificate can be changed
+type server struct {
+	address string
+	mu      sync.Mutex
+	cert    *tls.Certificate
+}
+
+func newServer(t *testing.T) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	s := &server{address: l.Addr().String()}
+	conf := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.cert, nil
+	}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = tls.Server(conn, conf).Handshake()
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(ca *spiffetest.CA) *x509.Certificate {
+	certs, key := ca.CreateX509SVID("spiffe://example.org/db")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &tls.Certificate{Certificate: [][]byte{certs[0].Raw}, PrivateKey: key}
+	return certs[0]
+}
+
+func TestHandshake(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	s := newServer(t)
+	want := s.serve(ca)
+	chain, err := tlscheck.Handshake(context.Background(), s.address, tlscheck.Options{})
+	require.NoError(t, err)
+	assert.True(t, want.Equal(chain[0]))
+
+	_, err = tlscheck.Handshake(context.Background(), "127.0.0.1:1", tlscheck.Options{})
+	assert.Error(t, err)
+}
+
+func TestWrap(t *testing.T) {
+	s := newServer(t)
+	s.serve(spiffetest.NewCA(t))
+	var wrapped bool
+	_, err := tlscheck.Handshake(context.Background(), s.address, tlscheck.Options{Wrap: func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		wrapped = true
+		return conn, nil
+	}})
+	require.NoError(t, err)
+	assert.True(t, wrapped)
+}
+
+func TestWaitFor(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	s := newServer(t)
+	s.serve(ca)
+	certs, key := ca.CreateX509SVID("spiffe://example.org/db")
+	// The server picks up the new certificate a little later
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cert = &tls.Certificate{Certificate: [][]byte{certs[0].Raw}, PrivateKey: key}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, tlscheck.WaitFor(ctx, s.address, tlscheck.Options{}, certs[0], 10*time.Millisecond))
+
+	// It never gets this one
+	other, _ := ca.CreateX509SVID("spiffe://example.org/db")
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := tlscheck.WaitFor(ctx, s.address, tlscheck.Options{}, other[0], 50*time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), certs[0].SerialNumber.String())
+}
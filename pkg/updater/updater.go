@@ -2,16 +2,24 @@ package updater
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/dfeldman/spiffelink/pkg/config"
 	"github.com/dfeldman/spiffelink/pkg/datastore"
+	"github.com/dfeldman/spiffelink/pkg/logging"
 	"github.com/dfeldman/spiffelink/pkg/shell"
 	"github.com/dfeldman/spiffelink/pkg/spiffelinkcore"
+	"github.com/dfeldman/spiffelink/pkg/status"
 	"github.com/dfeldman/spiffelink/pkg/step"
 	"github.com/dfeldman/spiffelink/pkg/taskmanager"
+	"github.com/dfeldman/spiffelink/pkg/telemetry"
 	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WorkloadAPIClient defines the interface for interacting with the SPIFFE Workload API.
@@ -36,6 +44,9 @@ func (rwac *RealWorkloadAPIClient) WatchX509Context(ctx context.Context, w workl
 	return rwac.client.WatchX509Context(ctx, w)
 }
 
+// A rotation is urgent if the database's certificate expires sooner than this
+const urgentExpiry = time.Hour
+
 type Updater struct {
 	config *config.Config
 	client WorkloadAPIClient
@@ -43,18 +54,65 @@ type Updater struct {
 	stores []datastore.Datastore
 	logger *logrus.Logger
 	sl     *spiffelinkcore.SpiffeLinkCore
+	status *status.Tracker
+	// The last update from the Workload API, kept so a rotation can be forced between updates
+	mu     sync.Mutex
+	latest *workloadapi.X509Context
+	// Journals every rotation, if set
+	journal *step.Journal
+	// Runs found in the journal at startup that still have to be finished or undone, by database
+	interrupted map[string][]step.JournalRun
 }
 
 func NewUpdater(config *config.Config, client WorkloadAPIClient, tm taskmanager.ManagerInterface, stores []datastore.Datastore, logger *logrus.Logger) *Updater {
+	tracker := status.NewTracker()
+	for _, db := range config.Databases {
+		tracker.AddDatabase(db.Name, db.SpiffeID)
+	}
 	return &Updater{
 		config: config,
 		client: client,
 		tm:     tm,
 		stores: stores,
 		logger: logger,
+		status: tracker,
+	}
+}
+
+// Status returns the tracker that records the outcome of every rotation.
+func (u *Updater) Status() *status.Tracker {
+	return u.status
+}
+
+// UseJournal makes the updater journal every rotation. Any rotation that was interrupted by spiffelink dying is
+// recovered when the database is next rotated, since finishing it needs an update from the Workload API.
+func (u *Updater) UseJournal(journal *step.Journal) error {
+	runs, err := journal.Incomplete()
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.journal = journal
+	u.interrupted = make(map[string][]step.JournalRun)
+	for _, run := range runs {
+		u.logger.WithField(logging.FieldDatabase, run.Begin.Database).Warnf(
+			"Rotation started at %s was interrupted; it will be finished or undone on the next update", run.Begin.Time)
+		u.interrupted[run.Begin.Database] = append(u.interrupted[run.Begin.Database], run)
 	}
+	return nil
 }
 
+// Take the interrupted runs for a database, so only one rotation recovers them.
+func (u *Updater) takeInterrupted(database string) []step.JournalRun {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	runs := u.interrupted[database]
+	delete(u.interrupted, database)
+	return runs
+}
+
+// Start watches the Workload API and starts a rotation on every update. It returns when ctx is cancelled.
 func (u *Updater) Start(ctx context.Context) {
 	u.logger.Info("Starting SPIFFE updater...")
 	// TODO this should probably be passed in higher up the stack
@@ -62,8 +120,10 @@ func (u *Updater) Start(ctx context.Context) {
 		Logger: u.logger,
 		Config: u.config,
 	}
+	u.scheduleRotations(ctx)
 	err := u.client.WatchX509Context(ctx, u)
-	if err != nil {
+	// The watch only ends without an error when ctx is cancelled, which is how spiffelink is stopped
+	if err != nil && ctx.Err() == nil {
 		u.logger.Fatalf("Error watching X.509 context: %v", err)
 	}
 
@@ -71,34 +131,233 @@ func (u *Updater) Start(ctx context.Context) {
 
 func (u *Updater) OnX509ContextUpdate(c *workloadapi.X509Context) {
 	u.logger.Info("Received SPIFFE update.")
+	u.status.AgentUpdate()
+	u.mu.Lock()
+	u.latest = c
+	u.mu.Unlock()
+	for _, dbConfig := range u.config.Databases {
+		if _, err := u.startRotation(dbConfig, c, u.rotationPriority(dbConfig, c)); err != nil {
+			u.logger.Errorf("Error starting task for database %s: %v", dbConfig.Name, err)
+		}
+	}
+}
+
+// Rotate starts a rotation of one database with the last SVIDs received from the Workload API,
+// without waiting for the next update.
+func (u *Updater) Rotate(name string) (*taskmanager.Task, error) {
+	u.mu.Lock()
+	latest := u.latest
+	u.mu.Unlock()
+	if latest == nil {
+		return nil, fmt.Errorf("no update has been received from the SPIFFE Workload API yet")
+	}
+	for _, dbConfig := range u.config.Databases {
+		if dbConfig.Name == name {
+			// Someone is waiting for this one
+			return u.startRotation(dbConfig, latest, taskmanager.PriorityHigh)
+		}
+	}
+	return nil, fmt.Errorf("database %s is not configured", name)
+}
+
+// Start a task that sends the SVIDs in the update to one database.
+// The task keeps a pointer to the config, so dbConfig is passed by value.
+func (u *Updater) startRotation(dbConfig config.DatabaseConfig, c *workloadapi.X509Context, priority taskmanager.Priority) (*taskmanager.Task, error) {
+	for _, store := range u.stores {
+		if dbConfig.Type != store.GetName() {
+			continue
+		}
+		update := spiffelinkcore.SpiffeLinkUpdate{
+			Svids:   c.SVIDs,
+			Bundles: c.Bundles.Bundles(),
+		}
+		svid := findSVID(c.SVIDs, dbConfig.SpiffeID)
+		if svid != nil {
+			telemetry.RecordTimeToExpiry(context.Background(), dbConfig.Name, time.Until(svid.Certificates[0].NotAfter))
+		}
+		// TODO handle errors in GetShellContext (there are none defined right now, but in the future there might be)
+		shellContext, _ := shell.GetShellContextFromConfig(dbConfig.Shell, u.logger)
+		taskFunc := store.GetUpdateSteps(context.TODO(), dbConfig, shellContext, update)
+		if err := taskFunc.Validate(u.logger); err != nil {
+			return nil, err
+		}
+		runner := step.Runner{
+			Dbc:          &dbConfig,
+			Update:       &update,
+			ShellContext: shellContext,
+		}
+		opts := []taskmanager.TaskOption{
+			taskmanager.WithDatabase(dbConfig.Name),
+			taskmanager.WithFields(logrus.Fields{logging.FieldSpiffeID: dbConfig.SpiffeID}),
+			taskmanager.WithPriority(priority),
+			taskmanager.WithShellTarget(dbConfig.Shell.TargetName()),
+		}
+		if grouper, ok := store.(datastore.Grouper); ok {
+			if group := grouper.Group(dbConfig); group != "" {
+				opts = append(opts, taskmanager.WithGroup(group))
+			}
+		}
+		return u.tm.NewTask("databaseUpdate", time.Duration(dbConfig.Timeout)*time.Second, u.stepListTaskFuncBuilder(taskFunc, runner, svid, step.Execute), opts...)
+	}
+	return nil, fmt.Errorf("no datastore found for database %s", dbConfig.Name)
+}
+
+// Rotate each database whose datastore is a datastore.Scheduler at the times it asks for, until ctx is cancelled.
+func (u *Updater) scheduleRotations(ctx context.Context) {
 	for _, dbConfig := range u.config.Databases {
 		for _, store := range u.stores {
-			if dbConfig.Name == store.GetName() {
-				update := spiffelinkcore.SpiffeLinkUpdate{
-					Svids:   c.SVIDs,
-					Bundles: c.Bundles.Bundles(),
-				}
-				// TODO handle errors in GetShellContext (there are none defined right now, but in the future there might be)
-				shellContext, _ := shell.GetShellContextFromConfig(dbConfig.Shell, u.logger)
-				taskFunc := store.GetUpdateSteps(context.TODO(), dbConfig, shellContext, update)
-				_, err := u.tm.NewTask("databaseUpdate", time.Duration(dbConfig.Timeout)*time.Second, u.stepListTaskFuncBuilder(taskFunc, &dbConfig, step.Execute))
-				if err != nil {
-					u.logger.Errorf("Error starting task for database %s: %v", dbConfig.Name, err)
-				}
+			if scheduler, ok := store.(datastore.Scheduler); ok && dbConfig.Type == store.GetName() {
+				go u.runScheduled(ctx, dbConfig, scheduler)
 			}
 		}
 	}
 }
 
+func (u *Updater) runScheduled(ctx context.Context, dbConfig config.DatabaseConfig, scheduler datastore.Scheduler) {
+	for {
+		next, ok := scheduler.NextRun(dbConfig, time.Now())
+		if !ok {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		u.mu.Lock()
+		latest := u.latest
+		u.mu.Unlock()
+		if latest == nil {
+			u.logger.Warnf("Not running scheduled rotation of %s: no update has been received from the SPIFFE Workload API yet", dbConfig.Name)
+			continue
+		}
+		u.logger.Infof("Running scheduled rotation of %s", dbConfig.Name)
+		if _, err := u.startRotation(dbConfig, latest, taskmanager.PriorityNormal); err != nil {
+			u.logger.Errorf("Error starting scheduled task for database %s: %v", dbConfig.Name, err)
+		}
+	}
+}
+
 func (u *Updater) OnX509ContextWatchError(err error) {
 	u.logger.Errorf("OnX509ContextWatchError error: %v", err)
+	u.status.AgentError()
 }
 
 // This is just an adapter that converts the task function used in TaskManager to the format used in the Step package
-func (u *Updater) stepListTaskFuncBuilder(sl step.StepList, dbc *config.DatabaseConfig, mode step.Mode) taskmanager.TaskFunc {
+// The runner is copied into the task, which fills in the logger and output channel.
+func (u *Updater) stepListTaskFuncBuilder(sl step.StepList, runner step.Runner, svid *x509svid.SVID, mode step.Mode) taskmanager.TaskFunc {
 	return func(logger *logrus.Logger, ctx context.Context, out chan step.StepFuncOutputMessage) {
-		// TODO wire in the output channel here
 		// TODO make the Mode option work properly
-		step.Run(ctx, u.sl, dbc, sl.Steps, mode)
+		// Steps log through the task's logger so their entries are captured with the task
+		taskSl := *u.sl
+		taskSl.Logger = logger
+		runner.Sl = &taskSl
+		runner.Output = out
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String(telemetry.AttrSpiffeID, runner.Dbc.SpiffeID),
+			attribute.String("datastore", sl.DatastoreName),
+		)
+		serial := ""
+		if svid != nil {
+			serial = svid.Certificates[0].SerialNumber.String()
+		}
+		if outputs, finished := u.recover(ctx, sl, runner, serial); finished {
+			u.recordRotation(ctx, runner.Dbc.Name, svid, outputs)
+			return
+		}
+		runner.Journal = u.beginJournal(sl, runner.Dbc.Name, mode, serial)
+		outputs := runner.Run(ctx, sl.Steps, mode)
+		runner.Journal.End(outputs)
+		u.recordRotation(ctx, runner.Dbc.Name, svid, outputs)
+	}
+}
+
+// Start the journal for a run. The run goes ahead without one if the journal can't be written.
+func (u *Updater) beginJournal(sl step.StepList, database string, mode step.Mode, serial string) *step.JournalWriter {
+	u.mu.Lock()
+	journal := u.journal
+	u.mu.Unlock()
+	if journal == nil {
+		return nil
+	}
+	w, err := journal.Begin(database, sl.DatastoreName, sl.ID, mode, serial)
+	if err != nil {
+		u.logger.Errorf("Not journaling rotation of %s: %v", database, err)
+		return nil
+	}
+	return w
+}
+
+// Finish or undo the interrupted runs of a database, oldest first. Returns true if one of them was finished,
+// with its outputs, so the rotation is done.
+func (u *Updater) recover(ctx context.Context, sl step.StepList, runner step.Runner, serial string) ([]step.StepFuncOutputMessage, bool) {
+	for _, run := range u.takeInterrupted(runner.Dbc.Name) {
+		// A resumed run is journaled as a new run, so it can be recovered again if it is interrupted too
+		runner.Journal = u.beginJournal(sl, runner.Dbc.Name, step.Execute, serial)
+		outputs, finished, err := runner.Recover(ctx, sl.Steps, run, serial)
+		if finished {
+			runner.Journal.End(outputs)
+		} else {
+			// Nothing was run, so there is nothing for the new journal to recover
+			runner.Journal.End(nil)
+		}
+		if err != nil {
+			// Nothing was undone either, so keep the journal for the next start
+			u.logger.Errorf("Unable to recover interrupted rotation of %s, keeping its journal: %v", runner.Dbc.Name, err)
+			continue
+		}
+		// The old journal is only removed once the run has been dealt with, so a crash while recovering
+		// leaves it to be recovered again
+		u.mu.Lock()
+		err = u.journal.Discard(run)
+		u.mu.Unlock()
+		if err != nil {
+			u.logger.Errorf("Unable to remove the journal of the recovered rotation of %s, so it will be recovered again on the next start: %v", runner.Dbc.Name, err)
+		}
+		if finished {
+			return outputs, true
+		}
+	}
+	return nil, false
+}
+
+// Step.Run only returns output messages when a step failed
+func (u *Updater) recordRotation(ctx context.Context, database string, svid *x509svid.SVID, outputs []step.StepFuncOutputMessage) {
+	var failure error
+	for _, output := range outputs {
+		for _, err := range output.Errors.Errors {
+			if failure == nil {
+				failure = err
+			}
+			telemetry.RecordFailure(ctx, database, string(err.Code))
+		}
+	}
+	telemetry.RecordRotation(ctx, database, failure == nil)
+	u.status.RecordRotation(database, svid, failure)
+}
+
+// Delivering a certificate the database doesn't have yet, or replacing one that is about to expire, can't wait.
+// If the database already has the SVID in the update, only the bundles have changed, which is routine.
+func (u *Updater) rotationPriority(dbConfig config.DatabaseConfig, c *workloadapi.X509Context) taskmanager.Priority {
+	svid := findSVID(c.SVIDs, dbConfig.SpiffeID)
+	if svid == nil {
+		return taskmanager.PriorityNormal
+	}
+	db, _ := u.status.Get(dbConfig.Name)
+	if db.SvidSerial != svid.Certificates[0].SerialNumber.String() || time.Until(db.SvidExpiry) < urgentExpiry {
+		return taskmanager.PriorityHigh
+	}
+	return taskmanager.PriorityLow
+}
+
+// Find the SVID for a SPIFFE ID in an update, or nil if the update doesn't have one.
+func findSVID(svids []*x509svid.SVID, spiffeID string) *x509svid.SVID {
+	for _, svid := range svids {
+		if svid.ID.String() == spiffeID && len(svid.Certificates) > 0 {
+			return svid
+		}
 	}
+	return nil
 }
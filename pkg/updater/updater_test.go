@@ -2,6 +2,7 @@ package updater_test
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,7 +17,9 @@ import (
 	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockWorkloadAPIClient
@@ -24,16 +27,24 @@ type MockWorkloadAPIClient struct {
 	mock.Mock
 }
 
+// The arguments aren't passed to Called, which formats them while the updater's goroutines may be using them
 func (m *MockWorkloadAPIClient) WatchX509Context(ctx context.Context, w workloadapi.X509ContextWatcher) error {
-	args := m.Called(ctx, w)
+	args := m.Called()
 	return args.Error(0)
 }
 
 type MockTaskManager struct {
 	mock.Mock
+	// The options of each new task, applied to an empty task
+	options []*taskmanager.Task
 }
 
-func (m *MockTaskManager) NewTask(taskType string, timeout time.Duration, taskFunc taskmanager.TaskFunc) (*taskmanager.Task, error) {
+func (m *MockTaskManager) NewTask(taskType string, timeout time.Duration, taskFunc taskmanager.TaskFunc, opts ...taskmanager.TaskOption) (*taskmanager.Task, error) {
+	options := &taskmanager.Task{Fields: logrus.Fields{}}
+	for _, opt := range opts {
+		opt(options)
+	}
+	m.options = append(m.options, options)
 	args := m.Called(taskType, timeout, taskFunc)
 	return args.Get(0).(*taskmanager.Task), args.Error(1)
 }
@@ -56,6 +67,16 @@ func (m *MockTaskManager) GetRunningTasks() []*taskmanager.Task {
 	return args.Get(0).([]*taskmanager.Task)
 }
 
+func (m *MockTaskManager) GetQueuedTasks() []*taskmanager.Task {
+	args := m.Called()
+	return args.Get(0).([]*taskmanager.Task)
+}
+
+func (m *MockTaskManager) QueueDepth() int {
+	args := m.Called()
+	return args.Int(0)
+}
+
 func (m *MockTaskManager) GetTaskByID(id string) (*taskmanager.Task, error) {
 	args := m.Called(id)
 	return args.Get(0).(*taskmanager.Task), args.Error(1)
@@ -66,8 +87,24 @@ func (m *MockTaskManager) GetTasksByType(taskType string) []*taskmanager.Task {
 	return args.Get(0).([]*taskmanager.Task)
 }
 
-func (m *MockTaskManager) Shutdown() {
-	m.Called()
+func (m *MockTaskManager) GetHistory() []*taskmanager.Task {
+	args := m.Called()
+	return args.Get(0).([]*taskmanager.Task)
+}
+
+func (m *MockTaskManager) GetHistoryByDatabase(database string) []*taskmanager.Task {
+	args := m.Called(database)
+	return args.Get(0).([]*taskmanager.Task)
+}
+
+func (m *MockTaskManager) GetHistoryByType(taskType string) []*taskmanager.Task {
+	args := m.Called(taskType)
+	return args.Get(0).([]*taskmanager.Task)
+}
+
+func (m *MockTaskManager) Shutdown(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
 }
 
 // MockDatastore
@@ -85,6 +122,28 @@ func (m *MockDatastore) GetUpdateSteps(ctx context.Context, dbConfig config.Data
 	return args.Get(0).(step.StepList)
 }
 
+// A datastore that asks for a rotation soon after it is asked, once
+type MockSchedulingDatastore struct {
+	MockDatastore
+	asked atomic.Int32
+}
+
+func (m *MockSchedulingDatastore) NextRun(dbConfig config.DatabaseConfig, now time.Time) (time.Time, bool) {
+	if m.asked.Add(1) > 1 {
+		return time.Time{}, false
+	}
+	return now.Add(10 * time.Millisecond), true
+}
+
+// A datastore that groups its databases by the connection string
+type MockGroupingDatastore struct {
+	MockDatastore
+}
+
+func (m *MockGroupingDatastore) Group(dbConfig config.DatabaseConfig) string {
+	return dbConfig.ConnectionString
+}
+
 func TestUpdater_OnX509ContextUpdate(t *testing.T) {
 	// Mock setup
 	mockClient := new(MockWorkloadAPIClient)
@@ -94,6 +153,7 @@ func TestUpdater_OnX509ContextUpdate(t *testing.T) {
 	// Config setup
 	dbConfig := config.DatabaseConfig{
 		Name: "mockDB",
+		Type: "mock",
 	}
 	cfg := config.Config{
 		Databases: []config.DatabaseConfig{dbConfig},
@@ -101,12 +161,12 @@ func TestUpdater_OnX509ContextUpdate(t *testing.T) {
 	stores := []datastore.Datastore{mockDatastore}
 
 	// Mock expectations
-	mockDatastore.On("GetName").Return("mockDB")
+	mockDatastore.On("GetName").Return("mock")
 	mockDatastore.On("GetUpdateSteps", mock.Anything, dbConfig, mock.Anything).Return(step.StepList{})
 	mockTM.On("NewTask", mock.Anything, mock.Anything, mock.Anything).Return(&taskmanager.Task{}, nil).Once()
 
 	// Create the Updater
-	u := updater.NewUpdater(cfg, mockClient, mockTM, stores, logrus.New())
+	u := updater.NewUpdater(&cfg, mockClient, mockTM, stores, logrus.New())
 
 	// Call OnX509ContextUpdate
 	bundlesSet := x509bundle.NewSet()
@@ -120,3 +180,115 @@ func TestUpdater_OnX509ContextUpdate(t *testing.T) {
 	mockDatastore.AssertExpectations(t)
 	mockTM.AssertExpectations(t)
 }
+
+func TestUpdater_Rotate(t *testing.T) {
+	mockClient := new(MockWorkloadAPIClient)
+	mockTM := new(MockTaskManager)
+	mockDatastore := new(MockDatastore)
+
+	dbConfig := config.DatabaseConfig{
+		Name: "mockDB",
+		Type: "mock",
+	}
+	cfg := config.Config{
+		Databases: []config.DatabaseConfig{dbConfig},
+	}
+	stores := []datastore.Datastore{mockDatastore}
+
+	mockDatastore.On("GetName").Return("mock")
+	mockDatastore.On("GetUpdateSteps", mock.Anything, dbConfig, mock.Anything).Return(step.StepList{})
+	mockTM.On("NewTask", mock.Anything, mock.Anything, mock.Anything).Return(&taskmanager.Task{ID: "databaseUpdate 1"}, nil)
+
+	u := updater.NewUpdater(&cfg, mockClient, mockTM, stores, logrus.New())
+
+	// Nothing to rotate with until the first update arrives
+	_, err := u.Rotate("mockDB")
+	assert.Error(t, err)
+
+	u.OnX509ContextUpdate(&workloadapi.X509Context{
+		SVIDs:   []*x509svid.SVID{},
+		Bundles: x509bundle.NewSet(),
+	})
+
+	task, err := u.Rotate("mockDB")
+	require.NoError(t, err)
+	assert.Equal(t, "databaseUpdate 1", task.ID)
+	mockTM.AssertNumberOfCalls(t, "NewTask", 2)
+
+	_, err = u.Rotate("otherDB")
+	assert.Error(t, err)
+}
+
+func TestUpdater_ScheduledRotation(t *testing.T) {
+	mockClient := new(MockWorkloadAPIClient)
+	mockTM := new(MockTaskManager)
+	store := new(MockSchedulingDatastore)
+
+	dbConfig := config.DatabaseConfig{
+		Name: "mockDB",
+		Type: "mock",
+	}
+	cfg := config.Config{
+		Databases: []config.DatabaseConfig{dbConfig},
+	}
+
+	store.On("GetName").Return("mock")
+	store.On("GetUpdateSteps", mock.Anything, dbConfig, mock.Anything).Return(step.StepList{})
+	started := make(chan struct{}, 2)
+	mockTM.On("NewTask", mock.Anything, mock.Anything, mock.Anything).Return(&taskmanager.Task{}, nil).Run(func(mock.Arguments) {
+		started <- struct{}{}
+	})
+	mockClient.On("WatchX509Context").Return(nil)
+
+	u := updater.NewUpdater(&cfg, mockClient, mockTM, []datastore.Datastore{store}, logrus.New())
+	u.OnX509ContextUpdate(&workloadapi.X509Context{
+		SVIDs:   []*x509svid.SVID{},
+		Bundles: x509bundle.NewSet(),
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u.Start(ctx)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduled rotation didn't start")
+	}
+	mockTM.AssertNumberOfCalls(t, "NewTask", 2)
+}
+
+func TestUpdater_Group(t *testing.T) {
+	mockClient := new(MockWorkloadAPIClient)
+	mockTM := new(MockTaskManager)
+	store := new(MockGroupingDatastore)
+
+	cfg := config.Config{
+		Databases: []config.DatabaseConfig{
+			{Name: "member1", Type: "mock", ConnectionString: "cluster"},
+			{Name: "member2", Type: "mock", ConnectionString: "cluster"},
+			{Name: "standalone", Type: "mock"},
+		},
+	}
+
+	store.On("GetName").Return("mock")
+	store.On("GetUpdateSteps", mock.Anything, mock.Anything, mock.Anything).Return(step.StepList{})
+	mockTM.On("NewTask", mock.Anything, mock.Anything, mock.Anything).Return(&taskmanager.Task{}, nil)
+
+	u := updater.NewUpdater(&cfg, mockClient, mockTM, []datastore.Datastore{store}, logrus.New())
+	u.OnX509ContextUpdate(&workloadapi.X509Context{
+		SVIDs:   []*x509svid.SVID{},
+		Bundles: x509bundle.NewSet(),
+	})
+
+	// The members' tasks are created in the order of the configuration, so they run in that order
+	require.Len(t, mockTM.options, 3)
+	for i, want := range []struct{ database, group string }{
+		{"member1", "cluster"},
+		{"member2", "cluster"},
+		{"standalone", ""},
+	} {
+		assert.Equal(t, want.database, mockTM.options[i].Database)
+		assert.Equal(t, want.group, mockTM.options[i].Group)
+	}
+}
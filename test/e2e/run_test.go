@@ -0,0 +1,262 @@
+package e2e
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/cmd"
+	"github.com/dfeldman/spiffelink/pkg/admin"
+	"github.com/dfeldman/spiffelink/test/fakeworkloadapi"
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// These tests run the whole run command, as spiffelink would be started, against a fake Workload API, with a
+// files database that writes to a temporary directory. Unlike the docker-compose tests in test/integ, they
+// need no SPIRE server or agent, so they run with go test.
+
+const spiffeID = "spiffe://example.org/app"
+
+// How long to wait for spiffelink to react to an update
+const waitFor = 15 * time.Second
+
+var td = spiffeid.RequireTrustDomainFromString("example.org")
+
+var configTemplate = `
+spiffeAgentSocketPath: "%s"
+databases:
+%sadmin:
+  socketPath: "%s"
+journal:
+  dir: "%s"
+tasks:
+  shutdownGracePeriod: 5s
+log:
+  level: INFO
+`
+
+// One database in the config. The datastore is found by its type, so the name can be anything.
+var databaseTemplate = `  - name: %s
+    type: files
+    connectionString: "%s?cert=tls.crt&key=tls.key&bundle=ca.crt"
+    spiffeID: "%s"
+`
+
+// A spiffelink run command running in the test
+type spiffelink struct {
+	t           *testing.T
+	certDir     string
+	adminSocket string
+	// The directory each database writes to, by name
+	certDirs map[string]string
+}
+
+// Start the run command with a config for the Workload API, with a files database for each name, or one named
+// "files" if there are none. It is stopped when the test ends.
+func start(t *testing.T, api *fakeworkloadapi.WorkloadAPI, names ...string) *spiffelink {
+	if len(names) == 0 {
+		names = []string{"files"}
+	}
+	confDir := t.TempDir()
+	certDirs := map[string]string{}
+	databases := ""
+	for _, name := range names {
+		certDirs[name] = t.TempDir()
+		databases += fmt.Sprintf(databaseTemplate, name, certDirs[name], spiffeID)
+	}
+	// Unix socket paths are limited to about 100 characters, and t.TempDir includes the test's name
+	socketDir, err := os.MkdirTemp("", "sl")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+	adminSocket := filepath.Join(socketDir, "admin.sock")
+	conf := fmt.Sprintf(configTemplate, api.Addr(), databases, adminSocket, filepath.Join(confDir, "journal"))
+	require.NoError(t, os.WriteFile(filepath.Join(confDir, "spiffelink.yaml"), []byte(conf), 0600))
+
+	// The config is read through viper's global instance, so start from scratch each time
+	viper.Reset()
+	root := &cobra.Command{Use: "spiffelink"}
+	root.AddCommand(cmd.NewRunCmd(logrus.New()))
+	root.SetArgs([]string{"run", "--config", confDir})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- root.ExecuteContext(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(waitFor):
+			t.Error("spiffelink did not stop")
+		}
+	})
+	return &spiffelink{t: t, certDir: certDirs[names[0]], adminSocket: adminSocket, certDirs: certDirs}
+}
+
+// The same run command, looking at the files of another database
+func (s *spiffelink) database(name string) *spiffelink {
+	require.Contains(s.t, s.certDirs, name)
+	other := *s
+	other.certDir = s.certDirs[name]
+	return &other
+}
+
+// The certificates in a PEM file, or nil if it can't be read yet
+func readCertificates(path string) []*x509.Certificate {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// Wait until the files database has an SVID
+func (s *spiffelink) waitForSVID(svid *x509svid.SVID) {
+	require.Eventually(s.t, func() bool {
+		certs := readCertificates(filepath.Join(s.certDir, "tls.crt"))
+		return len(certs) > 0 && certs[0].Equal(svid.Certificates[0])
+	}, waitFor, 50*time.Millisecond, "the SVID with serial %s was not written", svid.Certificates[0].SerialNumber)
+}
+
+// Wait until the files database trusts exactly the given authorities. Trust domains can come in any order.
+func (s *spiffelink) waitForBundle(authorities []*x509.Certificate) {
+	require.Eventually(s.t, func() bool {
+		certs := readCertificates(filepath.Join(s.certDir, "ca.crt"))
+		bundle := x509bundle.FromX509Authorities(td, certs)
+		if len(certs) != len(authorities) {
+			return false
+		}
+		for _, authority := range authorities {
+			if !bundle.HasX509Authority(authority) {
+				return false
+			}
+		}
+		return true
+	}, waitFor, 50*time.Millisecond, "the bundle was not written")
+}
+
+func TestRunInstallsSVID(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	api := fakeworkloadapi.New(t, ca, td)
+	svid := api.RotateSVID(spiffeID)
+	s := start(t, api)
+
+	s.waitForSVID(svid)
+	s.waitForBundle(ca.Roots())
+	// The key goes with the certificate, and only its owner can read it
+	keyPath := filepath.Join(s.certDir, "tls.key")
+	_, err := tls.LoadX509KeyPair(filepath.Join(s.certDir, "tls.crt"), keyPath)
+	require.NoError(t, err)
+	info, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The rotation is reported through the admin API, as "spiffelink status" shows it
+	client := admin.NewClient(s.adminSocket, logrus.New())
+	require.Eventually(t, func() bool {
+		st, err := client.Status()
+		return err == nil && len(st.Databases) == 1 && st.Databases[0].SvidSerial == svid.Certificates[0].SerialNumber.String()
+	}, waitFor, 50*time.Millisecond)
+}
+
+// Databases are matched to their datastore by type, so several databases can have the same type, under any name
+func TestRunFindsDatastoreByType(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	api := fakeworkloadapi.New(t, ca, td)
+	svid := api.RotateSVID(spiffeID)
+	s := start(t, api, "web", "worker")
+
+	for _, name := range []string{"web", "worker"} {
+		s.database(name).waitForSVID(svid)
+		s.database(name).waitForBundle(ca.Roots())
+	}
+	client := admin.NewClient(s.adminSocket, logrus.New())
+	require.Eventually(t, func() bool {
+		st, err := client.Status()
+		if err != nil || len(st.Databases) != 2 {
+			return false
+		}
+		for _, db := range st.Databases {
+			if db.SvidSerial != svid.Certificates[0].SerialNumber.String() {
+				return false
+			}
+		}
+		return true
+	}, waitFor, 50*time.Millisecond)
+}
+
+func TestRunRotatesSVID(t *testing.T) {
+	api := fakeworkloadapi.New(t, spiffetest.NewCA(t), td)
+	first := api.RotateSVID(spiffeID)
+	s := start(t, api)
+	s.waitForSVID(first)
+
+	second := api.RotateSVID(spiffeID)
+	s.waitForSVID(second)
+	third := api.RotateSVID(spiffeID)
+	s.waitForSVID(third)
+}
+
+func TestRunUpdatesBundle(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	api := fakeworkloadapi.New(t, ca, td)
+	svid := api.RotateSVID(spiffeID)
+	s := start(t, api)
+	s.waitForSVID(svid)
+	s.waitForBundle(ca.Roots())
+
+	// The trust domain's CA changes, while the SVID stays the same
+	newCA := spiffetest.NewCA(t)
+	authorities := append(ca.Roots(), newCA.Roots()...)
+	api.SetBundle(x509bundle.FromX509Authorities(td, authorities))
+	s.waitForBundle(authorities)
+
+	// Federated bundles are trusted too
+	partner := spiffetest.NewCA(t)
+	api.SetBundle(x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("partner.org"), partner.Roots()))
+	s.waitForBundle(append(authorities, partner.Roots()...))
+	s.waitForSVID(svid)
+}
+
+func TestRunReconnectsAfterWorkloadAPIError(t *testing.T) {
+	api := fakeworkloadapi.New(t, spiffetest.NewCA(t), td)
+	first := api.RotateSVID(spiffeID)
+	s := start(t, api)
+	s.waitForSVID(first)
+	require.Eventually(t, func() bool { return api.Streams() == 1 }, waitFor, 50*time.Millisecond)
+
+	// The agent goes away, and the SVID is rotated while spiffelink can't reach it
+	api.SetError(status.Error(codes.Unavailable, "agent restarting"))
+	require.Eventually(t, func() bool { return api.Streams() == 0 }, waitFor, 50*time.Millisecond)
+	second := api.RotateSVID(spiffeID)
+	s.waitForSVID(first)
+
+	// spiffelink reconnects when the agent is back, and gets the new SVID
+	api.SetError(nil)
+	s.waitForSVID(second)
+}
@@ -0,0 +1,297 @@
+package fakeworkloadapi
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// WorkloadAPI serves the SPIFFE Workload API on a Unix socket, with SVIDs issued by a spiffetest.CA, so
+// spiffelink can be tested end to end without a SPIRE server and agent. Only the X.509 SVID stream is served.
+// Every change to the SVIDs or bundles is pushed to the connected clients straight away, like an agent
+// pushes a rotation.
+//
+//	api := fakeworkloadapi.New(t, spiffetest.NewCA(t), spiffeid.RequireTrustDomainFromString("example.org"))
+//	api.RotateSVID("spiffe://example.org/db")
+//	client, _ := workloadapi.New(ctx, workloadapi.WithAddr(api.Addr()))
+type WorkloadAPI struct {
+	tb         testing.TB
+	ca         *spiffetest.CA
+	socketPath string
+	server     *grpc.Server
+	wg         sync.WaitGroup
+
+	mu      sync.Mutex
+	svids   []*x509svid.SVID
+	bundles map[spiffeid.TrustDomain]*x509bundle.Bundle
+	// Returned to every client while it is set
+	err     error
+	streams map[chan update]struct{}
+}
+
+// What a stream sends next: a response, or an error that ends the stream
+type update struct {
+	resp *workload.X509SVIDResponse
+	err  error
+}
+
+// Returned when there are no SVIDs, like the SPIRE agent does for a workload with no registration entries
+var errNoIdentity = status.Error(codes.PermissionDenied, "no identity issued")
+
+// New starts a Workload API for the trust domain td, whose bundle is the CA's roots. It has no SVIDs until
+// SetSVIDs or RotateSVID is called. It is stopped when the test ends.
+func New(tb testing.TB, ca *spiffetest.CA, td spiffeid.TrustDomain) *WorkloadAPI {
+	// Unix socket paths are limited to about 100 characters, and t.TempDir includes the test's name
+	dir, err := os.MkdirTemp("", "wlapi")
+	require.NoError(tb, err)
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(tb, err)
+
+	w := &WorkloadAPI{
+		tb:         tb,
+		ca:         ca,
+		socketPath: socketPath,
+		server:     grpc.NewServer(),
+		bundles:    map[spiffeid.TrustDomain]*x509bundle.Bundle{td: x509bundle.FromX509Authorities(td, ca.Roots())},
+		streams:    make(map[chan update]struct{}),
+	}
+	workload.RegisterSpiffeWorkloadAPIServer(w.server, &handler{w: w})
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		_ = w.server.Serve(listener)
+	}()
+	tb.Cleanup(w.Stop)
+	return w
+}
+
+// Stop closes every stream and stops the server.
+func (w *WorkloadAPI) Stop() {
+	w.server.Stop()
+	w.wg.Wait()
+}
+
+// Addr is the address to give workloadapi.WithAddr or spiffeAgentSocketPath.
+func (w *WorkloadAPI) Addr() string {
+	return "unix://" + w.socketPath
+}
+
+func (w *WorkloadAPI) SocketPath() string {
+	return w.socketPath
+}
+
+// Streams returns how many clients are watching for updates.
+func (w *WorkloadAPI) Streams() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.streams)
+}
+
+// SVIDs returns the SVIDs being served.
+func (w *WorkloadAPI) SVIDs() []*x509svid.SVID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*x509svid.SVID(nil), w.svids...)
+}
+
+// Bundle returns the bundle being served for a trust domain, or nil if there isn't one.
+func (w *WorkloadAPI) Bundle(td spiffeid.TrustDomain) *x509bundle.Bundle {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bundles[td]
+}
+
+// SetSVIDs replaces the SVIDs and pushes them to every client.
+func (w *WorkloadAPI) SetSVIDs(svids ...*x509svid.SVID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.svids = append([]*x509svid.SVID(nil), svids...)
+	w.push()
+}
+
+// RotateSVID issues a new SVID for a SPIFFE ID from the CA, replacing any SVID for the same ID, and pushes it
+// to every client.
+func (w *WorkloadAPI) RotateSVID(spiffeID string) *x509svid.SVID {
+	certs, key := w.ca.CreateX509SVID(spiffeID)
+	svid := &x509svid.SVID{ID: spiffeid.RequireFromString(spiffeID), Certificates: certs, PrivateKey: key}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	replaced := false
+	for i, existing := range w.svids {
+		if existing.ID == svid.ID {
+			w.svids[i] = svid
+			replaced = true
+		}
+	}
+	if !replaced {
+		w.svids = append(w.svids, svid)
+	}
+	w.push()
+	return svid
+}
+
+// SetBundle replaces the bundle for the bundle's trust domain, or adds it as a federated bundle, and pushes
+// the change to every client.
+func (w *WorkloadAPI) SetBundle(bundle *x509bundle.Bundle) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bundles[bundle.TrustDomain()] = bundle
+	w.push()
+}
+
+// RemoveBundle stops serving the bundle for a trust domain, and pushes the change to every client.
+func (w *WorkloadAPI) RemoveBundle(td spiffeid.TrustDomain) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.bundles, td)
+	w.push()
+}
+
+// SetError ends every stream with err, which should be a gRPC status error, and fails every new request with
+// it, like an agent that is unavailable. SetError(nil) puts things back, and clients that reconnect get the
+// current SVIDs.
+func (w *WorkloadAPI) SetError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+	if err != nil {
+		w.send(update{err: err})
+	}
+}
+
+// Push sends the current SVIDs and bundles to every client again, even if they haven't changed.
+func (w *WorkloadAPI) Push() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.push()
+}
+
+// Send the current response to every stream. Must be called with mu held.
+func (w *WorkloadAPI) push() {
+	if w.err != nil || len(w.svids) == 0 {
+		// Clients keep the last SVIDs they got
+		return
+	}
+	w.send(update{resp: w.response()})
+}
+
+// Send an update to every stream, replacing any update it hasn't sent yet. Must be called with mu held.
+func (w *WorkloadAPI) send(u update) {
+	for ch := range w.streams {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- u
+	}
+}
+
+// The response for the current SVIDs and bundles. Must be called with mu held.
+func (w *WorkloadAPI) response() *workload.X509SVIDResponse {
+	resp := &workload.X509SVIDResponse{FederatedBundles: make(map[string][]byte)}
+	own := make(map[spiffeid.TrustDomain]bool)
+	for _, svid := range w.svids {
+		certs, key, err := svid.MarshalRaw()
+		if err != nil {
+			// This runs on the server's goroutine, where the test can't be stopped
+			w.tb.Errorf("Unable to marshal SVID %s: %v", svid.ID, err)
+			continue
+		}
+		td := svid.ID.TrustDomain()
+		own[td] = true
+		resp.Svids = append(resp.Svids, &workload.X509SVID{
+			SpiffeId:    svid.ID.String(),
+			X509Svid:    certs,
+			X509SvidKey: key,
+			Bundle:      rawCertificates(w.bundles[td]),
+		})
+	}
+	for td, bundle := range w.bundles {
+		if !own[td] {
+			resp.FederatedBundles[td.IDString()] = rawCertificates(bundle)
+		}
+	}
+	return resp
+}
+
+// The Workload API sends bundles as concatenated DER certificates
+func rawCertificates(bundle *x509bundle.Bundle) []byte {
+	var raw []byte
+	if bundle == nil {
+		return raw
+	}
+	for _, cert := range bundle.X509Authorities() {
+		raw = append(raw, cert.Raw...)
+	}
+	return raw
+}
+
+// Start a stream. Returns the channel its updates come on, and the first response to send.
+func (w *WorkloadAPI) addStream() (chan update, *workload.X509SVIDResponse, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+	if len(w.svids) == 0 {
+		return nil, nil, errNoIdentity
+	}
+	ch := make(chan update, 1)
+	w.streams[ch] = struct{}{}
+	return ch, w.response(), nil
+}
+
+func (w *WorkloadAPI) removeStream(ch chan update) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.streams, ch)
+}
+
+type handler struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	w *WorkloadAPI
+}
+
+func (h *handler) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	// Clients have to send this header, so the API can't be called by a browser
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok || len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	ch, resp, err := h.w.addStream()
+	if err != nil {
+		return err
+	}
+	defer h.w.removeStream(ch)
+	if err := stream.Send(resp); err != nil {
+		return err
+	}
+	for {
+		select {
+		case u := <-ch:
+			if u.err != nil {
+				return u.err
+			}
+			if err := stream.Send(u.resp); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package fakeworkloadapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfeldman/spiffelink/test/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var td = spiffeid.RequireTrustDomainFromString("example.org")
+
+// watcher collects what a client receives
+type watcher struct {
+	updates chan *workloadapi.X509Context
+	errors  chan error
+}
+
+func newWatcher() *watcher {
+	return &watcher{updates: make(chan *workloadapi.X509Context, 10), errors: make(chan error, 10)}
+}
+
+func (w *watcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
+	w.updates <- c
+}
+
+func (w *watcher) OnX509ContextWatchError(err error) {
+	w.errors <- err
+}
+
+func (w *watcher) next(t *testing.T) *workloadapi.X509Context {
+	select {
+	case c := <-w.updates:
+		return c
+	case <-time.After(10 * time.Second):
+		t.Fatal("no update received")
+		return nil
+	}
+}
+
+func watch(t *testing.T, api *WorkloadAPI) *watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(api.Addr()))
+	require.NoError(t, err)
+	w := newWatcher()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.WatchX509Context(ctx, w)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		client.Close()
+	})
+	return w
+}
+
+func TestFetchX509Context(t *testing.T) {
+	ca := spiffetest.NewCA(t)
+	api := New(t, ca, td)
+	svid := api.RotateSVID("spiffe://example.org/db")
+
+	c, err := workloadapi.FetchX509Context(context.Background(), workloadapi.WithAddr(api.Addr()))
+	require.NoError(t, err)
+	require.Len(t, c.SVIDs, 1)
+	assert.Equal(t, svid.ID, c.SVIDs[0].ID)
+	assert.True(t, svid.Certificates[0].Equal(c.SVIDs[0].Certificates[0]))
+	bundle, err := c.Bundles.GetX509BundleForTrustDomain(td)
+	require.NoError(t, err)
+	assert.True(t, bundle.Equal(x509bundle.FromX509Authorities(td, ca.Roots())))
+}
+
+func TestNoIdentity(t *testing.T) {
+	api := New(t, spiffetest.NewCA(t), td)
+	_, err := workloadapi.FetchX509Context(context.Background(), workloadapi.WithAddr(api.Addr()))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestPushUpdates(t *testing.T) {
+	api := New(t, spiffetest.NewCA(t), td)
+	first := api.RotateSVID("spiffe://example.org/db")
+	w := watch(t, api)
+	assert.Equal(t, first.Certificates[0].SerialNumber, w.next(t).SVIDs[0].Certificates[0].SerialNumber)
+	require.Eventually(t, func() bool { return api.Streams() == 1 }, 10*time.Second, 10*time.Millisecond)
+
+	// Rotation
+	second := api.RotateSVID("spiffe://example.org/db")
+	c := w.next(t)
+	require.Len(t, c.SVIDs, 1)
+	assert.Equal(t, second.Certificates[0].SerialNumber, c.SVIDs[0].Certificates[0].SerialNumber)
+
+	// A new bundle for the trust domain, and a federated one
+	newCA := spiffetest.NewCA(t)
+	api.SetBundle(x509bundle.FromX509Authorities(td, newCA.Roots()))
+	bundle, err := w.next(t).Bundles.GetX509BundleForTrustDomain(td)
+	require.NoError(t, err)
+	assert.Equal(t, newCA.Roots(), bundle.X509Authorities())
+
+	federated := spiffeid.RequireTrustDomainFromString("partner.org")
+	api.SetBundle(x509bundle.FromX509Authorities(federated, spiffetest.NewCA(t).Roots()))
+	assert.True(t, w.next(t).Bundles.Has(federated))
+	api.RemoveBundle(federated)
+	assert.False(t, w.next(t).Bundles.Has(federated))
+}
+
+func TestSimulatedError(t *testing.T) {
+	api := New(t, spiffetest.NewCA(t), td)
+	api.RotateSVID("spiffe://example.org/db")
+	w := watch(t, api)
+	w.next(t)
+	require.Eventually(t, func() bool { return api.Streams() == 1 }, 10*time.Second, 10*time.Millisecond)
+
+	api.SetError(status.Error(codes.Unavailable, "agent restarting"))
+	require.Eventually(t, func() bool { return api.Streams() == 0 }, 10*time.Second, 10*time.Millisecond)
+	_, err := workloadapi.FetchX509Context(context.Background(), workloadapi.WithAddr(api.Addr()))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The client reconnects once the error is cleared, and gets the SVID issued in the meantime
+	api.SetError(nil)
+	svid := api.RotateSVID("spiffe://example.org/db")
+	assert.Equal(t, svid.Certificates[0].SerialNumber, w.next(t).SVIDs[0].Certificates[0].SerialNumber)
+}
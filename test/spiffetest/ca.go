@@ -45,6 +45,13 @@ func (ca *CA) CreateX509SVID(spiffeID string) ([]*x509.Certificate, crypto.Signe
 	return append([]*x509.Certificate{cert}, ca.chain(false)...), key
 }
 
+// CreateX509SVIDWithValidity is like CreateX509SVID, but the SVID is only valid between notBefore and notAfter,
+// for testing SVIDs that are about to expire or already have.
+func (ca *CA) CreateX509SVIDWithValidity(spiffeID string, notBefore time.Time, notAfter time.Time) ([]*x509.Certificate, crypto.Signer) {
+	cert, key := CreateX509SVIDWithValidity(ca.tb, ca.cert, ca.key, spiffeID, notBefore, notAfter)
+	return append([]*x509.Certificate{cert}, ca.chain(false)...), key
+}
+
 func (ca *CA) Roots() []*x509.Certificate {
 	root := ca
 	for root.parent != nil {
@@ -77,6 +84,10 @@ func CreateCACertificate(tb testing.TB, parent *x509.Certificate, parentKey cryp
 
 func CreateX509SVID(tb testing.TB, parent *x509.Certificate, parentKey crypto.Signer, spiffeID string) (*x509.Certificate, crypto.Signer) {
 	now := time.Now()
+	return CreateX509SVIDWithValidity(tb, parent, parentKey, spiffeID, now, now.Add(time.Hour))
+}
+
+func CreateX509SVIDWithValidity(tb testing.TB, parent *x509.Certificate, parentKey crypto.Signer, spiffeID string, notBefore time.Time, notAfter time.Time) (*x509.Certificate, crypto.Signer) {
 	serial := NewSerial(tb)
 
 	uriSAN, err := url.Parse(spiffeID)
@@ -88,9 +99,11 @@ func CreateX509SVID(tb testing.TB, parent *x509.Certificate, parentKey crypto.Si
 		Subject: pkix.Name{
 			CommonName: fmt.Sprintf("X509-SVID %x", serial),
 		},
-		NotBefore: now,
-		NotAfter:  now.Add(time.Hour),
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
 		URIs:      []*url.URL{uriSAN},
+		// Required of an X509-SVID, and checked when one is received from the Workload API
+		KeyUsage: x509.KeyUsageDigitalSignature,
 	}
 	return CreateCertificate(tb, tmpl, parent, key.Public(), parentKey), key
 }